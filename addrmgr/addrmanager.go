@@ -37,22 +37,44 @@ type AddrManager struct {
 	lookupFunc     func(string) ([]net.IP, error)
 	rand           *rand.Rand
 	key            [32]byte
-	addrIndex      map[string]*KnownAddress // address key to ka for all addrs.
-	addrNew        [newBucketCount]map[string]*KnownAddress
-	addrTried      [triedBucketCount]*list.List
+	streams        map[uint32]*streamAddresses
 	started        int32
 	shutdown       int32
 	wg             sync.WaitGroup
 	quit           chan struct{}
-	nTried         int
-	nNew           int
 	lamtx          sync.Mutex
 	localAddresses map[string]*localAddress
 }
 
+// streamAddresses holds the known addresses of a single stream along with the
+// new and tried buckets that they are kept in. Addresses of different streams
+// never share buckets.
+type streamAddresses struct {
+	addrIndex map[string]*KnownAddress // address key to ka for all addrs.
+	addrNew   [newBucketCount]map[string]*KnownAddress
+	addrTried [triedBucketCount]*list.List
+	nTried    int
+	nNew      int
+}
+
+// newStreamAddresses returns a new streamAddresses with empty buckets.
+func newStreamAddresses() *streamAddresses {
+	sa := &streamAddresses{
+		addrIndex: make(map[string]*KnownAddress),
+	}
+	for i := range sa.addrNew {
+		sa.addrNew[i] = make(map[string]*KnownAddress)
+	}
+	for i := range sa.addrTried {
+		sa.addrTried[i] = list.New()
+	}
+	return sa
+}
+
 type serializedKnownAddress struct {
 	Addr        string
 	Src         string
+	Stream      uint32
 	Attempts    int
 	TimeStamp   int64
 	LastAttempt int64
@@ -60,14 +82,24 @@ type serializedKnownAddress struct {
 	// no refcount or tried, that is available from context.
 }
 
-type serializedAddrManager struct {
-	Version      int
-	Key          [32]byte
-	Addresses    []*serializedKnownAddress
+type serializedStream struct {
+	Stream       uint32
 	NewBuckets   [newBucketCount][]string // string is NetAddressKey
 	TriedBuckets [triedBucketCount][]string
 }
 
+type serializedAddrManager struct {
+	Version   int
+	Key       [32]byte
+	Addresses []*serializedKnownAddress
+	Streams   []*serializedStream
+
+	// Only used by version 1, which had no notion of streams. All addresses
+	// belong to stream 1.
+	NewBuckets   [newBucketCount][]string
+	TriedBuckets [triedBucketCount][]string
+}
+
 type localAddress struct {
 	na    *wire.NetAddress
 	score AddressPriority
@@ -78,8 +110,12 @@ type localAddress struct {
 type AddressPriority int
 
 const (
+	// PeerPrio signifies the address was reported by a peer as the one from
+	// which we connected to it.
+	PeerPrio AddressPriority = iota
+
 	// InterfacePrio signifies the address is on a local interface
-	InterfacePrio AddressPriority = iota
+	InterfacePrio
 
 	// BoundPrio signifies the address has been explicitly bounded to.
 	BoundPrio
@@ -159,7 +195,7 @@ const (
 	getAddrPercent = 23
 
 	// serialisationVersion is the current version of the on-disk format.
-	serialisationVersion = 1
+	serialisationVersion = 2
 )
 
 // updateAddress is a helper function to either update an address already known
@@ -172,7 +208,8 @@ func (a *AddrManager) updateAddress(netAddr, srcAddr *wire.NetAddress) {
 	}
 
 	addr := NetAddressKey(netAddr)
-	ka := a.find(netAddr)
+	sa := a.stream(netAddr.Stream)
+	ka := sa.addrIndex[addr]
 	if ka != nil {
 		// TODO(oga) only update addresses periodically.
 		// Update the last seen time and services.
@@ -212,49 +249,49 @@ func (a *AddrManager) updateAddress(netAddr, srcAddr *wire.NetAddress) {
 		// change the actual netaddress on the peer.
 		netAddrCopy := *netAddr
 		ka = &KnownAddress{na: &netAddrCopy, srcAddr: srcAddr}
-		a.addrIndex[addr] = ka
-		a.nNew++
+		sa.addrIndex[addr] = ka
+		sa.nNew++
 		// XXX time penalty?
 	}
 
 	bucket := a.getNewBucket(netAddr, srcAddr)
 
 	// Already exists?
-	if _, ok := a.addrNew[bucket][addr]; ok {
+	if _, ok := sa.addrNew[bucket][addr]; ok {
 		return
 	}
 
 	// Enforce max addresses.
-	if len(a.addrNew[bucket]) > newBucketSize {
+	if len(sa.addrNew[bucket]) > newBucketSize {
 		log.Tracef("new bucket is full, expiring old")
-		a.expireNew(bucket)
+		sa.expireNew(bucket)
 	}
 
 	// Add to new bucket.
 	ka.refs++
-	a.addrNew[bucket][addr] = ka
+	sa.addrNew[bucket][addr] = ka
 
-	log.Tracef("Added new address %s for a total of %d addresses", addr,
-		a.nTried+a.nNew)
+	log.Tracef("Added new address %s in stream %d for a total of %d "+
+		"addresses", addr, netAddr.Stream, a.numAddresses())
 }
 
 // expireNew makes space in the new buckets by expiring the really bad entries.
 // If no bad entries are available we look at a few and remove the oldest.
-func (a *AddrManager) expireNew(bucket int) {
+func (sa *streamAddresses) expireNew(bucket int) {
 	// First see if there are any entries that are so bad we can just throw
 	// them away. otherwise we throw away the oldest entry in the cache.
 	// Bitcoind here chooses four random and just throws the oldest of
 	// those away, but we keep track of oldest in the initial traversal and
 	// use that information instead.
 	var oldest *KnownAddress
-	for k, v := range a.addrNew[bucket] {
+	for k, v := range sa.addrNew[bucket] {
 		if v.isBad() {
 			log.Tracef("expiring bad address %v", k)
-			delete(a.addrNew[bucket], k)
+			delete(sa.addrNew[bucket], k)
 			v.refs--
 			if v.refs == 0 {
-				a.nNew--
-				delete(a.addrIndex, k)
+				sa.nNew--
+				delete(sa.addrIndex, k)
 			}
 			continue
 		}
@@ -269,11 +306,11 @@ func (a *AddrManager) expireNew(bucket int) {
 		key := NetAddressKey(oldest.na)
 		log.Tracef("expiring oldest address %v", key)
 
-		delete(a.addrNew[bucket], key)
+		delete(sa.addrNew[bucket], key)
 		oldest.refs--
 		if oldest.refs == 0 {
-			a.nNew--
-			delete(a.addrIndex, key)
+			sa.nNew--
+			delete(sa.addrIndex, key)
 		}
 	}
 }
@@ -281,10 +318,10 @@ func (a *AddrManager) expireNew(bucket int) {
 // pickTried selects an address from the tried bucket to be evicted.
 // We just choose the eldest. Bitcoind selects 4 random entries and throws away
 // the older of them.
-func (a *AddrManager) pickTried(bucket int) *list.Element {
+func (sa *streamAddresses) pickTried(bucket int) *list.Element {
 	var oldest *KnownAddress
 	var oldestElem *list.Element
-	for e := a.addrTried[bucket].Front(); e != nil; e = e.Next() {
+	for e := sa.addrTried[bucket].Front(); e != nil; e = e.Next() {
 		ka := e.Value.(*KnownAddress)
 		if oldest == nil || oldest.na.Timestamp.After(ka.na.Timestamp) {
 			oldestElem = e
@@ -369,37 +406,42 @@ func (a *AddrManager) savePeers() {
 	sam.Version = serialisationVersion
 	copy(sam.Key[:], a.key[:])
 
-	sam.Addresses = make([]*serializedKnownAddress, len(a.addrIndex))
-	i := 0
-	for k, v := range a.addrIndex {
-		ska := new(serializedKnownAddress)
-		ska.Addr = k
-		ska.TimeStamp = v.na.Timestamp.Unix()
-		ska.Src = NetAddressKey(v.srcAddr)
-		ska.Attempts = v.attempts
-		ska.LastAttempt = v.lastattempt.Unix()
-		ska.LastSuccess = v.lastsuccess.Unix()
-		// Tried and refs are implicit in the rest of the structure
-		// and will be worked out from context on unserialisation.
-		sam.Addresses[i] = ska
-		i++
-	}
-	for i := range a.addrNew {
-		sam.NewBuckets[i] = make([]string, len(a.addrNew[i]))
-		j := 0
-		for k := range a.addrNew[i] {
-			sam.NewBuckets[i][j] = k
-			j++
+	sam.Addresses = make([]*serializedKnownAddress, 0, a.numAddresses())
+	sam.Streams = make([]*serializedStream, 0, len(a.streams))
+	for stream, sa := range a.streams {
+		for k, v := range sa.addrIndex {
+			ska := new(serializedKnownAddress)
+			ska.Addr = k
+			ska.TimeStamp = v.na.Timestamp.Unix()
+			ska.Src = NetAddressKey(v.srcAddr)
+			ska.Stream = stream
+			ska.Attempts = v.attempts
+			ska.LastAttempt = v.lastattempt.Unix()
+			ska.LastSuccess = v.lastsuccess.Unix()
+			// Tried and refs are implicit in the rest of the structure
+			// and will be worked out from context on unserialisation.
+			sam.Addresses = append(sam.Addresses, ska)
 		}
-	}
-	for i := range a.addrTried {
-		sam.TriedBuckets[i] = make([]string, a.addrTried[i].Len())
-		j := 0
-		for e := a.addrTried[i].Front(); e != nil; e = e.Next() {
-			ka := e.Value.(*KnownAddress)
-			sam.TriedBuckets[i][j] = NetAddressKey(ka.na)
-			j++
+
+		ss := &serializedStream{Stream: stream}
+		for i := range sa.addrNew {
+			ss.NewBuckets[i] = make([]string, len(sa.addrNew[i]))
+			j := 0
+			for k := range sa.addrNew[i] {
+				ss.NewBuckets[i][j] = k
+				j++
+			}
+		}
+		for i := range sa.addrTried {
+			ss.TriedBuckets[i] = make([]string, sa.addrTried[i].Len())
+			j := 0
+			for e := sa.addrTried[i].Front(); e != nil; e = e.Next() {
+				ka := e.Value.(*KnownAddress)
+				ss.TriedBuckets[i][j] = NetAddressKey(ka.na)
+				j++
+			}
 		}
+		sam.Streams = append(sam.Streams, ss)
 	}
 
 	w, err := os.Create(a.peersFile)
@@ -455,7 +497,20 @@ func (a *AddrManager) deserializePeers(filePath string) error {
 		return fmt.Errorf("error reading %s: %v", filePath, err)
 	}
 
-	if sam.Version != serialisationVersion {
+	switch sam.Version {
+	case 1:
+		// Version 1 predates support for multiple streams, so everything
+		// in it belongs to stream 1.
+		for _, v := range sam.Addresses {
+			v.Stream = 1
+		}
+		sam.Streams = []*serializedStream{&serializedStream{
+			Stream:       1,
+			NewBuckets:   sam.NewBuckets,
+			TriedBuckets: sam.TriedBuckets,
+		}}
+	case serialisationVersion:
+	default:
 		return fmt.Errorf("unknown version %v in serialized "+
 			"addrmanager", sam.Version)
 	}
@@ -473,51 +528,58 @@ func (a *AddrManager) deserializePeers(filePath string) error {
 			return fmt.Errorf("failed to deserialize netaddress "+
 				"%s: %v", v.Src, err)
 		}
+		ka.na.Stream = v.Stream
 		ka.attempts = v.Attempts
 		ka.lastattempt = time.Unix(v.LastAttempt, 0)
 		ka.lastsuccess = time.Unix(v.LastSuccess, 0)
-		a.addrIndex[NetAddressKey(ka.na)] = ka
+		a.stream(v.Stream).addrIndex[NetAddressKey(ka.na)] = ka
 	}
 
-	for i := range sam.NewBuckets {
-		for _, val := range sam.NewBuckets[i] {
-			ka, ok := a.addrIndex[val]
-			if !ok {
-				return fmt.Errorf("newbucket contains %s but "+
-					"none in address list", val)
-			}
+	for _, ss := range sam.Streams {
+		sa := a.stream(ss.Stream)
+
+		for i := range ss.NewBuckets {
+			for _, val := range ss.NewBuckets[i] {
+				ka, ok := sa.addrIndex[val]
+				if !ok {
+					return fmt.Errorf("newbucket contains %s but "+
+						"none in address list", val)
+				}
 
-			if ka.refs == 0 {
-				a.nNew++
+				if ka.refs == 0 {
+					sa.nNew++
+				}
+				ka.refs++
+				sa.addrNew[i][val] = ka
 			}
-			ka.refs++
-			a.addrNew[i][val] = ka
 		}
-	}
-	for i := range sam.TriedBuckets {
-		for _, val := range sam.TriedBuckets[i] {
-			ka, ok := a.addrIndex[val]
-			if !ok {
-				return fmt.Errorf("Newbucket contains %s but "+
-					"none in address list", val)
-			}
+		for i := range ss.TriedBuckets {
+			for _, val := range ss.TriedBuckets[i] {
+				ka, ok := sa.addrIndex[val]
+				if !ok {
+					return fmt.Errorf("Newbucket contains %s but "+
+						"none in address list", val)
+				}
 
-			ka.tried = true
-			a.nTried++
-			a.addrTried[i].PushBack(ka)
+				ka.tried = true
+				sa.nTried++
+				sa.addrTried[i].PushBack(ka)
+			}
 		}
 	}
 
 	// Sanity checking.
-	for k, v := range a.addrIndex {
-		if v.refs == 0 && !v.tried {
-			return fmt.Errorf("address %s after serialisation "+
-				"with no references", k)
-		}
+	for _, sa := range a.streams {
+		for k, v := range sa.addrIndex {
+			if v.refs == 0 && !v.tried {
+				return fmt.Errorf("address %s after serialisation "+
+					"with no references", k)
+			}
 
-		if v.refs > 0 && v.tried {
-			return fmt.Errorf("address %s after serialisation "+
-				"which is both new and tried!", k)
+			if v.refs > 0 && v.tried {
+				return fmt.Errorf("address %s after serialisation "+
+					"which is both new and tried!", k)
+			}
 		}
 	}
 
@@ -525,6 +587,7 @@ func (a *AddrManager) deserializePeers(filePath string) error {
 }
 
 // DeserializeNetAddress converts a given address string to a *wire.NetAddress
+// in stream 1.
 func (a *AddrManager) DeserializeNetAddress(addr string) (*wire.NetAddress, error) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -535,8 +598,9 @@ func (a *AddrManager) DeserializeNetAddress(addr string) (*wire.NetAddress, erro
 		return nil, err
 	}
 
-	// Hard-coded stream 1 in here. In the future when we support streams,
-	// we will want to update this.
+	// The string form of an address says nothing about its stream, so the
+	// address is put in stream 1. Callers which know the stream of the
+	// address should set it themselves.
 	return a.HostToNetAddress(host, uint16(port), 1, wire.SFNodeNetwork)
 }
 
@@ -618,9 +682,25 @@ func (a *AddrManager) AddAddressByIP(addrIP string) error {
 	return nil
 }
 
-// NumAddresses returns the number of addresses known to the address manager.
+// numAddresses returns the number of addresses known to the address manager
+// across all streams.
 func (a *AddrManager) numAddresses() int {
-	return a.nTried + a.nNew
+	n := 0
+	for _, sa := range a.streams {
+		n += sa.nTried + sa.nNew
+	}
+	return n
+}
+
+// stream returns the addresses of the given stream, creating an empty set of
+// buckets for the stream if it is not yet known.
+func (a *AddrManager) stream(stream uint32) *streamAddresses {
+	sa, ok := a.streams[stream]
+	if !ok {
+		sa = newStreamAddresses()
+		a.streams[stream] = sa
+	}
+	return sa
 }
 
 // NumAddresses returns the number of addresses known to the address manager.
@@ -631,6 +711,19 @@ func (a *AddrManager) NumAddresses() int {
 	return a.numAddresses()
 }
 
+// NumStreamAddresses returns the number of addresses known to the address
+// manager in the given stream.
+func (a *AddrManager) NumStreamAddresses(stream uint32) int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	sa, ok := a.streams[stream]
+	if !ok {
+		return 0
+	}
+	return sa.nTried + sa.nNew
+}
+
 // NeedMoreAddresses returns whether or not the address manager needs more
 // addresses.
 func (a *AddrManager) NeedMoreAddresses() bool {
@@ -645,16 +738,16 @@ func (a *AddrManager) NeedMoreAddresses() bool {
 func (a *AddrManager) AddressCache() []*wire.NetAddress {
 	a.mtx.Lock()
 	defer a.mtx.Unlock()
-	if a.nNew+a.nTried == 0 {
+	if a.numAddresses() == 0 {
 		return nil
 	}
 
-	allAddr := make([]*wire.NetAddress, a.nNew+a.nTried)
-	i := 0
+	allAddr := make([]*wire.NetAddress, 0, a.numAddresses())
 	// Iteration order is undefined here, but we randomise it anyway.
-	for _, v := range a.addrIndex {
-		allAddr[i] = v.na
-		i++
+	for _, sa := range a.streams {
+		for _, v := range sa.addrIndex {
+			allAddr = append(allAddr, v.na)
+		}
 	}
 
 	numAddresses := len(allAddr) * getAddrPercent / 100
@@ -678,16 +771,10 @@ func (a *AddrManager) AddressCache() []*wire.NetAddress {
 // and allocating fresh empty bucket storage.
 func (a *AddrManager) reset() {
 
-	a.addrIndex = make(map[string]*KnownAddress)
+	a.streams = make(map[uint32]*streamAddresses)
 
 	// fill key with bytes from a good random source.
 	io.ReadFull(crand.Reader, a.key[:])
-	for i := range a.addrNew {
-		a.addrNew[i] = make(map[string]*KnownAddress)
-	}
-	for i := range a.addrTried {
-		a.addrTried[i] = list.New()
-	}
 }
 
 // HostToNetAddress returns a netaddress given a host address. If the address is
@@ -742,35 +829,36 @@ func NetAddressKey(na *wire.NetAddress) string {
 	return net.JoinHostPort(ipString(na), port)
 }
 
-// GetAddress returns a single address that should be routable.  It picks a
-// random one from the possible addresses with preference given to ones that
-// have not been used recently and should not pick 'close' addresses
-// consecutively.
-func (a *AddrManager) GetAddress(class string) *KnownAddress {
+// GetAddress returns a single address in the given stream that should be
+// routable.  It picks a random one from the possible addresses with preference
+// given to ones that have not been used recently and should not pick 'close'
+// addresses consecutively.
+func (a *AddrManager) GetAddress(stream uint32) *KnownAddress {
 	// Protect concurrent access.
 	a.mtx.Lock()
 	defer a.mtx.Unlock()
 
-	if a.numAddresses() == 0 {
+	sa, ok := a.streams[stream]
+	if !ok || sa.nTried+sa.nNew == 0 {
 		return nil
 	}
 
 	// Use a 50% chance for choosing between tried and new table entries.
-	if a.nTried > 0 && (a.nNew == 0 || a.rand.Intn(2) == 0) {
+	if sa.nTried > 0 && (sa.nNew == 0 || a.rand.Intn(2) == 0) {
 		// Tried entry.
 		large := 1 << 30
 		factor := 1.0
 		for {
 			// pick a random bucket.
-			bucket := a.rand.Intn(len(a.addrTried))
-			if a.addrTried[bucket].Len() == 0 {
+			bucket := a.rand.Intn(len(sa.addrTried))
+			if sa.addrTried[bucket].Len() == 0 {
 				continue
 			}
 
 			// Pick a random entry in the list
-			e := a.addrTried[bucket].Front()
+			e := sa.addrTried[bucket].Front()
 			for i :=
-				a.rand.Int63n(int64(a.addrTried[bucket].Len())); i > 0; i-- {
+				a.rand.Int63n(int64(sa.addrTried[bucket].Len())); i > 0; i-- {
 				e = e.Next()
 			}
 			ka := e.Value.(*KnownAddress)
@@ -789,14 +877,14 @@ func (a *AddrManager) GetAddress(class string) *KnownAddress {
 		factor := 1.0
 		for {
 			// Pick a random bucket.
-			bucket := a.rand.Intn(len(a.addrNew))
-			if len(a.addrNew[bucket]) == 0 {
+			bucket := a.rand.Intn(len(sa.addrNew))
+			if len(sa.addrNew[bucket]) == 0 {
 				continue
 			}
 			// Then, a random entry in it.
 			var ka *KnownAddress
-			nth := a.rand.Intn(len(a.addrNew[bucket]))
-			for _, value := range a.addrNew[bucket] {
+			nth := a.rand.Intn(len(sa.addrNew[bucket]))
+			for _, value := range sa.addrNew[bucket] {
 				if nth == 0 {
 					ka = value
 				}
@@ -814,7 +902,11 @@ func (a *AddrManager) GetAddress(class string) *KnownAddress {
 }
 
 func (a *AddrManager) find(addr *wire.NetAddress) *KnownAddress {
-	return a.addrIndex[NetAddressKey(addr)]
+	sa, ok := a.streams[addr.Stream]
+	if !ok {
+		return nil
+	}
+	return sa.addrIndex[NetAddressKey(addr)]
 }
 
 // Attempt increases the given address' attempt counter and updates
@@ -885,19 +977,20 @@ func (a *AddrManager) Good(addr *wire.NetAddress) {
 
 	// remove from all new buckets.
 	// record one of the buckets in question and call it the `first'
+	sa := a.streams[addr.Stream]
 	addrKey := NetAddressKey(addr)
 	oldBucket := -1
-	for i := range a.addrNew {
+	for i := range sa.addrNew {
 		// we check for existance so we can record the first one
-		if _, ok := a.addrNew[i][addrKey]; ok {
-			delete(a.addrNew[i], addrKey)
+		if _, ok := sa.addrNew[i][addrKey]; ok {
+			delete(sa.addrNew[i], addrKey)
 			ka.refs--
 			if oldBucket == -1 {
 				oldBucket = i
 			}
 		}
 	}
-	a.nNew--
+	sa.nNew--
 
 	if oldBucket == -1 {
 		// What? wasn't in a bucket after all.... Panic?
@@ -907,16 +1000,16 @@ func (a *AddrManager) Good(addr *wire.NetAddress) {
 	bucket := a.getTriedBucket(ka.na)
 
 	// Room in this tried bucket?
-	if a.addrTried[bucket].Len() < triedBucketSize {
+	if sa.addrTried[bucket].Len() < triedBucketSize {
 		ka.tried = true
-		a.addrTried[bucket].PushBack(ka)
-		a.nTried++
+		sa.addrTried[bucket].PushBack(ka)
+		sa.nTried++
 		return
 	}
 
 	// No room, we have to evict something else. We replace the addr's
 	// space in its previous bucket with a random address.
-	entry := a.pickTried(bucket)
+	entry := sa.pickTried(bucket)
 	rmka := entry.Value.(*KnownAddress)
 
 	// First bucket it would have been put in.
@@ -924,7 +1017,7 @@ func (a *AddrManager) Good(addr *wire.NetAddress) {
 
 	// If no room in the original bucket, we put it in a bucket we just
 	// freed up a space in.
-	if len(a.addrNew[newBucket]) >= newBucketSize {
+	if len(sa.addrNew[newBucket]) >= newBucketSize {
 		newBucket = oldBucket
 	}
 
@@ -935,16 +1028,16 @@ func (a *AddrManager) Good(addr *wire.NetAddress) {
 	rmka.tried = false
 	rmka.refs++
 
-	// We don't touch a.nTried here since the number of tried stays the same
+	// We don't touch sa.nTried here since the number of tried stays the same
 	// but we decemented new above, raise it again since we're putting
 	// something back.
-	a.nNew++
+	sa.nNew++
 
 	rmkey := NetAddressKey(rmka.na)
 	log.Tracef("Replacing %s with %s in tried", rmkey, addrKey)
 
 	// We made sure there is space here just above.
-	a.addrNew[newBucket][rmkey] = rmka
+	sa.addrNew[newBucket][rmkey] = rmka
 }
 
 // AddLocalAddress adds na to the list of known local addresses to advertise
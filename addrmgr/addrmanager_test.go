@@ -340,7 +340,7 @@ func TestAttempt(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Adding address failed: %v", err)
 	}
-	ka := n.GetAddress("any")
+	ka := n.GetAddress(0)
 
 	if !ka.LastAttempt().IsZero() {
 		t.Errorf("Address should not have attempts, but does")
@@ -370,7 +370,7 @@ func TestConnected(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Adding address failed: %v", err)
 	}
-	ka := n.GetAddress("any")
+	ka := n.GetAddress(0)
 	na = ka.NetAddress()
 	na.Timestamp = time.Now().Add(time.Hour * -1) // make it an hour ago
 
@@ -596,8 +596,11 @@ func TestGetAddress(t *testing.T) {
 
 	n = addrmgr.New("testgetaddress", lookupFunc)
 
+	// The addresses used here don't specify a stream, so they all end up in
+	// stream 0.
+
 	// Get an address from an empty set (should error)
-	if rv := n.GetAddress("any"); rv != nil {
+	if rv := n.GetAddress(0); rv != nil {
 		t.Errorf("GetAddress failed: got: %v want: %v\n", rv, nil)
 	}
 
@@ -606,7 +609,7 @@ func TestGetAddress(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Adding address failed: %v", err)
 	}
-	ka = n.GetAddress("any")
+	ka = n.GetAddress(0)
 	if ka == nil {
 		t.Fatalf("Did not get an address where there is one in the pool")
 	}
@@ -616,7 +619,7 @@ func TestGetAddress(t *testing.T) {
 
 	// Mark this as a good address and get it
 	n.Good(ka.NetAddress())
-	ka = n.GetAddress("any")
+	ka = n.GetAddress(0)
 	if ka == nil {
 		t.Fatalf("Did not get an address where there is one in the pool")
 	}
@@ -642,7 +645,7 @@ func TestGetAddress(t *testing.T) {
 	n.TstAddKnownAddress(
 		addrmgr.TstNewKnownAddress(netAddrB,
 			10, time.Now().Add(-30*time.Minute), time.Now(), false, 0), 3)
-	ka = n.GetAddress("any")
+	ka = n.GetAddress(0)
 
 	if ka == nil {
 		t.Fatalf("Did not get an address where there is one in the pool")
@@ -657,7 +660,7 @@ func TestGetAddress(t *testing.T) {
 	n.TstGoodNoChecks(netAddrA, 3)
 	n.TstGoodNoChecks(netAddrB, 3)
 
-	ka = n.GetAddress("any")
+	ka = n.GetAddress(0)
 	if ka == nil {
 		t.Fatalf("Did not get an address where there is one in the pool")
 	}
@@ -666,6 +669,56 @@ func TestGetAddress(t *testing.T) {
 	}
 }
 
+// TestStreams ensures that addresses of different streams are kept apart.
+func TestStreams(t *testing.T) {
+	n := addrmgr.New("teststreams", lookupFunc)
+	srcAddr := newNetAddress("173.144.173.111")
+
+	na1 := wire.NewNetAddressIPPort(net.ParseIP("9.8.7.6"), 8444, 1,
+		wire.SFNodeNetwork)
+	na2 := wire.NewNetAddressIPPort(net.ParseIP("98.76.54.32"), 8444, 2,
+		wire.SFNodeNetwork)
+	n.AddAddresses([]*wire.NetAddress{na1, na2}, srcAddr)
+
+	if n.NumAddresses() != 2 {
+		t.Errorf("Wrong number of addresses: got %d, want %d",
+			n.NumAddresses(), 2)
+	}
+	for _, stream := range []uint32{1, 2} {
+		if num := n.NumStreamAddresses(stream); num != 1 {
+			t.Errorf("Wrong number of addresses in stream %d: got %d, want %d",
+				stream, num, 1)
+		}
+	}
+
+	ka := n.GetAddress(1)
+	if ka == nil {
+		t.Fatalf("Did not get an address from stream 1")
+	}
+	if !ka.NetAddress().IP.Equal(na1.IP) {
+		t.Errorf("Wrong IP: got %v, want %v", ka.NetAddress().IP, na1.IP)
+	}
+
+	ka = n.GetAddress(2)
+	if ka == nil {
+		t.Fatalf("Did not get an address from stream 2")
+	}
+	if !ka.NetAddress().IP.Equal(na2.IP) {
+		t.Errorf("Wrong IP: got %v, want %v", ka.NetAddress().IP, na2.IP)
+	}
+
+	if ka = n.GetAddress(3); ka != nil {
+		t.Errorf("Got address %v from stream 3 which has none",
+			ka.NetAddress().IP)
+	}
+
+	// Marking an address as good only affects its own stream.
+	n.Good(na2)
+	if n.NumStreamAddresses(1) != 1 || n.NumStreamAddresses(2) != 1 {
+		t.Error("Good changed the number of addresses in a stream")
+	}
+}
+
 func TestGetBestLocalAddress(t *testing.T) {
 	localAddrs := []wire.NetAddress{
 		{IP: net.ParseIP("192.168.0.100")},
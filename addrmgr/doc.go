@@ -37,5 +37,8 @@ provided by the caller about connected, known good, and attempted addresses to
 periodically purge peers which no longer appear to be good peers as well as
 bias the selection toward known good peers. The general idea is to make a best
 effort at only providing usuable addresses.
+
+Addresses are kept separately for each stream that they belong to, so that a
+caller serving several streams can ask for addresses in a particular stream.
 */
 package addrmgr
@@ -52,14 +52,15 @@ func (a *AddrManager) TstAddAddressesSkipChecks(addrs []*wire.NetAddress, srcAdd
 
 		netAddrCopy := *netAddr
 		ka := &KnownAddress{na: &netAddrCopy, srcAddr: srcAddr}
-		a.addrIndex[addr] = ka
-		a.nNew++
+		sa := a.stream(netAddr.Stream)
+		sa.addrIndex[addr] = ka
+		sa.nNew++
 
 		// Put in bucket.
 		bucket := a.getNewBucket(netAddr, srcAddr)
 
 		ka.refs++
-		a.addrNew[bucket][addr] = ka
+		sa.addrNew[bucket][addr] = ka
 	}
 }
 
@@ -67,11 +68,12 @@ func (a *AddrManager) TstAddAddressesSkipChecks(addrs []*wire.NetAddress, srcAdd
 // testing purposes.
 func (a *AddrManager) TstAddKnownAddress(ka *KnownAddress, bucket int) {
 	addr := NetAddressKey(ka.na)
-	a.addrIndex[addr] = ka
-	a.nNew++
+	sa := a.stream(ka.na.Stream)
+	sa.addrIndex[addr] = ka
+	sa.nNew++
 
 	ka.refs++
-	a.addrNew[bucket][addr] = ka
+	sa.addrNew[bucket][addr] = ka
 }
 
 // GoodNoChecks Sets a new address as good without performing the usual
@@ -89,23 +91,24 @@ func (a *AddrManager) TstGoodNoChecks(addr *wire.NetAddress, bucket int) {
 	}
 
 	// Remove from new buckets.
+	sa := a.stream(addr.Stream)
 	addrKey := NetAddressKey(addr)
 	oldBucket := -1
-	for i := range a.addrNew {
+	for i := range sa.addrNew {
 		// we check for existance so we can record the first one
-		if _, ok := a.addrNew[i][addrKey]; ok {
-			delete(a.addrNew[i], addrKey)
+		if _, ok := sa.addrNew[i][addrKey]; ok {
+			delete(sa.addrNew[i], addrKey)
 			ka.refs--
 			if oldBucket == -1 {
 				oldBucket = i
 			}
 		}
 	}
-	a.nNew--
+	sa.nNew--
 
 	ka.tried = true
-	a.addrTried[bucket].PushBack(ka)
-	a.nTried++
+	sa.addrTried[bucket].PushBack(ka)
+	sa.nTried++
 	return
 }
 
@@ -117,8 +120,9 @@ func (a *AddrManager) TstAddAddressNoBucket(netAddr *wire.NetAddress, srcAddr *w
 
 	netAddrCopy := *netAddr
 	ka := &KnownAddress{na: &netAddrCopy, srcAddr: srcAddr}
-	a.addrIndex[addr] = ka
-	a.nNew++
+	sa := a.stream(netAddr.Stream)
+	sa.addrIndex[addr] = ka
+	sa.nNew++
 }
 
 // TstGetBucketAndTried gets the bucket that an address is in and whether it has
@@ -128,9 +132,10 @@ func (a *AddrManager) TstGetBucketAndTried(ka *KnownAddress) (bucket []int, trie
 
 	x := 0
 	tried = ka.tried
+	sa := a.stream(ka.na.Stream)
 
 	if tried {
-		for i, triedBucket := range a.addrTried {
+		for i, triedBucket := range sa.addrTried {
 			for e := triedBucket.Front(); e != nil; e = e.Next() {
 				if ka == e.Value.(*KnownAddress) {
 					bucket[x] = i
@@ -140,7 +145,7 @@ func (a *AddrManager) TstGetBucketAndTried(ka *KnownAddress) (bucket []int, trie
 			}
 		}
 	} else {
-		for i, newBucket := range a.addrNew {
+		for i, newBucket := range sa.addrNew {
 			// we check for existance so we can record the first one
 			for _, val := range newBucket {
 				if val == ka {
@@ -15,9 +15,13 @@ import (
 	"runtime"
 	"runtime/pprof"
 
-	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmd/node"
+	"golang.org/x/net/context"
 )
 
+// metricsPath is the path on which metrics are served.
+const metricsPath = "/metrics"
+
 var (
 	cfg             *config
 	shutdownChannel = make(chan struct{})
@@ -35,11 +39,8 @@ func bmdMain() error {
 	cfg = tcfg
 	defer backendLog.Flush()
 
-	// Ensure that the correct dialer is used.
-	peer.SetDialer(bmdDial)
-
 	// Show version at startup.
-	bmdLog.Infof("Version %s", version())
+	bmdLog.Infof("Version %s", node.Version())
 
 	// Enable http profiling server if requested.
 	if cfg.Profile != "" {
@@ -79,19 +80,39 @@ func bmdMain() error {
 		db.RollbackClose()
 	})
 
-	// Create server and start it.
-	server, err := newDefaultServer(cfg.Listeners, db)
+	// Create the node and start it.
+	opts := nodeOptions(cfg)
+	opts.DB = db
+	n, err := node.New(opts)
 	if err != nil {
 		serverLog.Errorf("Failed to start server on %v: %v", cfg.Listeners,
 			err)
 		return err
 	}
-	server.Start()
+	if err = n.Start(context.Background()); err != nil {
+		serverLog.Errorf("Failed to start server: %v", err)
+		return err
+	}
+
+	// Serve metrics if requested.
+	if cfg.MetricsListen != "" {
+		if err = startMetricsServer(n, cfg.MetricsListen); err != nil {
+			serverLog.Errorf("Failed to start metrics server on %s: %v",
+				cfg.MetricsListen, err)
+			n.Stop(context.Background())
+			return err
+		}
+	}
+
+	// Reload the configuration on SIGHUP.
+	addReloadHandler(func() {
+		bmdLog.Infof("Received SIGHUP.  Reloading configuration...")
+		reloadNodeConfig(n)
+	})
 
 	addInterruptHandler(func() {
 		bmdLog.Infof("Gracefully shutting down the server...")
-		server.Stop()
-		server.WaitForShutdown()
+		n.Stop(context.Background())
 	})
 
 	// Monitor for graceful server shutdown and signal the main goroutine
@@ -101,7 +122,7 @@ func bmdMain() error {
 	// necessary since the main goroutine must be kept running long enough
 	// for the interrupt handler goroutine to finish.
 	go func() {
-		server.WaitForShutdown()
+		n.WaitForShutdown()
 		serverLog.Info("Server shutdown complete")
 		shutdownChannel <- struct{}{}
 	}()
@@ -113,6 +134,24 @@ func bmdMain() error {
 	return nil
 }
 
+// startMetricsServer begins serving the metrics of the node on the given
+// address.
+func startMetricsServer(n *node.Node, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, n.MetricsHandler())
+
+	serverLog.Infof("Metrics server listening on %s", listener.Addr())
+	go func() {
+		serverLog.Errorf("Metrics server: %v", http.Serve(listener, mux))
+	}()
+	return nil
+}
+
 func main() {
 	// Use all processor cores.
 	runtime.GOMAXPROCS(runtime.NumCPU())
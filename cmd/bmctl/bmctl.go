@@ -0,0 +1,152 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/monetas/bmd/rpcclient"
+)
+
+// command is a subcommand of bmctl, which makes one or more RPC calls.
+type command struct {
+	name    string
+	args    string
+	desc    string
+	minArgs int
+	maxArgs int // -1 if unlimited.
+
+	// reconnect is whether the client should reconnect when the connection
+	// to bmd is lost, for commands that run until they are interrupted.
+	reconnect bool
+
+	handler func(c *rpcclient.Client, cfg *config, args []string) error
+}
+
+// commands are the subcommands of bmctl, in the order they are listed in the
+// usage message.
+var commands = []*command{
+	{name: "sendobject", args: "[file]", minArgs: 0, maxArgs: 1,
+		desc: "Send a serialized object read from file, or from stdin if " +
+			"file is omitted or -",
+		handler: sendObject},
+	{name: "getidentity", args: "<address>", minArgs: 1, maxArgs: 1,
+		desc:    "Show the public identity of a Bitmessage address",
+		handler: getIdentity},
+	{name: "subscribe",
+		args:    "<kind> [fromcounter] [tag=<hex>...] [ripe=<hex>...]",
+		minArgs: 1, maxArgs: -1, reconnect: true,
+		desc: "Print objects of a kind (messages, broadcasts, getpubkeys, " +
+			"pubkeys or unknownobjects) as JSON lines until interrupted",
+		handler: subscribe},
+	{name: "getinfo", minArgs: 0, maxArgs: 0,
+		desc:    "Show the status of bmd",
+		handler: getInfo},
+	{name: "getpeers", minArgs: 0, maxArgs: 0,
+		desc:    "List connected peers",
+		handler: getPeers},
+	{name: "getbanscores", minArgs: 0, maxArgs: 0,
+		desc:    "List the ban scores of peers",
+		handler: getBanScores},
+	{name: "addpeer", args: "<address> [stream] [permanent]", minArgs: 1,
+		maxArgs: 3,
+		desc: "Connect to a peer in a stream, by default the first one " +
+			"served by bmd, reconnecting whenever the connection is " +
+			"lost if permanent is true",
+		handler: addPeer},
+	{name: "disconnectpeer", args: "<address>", minArgs: 1, maxArgs: 1,
+		desc:    "Disconnect a peer",
+		handler: disconnectPeer},
+	{name: "banpeer", args: "<ip>", minArgs: 1, maxArgs: 1,
+		desc:    "Ban an IP address and disconnect its peers",
+		handler: banPeer},
+	{name: "unbanpeer", args: "<ip>", minArgs: 1, maxArgs: 1,
+		desc:    "Lift the ban of an IP address",
+		handler: unbanPeer},
+	{name: "getbanlist", minArgs: 0, maxArgs: 0,
+		desc:    "List banned IP addresses and the allow and deny lists",
+		handler: getBanList},
+	{name: "addiprange", args: "<allow|deny> <range>", minArgs: 2,
+		maxArgs: 2,
+		desc: "Add an IP address or CIDR range to the allow or deny " +
+			"list, disconnecting denied peers",
+		handler: addIPRange},
+	{name: "removeiprange", args: "<allow|deny> <range>", minArgs: 2,
+		maxArgs: 2,
+		desc:    "Remove an IP address or CIDR range from the allow or deny list",
+		handler: removeIPRange},
+}
+
+// findCommand returns the command with the given name, or nil.
+func findCommand(name string) *command {
+	name = strings.ToLower(name)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// usage returns the list of commands for the usage message.
+func usage() string {
+	var buf bytes.Buffer
+	buf.WriteString("Commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&buf, "  %s %s\n", cmd.name, cmd.args)
+		fmt.Fprintf(&buf, "      %s\n", cmd.desc)
+	}
+	return buf.String()
+}
+
+func main() {
+	cfg, args, rpcCfg, err := loadConfig()
+	if err != nil {
+		// Errors parsing the command line have already been printed.
+		e, ok := err.(*flags.Error)
+		if ok && e.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		if !ok {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "No command specified")
+		fmt.Fprint(os.Stderr, usage())
+		os.Exit(1)
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", args[0])
+		fmt.Fprint(os.Stderr, usage())
+		os.Exit(1)
+	}
+	args = args[1:]
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		fmt.Fprintf(os.Stderr, "Usage: bmctl %s %s\n", cmd.name, cmd.args)
+		os.Exit(1)
+	}
+
+	rpcCfg.DisableAutoReconnect = !cmd.reconnect
+	client, err := rpcclient.New(rpcCfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to bmd: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = cmd.handler(client, cfg, args)
+	client.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
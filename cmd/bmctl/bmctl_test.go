@@ -0,0 +1,114 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/monetas/bmd/rpcclient"
+)
+
+func TestParseSubscribeArgs(t *testing.T) {
+	tag := strings.Repeat("ab", 32)
+	ripe := strings.Repeat("cd", 20)
+
+	tests := []struct {
+		args    []string
+		kind    rpcclient.Kind
+		from    uint64
+		tags    int
+		ripes   int
+		invalid bool
+	}{
+		{args: []string{"messages"}, kind: rpcclient.Messages, from: 1},
+		{args: []string{"UnknownObjects", "42"},
+			kind: rpcclient.UnknownObjects, from: 42},
+		{args: []string{"pubkeys", "7", "tag=" + tag, "ripe=" + ripe},
+			kind: rpcclient.Pubkeys, from: 7, tags: 1, ripes: 1},
+		{args: []string{"broadcasts", "tag=" + tag, "tag=" + tag},
+			kind: rpcclient.Broadcasts, from: 1, tags: 2},
+		{args: []string{"objects"}, invalid: true},
+		{args: []string{"messages", "-1"}, invalid: true},
+		{args: []string{"messages", "tag=" + tag}, invalid: true},
+		{args: []string{"pubkeys", "tag=abcd"}, invalid: true},
+		{args: []string{"pubkeys", "ripe=" + tag}, invalid: true},
+		{args: []string{"pubkeys", "nonce=" + tag}, invalid: true},
+		{args: []string{"pubkeys", "tag=xyz"}, invalid: true},
+	}
+
+	for i, test := range tests {
+		kind, from, filter, err := parseSubscribeArgs(test.args)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("for case #%d expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("for case #%d got error %v", i, err)
+			continue
+		}
+		if kind != test.kind || from != test.from {
+			t.Errorf("for case #%d expected %v from %d, got %v from %d", i,
+				test.kind, test.from, kind, from)
+		}
+		var tags, ripes int
+		if filter != nil {
+			tags, ripes = len(filter.Tags), len(filter.Ripes)
+		}
+		if tags != test.tags || ripes != test.ripes {
+			t.Errorf("for case #%d expected %d tags and %d ripes, got %d "+
+				"and %d", i, test.tags, test.ripes, tags, ripes)
+		}
+	}
+}
+
+func TestReadBmdConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bmctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bmd.conf")
+	conf := "[Application Options]\nrpcuser=admin\nrpcpass=secret\n" +
+		"rpclisten=0.0.0.0:8442\nmaxpeers=10\n"
+	if err = ioutil.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bmdCfg, err := readBmdConfig(path)
+	if err != nil {
+		t.Fatalf("readBmdConfig failed: %v", err)
+	}
+	if bmdCfg.RPCUser != "admin" || bmdCfg.RPCPass != "secret" {
+		t.Errorf("unexpected credentials %s:%s", bmdCfg.RPCUser,
+			bmdCfg.RPCPass)
+	}
+	if len(bmdCfg.RPCListeners) != 1 ||
+		rpcServerFromListener(bmdCfg.RPCListeners[0]) != "localhost:8442" {
+		t.Errorf("unexpected listeners %v", bmdCfg.RPCListeners)
+	}
+
+	// A missing file is not an error.
+	if _, err = readBmdConfig(filepath.Join(dir, "missing.conf")); err != nil {
+		t.Errorf("expected no error for a missing file, got %v", err)
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	for _, cmd := range commands {
+		if findCommand(strings.ToUpper(cmd.name)) != cmd {
+			t.Errorf("command %s not found", cmd.name)
+		}
+	}
+	if findCommand("authenticate") != nil {
+		t.Error("found nonexistent command")
+	}
+}
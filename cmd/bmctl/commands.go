@@ -0,0 +1,380 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/monetas/bmd/rpcclient"
+	"github.com/monetas/bmutil/wire"
+)
+
+// printJSON prints the value as indented JSON.
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// newTabWriter returns a writer that aligns tab separated columns on stdout.
+func newTabWriter() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+}
+
+// sendObject sends an object read from a file or stdin and prints its counter.
+func sendObject(c *rpcclient.Client, cfg *config, args []string) error {
+	var data []byte
+	var err error
+	if len(args) == 0 || args[0] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	obj, err := wire.DecodeMsgObject(data)
+	if err != nil {
+		return fmt.Errorf("invalid object: %v", err)
+	}
+	counter, err := c.SendObject(obj)
+	if err != nil {
+		return err
+	}
+
+	if cfg.JSON {
+		return printJSON(struct {
+			Counter uint64 `json:"counter"`
+		}{counter})
+	}
+	fmt.Println(counter)
+	return nil
+}
+
+// getIdentity prints the public identity of an address.
+func getIdentity(c *rpcclient.Client, cfg *config, args []string) error {
+	id, err := c.GetIdentity(args[0])
+	if err != nil {
+		return err
+	}
+	if cfg.JSON {
+		return printJSON(id)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintf(w, "Address:\t%s\n", id.Address)
+	fmt.Fprintf(w, "Nonce trials per byte:\t%d\n", id.NonceTrialsPerByte)
+	fmt.Fprintf(w, "Extra bytes:\t%d\n", id.ExtraBytes)
+	fmt.Fprintf(w, "Signing key:\t%x\n", id.SigningKey)
+	fmt.Fprintf(w, "Encryption key:\t%x\n", id.EncryptionKey)
+	return w.Flush()
+}
+
+// getInfo prints the status of bmd.
+func getInfo(c *rpcclient.Client, cfg *config, args []string) error {
+	info, err := c.GetInfo()
+	if err != nil {
+		return err
+	}
+	if cfg.JSON {
+		return printJSON(info)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintf(w, "Version:\t%s\n", info.Version)
+	fmt.Fprintf(w, "Uptime:\t%s\n", time.Duration(info.Uptime)*time.Second)
+	fmt.Fprintf(w, "Protocol version:\t%d\n", info.ProtocolVersion)
+	fmt.Fprintf(w, "Streams:\t%v\n", info.Streams)
+	fmt.Fprintf(w, "Listeners:\t%s\n", strings.Join(info.Listeners, ", "))
+	fmt.Fprintf(w, "Peers:\t%d inbound, %d outbound\n", info.InboundPeers,
+		info.OutboundPeers)
+	fmt.Fprintf(w, "Objects:\t%d\n", info.Objects)
+	fmt.Fprintf(w, "Pubkeys:\t%d\n", info.Pubkeys)
+	fmt.Fprintf(w, "Counters:\tmessages %d, broadcasts %d, getpubkeys %d, "+
+		"pubkeys %d, unknown %d\n", info.Counters.Messages,
+		info.Counters.Broadcasts, info.Counters.Getpubkeys,
+		info.Counters.Pubkeys, info.Counters.UnknownObjects)
+	fmt.Fprintf(w, "Bytes sent:\t%d\n", info.BytesSent)
+	fmt.Fprintf(w, "Bytes received:\t%d\n", info.BytesReceived)
+	fmt.Fprintf(w, "Requested objects:\t%d\n", info.RequestedObjects)
+	fmt.Fprintf(w, "Verifying objects:\t%d\n", info.VerifyingObjects)
+	fmt.Fprintf(w, "Dropped objects:\t%d\n", info.DroppedObjects)
+	fmt.Fprintf(w, "Pruned:\t%d objects, %d bytes\n", info.PrunedObjects,
+		info.PrunedBytes)
+	return w.Flush()
+}
+
+// getPeers prints a table of the connected peers.
+func getPeers(c *rpcclient.Client, cfg *config, args []string) error {
+	peers, err := c.GetPeers()
+	if err != nil {
+		return err
+	}
+	if cfg.JSON {
+		return printJSON(peers)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintln(w, "ADDRESS\tDIRECTION\tUSER AGENT\tSTREAMS\tLATENCY\t"+
+		"BAN SCORE\tSENT\tRECEIVED\tREJECTED")
+	for _, p := range peers {
+		direction := "outbound"
+		if p.Inbound {
+			direction = "inbound"
+		}
+		if p.Persistent {
+			direction += " (permanent)"
+		}
+		var rejected uint64
+		for _, n := range p.RejectedObjects {
+			rejected += n
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%dms\t%d\t%d\t%d\t%d\n",
+			p.Address, direction, p.UserAgent, p.Streams, p.Latency,
+			p.BanScore, p.BytesSent, p.BytesReceived, rejected)
+	}
+	return w.Flush()
+}
+
+// getBanScores prints a table of the ban scores of peers.
+func getBanScores(c *rpcclient.Client, cfg *config, args []string) error {
+	scores, err := c.GetBanScores()
+	if err != nil {
+		return err
+	}
+	if cfg.JSON {
+		return printJSON(scores)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintln(w, "ADDRESS\tCONNECTED\tSCORE\tLAST PENALTY")
+	for _, s := range scores {
+		last := "-"
+		if len(s.History) > 0 {
+			e := s.History[len(s.History)-1]
+			last = fmt.Sprintf("%s: +%d at %s", e.Reason, e.Penalty,
+				e.Time.Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "%s\t%v\t%d\t%s\n", s.Address, s.Connected, s.Score,
+			last)
+	}
+	return w.Flush()
+}
+
+// addPeer connects to a peer.
+func addPeer(c *rpcclient.Client, cfg *config, args []string) error {
+	var stream uint64
+	var permanent bool
+	var err error
+	if len(args) > 1 {
+		stream, err = strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid stream %s", args[1])
+		}
+	}
+	if len(args) > 2 {
+		permanent, err = strconv.ParseBool(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid value for permanent %s", args[2])
+		}
+	}
+	return c.AddPeer(args[0], uint32(stream), permanent)
+}
+
+// disconnectPeer disconnects a peer.
+func disconnectPeer(c *rpcclient.Client, cfg *config, args []string) error {
+	return c.DisconnectPeer(args[0])
+}
+
+// banPeer bans an IP address.
+func banPeer(c *rpcclient.Client, cfg *config, args []string) error {
+	return c.BanPeer(args[0])
+}
+
+// unbanPeer lifts the ban of an IP address.
+func unbanPeer(c *rpcclient.Client, cfg *config, args []string) error {
+	return c.UnbanPeer(args[0])
+}
+
+// getBanList prints a table of the banned IP addresses and the IP ranges in the
+// allow and deny lists.
+func getBanList(c *rpcclient.Client, cfg *config, args []string) error {
+	list, err := c.GetBanList()
+	if err != nil {
+		return err
+	}
+	if cfg.JSON {
+		return printJSON(list)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintln(w, "LIST\tADDRESS\tUNTIL")
+	for _, ban := range list.Bans {
+		fmt.Fprintf(w, "banned\t%s\t%s\n", ban.IP,
+			ban.Until.Format(time.RFC3339))
+	}
+	for _, r := range list.Allow {
+		fmt.Fprintf(w, "%s\t%s\t-\n", rpcclient.AllowList, r)
+	}
+	for _, r := range list.Deny {
+		fmt.Fprintf(w, "%s\t%s\t-\n", rpcclient.DenyList, r)
+	}
+	return w.Flush()
+}
+
+// addIPRange adds an IP range to the allow or deny list.
+func addIPRange(c *rpcclient.Client, cfg *config, args []string) error {
+	return c.AddIPRange(strings.ToLower(args[0]), args[1])
+}
+
+// removeIPRange removes an IP range from the allow or deny list.
+func removeIPRange(c *rpcclient.Client, cfg *config, args []string) error {
+	return c.RemoveIPRange(strings.ToLower(args[0]), args[1])
+}
+
+// parseKind returns the kind of objects with the given name, as named in the
+// Subscribe methods but case insensitive.
+func parseKind(name string) (rpcclient.Kind, error) {
+	for kind := rpcclient.Messages; kind <= rpcclient.UnknownObjects; kind++ {
+		if strings.EqualFold(kind.String(), name) {
+			return kind, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown kind of object %s", name)
+}
+
+// parseSubscribeArgs parses the arguments of the subscribe command, which are
+// the kind of objects, an optional counter to start from, and tags and ripes
+// to filter pubkeys and broadcasts by.
+func parseSubscribeArgs(args []string) (rpcclient.Kind, uint64,
+	*rpcclient.Filter, error) {
+	kind, err := parseKind(args[0])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	args = args[1:]
+
+	fromCounter := uint64(1)
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		fromCounter, err = strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("invalid counter %s", args[0])
+		}
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return kind, fromCounter, nil, nil
+	}
+	if kind != rpcclient.Pubkeys && kind != rpcclient.Broadcasts {
+		return 0, 0, nil, errors.New("filters are only supported for " +
+			"pubkeys and broadcasts")
+	}
+
+	filter := new(rpcclient.Filter)
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return 0, 0, nil, fmt.Errorf("invalid filter %s", arg)
+		}
+		b, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("invalid filter %s: %v", arg, err)
+		}
+
+		switch parts[0] {
+		case "tag":
+			tag, err := wire.NewShaHash(b)
+			if err != nil {
+				return 0, 0, nil, fmt.Errorf("invalid tag %s: %v", parts[1],
+					err)
+			}
+			filter.Tags = append(filter.Tags, *tag)
+		case "ripe":
+			if len(b) != wire.RipeHashSize {
+				return 0, 0, nil, fmt.Errorf("invalid ripe %s: %d bytes, "+
+					"expected %d", parts[1], len(b), wire.RipeHashSize)
+			}
+			var ripe [wire.RipeHashSize]byte
+			copy(ripe[:], b)
+			filter.Ripes = append(filter.Ripes, ripe)
+		default:
+			return 0, 0, nil, fmt.Errorf("invalid filter %s", arg)
+		}
+	}
+	return kind, fromCounter, filter, nil
+}
+
+// subscribe prints the objects of a kind as JSON lines until interrupted.
+// Objects are printed as {"counter":...,"object":"<base64>"} and the counters
+// of expired objects as {"expired":[...]}.
+func subscribe(c *rpcclient.Client, cfg *config, args []string) error {
+	kind, fromCounter, filter, err := parseSubscribeArgs(args)
+	if err != nil {
+		return err
+	}
+
+	var sub *rpcclient.Subscription
+	switch kind {
+	case rpcclient.Messages:
+		sub, err = c.SubscribeMessages(fromCounter)
+	case rpcclient.Broadcasts:
+		sub, err = c.SubscribeBroadcasts(fromCounter, filter)
+	case rpcclient.Getpubkeys:
+		sub, err = c.SubscribeGetpubkeys(fromCounter)
+	case rpcclient.Pubkeys:
+		sub, err = c.SubscribePubkeys(fromCounter, filter)
+	case rpcclient.UnknownObjects:
+		sub, err = c.SubscribeUnknownObjects(fromCounter)
+	}
+	if err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case obj, ok := <-sub.Objects():
+			if !ok {
+				return errors.New("subscription ended")
+			}
+			err = enc.Encode(struct {
+				Counter uint64 `json:"counter"`
+				Object  []byte `json:"object"`
+			}{obj.Counter, wire.EncodeMessage(obj.Object)})
+
+		case counters, ok := <-sub.Expired():
+			if !ok {
+				return errors.New("subscription ended")
+			}
+			err = enc.Encode(struct {
+				Expired []uint64 `json:"expired"`
+			}{counters})
+
+		case <-interrupt:
+			return sub.Unsubscribe()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/btcsuite/btcutil"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/monetas/bmd/rpcclient"
+)
+
+const (
+	defaultRPCServer = "localhost:8442"
+)
+
+var (
+	bmdHomeDir           = btcutil.AppDataDir("bmd", false)
+	defaultBmdConfigFile = filepath.Join(bmdHomeDir, "bmd.conf")
+	defaultRPCCertFile   = filepath.Join(bmdHomeDir, "rpc.cert")
+)
+
+// config defines the configuration options for bmctl.
+type config struct {
+	BmdConfigFile string `short:"C" long:"bmdconfig" description:"Path to the configuration file of bmd to read the RPC options from"`
+	RPCUser       string `short:"u" long:"rpcuser" description:"RPC username"`
+	RPCPass       string `short:"P" long:"rpcpass" default-mask:"-" description:"RPC password"`
+	RPCServer     string `short:"s" long:"rpcserver" description:"RPC server to connect to (default: localhost:8442)"`
+	RPCUnix       string `long:"rpcunix" description:"Unix domain socket of the RPC server to connect to"`
+	RPCCert       string `short:"c" long:"rpccert" description:"RPC server certificate chain for validation"`
+	NoTLS         bool   `long:"notls" description:"Disable TLS"`
+	JSON          bool   `short:"j" long:"json" description:"Print results as JSON"`
+}
+
+// bmdConfig holds the options of bmd that describe how to connect to its RPC
+// server.
+type bmdConfig struct {
+	RPCUser      string   `long:"rpcuser"`
+	RPCPass      string   `long:"rpcpass"`
+	RPCLimitUser string   `long:"rpclimituser"`
+	RPCLimitPass string   `long:"rpclimitpass"`
+	RPCListeners []string `long:"rpclisten"`
+	RPCUnix      string   `long:"rpcunix"`
+	RPCCert      string   `long:"rpccert"`
+	DisableTLS   bool     `long:"notls"`
+}
+
+// cleanAndExpandPath expands environment variables and leading ~ in the
+// passed path, cleans the result, and returns it.
+func cleanAndExpandPath(path string) string {
+	// Expand initial ~ to OS specific home directory.
+	if strings.HasPrefix(path, "~") {
+		homeDir := filepath.Dir(bmdHomeDir)
+		path = strings.Replace(path, "~", homeDir, 1)
+	}
+
+	// NOTE: The os.ExpandEnv doesn't work with Windows-style %VARIABLE%,
+	// but they variables can still be expanded via POSIX-style $VARIABLE.
+	return filepath.Clean(os.ExpandEnv(path))
+}
+
+// readBmdConfig reads the RPC options from the configuration file of bmd. A
+// missing file is not an error.
+func readBmdConfig(path string) (*bmdConfig, error) {
+	bmdCfg := new(bmdConfig)
+	parser := flags.NewParser(bmdCfg, flags.IgnoreUnknown)
+	err := flags.NewIniParser(parser).ParseFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return bmdCfg, nil
+}
+
+// rpcServerFromListener returns the address to connect to for an address that
+// bmd listens on, replacing unspecified addresses with localhost.
+func rpcServerFromListener(listener string) string {
+	host, port, err := net.SplitHostPort(listener)
+	if err != nil {
+		return listener
+	}
+	ip := net.ParseIP(host)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// loadConfig parses the command line and fills in the options that were not
+// given from the configuration file of bmd. It returns the configuration, the
+// remaining arguments and the configuration of the RPC client.
+func loadConfig() (*config, []string, *rpcclient.Config, error) {
+	cfg := config{
+		BmdConfigFile: defaultBmdConfigFile,
+	}
+
+	parser := flags.NewParser(&cfg, flags.Default)
+	parser.Usage = "[OPTIONS] <command> <args...>"
+	args, err := parser.Parse()
+	if err != nil {
+		if e, ok := err.(*flags.Error); !ok || e.Type != flags.ErrHelp {
+			fmt.Fprintln(os.Stderr, "Use bmctl -h to show usage")
+		} else {
+			fmt.Fprintln(os.Stdout, "")
+			fmt.Fprint(os.Stdout, usage())
+		}
+		return nil, nil, nil, err
+	}
+
+	bmdCfg, err := readBmdConfig(cleanAndExpandPath(cfg.BmdConfigFile))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read %s: %v",
+			cfg.BmdConfigFile, err)
+	}
+
+	// Credentials given on the command line take precedence over those of
+	// the admin user of bmd, which take precedence over the limited user.
+	rpcCfg := &rpcclient.Config{
+		User: cfg.RPCUser,
+		Pass: cfg.RPCPass,
+	}
+	if rpcCfg.User == "" {
+		rpcCfg.User, rpcCfg.Pass = bmdCfg.RPCUser, bmdCfg.RPCPass
+	}
+	if rpcCfg.User == "" {
+		rpcCfg.User, rpcCfg.Pass = bmdCfg.RPCLimitUser, bmdCfg.RPCLimitPass
+	}
+
+	// Connect to the given server, or else to the Unix domain socket or the
+	// first listener of bmd.
+	switch {
+	case cfg.RPCServer != "":
+		rpcCfg.Host = cfg.RPCServer
+	case cfg.RPCUnix != "":
+		rpcCfg.UnixSocket = cleanAndExpandPath(cfg.RPCUnix)
+	case bmdCfg.RPCUnix != "":
+		rpcCfg.UnixSocket = cleanAndExpandPath(bmdCfg.RPCUnix)
+	case len(bmdCfg.RPCListeners) > 0:
+		rpcCfg.Host = rpcServerFromListener(bmdCfg.RPCListeners[0])
+	default:
+		rpcCfg.Host = defaultRPCServer
+	}
+
+	rpcCfg.DisableTLS = cfg.NoTLS || bmdCfg.DisableTLS
+	if rpcCfg.UnixSocket == "" && !rpcCfg.DisableTLS {
+		certFile := cfg.RPCCert
+		if certFile == "" {
+			certFile = bmdCfg.RPCCert
+		}
+		if certFile == "" {
+			certFile = defaultRPCCertFile
+		}
+		certFile = cleanAndExpandPath(certFile)
+		rpcCfg.Certificates, err = ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return &cfg, args, rpcCfg, nil
+}
@@ -22,7 +22,9 @@ import (
 	"github.com/btcsuite/go-socks/socks"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/monetas/bmd/database"
+	_ "github.com/monetas/bmd/database/bdb"
 	_ "github.com/monetas/bmd/database/memdb"
+	"github.com/monetas/bmd/node"
 )
 
 const (
@@ -33,13 +35,27 @@ const (
 	defaultLogFilename    = "bmd.log"
 	defaultMaxPeers       = 125
 	defaultBanDuration    = time.Hour * 24
+	defaultBanThreshold   = 100
+	defaultBanHalfLife    = time.Minute * 10
+	defaultBanPoW         = 20
+	defaultBanUnrequested = 10
+	defaultBanMalformed   = 20
+	defaultBanHandshake   = 25
 	defaultMaxRPCClients  = 25
-	defaultDbType         = "memdb"
-	defaultPort           = "8444"
+	defaultRPCQueueSize   = 1000
+	defaultRPCMaxInFlight = 8
+	defaultRPCUnixPerm    = "0600"
+	defaultDbType         = "boltdb"
+	defaultPort           = node.DefaultPort
 	defaultRPCPort        = "8442"
+	defaultMetricsPort    = "8446"
 	defaultMaxUpPerPeer   = 1024 * 1024 // 1MBps
 	defaultMaxDownPerPeer = 1024 * 1024
+	defaultQuotaPeriod    = "month"
 	defaultMaxOutbound    = 10
+	defaultPruneInterval  = time.Hour
+	defaultExpiryMargin   = time.Hour * 3
+	defaultStream         = 1
 )
 
 var (
@@ -114,17 +130,32 @@ type config struct {
 	Listeners      []string      `long:"listen" description:"Add an interface/port to listen for connections (default all interfaces port: 8444)"`
 	MaxPeers       int           `long:"maxpeers" description:"Max number of inbound and outbound peers"`
 	BanDuration    time.Duration `long:"banduration" description:"How long to ban misbehaving peers. Valid time units are {s, m, h}.  Minimum 1 second"`
+	BanThreshold   uint32        `long:"banthreshold" description:"Ban score at which misbehaving peers are disconnected and banned"`
+	BanHalfLife    time.Duration `long:"banhalflife" description:"How long it takes for the ban score of a peer to halve. Valid time units are {s, m, h}.  Minimum 1 second"`
+	BanPoW         uint32        `long:"banpow" description:"Ban score penalty for sending an object with insufficient proof of work"`
+	BanUnrequested uint32        `long:"banunrequested" description:"Ban score penalty for sending an object that was not requested"`
+	BanMalformed   uint32        `long:"banmalformed" description:"Ban score penalty for sending an empty or oversized inv or addr message"`
+	BanHandshake   uint32        `long:"banhandshake" description:"Ban score penalty for violating the version handshake"`
+	AllowList      []string      `long:"allow" description:"Add an IP address or CIDR range whose peers are always accepted and never banned"`
+	DenyList       []string      `long:"deny" description:"Add an IP address or CIDR range whose peers are refused"`
 	RPCUser        string        `short:"u" long:"rpcuser" description:"Username for RPC connections"`
 	RPCPass        string        `short:"P" long:"rpcpass" default-mask:"-" description:"Password for RPC connections"`
 	RPCLimitUser   string        `long:"rpclimituser" description:"Username for limited RPC connections"`
 	RPCLimitPass   string        `long:"rpclimitpass" default-mask:"-" description:"Password for limited RPC connections"`
+	RPCCredentials string        `long:"rpccredentials" description:"File containing RPC users, their hashed passwords and the methods they may call"`
 	RPCListeners   []string      `long:"rpclisten" description:"Add an interface/port to listen for RPC connections (default port: 8334)"`
+	RPCUnix        string        `long:"rpcunix" description:"Path of a Unix domain socket to listen for RPC connections on"`
+	RPCUnixPerm    string        `long:"rpcunixperm" description:"File permissions of the RPC Unix domain socket, in octal"`
+	RPCUnixUsers   []string      `long:"rpcunixuser" description:"Authenticate clients connecting to the RPC Unix domain socket as the system user with the given id as an RPC user, given as uid:username (Linux only)"`
 	RPCCert        string        `long:"rpccert" description:"File containing the certificate file"`
 	RPCKey         string        `long:"rpckey" description:"File containing the certificate key"`
 	RPCMaxClients  int           `long:"rpcmaxclients" description:"Max number of RPC clients"`
-	DisableRPC     bool          `long:"norpc" description:"Disable built-in RPC server -- NOTE: The RPC server is disabled by default if no rpcuser/rpcpass or rpclimituser/rpclimitpass is specified"`
+	RPCQueueSize   int           `long:"rpcqueuesize" description:"Max number of notifications waiting to be sent to an RPC client before it is disconnected"`
+	RPCMaxInFlight int           `long:"rpcmaxinflight" description:"Max number of notifications sent to an RPC client at a time"`
+	DisableRPC     bool          `long:"norpc" description:"Disable built-in RPC server -- NOTE: The RPC server is disabled by default if no rpcuser/rpcpass, rpclimituser/rpclimitpass or rpccredentials is specified"`
 	DisableTLS     bool          `long:"notls" description:"Disable TLS for the RPC server -- NOTE: This is only allowed if the RPC server is bound to localhost"`
 	DisableDNSSeed bool          `long:"nodnsseed" description:"Disable DNS seeding for peers"`
+	DNSSeeds       []string      `long:"dnsseed" description:"Add a DNS seeder to query for peers, as host:port, where port is that of the peers it returns (default: bootstrap8444.bitmessage.org:8444 and bootstrap8080.bitmessage.org:8080)"`
 	ExternalIPs    []string      `long:"externalip" description:"Add an ip to the list of local addresses we claim to listen on to peers"`
 	Proxy          string        `long:"proxy" description:"Connect via SOCKS5 proxy (eg. 127.0.0.1:9050)"`
 	ProxyUser      string        `long:"proxyuser" description:"Username for proxy server"`
@@ -137,11 +168,20 @@ type config struct {
 	DbType         string        `long:"dbtype" description:"Database backend to use"`
 	Profile        string        `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
 	CPUProfile     string        `long:"cpuprofile" description:"Write CPU profile to the specified file"`
+	MetricsListen  string        `long:"metricslisten" description:"Serve Prometheus metrics over HTTP on the given interface/port (default port: 8446) -- Metrics are disabled unless this is set"`
 	DebugLevel     string        `short:"d" long:"debuglevel" description:"Logging level for all subsystems {trace, debug, info, warn, error, critical} -- You may also specify <subsystem>=<level>,<subsystem2>=<level>,... to set the log level for individual subsystems -- Use show to list available subsystems"`
 	Upnp           bool          `long:"upnp" description:"Use UPnP to map our listening port outside of NAT"`
 	MaxUpPerPeer   Filesize      `long:"maxupload" description:"Maximum upload rate for any peer. Valid units are {B, K, M, G} bytes/sec."`
 	MaxDownPerPeer Filesize      `long:"maxdownload" description:"Maximum download rate for any peer. Valid units are {B, K, M, G} bytes/sec."`
-	MaxOutbound    int           `long:"maxoutbound" description:"The maximum number of outbound peers that bmd will try to maintain."`
+	MaxUp          Filesize      `long:"maxtotalupload" description:"Maximum upload rate for all peers together, or 0 for no limit. Valid units are {B, K, M, G} bytes/sec."`
+	MaxDown        Filesize      `long:"maxtotaldownload" description:"Maximum download rate for all peers together, or 0 for no limit. Valid units are {B, K, M, G} bytes/sec."`
+	UploadQuota    Filesize      `long:"uploadquota" description:"Maximum number of bytes to upload per quota period, after which only new objects are sent to peers, or 0 for no quota. Valid units are {B, K, M, G}."`
+	QuotaPeriod    string        `long:"quotaperiod" description:"Period after which the upload quota starts over: day or month (UTC)"`
+	MaxOutbound    int           `long:"maxoutbound" description:"The maximum number of outbound peers that bmd will try to maintain in each stream."`
+	Streams        []uint32      `long:"stream" description:"Add a stream to take part in (default: 1)"`
+	ChildStreams   bool          `long:"childstreams" description:"Also take part in the child streams (2n and 2n+1) of each stream"`
+	PruneInterval  time.Duration `long:"pruneinterval" description:"How often to remove expired objects from the database. Valid time units are {s, m, h}.  Minimum 1 minute"`
+	ExpiryMargin   time.Duration `long:"expirymargin" description:"How long to keep objects around after they have expired. Valid time units are {s, m, h}."`
 	onionlookup    func(string) ([]net.IP, error)
 	lookup         func(string) ([]net.IP, error)
 	oniondial      func(string, string) (net.Conn, error)
@@ -195,32 +235,34 @@ func supportedSubsystems() []string {
 	return subsystems
 }
 
-// parseAndSetDebugLevels attempts to parse the specified debug level and set
-// the levels accordingly.  An appropriate error is returned if anything is
-// invalid.
-func parseAndSetDebugLevels(debugLevel string) error {
+// parseDebugLevels parses the specified debug level and returns the log level
+// of each subsystem that it sets. An appropriate error is returned if anything
+// is invalid.
+func parseDebugLevels(debugLevel string) (map[string]string, error) {
+	levels := make(map[string]string)
+
 	// When the specified string doesn't have any delimters, treat it as
 	// the log level for all subsystems.
 	if !strings.Contains(debugLevel, ",") && !strings.Contains(debugLevel, "=") {
 		// Validate debug log level.
 		if !validLogLevel(debugLevel) {
 			str := "The specified debug level [%v] is invalid"
-			return fmt.Errorf(str, debugLevel)
+			return nil, fmt.Errorf(str, debugLevel)
 		}
 
-		// Change the logging level for all subsystems.
-		setLogLevels(debugLevel)
-
-		return nil
+		for subsysID := range subsystemLoggers {
+			levels[subsysID] = debugLevel
+		}
+		return levels, nil
 	}
 
 	// Split the specified string into subsystem/level pairs while detecting
-	// issues and update the log levels accordingly.
+	// issues.
 	for _, logLevelPair := range strings.Split(debugLevel, ",") {
 		if !strings.Contains(logLevelPair, "=") {
 			str := "The specified debug level contains an invalid " +
 				"subsystem/level pair [%v]"
-			return fmt.Errorf(str, logLevelPair)
+			return nil, fmt.Errorf(str, logLevelPair)
 		}
 
 		// Extract the specified subsystem and log level.
@@ -231,18 +273,33 @@ func parseAndSetDebugLevels(debugLevel string) error {
 		if _, exists := subsystemLoggers[subsysID]; !exists {
 			str := "The specified subsystem [%v] is invalid -- " +
 				"supported subsytems %v"
-			return fmt.Errorf(str, subsysID, supportedSubsystems())
+			return nil, fmt.Errorf(str, subsysID, supportedSubsystems())
 		}
 
 		// Validate log level.
 		if !validLogLevel(logLevel) {
 			str := "The specified debug level [%v] is invalid"
-			return fmt.Errorf(str, logLevel)
+			return nil, fmt.Errorf(str, logLevel)
 		}
 
-		setLogLevel(subsysID, logLevel)
+		levels[subsysID] = logLevel
+	}
+
+	return levels, nil
+}
+
+// parseAndSetDebugLevels attempts to parse the specified debug level and set
+// the levels accordingly.  An appropriate error is returned if anything is
+// invalid, in which case no levels are changed.
+func parseAndSetDebugLevels(debugLevel string) error {
+	levels, err := parseDebugLevels(debugLevel)
+	if err != nil {
+		return err
 	}
 
+	for subsysID, logLevel := range levels {
+		setLogLevel(subsysID, logLevel)
+	}
 	return nil
 }
 
@@ -291,6 +348,50 @@ func normalizeAddresses(addrs []string, defaultPort string) []string {
 	return removeDuplicateAddresses(addrs)
 }
 
+// parseQuotaPeriod parses the period of the upload quota.
+func parseQuotaPeriod(s string) (node.QuotaPeriod, error) {
+	switch s {
+	case "day":
+		return node.QuotaDaily, nil
+	case "month":
+		return node.QuotaMonthly, nil
+	}
+	return 0, fmt.Errorf("unknown quota period %s", s)
+}
+
+// parseRPCUnixPerm parses the octal file permissions of the RPC Unix domain
+// socket.
+func parseRPCUnixPerm(s string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || perm&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid file permissions %s", s)
+	}
+	return os.FileMode(perm), nil
+}
+
+// parseRPCUnixUsers parses a list of uid:username pairs, which map the system
+// users that may connect to the RPC Unix domain socket to the RPC users they
+// are authenticated as.
+func parseRPCUnixUsers(entries []string) (map[uint32]string, error) {
+	users := make(map[uint32]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("%s is not of the form uid:username",
+				entry)
+		}
+		uid, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %s", parts[0])
+		}
+		if _, ok := users[uint32(uid)]; ok {
+			return nil, fmt.Errorf("uid %d is given more than once", uid)
+		}
+		users[uint32(uid)] = parts[1]
+	}
+	return users, nil
+}
+
 // filesExists reports whether the named file or directory exists.
 func fileExists(name string) bool {
 	if _, err := os.Stat(name); err != nil {
@@ -320,13 +421,36 @@ func newConfigParser(cfg *config, options flags.Options) *flags.Parser {
 // while still allowing the user to override settings with config files and
 // command line options. Command line options always take precedence.
 func loadConfig(ignoreCL bool) (*config, []string, error) {
+	return readConfig(ignoreCL, false)
+}
+
+// reloadConfig reads the configuration again in the same way as loadConfig,
+// but without initializing logging or exiting for informational flags. It is
+// meant to be used to pick up changes to the config file while bmd is running.
+func reloadConfig() (*config, error) {
+	cfg, _, err := readConfig(false, true)
+	return cfg, err
+}
+
+// readConfig is the implementation of loadConfig and reloadConfig. reload is
+// whether bmd is already running.
+func readConfig(ignoreCL, reload bool) (*config, []string, error) {
 	// Default config.
 	cfg := config{
 		ConfigFile:     defaultConfigFile,
 		DebugLevel:     defaultLogLevel,
 		MaxPeers:       defaultMaxPeers,
 		BanDuration:    defaultBanDuration,
+		BanThreshold:   defaultBanThreshold,
+		BanHalfLife:    defaultBanHalfLife,
+		BanPoW:         defaultBanPoW,
+		BanUnrequested: defaultBanUnrequested,
+		BanMalformed:   defaultBanMalformed,
+		BanHandshake:   defaultBanHandshake,
 		RPCMaxClients:  defaultMaxRPCClients,
+		RPCQueueSize:   defaultRPCQueueSize,
+		RPCMaxInFlight: defaultRPCMaxInFlight,
+		RPCUnixPerm:    defaultRPCUnixPerm,
 		DataDir:        defaultDataDir,
 		LogDir:         defaultLogDir,
 		DbType:         defaultDbType,
@@ -334,7 +458,10 @@ func loadConfig(ignoreCL bool) (*config, []string, error) {
 		RPCCert:        defaultRPCCertFile,
 		MaxDownPerPeer: defaultMaxDownPerPeer,
 		MaxUpPerPeer:   defaultMaxUpPerPeer,
+		QuotaPeriod:    defaultQuotaPeriod,
 		MaxOutbound:    defaultMaxOutbound,
+		PruneInterval:  defaultPruneInterval,
+		ExpiryMargin:   defaultExpiryMargin,
 	}
 
 	// Pre-parse the command line options to see if an alternative config
@@ -359,7 +486,7 @@ func loadConfig(ignoreCL bool) (*config, []string, error) {
 	appName = strings.TrimSuffix(appName, filepath.Ext(appName))
 	usageMessage := fmt.Sprintf("Use %s -h to show usage", appName)
 	if preCfg.ShowVersion {
-		fmt.Println(appName, "version", version())
+		fmt.Println(appName, "version", node.Version())
 		os.Exit(0)
 	}
 
@@ -414,19 +541,30 @@ func loadConfig(ignoreCL bool) (*config, []string, error) {
 
 	cfg.DataDir = cleanAndExpandPath(cfg.DataDir)
 	cfg.LogDir = cleanAndExpandPath(cfg.LogDir)
+	if cfg.RPCCredentials != "" {
+		cfg.RPCCredentials = cleanAndExpandPath(cfg.RPCCredentials)
+	}
+	if cfg.RPCUnix != "" {
+		cfg.RPCUnix = cleanAndExpandPath(cfg.RPCUnix)
+	}
 
 	// Special show command to list supported subsystems and exit.
-	if cfg.DebugLevel == "show" {
+	if cfg.DebugLevel == "show" && !reload {
 		fmt.Println("Supported subsystems", supportedSubsystems())
 		os.Exit(0)
 	}
 
-	// Initialize logging at the default logging level.
-	initSeelogLogger(filepath.Join(cfg.LogDir, defaultLogFilename))
-	setLogLevels(defaultLogLevel)
-
-	// Parse, validate, and set debug log level(s).
-	if err := parseAndSetDebugLevels(cfg.DebugLevel); err != nil {
+	// Initialize logging at the default logging level, unless it is already
+	// running, in which case the debug levels are only validated and will be
+	// set once the new configuration is applied.
+	if !reload {
+		initSeelogLogger(filepath.Join(cfg.LogDir, defaultLogFilename))
+		setLogLevels(defaultLogLevel)
+		err = parseAndSetDebugLevels(cfg.DebugLevel)
+	} else {
+		_, err = parseDebugLevels(cfg.DebugLevel)
+	}
+	if err != nil {
 		err := fmt.Errorf("%s: %v", funcName, err.Error())
 		fmt.Fprintln(os.Stderr, err)
 		fmt.Fprintln(os.Stderr, usageMessage)
@@ -464,6 +602,75 @@ func loadConfig(ignoreCL bool) (*config, []string, error) {
 		return nil, nil, err
 	}
 
+	// Ban scores must decay.
+	if cfg.BanHalfLife < time.Duration(time.Second) {
+		str := "%s: The banhalflife option may not be less than 1s -- parsed [%v]"
+		err := fmt.Errorf(str, funcName, cfg.BanHalfLife)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	// A threshold of 0 would ban every peer on its first penalty.
+	if cfg.BanThreshold == 0 {
+		str := "%s: The banthreshold option may not be 0"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	// Don't allow the database to be pruned too often.
+	if cfg.PruneInterval < time.Minute {
+		str := "%s: The pruneinterval option may not be less than 1m -- parsed [%v]"
+		err := fmt.Errorf(str, funcName, cfg.PruneInterval)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	// The expiry margin can't be negative.
+	if cfg.ExpiryMargin < 0 {
+		str := "%s: The expirymargin option may not be negative -- parsed [%v]"
+		err := fmt.Errorf(str, funcName, cfg.ExpiryMargin)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	// Bandwidth limits can't be negative.
+	if cfg.MaxUp < 0 || cfg.MaxDown < 0 || cfg.UploadQuota < 0 {
+		str := "%s: The maxtotalupload, maxtotaldownload and uploadquota " +
+			"options may not be negative"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if _, err := parseQuotaPeriod(cfg.QuotaPeriod); err != nil {
+		str := "%s: The quotaperiod option is invalid: %v"
+		err := fmt.Errorf(str, funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	// Take part in the default stream if none were specified.
+	if len(cfg.Streams) == 0 {
+		cfg.Streams = []uint32{defaultStream}
+	}
+
+	// Stream numbers start at 1.
+	for _, stream := range cfg.Streams {
+		if stream == 0 {
+			str := "%s: The stream option may not be 0"
+			err := fmt.Errorf(str, funcName)
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, usageMessage)
+			return nil, nil, err
+		}
+	}
+
 	// --addPeer and --connect do not mix.
 	if len(cfg.AddPeers) > 0 && len(cfg.ConnectPeers) > 0 {
 		str := "%s: the --addpeer and --connect options can not be " +
@@ -494,6 +701,47 @@ func loadConfig(ignoreCL bool) (*config, []string, error) {
 		}
 	}
 
+	// The queue must hold a batch of objects replayed to a subscriber.
+	if cfg.RPCQueueSize < node.MinRPCQueueSize {
+		str := "%s: The rpcqueuesize option may not be less than %d -- parsed [%d]"
+		err := fmt.Errorf(str, funcName, node.MinRPCQueueSize,
+			cfg.RPCQueueSize)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	if cfg.RPCMaxInFlight < 1 {
+		str := "%s: The rpcmaxinflight option may not be less than 1 -- parsed [%d]"
+		err := fmt.Errorf(str, funcName, cfg.RPCMaxInFlight)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	// Validate the options of the RPC Unix domain socket.
+	if _, err := parseRPCUnixPerm(cfg.RPCUnixPerm); err != nil {
+		str := "%s: The rpcunixperm option is invalid: %v"
+		err := fmt.Errorf(str, funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if _, err := parseRPCUnixUsers(cfg.RPCUnixUsers); err != nil {
+		str := "%s: The rpcunixuser option is invalid: %v"
+		err := fmt.Errorf(str, funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if len(cfg.RPCUnixUsers) > 0 && cfg.RPCUnix == "" {
+		str := "%s: The rpcunixuser option requires the rpcunix option"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
 	// Check to make sure limited and admin users don't have the same username
 	if cfg.RPCUser == cfg.RPCLimitUser && cfg.RPCUser != "" {
 		str := "%s: --rpcuser and --rpclimituser must not specify the " +
@@ -516,7 +764,8 @@ func loadConfig(ignoreCL bool) (*config, []string, error) {
 
 	// The RPC server is disabled if no username or password is provided.
 	if (cfg.RPCUser == "" || cfg.RPCPass == "") &&
-		(cfg.RPCLimitUser == "" || cfg.RPCLimitPass == "") {
+		(cfg.RPCLimitUser == "" || cfg.RPCLimitPass == "") &&
+		cfg.RPCCredentials == "" {
 		cfg.DisableRPC = true
 	}
 
@@ -541,6 +790,12 @@ func loadConfig(ignoreCL bool) (*config, []string, error) {
 	// duplicate addresses.
 	cfg.RPCListeners = normalizeAddresses(cfg.RPCListeners, defaultRPCPort)
 
+	// Add default port to the metrics listener address if needed.
+	if cfg.MetricsListen != "" {
+		cfg.MetricsListen = normalizeAddress(cfg.MetricsListen,
+			defaultMetricsPort)
+	}
+
 	// Only allow TLS to be disabled if the RPC is bound to localhost
 	// addresses.
 	if !cfg.DisableRPC && cfg.DisableTLS {
@@ -576,6 +831,13 @@ func loadConfig(ignoreCL bool) (*config, []string, error) {
 	cfg.AddPeers = normalizeAddresses(cfg.AddPeers, defaultPort)
 	cfg.ConnectPeers = normalizeAddresses(cfg.ConnectPeers, defaultPort)
 
+	// Use the default DNS seeders if none were specified, and add the
+	// default port to those without one.
+	if len(cfg.DNSSeeds) == 0 {
+		cfg.DNSSeeds = append([]string(nil), node.DefaultDNSSeeds...)
+	}
+	cfg.DNSSeeds = normalizeAddresses(cfg.DNSSeeds, defaultPort)
+
 	// Tor stream isolation requires either proxy or onion proxy to be set.
 	if cfg.TorIsolation && cfg.Proxy == "" && cfg.OnionProxy == "" {
 		str := "%s: Tor stream isolation requires either proxy or " +
@@ -711,3 +973,64 @@ func bmdLookup(host string) ([]net.IP, error) {
 	}
 	return cfg.lookup(host)
 }
+
+// nodeOptions returns the options of the node for the given configuration,
+// without the database.
+func nodeOptions(cfg *config) *node.Options {
+	opts := &node.Options{
+		Dial:           bmdDial,
+		Lookup:         bmdLookup,
+		DataDir:        cfg.DataDir,
+		AddPeers:       cfg.AddPeers,
+		ConnectPeers:   cfg.ConnectPeers,
+		MaxPeers:       cfg.MaxPeers,
+		MaxOutbound:    cfg.MaxOutbound,
+		MaxUpPerPeer:   int64(cfg.MaxUpPerPeer),
+		MaxDownPerPeer: int64(cfg.MaxDownPerPeer),
+		MaxUp:          int64(cfg.MaxUp),
+		MaxDown:        int64(cfg.MaxDown),
+		UploadQuota:    int64(cfg.UploadQuota),
+		BanDuration:    cfg.BanDuration,
+		BanThreshold:   cfg.BanThreshold,
+		BanHalfLife:    cfg.BanHalfLife,
+		BanPoW:         cfg.BanPoW,
+		BanUnrequested: cfg.BanUnrequested,
+		BanMalformed:   cfg.BanMalformed,
+		BanHandshake:   cfg.BanHandshake,
+		AllowList:      cfg.AllowList,
+		DenyList:       cfg.DenyList,
+		Streams:        cfg.Streams,
+		ChildStreams:   cfg.ChildStreams,
+		PruneInterval:  cfg.PruneInterval,
+		ExpiryMargin:   cfg.ExpiryMargin,
+		DisableRPC:     cfg.DisableRPC,
+		RPCListeners:   cfg.RPCListeners,
+		DisableTLS:     cfg.DisableTLS,
+		RPCCert:        cfg.RPCCert,
+		RPCKey:         cfg.RPCKey,
+		RPCUser:        cfg.RPCUser,
+		RPCPass:        cfg.RPCPass,
+		RPCLimitUser:   cfg.RPCLimitUser,
+		RPCLimitPass:   cfg.RPCLimitPass,
+		RPCCredentials: cfg.RPCCredentials,
+		RPCMaxClients:  cfg.RPCMaxClients,
+		RPCQueueSize:   cfg.RPCQueueSize,
+		RPCMaxInFlight: cfg.RPCMaxInFlight,
+		RPCUnix:        cfg.RPCUnix,
+	}
+	if !cfg.DisableListen {
+		opts.Listeners = cfg.Listeners
+		opts.ExternalIPs = cfg.ExternalIPs
+		opts.Upnp = cfg.Upnp
+	}
+	if !cfg.DisableDNSSeed {
+		opts.DNSSeeds = cfg.DNSSeeds
+	}
+
+	// The quota period and the options of the Unix domain socket were
+	// validated by loadConfig.
+	opts.QuotaPeriod, _ = parseQuotaPeriod(cfg.QuotaPeriod)
+	opts.RPCUnixPerm, _ = parseRPCUnixPerm(cfg.RPCUnixPerm)
+	opts.RPCUnixUsers, _ = parseRPCUnixUsers(cfg.RPCUnixUsers)
+	return opts
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/monetas/bmd/node"
+)
+
+// TestParseRPCUnixOptions checks the parsing of the permissions of the RPC Unix
+// domain socket and of the users its clients are authenticated as.
+func TestParseRPCUnixOptions(t *testing.T) {
+	permTests := []struct {
+		in   string
+		perm os.FileMode
+		ok   bool
+	}{
+		{"0600", 0600, true},
+		{"660", 0660, true},
+		{"0777", 0777, true},
+		{"", 0, false},
+		{"0800", 0, false},
+		{"10777", 0, false},
+		{"rw", 0, false},
+	}
+	for i, test := range permTests {
+		perm, err := parseRPCUnixPerm(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("for case #%d expected ok %v, got error %v", i, test.ok,
+				err)
+		}
+		if perm != test.perm {
+			t.Errorf("for case #%d expected %o, got %o", i, test.perm, perm)
+		}
+	}
+
+	users, err := parseRPCUnixUsers([]string{"1000:alice", "0:admin"})
+	if err != nil {
+		t.Fatalf("parseRPCUnixUsers failed: %v", err)
+	}
+	if len(users) != 2 || users[1000] != "alice" || users[0] != "admin" {
+		t.Errorf("unexpected users %v", users)
+	}
+
+	invalid := [][]string{
+		{"1000"},
+		{"1000:"},
+		{"alice:1000"},
+		{"-1:alice"},
+		{"1000:alice", "1000:bob"},
+	}
+	for i, entries := range invalid {
+		if _, err := parseRPCUnixUsers(entries); err == nil {
+			t.Errorf("for case #%d expected error for %v", i, entries)
+		}
+	}
+}
+
+// TestParseQuotaPeriod checks the parsing of the period of the upload quota.
+func TestParseQuotaPeriod(t *testing.T) {
+	tests := []struct {
+		in     string
+		period node.QuotaPeriod
+		ok     bool
+	}{
+		{"day", node.QuotaDaily, true},
+		{"month", node.QuotaMonthly, true},
+		{"", 0, false},
+		{"week", 0, false},
+		{"Month", 0, false},
+	}
+	for i, test := range tests {
+		period, err := parseQuotaPeriod(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("for case #%d expected ok %v, got error %v", i, test.ok,
+				err)
+		}
+		if period != test.period {
+			t.Errorf("for case #%d expected %d, got %d", i, test.period,
+				period)
+		}
+	}
+}
@@ -0,0 +1,698 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bdb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/monetas/bmd/database"
+	"github.com/monetas/bmutil"
+	"github.com/monetas/bmutil/identity"
+	"github.com/monetas/bmutil/wire"
+)
+
+// Names of the top-level buckets used by the database.
+var (
+	// objectsBucket maps inventory hash to the serialized object.
+	objectsBucket = []byte("objectsByHash")
+
+	// counterIndexBucket maps inventory hash to the counter value of the
+	// object so that objects can be removed from their counter bucket
+	// without a scan.
+	counterIndexBucket = []byte("counterByHash")
+
+	// countersBucket holds one nested bucket for each counter, which maps
+	// counter value to inventory hash.
+	countersBucket = []byte("counters")
+
+	// counterPosBucket holds the last counter value assigned for each
+	// counter.
+	counterPosBucket = []byte("counterPos")
+
+	// pubKeysBucket maps the tag of a public key to the serialized pubkey
+	// object.
+	pubKeysBucket = []byte("pubKeyByTag")
+)
+
+// Names of the counters for the various object types. Unknown objects are
+// consolidated into one counter.
+var (
+	msgCounter        = []byte("msg")
+	broadcastCounter  = []byte("broadcast")
+	pubKeyCounter     = []byte("pubkey")
+	getPubKeyCounter  = []byte("getpubkey")
+	unknownObjCounter = []byte("unknown")
+)
+
+// counterName returns the name of the counter used for objects of type
+// `objType'.
+func counterName(objType wire.ObjectType) []byte {
+	switch objType {
+	case wire.ObjectTypeBroadcast:
+		return broadcastCounter
+	case wire.ObjectTypeMsg:
+		return msgCounter
+	case wire.ObjectTypePubKey:
+		return pubKeyCounter
+	case wire.ObjectTypeGetPubKey:
+		return getPubKeyCounter
+	default:
+		return unknownObjCounter
+	}
+}
+
+// counterKey serializes a counter value so that keys sort in counter order.
+func counterKey(counter uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, counter)
+	return b
+}
+
+// BoltDb is a concrete implementation of the database.Db interface which
+// stores objects in a BoltDB file on disk.
+type BoltDb struct {
+	// Embed a mutex for safe access to the closed flag. BoltDB handles
+	// concurrency of the transactions themselves.
+	sync.RWMutex
+
+	db *bolt.DB
+
+	// closed indicates whether or not the database has been closed and is
+	// therefore invalidated.
+	closed bool
+}
+
+// Close cleanly shuts down the database and syncs all data. This is part of
+// the database.Db interface implementation.
+func (db *BoltDb) Close() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return database.ErrDbClosed
+	}
+
+	db.closed = true
+	return db.db.Close()
+}
+
+// CountObjects returns the number of objects in the main circulation store and
+// the number of public keys in the pubkey store. This is part of the
+// database.Db interface implementation.
+func (db *BoltDb) CountObjects() (uint64, uint64, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return 0, 0, database.ErrDbClosed
+	}
+
+	var objects, pubKeys uint64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		objects = uint64(tx.Bucket(objectsBucket).Stats().KeyN)
+		pubKeys = uint64(tx.Bucket(pubKeysBucket).Stats().KeyN)
+		return nil
+	})
+	return objects, pubKeys, err
+}
+
+// ExistsObject returns whether or not an object with the given inventory hash
+// exists in the database. This is part of the database.Db interface
+// implementation.
+func (db *BoltDb) ExistsObject(hash *wire.ShaHash) (bool, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return false, database.ErrDbClosed
+	}
+
+	var exists bool
+	err := db.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(objectsBucket).Get(hash[:]) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// fetchObject retrieves and decodes the object with the given hash within
+// a transaction.
+func fetchObject(tx *bolt.Tx, hash []byte) (*wire.MsgObject, error) {
+	data := tx.Bucket(objectsBucket).Get(hash)
+	if data == nil {
+		return nil, database.ErrNonexistentObject
+	}
+	return wire.DecodeMsgObject(data)
+}
+
+// FetchObjectByHash returns an object from the database as a wire.MsgObject.
+// This is part of the database.Db interface implementation.
+func (db *BoltDb) FetchObjectByHash(hash *wire.ShaHash) (*wire.MsgObject, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, database.ErrDbClosed
+	}
+
+	var obj *wire.MsgObject
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var err error
+		obj, err = fetchObject(tx, hash[:])
+		return err
+	})
+	return obj, err
+}
+
+// FetchObjectByCounter returns the corresponding object based on the
+// counter. This is part of the database.Db interface implementation.
+func (db *BoltDb) FetchObjectByCounter(objType wire.ObjectType,
+	counter uint64) (*wire.MsgObject, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, database.ErrDbClosed
+	}
+
+	var obj *wire.MsgObject
+	err := db.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(countersBucket).Bucket(counterName(objType))
+		hash := bucket.Get(counterKey(counter))
+		if hash == nil {
+			return database.ErrNonexistentObject
+		}
+
+		var err error
+		obj, err = fetchObject(tx, hash)
+		return err
+	})
+	return obj, err
+}
+
+// FetchObjectsFromCounter returns a map of `count' objects which have a
+// counter position starting from `counter'. Key is the value of counter and
+// value is the object. It also returns the counter value of the last object,
+// which could be useful for more queries to the function. This is part of the
+// database.Db interface implementation.
+func (db *BoltDb) FetchObjectsFromCounter(objType wire.ObjectType, counter uint64,
+	count uint64) (map[uint64]*wire.MsgObject, uint64, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, 0, database.ErrDbClosed
+	}
+
+	objects := make(map[uint64]*wire.MsgObject)
+	var newCounter uint64
+
+	err := db.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(countersBucket).Bucket(counterName(objType)).Cursor()
+
+		// Counter keys are big-endian so the cursor walks them in
+		// ascending order.
+		k, hash := cursor.Seek(counterKey(counter))
+		for ; k != nil && uint64(len(objects)) < count; k, hash = cursor.Next() {
+			obj, err := fetchObject(tx, hash)
+			if err != nil {
+				return err
+			}
+			newCounter = binary.BigEndian.Uint64(k)
+			objects[newCounter] = obj
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return objects, newCounter, nil
+}
+
+// FetchIdentityByAddress returns identity.Public stored in the form
+// of a PubKey message in the pubkey database. Public keys are stored by tag,
+// so this does not need to go through all of them. This is part of the
+// database.Db interface implementation.
+func (db *BoltDb) FetchIdentityByAddress(addr *bmutil.Address) (*identity.Public,
+	error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, database.ErrDbClosed
+	}
+
+	var id *identity.Public
+	err := db.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(pubKeysBucket).Get(addr.Tag())
+		if data == nil {
+			return database.ErrNonexistentObject
+		}
+
+		msg := new(wire.MsgPubKey)
+		err := msg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+
+		switch msg.Version {
+		case wire.SimplePubKeyVersion:
+			fallthrough
+		case wire.ExtendedPubKeyVersion:
+			id, err = identity.FromPubKeyMsg(msg)
+			return err
+		case wire.EncryptedPubKeyVersion:
+			// TODO
+			return database.ErrNotImplemented
+		default:
+			return database.ErrNonexistentObject
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// FilterObjects returns a map of objects that return true when passed to
+// the filter function. It could be used for grabbing objects of a certain
+// type, like getpubkey requests. This is an expensive operation as it
+// decodes every object in the database. Use sparingly and ensure that only a
+// few objects can match.
+//
+// WARNING: filter must not mutate the object and/or its inventory hash.
+//
+// This is part of the database.Db interface implementation.
+func (db *BoltDb) FilterObjects(filter func(hash *wire.ShaHash,
+	obj *wire.MsgObject) bool) (map[wire.ShaHash]*wire.MsgObject, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, database.ErrDbClosed
+	}
+
+	res := make(map[wire.ShaHash]*wire.MsgObject)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(objectsBucket).ForEach(func(k, v []byte) error {
+			hash, err := wire.NewShaHash(k)
+			if err != nil {
+				return err
+			}
+			obj, err := wire.DecodeMsgObject(v)
+			if err != nil {
+				return err
+			}
+			if filter(hash, obj) { // we need this
+				res[*hash] = obj
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// FetchRandomInvHashes returns the specified number of inventory hashes
+// corresponding to random unexpired objects from the database and filtering
+// them by calling filter(invHash, objectData) on each object. A return
+// value of true from filter means that the object would be returned.
+//
+// Useful for creating inv message, with filter being used to filter out
+// inventory hashes that have already been sent out to a particular node.
+//
+// WARNING: filter must not mutate the object and/or its inventory hash.
+//
+// This is part of the database.Db interface implementation.
+func (db *BoltDb) FetchRandomInvHashes(count uint64,
+	filter func(*wire.ShaHash, *wire.MsgObject) bool) ([]wire.ShaHash, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, database.ErrDbClosed
+	}
+
+	res := make([]wire.ShaHash, 0, count)
+	if count == 0 {
+		return res, nil
+	}
+
+	// Objects are keyed by their inventory hash, which is already random,
+	// so start at a random key and wrap around to the beginning.
+	start := make([]byte, wire.HashSize)
+	rand.Read(start)
+
+	err := db.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(objectsBucket).Cursor()
+
+		visit := func(k, v []byte) (bool, error) {
+			hash, err := wire.NewShaHash(k)
+			if err != nil {
+				return false, err
+			}
+			obj, err := wire.DecodeMsgObject(v)
+			if err != nil {
+				return false, err
+			}
+			if filter(hash, obj) { // we need this item
+				res = append(res, *hash)
+			}
+			return uint64(len(res)) >= count, nil
+		}
+
+		for k, v := cursor.Seek(start); k != nil; k, v = cursor.Next() {
+			if done, err := visit(k, v); done || err != nil {
+				return err
+			}
+		}
+		for k, v := cursor.First(); k != nil && bytes.Compare(k, start) < 0; k, v = cursor.Next() {
+			if done, err := visit(k, v); done || err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetCounter returns the highest value of counter that exists for objects
+// of the given type. This is part of the database.Db interface implementation.
+func (db *BoltDb) GetCounter(objType wire.ObjectType) (uint64, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return 0, database.ErrDbClosed
+	}
+
+	var counter uint64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		pos := tx.Bucket(counterPosBucket).Get(counterName(objType))
+		if pos != nil {
+			counter = binary.BigEndian.Uint64(pos)
+		}
+		return nil
+	})
+	return counter, err
+}
+
+// pubKeyTag returns the tag under which a pubkey object is stored in the
+// pubkey bucket. An error is returned if the object is not a valid pubkey.
+func pubKeyTag(data []byte) ([]byte, error) {
+	pubkeyMsg := new(wire.MsgPubKey)
+	err := pubkeyMsg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	switch pubkeyMsg.Version {
+	case wire.SimplePubKeyVersion:
+		fallthrough
+	case wire.ExtendedPubKeyVersion:
+		id, err := identity.FromPubKeyMsg(pubkeyMsg)
+		if err != nil { // invalid encryption/signing keys
+			return nil, err
+		}
+		return id.Address.Tag(), nil
+	case wire.EncryptedPubKeyVersion:
+		return pubkeyMsg.Tag.Bytes(), nil // directly included
+	}
+	return nil, database.ErrNonexistentObject
+}
+
+// InsertObject inserts the given object into the database and returns the
+// counter position. If the object is a PubKey, it is also inserted into a
+// separate place where it isn't touched by RemoveObject or
+// RemoveExpiredObjects and has to be removed using RemovePubKey. This is part
+// of the database.Db interface implementation.
+func (db *BoltDb) InsertObject(obj *wire.MsgObject) (uint64, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return 0, database.ErrDbClosed
+	}
+
+	hash := obj.InventoryHash()
+	data := wire.EncodeMessage(obj)
+
+	var counter uint64
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(objectsBucket)
+		if objects.Get(hash[:]) != nil {
+			return database.ErrDuplicateObject
+		}
+
+		// Handle pubkeys. Normal insertion should still succeed even if
+		// the pubkey is invalid, so errors are ignored.
+		if obj.ObjectType == wire.ObjectTypePubKey {
+			if tag, err := pubKeyTag(data); err == nil {
+				err = tx.Bucket(pubKeysBucket).Put(tag, data)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := objects.Put(hash[:], data); err != nil {
+			return err
+		}
+
+		// Increment counter.
+		name := counterName(obj.ObjectType)
+		positions := tx.Bucket(counterPosBucket)
+		if pos := positions.Get(name); pos != nil {
+			counter = binary.BigEndian.Uint64(pos)
+		}
+		counter++
+
+		key := counterKey(counter)
+		if err := positions.Put(name, key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(countersBucket).Bucket(name).Put(key, hash[:]); err != nil {
+			return err
+		}
+		return tx.Bucket(counterIndexBucket).Put(hash[:], key)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counter, nil
+}
+
+// removeObject removes the object with the given hash from the object bucket
+// and from its counter bucket within a transaction. It returns the counter
+// value the object had, or 0 if it had none.
+func removeObject(tx *bolt.Tx, hash []byte, objType wire.ObjectType) (uint64, error) {
+	var counter uint64
+	index := tx.Bucket(counterIndexBucket)
+	if key := index.Get(hash); key != nil {
+		counter = binary.BigEndian.Uint64(key)
+		err := tx.Bucket(countersBucket).Bucket(counterName(objType)).Delete(key)
+		if err != nil {
+			return 0, err
+		}
+		if err = index.Delete(hash); err != nil {
+			return 0, err
+		}
+	}
+	return counter, tx.Bucket(objectsBucket).Delete(hash)
+}
+
+// RemoveObject removes the object with the specified hash from the database.
+// Does not remove PubKeys. This is part of the database.Db interface
+// implementation.
+func (db *BoltDb) RemoveObject(hash *wire.ShaHash) error {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return database.ErrDbClosed
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		obj, err := fetchObject(tx, hash[:])
+		if err != nil {
+			return err
+		}
+		_, err = removeObject(tx, hash[:], obj.ObjectType)
+		return err
+	})
+}
+
+// RemoveObjectByCounter removes the object with the specified counter value
+// from the database. This is part of the database.Db interface implementation.
+func (db *BoltDb) RemoveObjectByCounter(objType wire.ObjectType,
+	counter uint64) error {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return database.ErrDbClosed
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		hash := tx.Bucket(countersBucket).Bucket(counterName(objType)).
+			Get(counterKey(counter))
+		if hash == nil {
+			return database.ErrNonexistentObject
+		}
+		_, err := removeObject(tx, hash, objType)
+		return err
+	})
+}
+
+// RemoveExpiredObjects prunes all objects in the main circulation store
+// whose expiry time has passed (along with the given margin). This does not
+// touch the pubkeys stored in the public key collection. It returns the counter
+// values of the removed objects grouped by object type and the total size in
+// bytes of the removed objects. This is part of the database.Db interface
+// implementation.
+func (db *BoltDb) RemoveExpiredObjects(margin time.Duration) (map[wire.ObjectType][]uint64,
+	uint64, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return nil, 0, database.ErrDbClosed
+	}
+
+	removed := make(map[wire.ObjectType][]uint64)
+	var size uint64
+
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		// current time - margin
+		cutoff := time.Now().Add(-margin)
+
+		// Collect the expired objects first since the bucket must not be
+		// modified while it is being iterated.
+		expired := make(map[string]wire.ObjectType)
+		err := tx.Bucket(objectsBucket).ForEach(func(k, v []byte) error {
+			obj, err := wire.DecodeMsgObject(v)
+			if err != nil {
+				return err
+			}
+			if cutoff.After(obj.ExpiresTime) { // expired
+				expired[string(k)] = obj.ObjectType
+				size += uint64(len(v))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for hash, objType := range expired {
+			counter, err := removeObject(tx, []byte(hash), objType)
+			if err != nil {
+				return err
+			}
+			if counter != 0 {
+				removed[objType] = append(removed[objType], counter)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return removed, size, nil
+}
+
+// RemovePubKey removes a PubKey from the PubKey store with the specified
+// tag. Note that it doesn't touch the general object store and won't remove
+// the public key from there. This is part of the database.Db interface
+// implementation.
+func (db *BoltDb) RemovePubKey(tag *wire.ShaHash) error {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.closed {
+		return database.ErrDbClosed
+	}
+
+	return db.db.Update(func(tx *bolt.Tx) error {
+		pubkeys := tx.Bucket(pubKeysBucket)
+		if pubkeys.Get(tag[:]) == nil {
+			return database.ErrNonexistentObject
+		}
+		return pubkeys.Delete(tag[:])
+	})
+}
+
+// RollbackClose discards the recent database changes to the previously saved
+// data at last Sync and closes the database. This is part of the database.Db
+// interface implementation.
+//
+// Every write to this database is committed in its own transaction, so there
+// are never any uncommitted changes to discard and this function behaves no
+// differently than Close.
+func (db *BoltDb) RollbackClose() error {
+	return db.Close()
+}
+
+// Sync verifies that the database is coherent on disk and no outstanding
+// transactions are in flight. This is part of the database.Db interface
+// implementation.
+func (db *BoltDb) Sync() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return database.ErrDbClosed
+	}
+
+	return db.db.Sync()
+}
+
+// openDB opens the BoltDB file at the given path, creating it and the buckets
+// used by the database as needed.
+func openDB(dbPath string) (*BoltDb, error) {
+	bdb, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{objectsBucket, counterIndexBucket,
+			counterPosBucket, pubKeysBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		counters, err := tx.CreateBucketIfNotExists(countersBucket)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{msgCounter, broadcastCounter,
+			pubKeyCounter, getPubKeyCounter, unknownObjCounter} {
+			if _, err := counters.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+
+	log.Infof("Opened object database at %s", dbPath)
+	return &BoltDb{db: bdb}, nil
+}
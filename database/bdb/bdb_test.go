@@ -0,0 +1,187 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bdb_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmd/database"
+	_ "github.com/monetas/bmd/database/bdb"
+	"github.com/monetas/bmutil/wire"
+)
+
+// tempDbPath returns the path of a database file in a new temporary directory
+// along with a function that removes the directory.
+func tempDbPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "bdbtest")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	return filepath.Join(dir, "objects.db"), func() { os.RemoveAll(dir) }
+}
+
+// TestClosed ensures that the correct errors are returend when the public
+// functions are called on a closed database.
+func TestClosed(t *testing.T) {
+	dbPath, cleanup := tempDbPath(t)
+	defer cleanup()
+
+	db, err := database.CreateDB("boltdb", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open test database %v", err)
+	}
+
+	db.Close()
+	hash, _ := wire.NewShaHash(bytes.Repeat([]byte{0}, 32))
+
+	if err := db.Sync(); err != database.ErrDbClosed {
+		t.Errorf("Sync: unexpected error %v", err)
+	}
+
+	if err := db.Close(); err != database.ErrDbClosed {
+		t.Errorf("Close: unexpected error %v", err)
+	}
+
+	if err := db.RollbackClose(); err != database.ErrDbClosed {
+		t.Errorf("RollbackClose: unexpected error %v", err)
+	}
+
+	if _, err := db.InsertObject(nil); err != database.ErrDbClosed {
+		t.Errorf("InsertObject: unexpected error %v", err)
+	}
+
+	if _, err = db.ExistsObject(hash); err != database.ErrDbClosed {
+		t.Errorf("ExistsObject: unexpected error %v", err)
+	}
+
+	if err := db.RemoveObject(hash); err != database.ErrDbClosed {
+		t.Errorf("RemoveObject: unexpected error %v", err)
+	}
+
+	if _, err := db.FetchObjectByHash(hash); err != database.ErrDbClosed {
+		t.Errorf("FetchObjectByHash: unexpected error %v", err)
+	}
+
+	if _, _, err := db.RemoveExpiredObjects(0); err != database.ErrDbClosed {
+		t.Errorf("RemoveExpiredObjects: unexpected error %v", err)
+	}
+
+	_, err = db.FetchObjectByCounter(wire.ObjectType(4), 1)
+	if err != database.ErrDbClosed {
+		t.Errorf("FetchObjectByCounter: unexpected error %v", err)
+	}
+
+	_, _, err = db.FetchObjectsFromCounter(wire.ObjectType(4), 1, 10)
+	if err != database.ErrDbClosed {
+		t.Errorf("FetchObjectsFromCounter: unexpected error %v", err)
+	}
+
+	if _, err := db.GetCounter(wire.ObjectType(4)); err != database.ErrDbClosed {
+		t.Errorf("GetCounter: unexpected error %v", err)
+	}
+
+	if _, _, err := db.CountObjects(); err != database.ErrDbClosed {
+		t.Errorf("CountObjects: unexpected error %v", err)
+	}
+
+	if err := db.RemoveObjectByCounter(wire.ObjectType(4), 3); err !=
+		database.ErrDbClosed {
+		t.Errorf("RemoveObjectByCounter: unexpected error %v", err)
+	}
+
+	if err := db.RemovePubKey(hash); err != database.ErrDbClosed {
+		t.Errorf("RemovePubKey: unexpected error %v", err)
+	}
+
+	if _, err := db.FetchIdentityByAddress(nil); err != database.ErrDbClosed {
+		t.Errorf("FetchIdentityByAddress: unexpected error %v", err)
+	}
+
+	if _, err := db.FilterObjects(nil); err != database.ErrDbClosed {
+		t.Errorf("FilterObjects: unexpected error %v", err)
+	}
+
+	if _, err := db.FetchRandomInvHashes(0, nil); err != database.ErrDbClosed {
+		t.Errorf("FetchRandomInvHashes: unexpected error %v", err)
+	}
+}
+
+// TestOpenNonexistent ensures that opening a database that was never created
+// returns database.ErrDbDoesNotExist so that callers know to create it.
+func TestOpenNonexistent(t *testing.T) {
+	dbPath, cleanup := tempDbPath(t)
+	defer cleanup()
+
+	_, err := database.OpenDB("boltdb", dbPath)
+	if err != database.ErrDbDoesNotExist {
+		t.Errorf("OpenDB: expected %v got %v", database.ErrDbDoesNotExist, err)
+	}
+}
+
+// TestPersistence ensures that objects and counters survive closing and
+// reopening the database.
+func TestPersistence(t *testing.T) {
+	dbPath, cleanup := tempDbPath(t)
+	defer cleanup()
+
+	db, err := database.CreateDB("boltdb", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create test database %v", err)
+	}
+
+	expires := time.Now().Add(10 * time.Minute)
+	msg := wire.NewMsgUnknownObject(345, expires, wire.ObjectType(4), 1, 1,
+		[]byte{77, 82, 53, 48, 96, 1}).ToMsgObject()
+
+	counter, err := db.InsertObject(msg)
+	if err != nil {
+		t.Fatalf("InsertObject: got error %v", err)
+	}
+	if _, err = db.InsertObject(msg); err != database.ErrDuplicateObject {
+		t.Errorf("InsertObject: expected %v inserting duplicate, got %v",
+			database.ErrDuplicateObject, err)
+	}
+	if err = db.Sync(); err != nil {
+		t.Fatalf("Sync: got error %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Close: got error %v", err)
+	}
+
+	db, err = database.OpenDB("boltdb", dbPath)
+	if err != nil {
+		t.Fatalf("OpenDB: got error %v", err)
+	}
+	defer db.Close()
+
+	exists, err := db.ExistsObject(msg.InventoryHash())
+	if err != nil || !exists {
+		t.Errorf("ExistsObject: object lost after reopening, error %v", err)
+	}
+
+	c, err := db.GetCounter(wire.ObjectType(4))
+	if err != nil {
+		t.Errorf("GetCounter: got error %v", err)
+	}
+	if c != counter {
+		t.Errorf("GetCounter: expected %d got %d", counter, c)
+	}
+
+	// The counter must continue from where it left off.
+	msg2 := wire.NewMsgUnknownObject(987, expires, wire.ObjectType(4), 1, 1,
+		[]byte{1, 2, 3, 4, 5, 0, 6, 7, 8, 9, 100}).ToMsgObject()
+	c, err = db.InsertObject(msg2)
+	if err != nil {
+		t.Fatalf("InsertObject: got error %v", err)
+	}
+	if c != counter+1 {
+		t.Errorf("InsertObject: expected counter %d got %d", counter+1, c)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package bdb implements an instance of the database package that uses BoltDB
+for object storage.
+
+BoltDB is a pure Go key/value store which keeps all of its data in a single
+file. Objects, counters and public keys are all stored there, so the contents
+of the database survive a restart of bmd.
+
+Layout
+
+Objects are stored in a bucket keyed by their inventory hash. Each object type
+has its own counter bucket which maps the big-endian encoding of a counter
+value to the inventory hash of the object, along with a reverse index so that
+objects can be removed by hash without scanning the counter buckets. Public
+keys are kept in a separate bucket keyed by tag and are never touched by
+RemoveObject or RemoveExpiredObjects.
+*/
+package bdb
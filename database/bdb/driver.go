@@ -0,0 +1,72 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package bdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/btcsuite/btclog"
+	"github.com/monetas/bmd/database"
+)
+
+// dbType is the name under which this driver is registered.
+const dbType = "boltdb"
+
+var log = btclog.Disabled
+
+func init() {
+	driver := database.DriverDB{DbType: dbType, CreateDB: CreateDB, OpenDB: OpenDB}
+	database.AddDBDriver(driver)
+}
+
+// parseArgs parses the arguments from the database package Open/Create methods.
+func parseArgs(funcName string, args ...interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("bdb.%s expects exactly one argument, the "+
+			"path to the database file", funcName)
+	}
+
+	dbPath, ok := args[0].(string)
+	if !ok {
+		return "", fmt.Errorf("bdb.%s: first argument must be a string "+
+			"path to the database file", funcName)
+	}
+
+	return dbPath, nil
+}
+
+// OpenDB opens an existing database for use. database.ErrDbDoesNotExist is
+// returned if there is no database at the given path.
+func OpenDB(args ...interface{}) (database.Db, error) {
+	dbPath, err := parseArgs("OpenDB", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, database.ErrDbDoesNotExist
+	}
+
+	log = database.GetLog()
+	return openDB(dbPath)
+}
+
+// CreateDB creates, initializes, and opens a database for use.
+func CreateDB(args ...interface{}) (database.Db, error) {
+	dbPath, err := parseArgs("CreateDB", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the directory the database lives in if needed.
+	if err = os.MkdirAll(filepath.Dir(dbPath), 0700); err != nil {
+		return nil, err
+	}
+
+	log = database.GetLog()
+	return openDB(dbPath)
+}
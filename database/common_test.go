@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 
 	"github.com/monetas/bmd/database"
+	_ "github.com/monetas/bmd/database/bdb"
 	_ "github.com/monetas/bmd/database/memdb"
 )
 
@@ -9,6 +9,7 @@ package database
 
 import (
 	"errors"
+	"time"
 
 	"github.com/monetas/bmutil"
 	"github.com/monetas/bmutil/identity"
@@ -33,6 +34,10 @@ type Db interface {
 	// Close cleanly shuts down the database and syncs all data.
 	Close() error
 
+	// CountObjects returns the number of objects in the main circulation
+	// store and the number of public keys in the pubkey store.
+	CountObjects() (objects uint64, pubKeys uint64, err error)
+
 	// ExistsObject returns whether or not an object with the given inventory
 	// hash exists in the database.
 	ExistsObject(*wire.ShaHash) (bool, error)
@@ -101,9 +106,12 @@ type Db interface {
 	RemoveObjectByCounter(wire.ObjectType, uint64) error
 
 	// RemoveExpiredObjects prunes all objects in the main circulation store
-	// whose expiry time has passed (along with a margin of 3 hours). This does
-	// not touch the pubkeys stored in the public key collection.
-	RemoveExpiredObjects() error
+	// whose expiry time has passed (along with the given margin). This does
+	// not touch the pubkeys stored in the public key collection. It returns
+	// the counter values of the removed objects grouped by object type and
+	// the total size in bytes of the removed objects.
+	RemoveExpiredObjects(margin time.Duration) (map[wire.ObjectType][]uint64,
+		uint64, error)
 
 	// RemovePubKey removes a PubKey from the PubKey store with the specified
 	// tag. Note that it doesn't touch the general object store and won't remove
@@ -154,6 +154,16 @@ func testObject(tc *testContext) {
 
 		hash := msg.InventoryHash()
 
+		objects, _, err := tc.db.CountObjects()
+		if err != nil {
+			tc.t.Errorf("CountObjects (%s): object #%d, got error %v",
+				tc.dbType, i, err)
+		}
+		if objects != 1 {
+			tc.t.Errorf("CountObjects (%s): object #%d, expected 1 object,"+
+				" got %d", tc.dbType, i, objects)
+		}
+
 		exists, err := tc.db.ExistsObject(hash)
 		if err != nil {
 			tc.t.Errorf("ExistsObject (%s): object #%d,"+
@@ -198,6 +208,16 @@ func testObject(tc *testContext) {
 				" in db but does", tc.dbType, i)
 		}
 
+		objects, _, err = tc.db.CountObjects()
+		if err != nil {
+			tc.t.Errorf("CountObjects (%s): object #%d, got error %v",
+				tc.dbType, i, err)
+		}
+		if objects != 0 {
+			tc.t.Errorf("CountObjects (%s): object #%d, expected 0 objects,"+
+				" got %d", tc.dbType, i, objects)
+		}
+
 		_, err = tc.db.FetchObjectByHash(hash)
 		if err == nil {
 			tc.t.Errorf("FetchObjectByHash (%s): object #%d, fetching"+
@@ -580,7 +600,32 @@ func testRemoveExpiredObjects(tc *testContext) {
 		}
 	}
 
-	tc.db.RemoveExpiredObjects()
+	removed, size, err := tc.db.RemoveExpiredObjects(3 * time.Hour)
+	if err != nil {
+		tc.t.Fatalf("RemoveExpiredObjects (%s): got error %v", tc.dbType, err)
+	}
+
+	// One object of each group in testObj has expired.
+	count := 0
+	for objType, counters := range removed {
+		for _, counter := range counters {
+			_, err := tc.db.FetchObjectByCounter(objType, counter)
+			if err == nil {
+				tc.t.Errorf("RemoveExpiredObjects (%s): object with counter"+
+					" %d of type %s was reported removed but still exists",
+					tc.dbType, counter, objType)
+			}
+		}
+		count += len(counters)
+	}
+	if count != len(testObj) {
+		tc.t.Errorf("RemoveExpiredObjects (%s): expected %d removed objects,"+
+			" got %d", tc.dbType, len(testObj), count)
+	}
+	if size == 0 {
+		tc.t.Errorf("RemoveExpiredObjects (%s): expected size of removed"+
+			" objects to be non-zero", tc.dbType)
+	}
 
 	for i, messages := range testObj {
 		for j, message := range messages {
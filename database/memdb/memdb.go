@@ -118,6 +118,19 @@ func (db *MemDb) Close() error {
 	return nil
 }
 
+// CountObjects returns the number of objects in the main circulation store and
+// the number of public keys in the pubkey store. This is part of the
+// database.Db interface implementation.
+func (db *MemDb) CountObjects() (uint64, uint64, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.closed {
+		return 0, 0, database.ErrDbClosed
+	}
+
+	return uint64(len(db.objectsByHash)), uint64(len(db.pubKeyByTag)), nil
+}
+
 // ExistsObject returns whether or not an object with the given inventory hash
 // exists in the database. This is part of the database.Db interface
 // implementation.
@@ -464,34 +477,42 @@ func (db *MemDb) RemoveObjectByCounter(objType wire.ObjectType,
 }
 
 // RemoveExpiredObjects prunes all objects in the main circulation store
-// whose expiry time has passed (along with a margin of 3 hours). This does
-// not touch the pubkeys stored in the public key collection. This is part of
-// the database.Db interface implementation.
-func (db *MemDb) RemoveExpiredObjects() error {
+// whose expiry time has passed (along with the given margin). This does not
+// touch the pubkeys stored in the public key collection. It returns the counter
+// values of the removed objects grouped by object type and the total size in
+// bytes of the removed objects. This is part of the database.Db interface
+// implementation.
+func (db *MemDb) RemoveExpiredObjects(margin time.Duration) (map[wire.ObjectType][]uint64,
+	uint64, error) {
 	db.Lock()
 	defer db.Unlock()
 	if db.closed {
-		return database.ErrDbClosed
+		return nil, 0, database.ErrDbClosed
 	}
 
+	removed := make(map[wire.ObjectType][]uint64)
+	var size uint64
+
 	for hash, obj := range db.objectsByHash {
-		// current time - 3 hours
-		if time.Now().Add(-time.Hour * 3).After(obj.ExpiresTime) { // expired
+		// current time - margin
+		if time.Now().Add(-margin).After(obj.ExpiresTime) { // expired
 			// remove from counter map
 			counterMap := db.getCounter(obj.ObjectType)
 
 			for k, v := range counterMap.ByCounter { // go through each element
 				if v.IsEqual(&hash) { // we got a match, so delete
 					delete(counterMap.ByCounter, k)
+					removed[obj.ObjectType] = append(removed[obj.ObjectType], k)
 					break
 				}
 			}
+			size += uint64(len(wire.EncodeMessage(obj)))
 
 			// remove object from object map
 			delete(db.objectsByHash, hash)
 		}
 	}
-	return nil
+	return removed, size, nil
 }
 
 // RemovePubKey removes a PubKey from the PubKey store with the specified
@@ -55,7 +55,7 @@ func TestClosed(t *testing.T) {
 		t.Errorf("FetchObjectByHash: unexpected error %v", err)
 	}
 
-	if err := db.RemoveExpiredObjects(); err != database.ErrDbClosed {
+	if _, _, err := db.RemoveExpiredObjects(0); err != database.ErrDbClosed {
 		t.Errorf("RemoveExpiredObjects: unexpected error %v", err)
 	}
 
@@ -73,6 +73,10 @@ func TestClosed(t *testing.T) {
 		t.Errorf("GetCounter: unexpected error %v", err)
 	}
 
+	if _, _, err := db.CountObjects(); err != database.ErrDbClosed {
+		t.Errorf("CountObjects: unexpected error %v", err)
+	}
+
 	if err := db.RemoveObjectByCounter(wire.ObjectType(4), 3); err !=
 		database.ErrDbClosed {
 		t.Errorf("RemoveObjectByCounter: unexpected error %v", err)
@@ -0,0 +1,105 @@
+// Originally derived from: btcsuite/btcd/blockmanager.go
+// Copyright (c) 2013-2015 the btcsuite developers.
+
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/monetas/bmd/database"
+)
+
+const (
+	// objectDbNamePrefix is the prefix for the object database name. The
+	// database type is appended to this value to form the full object database
+	// name.
+	objectDbNamePrefix = "objects"
+)
+
+// objectDbPath returns the path to the object database given a database type.
+func objectDbPath(dbType string) string {
+	// The database name is based on the database type.
+	dbName := objectDbNamePrefix + "_" + dbType
+	if dbType == "sqlite" || dbType == "boltdb" {
+		dbName = dbName + ".db"
+	}
+	dbPath := filepath.Join(cfg.DataDir, dbName)
+	return dbPath
+}
+
+// warnMultipeDBs shows a warning if multiple database types are detected.
+// This is not a situation most users want.  It is handy for development however
+// to support multiple side-by-side databases.
+func warnMultipeDBs(dbType string) {
+	// This is intentionally not using the known db types which depend
+	// on the database types compiled into the binary since we want to
+	// detect legacy db types as well.
+	dbTypes := []string{"boltdb", "leveldb", "sqlite"}
+	duplicateDbPaths := make([]string, 0, len(dbTypes)-1)
+	for _, dbt := range dbTypes {
+		if dbt == dbType {
+			continue
+		}
+
+		// Store db path as a duplicate db if it exists.
+		dbPath := objectDbPath(dbt)
+		if fileExists(dbPath) {
+			duplicateDbPaths = append(duplicateDbPaths, dbPath)
+		}
+	}
+
+	// Warn if there are extra databases.
+	if len(duplicateDbPaths) > 0 {
+		selectedDbPath := objectDbPath(dbType)
+		bmdLog.Warnf("WARNING: There are multiple object databases using "+
+			"different database types.\nYou probably don't want to "+
+			"waste disk space by having more than one.\nYour current "+
+			"database is located at [%v].\nThe additional databases "+
+			"are located at %v", selectedDbPath, duplicateDbPaths)
+	}
+}
+
+// setupDB loads (or creates when needed) the object database taking into
+// account the selected database backend. It also contains additional logic
+// such warning the user if there are multiple databases which consume space on
+// the file system.
+func setupDB(dbType, dbPath string) (database.Db, error) {
+	// The memdb backend does not have a file path associated with it, so
+	// handle it uniquely.  We also don't want to worry about the multiple
+	// database type warnings when running with the memory database.
+	if dbType == "memdb" {
+		db, err := database.CreateDB(dbType)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+
+	warnMultipeDBs(dbType)
+
+	db, err := database.OpenDB(dbType, dbPath)
+	if err != nil {
+		// Return the error if it's not because the database
+		// doesn't exist.
+		if err != database.ErrDbDoesNotExist {
+			return nil, err
+		}
+
+		// Create the db if it does not exist.
+		err = os.MkdirAll(cfg.DataDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		db, err = database.CreateDB(dbType, dbPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/btcsuite/seelog"
 	"github.com/monetas/bmd/addrmgr"
 	"github.com/monetas/bmd/database"
+	"github.com/monetas/bmd/node"
 	"github.com/monetas/bmd/peer"
 	"github.com/monetas/bmutil/wire"
 )
@@ -86,16 +87,20 @@ func useLogger(subsystemID string, logger btclog.Logger) {
 	case "PEER":
 		peerLog = logger
 		peer.UseLogger(logger)
+		node.UseLogger(node.PeerSubsystem, logger)
 
 	case "RPC":
 		rpcLog = logger
+		node.UseLogger(node.RPCSubsystem, logger)
 
 	case "SERVER":
 		serverLog = logger
+		node.UseLogger(node.ServerSubsystem, logger)
 
 	case "DB":
 		dbLog = logger
 		database.UseLogger(logger)
+		node.UseLogger(node.DBSubsystem, logger)
 	}
 }
 
@@ -0,0 +1,354 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	// quotaFilename is the name of the file in the data directory in which
+	// the use of the upload quota is stored.
+	quotaFilename = "quota.json"
+
+	// quotaInterval is how often the use of the upload quota is saved and
+	// objects stop being fresh.
+	quotaInterval = time.Minute
+
+	// freshObjectAge is how long an object is still sent to peers after it
+	// was received once the upload quota is used up.
+	freshObjectAge = time.Hour
+
+	// rateBurst is how long the transfers of idle connections may go
+	// unlimited before the rate limit applies.
+	rateBurst = time.Second
+)
+
+// QuotaPeriod is the period after which the upload quota starts over.
+type QuotaPeriod int
+
+const (
+	// QuotaDaily starts the upload quota over at midnight UTC.
+	QuotaDaily QuotaPeriod = iota
+
+	// QuotaMonthly starts the upload quota over on the first day of each
+	// month, at midnight UTC.
+	QuotaMonthly
+)
+
+// start returns the start of the period which contains t.
+func (p QuotaPeriod) start(t time.Time) time.Time {
+	t = t.UTC()
+	if p == QuotaMonthly {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// rateLimiter limits the combined rate of transfers made by many goroutines.
+// Transfers are paid for in the order in which they are made, so that each
+// connection, which waits for one transfer before it makes the next, gets its
+// turn. It is safe for concurrent access.
+type rateLimiter struct {
+	mtx  sync.Mutex
+	rate float64   // bytes per second, 0 if there is no limit.
+	next time.Time // when the transfers made so far are paid for.
+}
+
+// SetRate changes the limit to the given number of bytes per second. There is
+// no limit if it is 0.
+func (l *rateLimiter) SetRate(rate int64) {
+	l.mtx.Lock()
+	l.rate = float64(rate)
+	l.mtx.Unlock()
+}
+
+// Transfer accounts for n bytes and returns how long to wait before the next
+// transfer to stay within the limit.
+func (l *rateLimiter) Transfer(n int) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if earliest := now.Add(-rateBurst); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	return l.next.Sub(now)
+}
+
+// bandwidth limits the rates at which the node as a whole sends data to and
+// receives data from peers, and keeps track of the upload quota. It is safe for
+// concurrent access.
+type bandwidth struct {
+	up   rateLimiter
+	down rateLimiter
+
+	mtx         sync.Mutex
+	quota       uint64 // 0 if there is no quota.
+	period      QuotaPeriod
+	periodStart time.Time
+	used        uint64
+	fresh       map[wire.ShaHash]time.Time // when fresh objects were received.
+}
+
+// SetQuota changes the upload quota. The bytes sent so far in the current
+// period count towards the new quota, unless the period changes, in which case
+// the quota starts over. There is no quota if it is 0.
+func (b *bandwidth) SetQuota(quota int64, period QuotaPeriod) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.quota = uint64(quota)
+	if period != b.period {
+		b.period = period
+		b.periodStart = period.start(time.Now())
+		b.used = 0
+	}
+	if b.quota == 0 {
+		b.fresh = make(map[wire.ShaHash]time.Time)
+	}
+}
+
+// Sent accounts for n bytes sent to a peer and returns how long to wait before
+// sending more.
+func (b *bandwidth) Sent(n int) time.Duration {
+	b.mtx.Lock()
+	b.rollOver(time.Now())
+	b.used += uint64(n)
+	b.mtx.Unlock()
+
+	return b.up.Transfer(n)
+}
+
+// Received accounts for n bytes received from a peer and returns how long to
+// wait before receiving more.
+func (b *bandwidth) Received(n int) time.Duration {
+	return b.down.Transfer(n)
+}
+
+// QuotaUsed returns whether the upload quota for the current period is used
+// up.
+func (b *bandwidth) QuotaUsed() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.rollOver(time.Now())
+	return b.quota != 0 && b.used >= b.quota
+}
+
+// AddFresh records that an object was just received. Fresh objects are still
+// sent to peers once the upload quota is used up, so that they are relayed.
+func (b *bandwidth) AddFresh(hash *wire.ShaHash) {
+	b.mtx.Lock()
+	if b.quota != 0 {
+		b.fresh[*hash] = time.Now()
+	}
+	b.mtx.Unlock()
+}
+
+// IsFresh returns whether an object was received recently.
+func (b *bandwidth) IsFresh(hash *wire.ShaHash) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	received, ok := b.fresh[*hash]
+	return ok && time.Since(received) < freshObjectAge
+}
+
+// FilterFresh returns the inventory vectors of fresh objects.
+func (b *bandwidth) FilterFresh(invList []*wire.InvVect) []*wire.InvVect {
+	fresh := make([]*wire.InvVect, 0, len(invList))
+	for _, inv := range invList {
+		if b.IsFresh(&inv.Hash) {
+			fresh = append(fresh, inv)
+		}
+	}
+	return fresh
+}
+
+// rollOver starts the quota over if a new period has begun. b.mtx must be
+// held.
+func (b *bandwidth) rollOver(now time.Time) {
+	if start := b.period.start(now); start.After(b.periodStart) {
+		if b.quota != 0 && b.used >= b.quota {
+			serverLog.Info("Upload quota is available again.")
+		}
+		b.periodStart = start
+		b.used = 0
+	}
+}
+
+// pruneFresh forgets the objects that are no longer fresh.
+func (b *bandwidth) pruneFresh(now time.Time) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for hash, received := range b.fresh {
+		if now.Sub(received) >= freshObjectAge {
+			delete(b.fresh, hash)
+		}
+	}
+}
+
+// serializedQuota is the content of the quota file.
+type serializedQuota struct {
+	PeriodStart time.Time `json:"periodStart"`
+	Used        uint64    `json:"used"`
+}
+
+// load restores the use of the upload quota from the file at path, if it was
+// saved during the current period.
+func (b *bandwidth) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var q serializedQuota
+	if err = json.NewDecoder(f).Decode(&q); err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if q.PeriodStart.Equal(b.periodStart) {
+		b.used = q.Used
+	}
+	return nil
+}
+
+// save writes the use of the upload quota to the file at path.
+func (b *bandwidth) save(path string) error {
+	b.mtx.Lock()
+	b.rollOver(time.Now())
+	q := serializedQuota{PeriodStart: b.periodStart, Used: b.used}
+	b.mtx.Unlock()
+
+	return writeJSONFileAtomic(path, &q)
+}
+
+// newBandwidth returns the limits and the upload quota given by the options.
+func newBandwidth(opts *Options) *bandwidth {
+	b := &bandwidth{
+		quota:       uint64(opts.UploadQuota),
+		period:      opts.QuotaPeriod,
+		periodStart: opts.QuotaPeriod.start(time.Now()),
+		fresh:       make(map[wire.ShaHash]time.Time),
+	}
+	b.up.SetRate(opts.MaxUp)
+	b.down.SetRate(opts.MaxDown)
+	return b
+}
+
+// quotaPath returns the path of the file in which the use of the upload quota
+// is stored.
+func (s *server) quotaPath() string {
+	return filepath.Join(s.cfg.DataDir, quotaFilename)
+}
+
+// bandwidthHandler periodically saves the use of the upload quota and forgets
+// the objects that are no longer fresh. It must be run as a goroutine.
+func (s *server) bandwidthHandler() {
+	ticker := time.NewTicker(quotaInterval)
+	defer ticker.Stop()
+
+	quotaUsed := false
+out:
+	for {
+		select {
+		case <-ticker.C:
+			s.bandwidth.pruneFresh(time.Now())
+			if used := s.bandwidth.QuotaUsed(); used && !quotaUsed {
+				serverLog.Info("Upload quota is used up. Only fresh " +
+					"objects are sent to peers until the next period.")
+				quotaUsed = true
+			} else if !used {
+				quotaUsed = false
+			}
+			s.saveQuota()
+
+		case <-s.quit:
+			break out
+		}
+	}
+
+	s.saveQuota()
+	s.wg.Done()
+}
+
+// saveQuota stores the use of the upload quota, if there is one, so that it is
+// restored after a restart.
+func (s *server) saveQuota() {
+	s.bandwidth.mtx.Lock()
+	quota := s.bandwidth.quota
+	s.bandwidth.mtx.Unlock()
+	if quota == 0 {
+		return
+	}
+
+	if err := s.bandwidth.save(s.quotaPath()); err != nil {
+		serverLog.Errorf("Failed to save the use of the upload quota: %v", err)
+	}
+}
+
+// limitedConn is a connection to a peer whose transfers count towards the
+// bandwidth limits and the upload quota of the node.
+type limitedConn struct {
+	peer.Connection
+	bandwidth *bandwidth
+	quit      chan struct{}
+}
+
+// WriteMessage writes a message to the peer and waits for the bandwidth that
+// it used to become available again.
+func (c *limitedConn) WriteMessage(msg wire.Message) error {
+	written := c.BytesWritten()
+	err := c.Connection.WriteMessage(msg)
+	c.pause(c.bandwidth.Sent(int(c.BytesWritten() - written)))
+	return err
+}
+
+// ReadMessage reads a message from the peer and waits for the bandwidth that
+// it used to become available again.
+func (c *limitedConn) ReadMessage() (wire.Message, error) {
+	read := c.BytesRead()
+	msg, err := c.Connection.ReadMessage()
+	c.pause(c.bandwidth.Received(int(c.BytesRead() - read)))
+	return msg, err
+}
+
+// pause waits for d, or until the server shuts down.
+func (c *limitedConn) pause(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	select {
+	case <-t.C:
+	case <-c.quit:
+	}
+	t.Stop()
+}
+
+// limitConn returns a connection whose transfers count towards the bandwidth
+// limits and the upload quota of the node.
+func (s *server) limitConn(conn peer.Connection) peer.Connection {
+	return &limitedConn{Connection: conn, bandwidth: s.bandwidth, quit: s.quit}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+func TestQuotaPeriodStart(t *testing.T) {
+	now := time.Date(2015, time.March, 14, 15, 9, 26, 0, time.UTC)
+	tests := []struct {
+		period   QuotaPeriod
+		t        time.Time
+		expected time.Time
+	}{
+		{QuotaDaily, now, time.Date(2015, time.March, 14, 0, 0, 0, 0, time.UTC)},
+		{QuotaMonthly, now, time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		// Periods are in UTC.
+		{QuotaDaily, now.In(time.FixedZone("UTC+10", 10*3600)),
+			time.Date(2015, time.March, 14, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for i, test := range tests {
+		if start := test.period.start(test.t); !start.Equal(test.expected) {
+			t.Errorf("for case #%d expected %v, got %v", i, test.expected,
+				start)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	if wait := l.Transfer(1 << 20); wait != 0 {
+		t.Errorf("expected no wait without a limit, got %v", wait)
+	}
+
+	// An idle limiter allows a second's worth of data right away, after
+	// which transfers take turns.
+	l.SetRate(1000)
+	if wait := l.Transfer(1000); wait > 10*time.Millisecond {
+		t.Errorf("expected no wait for the first transfer, got %v", wait)
+	}
+	for i := 1; i <= 3; i++ {
+		wait := l.Transfer(500)
+		expected := time.Duration(i) * 500 * time.Millisecond
+		if wait < expected-10*time.Millisecond || wait > expected {
+			t.Errorf("for transfer #%d expected to wait %v, got %v", i,
+				expected, wait)
+		}
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bmd-quota")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, quotaFilename)
+
+	opts := DefaultOptions()
+	opts.UploadQuota = 100
+	opts.QuotaPeriod = QuotaDaily
+	b := newBandwidth(opts)
+
+	b.Sent(60)
+	if b.QuotaUsed() {
+		t.Error("quota used up after 60 of 100 bytes")
+	}
+	b.Sent(50)
+	if !b.QuotaUsed() {
+		t.Error("quota not used up after 110 of 100 bytes")
+	}
+
+	// Only fresh objects are sent once the quota is used up.
+	fresh := &wire.InvVect{Hash: wire.ShaHash{1}}
+	old := &wire.InvVect{Hash: wire.ShaHash{2}}
+	b.AddFresh(&fresh.Hash)
+	b.mtx.Lock()
+	b.fresh[old.Hash] = time.Now().Add(-freshObjectAge)
+	b.mtx.Unlock()
+	invList := b.FilterFresh([]*wire.InvVect{fresh, old})
+	if len(invList) != 1 || invList[0] != fresh {
+		t.Errorf("expected only the fresh object, got %v", invList)
+	}
+	b.pruneFresh(time.Now())
+	if len(b.fresh) != 1 {
+		t.Errorf("expected 1 fresh object after pruning, got %d",
+			len(b.fresh))
+	}
+
+	// The use of the quota is restored in the same period only.
+	if err = b.save(path); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	b = newBandwidth(opts)
+	if err = b.load(path); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !b.QuotaUsed() {
+		t.Error("use of the quota was not restored")
+	}
+	opts.QuotaPeriod = QuotaMonthly
+	b = newBandwidth(opts)
+	if err = b.load(path); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if b.QuotaUsed() && !QuotaDaily.start(time.Now()).Equal(
+		QuotaMonthly.start(time.Now())) {
+		t.Error("use of the quota was restored in another period")
+	}
+
+	// Removing the quota makes all objects available again.
+	b.SetQuota(0, QuotaMonthly)
+	if b.QuotaUsed() {
+		t.Error("quota used up without a quota")
+	}
+	b.AddFresh(&fresh.Hash)
+	if len(b.fresh) != 0 {
+		t.Error("objects are kept track of without a quota")
+	}
+
+	if err = ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err = b.load(path); err == nil {
+		t.Error("expected an error loading an invalid file")
+	}
+}
+
+// countingConn is a connection which transfers messages of a fixed size.
+type countingConn struct {
+	peer.Connection
+	written, read uint64
+}
+
+func (c *countingConn) WriteMessage(wire.Message) error {
+	c.written += 1000
+	return nil
+}
+
+func (c *countingConn) ReadMessage() (wire.Message, error) {
+	c.read += 1000
+	return &wire.MsgVerAck{}, nil
+}
+
+func (c *countingConn) BytesWritten() uint64 {
+	return c.written
+}
+
+func (c *countingConn) BytesRead() uint64 {
+	return c.read
+}
+
+func TestLimitedConn(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxUp = 1000
+	opts.MaxDown = 1000
+	opts.UploadQuota = 1500
+	quit := make(chan struct{})
+	conn := &limitedConn{
+		Connection: &countingConn{},
+		bandwidth:  newBandwidth(opts),
+		quit:       quit,
+	}
+
+	// The first message of each direction is within the burst.
+	start := time.Now()
+	conn.WriteMessage(&wire.MsgVerAck{})
+	conn.ReadMessage()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("first messages took %v", elapsed)
+	}
+	if conn.bandwidth.QuotaUsed() {
+		t.Error("quota used up after 1000 of 1500 bytes")
+	}
+
+	// The next one waits for the limit, unless the server shuts down.
+	time.AfterFunc(50*time.Millisecond, func() { close(quit) })
+	conn.WriteMessage(&wire.MsgVerAck{})
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waiting for the limit did not stop at shutdown, took %v",
+			elapsed)
+	}
+	if !conn.bandwidth.QuotaUsed() {
+		t.Error("quota not used up after 2000 of 1500 bytes")
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// banListFilename is the name of the file in the data directory in which
+	// bans are stored.
+	banListFilename = "banlist.json"
+
+	// banListVersion is the version of the format of the ban list file.
+	banListVersion = 1
+
+	// allowListName and denyListName are the names by which the lists of IP
+	// ranges given by the AllowList and DenyList options are edited.
+	allowListName = "allow"
+	denyListName  = "deny"
+)
+
+// parseIPRange parses an IP address or a CIDR range. A single address is
+// returned as a range which contains only that address.
+func parseIPRange(r string) (*net.IPNet, error) {
+	if strings.Contains(r, "/") {
+		_, ipNet, err := net.ParseCIDR(r)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(r)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address or range %s", r)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseIPRanges parses a list of IP addresses and CIDR ranges.
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		ipNet, err := parseIPRange(r)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// ipList is a list of IP ranges. It is safe for concurrent access.
+type ipList struct {
+	mtx  sync.RWMutex
+	nets []*net.IPNet
+}
+
+// Contains returns whether the IP address is in one of the ranges.
+func (l *ipList) Contains(ip net.IP) bool {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	for _, ipNet := range l.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds an IP address or CIDR range to the list. An error is returned if
+// it is invalid or already in the list.
+func (l *ipList) Add(r string) (*net.IPNet, error) {
+	ipNet, err := parseIPRange(r)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for _, n := range l.nets {
+		if n.String() == ipNet.String() {
+			return nil, fmt.Errorf("%s is already listed", ipNet)
+		}
+	}
+	l.nets = append(l.nets, ipNet)
+	return ipNet, nil
+}
+
+// Remove removes an IP address or CIDR range from the list. An error is
+// returned if it is not in the list.
+func (l *ipList) Remove(r string) error {
+	ipNet, err := parseIPRange(r)
+	if err != nil {
+		return err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for i, n := range l.nets {
+		if n.String() == ipNet.String() {
+			l.nets = append(l.nets[:i], l.nets[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not listed", ipNet)
+}
+
+// Set replaces the ranges in the list.
+func (l *ipList) Set(nets []*net.IPNet) {
+	l.mtx.Lock()
+	l.nets = nets
+	l.mtx.Unlock()
+}
+
+// Ranges returns the ranges in the list in CIDR notation.
+func (l *ipList) Ranges() []string {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	ranges := make([]string, len(l.nets))
+	for i, ipNet := range l.nets {
+		ranges[i] = ipNet.String()
+	}
+	return ranges
+}
+
+// newIPList returns a list of the given IP addresses and CIDR ranges.
+func newIPList(ranges []string) (*ipList, error) {
+	nets, err := parseIPRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
+	return &ipList{nets: nets}, nil
+}
+
+// serializedBan is a ban as it is stored in the ban list file.
+type serializedBan struct {
+	Host  string    `json:"host"`
+	Until time.Time `json:"until"`
+}
+
+// serializedBanList is the content of the ban list file.
+type serializedBanList struct {
+	Version int             `json:"version"`
+	Bans    []serializedBan `json:"bans"`
+}
+
+// loadBans reads the bans stored in the file at path and returns the end of the
+// ban of each host. Bans that have ended are left out. There are no bans if the
+// file does not exist.
+func loadBans(path string) (map[string]time.Time, error) {
+	bans := make(map[string]time.Time)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return bans, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list serializedBanList
+	if err = json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, err
+	}
+	if list.Version != banListVersion {
+		return nil, fmt.Errorf("unknown version %d in ban list", list.Version)
+	}
+
+	now := time.Now()
+	for _, ban := range list.Bans {
+		if net.ParseIP(ban.Host) == nil {
+			return nil, fmt.Errorf("invalid host %s in ban list", ban.Host)
+		}
+		if ban.Until.After(now) {
+			bans[ban.Host] = ban.Until
+		}
+	}
+	return bans, nil
+}
+
+// saveBans writes the bans that have not ended yet to the file at path.
+func saveBans(path string, bans map[string]time.Time) error {
+	list := serializedBanList{
+		Version: banListVersion,
+		Bans:    make([]serializedBan, 0, len(bans)),
+	}
+	now := time.Now()
+	for host, until := range bans {
+		if until.After(now) {
+			list.Bans = append(list.Bans, serializedBan{host, until})
+		}
+	}
+	sort.Sort(bansByHost(list.Bans))
+
+	return writeJSONFileAtomic(path, &list)
+}
+
+// writeJSONFileAtomic writes v encoded as JSON to the file at path. The file is
+// replaced only once it has been written completely, so that it is not left
+// corrupt if bmd stops in the meantime.
+func writeJSONFileAtomic(path string, v interface{}) error {
+	tmpPath := path + ".new"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(v)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// bansByHost sorts bans by host.
+type bansByHost []serializedBan
+
+func (b bansByHost) Len() int           { return len(b) }
+func (b bansByHost) Less(i, j int) bool { return b[i].Host < b[j].Host }
+func (b bansByHost) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// banListPath returns the path of the file in which bans are stored.
+func (s *server) banListPath() string {
+	return filepath.Join(s.cfg.DataDir, banListFilename)
+}
+
+// saveBans stores the bans so that they are restored after a restart. It is
+// invoked from the peerHandler goroutine.
+func (s *server) saveBans() {
+	if err := saveBans(s.banListPath(), s.state.banned); err != nil {
+		serverLog.Errorf("Failed to save bans: %v", err)
+	}
+}
+
+// isAllowed returns whether the IP address is in the allow list. Peers at such
+// addresses are never banned or denied, and are accepted even if there are
+// already as many peers as allowed.
+func (s *server) isAllowed(ip net.IP) bool {
+	return s.allowList.Contains(ip)
+}
+
+// isDenied returns whether connections to and from the IP address are refused
+// because of the deny list.
+func (s *server) isDenied(ip net.IP) bool {
+	return s.denyList.Contains(ip) && !s.allowList.Contains(ip)
+}
+
+// addrIP returns the IP address of a peer address, or nil if it has none.
+func addrIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// ipListByName returns the list of IP ranges with the given name.
+func (s *server) ipListByName(name string) (*ipList, error) {
+	switch name {
+	case allowListName:
+		return s.allowList, nil
+	case denyListName:
+		return s.denyList, nil
+	}
+	return nil, errors.New("unknown list " + name)
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+func TestParseIPRange(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string // empty if invalid.
+	}{
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"192.0.2.1/24", "192.0.2.0/24"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"::ffff:192.0.2.1", "192.0.2.1/32"},
+		{"", ""},
+		{"192.0.2", ""},
+		{"192.0.2.1/33", ""},
+		{"localhost", ""},
+	}
+
+	for i, test := range tests {
+		ipNet, err := parseIPRange(test.in)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("for case #%d expected an error, got %s", i, ipNet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("for case #%d parseIPRange failed: %v", i, err)
+			continue
+		}
+		if ipNet.String() != test.expected {
+			t.Errorf("for case #%d expected %s, got %s", i, test.expected,
+				ipNet)
+		}
+	}
+}
+
+func TestIPList(t *testing.T) {
+	if _, err := newIPList([]string{"192.0.2.0/24", "not an ip"}); err == nil {
+		t.Error("expected an error for an invalid range")
+	}
+	l, err := newIPList([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("newIPList failed: %v", err)
+	}
+
+	if _, err = l.Add("2001:db8::1"); err != nil {
+		t.Errorf("Add failed: %v", err)
+	}
+	if _, err = l.Add("192.0.2.7/24"); err == nil {
+		t.Error("expected an error adding a range twice")
+	}
+	expected := []string{"192.0.2.0/24", "2001:db8::1/128"}
+	if ranges := l.Ranges(); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected ranges %v, got %v", expected, ranges)
+	}
+
+	for ip, contained := range map[string]bool{
+		"192.0.2.1":   true,
+		"192.0.2.255": true,
+		"192.0.3.1":   false,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+	} {
+		if l.Contains(net.ParseIP(ip)) != contained {
+			t.Errorf("expected Contains(%s) to be %v", ip, contained)
+		}
+	}
+
+	if err = l.Remove("192.0.2.0/24"); err != nil {
+		t.Errorf("Remove failed: %v", err)
+	}
+	if err = l.Remove("192.0.2.0/24"); err == nil {
+		t.Error("expected an error removing a range twice")
+	}
+	if l.Contains(net.ParseIP("192.0.2.1")) {
+		t.Error("removed range is still in the list")
+	}
+}
+
+func TestSaveLoadBans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bmd-banlist")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, banListFilename)
+
+	// There are no bans before the file is written.
+	bans, err := loadBans(path)
+	if err != nil {
+		t.Fatalf("loadBans failed: %v", err)
+	}
+	if len(bans) != 0 {
+		t.Errorf("expected no bans, got %v", bans)
+	}
+
+	// Bans that have ended are not restored.
+	until := time.Now().Add(time.Hour).Round(time.Second)
+	err = saveBans(path, map[string]time.Time{
+		"192.0.2.1":   until,
+		"2001:db8::1": until,
+		"192.0.2.2":   time.Now().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatalf("saveBans failed: %v", err)
+	}
+	bans, err = loadBans(path)
+	if err != nil {
+		t.Fatalf("loadBans failed: %v", err)
+	}
+	if len(bans) != 2 || !bans["192.0.2.1"].Equal(until) ||
+		!bans["2001:db8::1"].Equal(until) {
+		t.Errorf("unexpected bans %v", bans)
+	}
+
+	for _, content := range []string{
+		`not json`,
+		`{"version":2,"bans":[]}`,
+		`{"version":1,"bans":[{"host":"x","until":"2100-01-01T00:00:00Z"}]}`,
+	} {
+		if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if _, err = loadBans(path); err == nil {
+			t.Errorf("expected an error loading %s", content)
+		}
+	}
+}
+
+func TestWriteJSONFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bmd-json")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.json")
+
+	if err = writeJSONFileAtomic(path, []int{1, 2}); err != nil {
+		t.Fatalf("writeJSONFileAtomic failed: %v", err)
+	}
+
+	// A value that can not be encoded leaves the file as it was.
+	if err = writeJSONFileAtomic(path, make(chan int)); err == nil {
+		t.Error("expected an error encoding a channel")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if string(data) != "[1,2]\n" {
+		t.Errorf("expected the file to be unchanged, got %q", data)
+	}
+	if _, err = os.Stat(path + ".new"); !os.IsNotExist(err) {
+		t.Error("temporary file was not removed")
+	}
+}
+
+// TestBansRestored checks that bans made by a server are restored by the next
+// server using the same data directory, and that the allow and deny lists are
+// applied to peers.
+func TestBansRestored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bmd-banlist")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	newTestServer := func() *server {
+		opts := testOptions(getMemDb([]*wire.MsgObject{}),
+			MockListen([]*MockListener{NewMockListener(
+				&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8445},
+				make(chan peer.Connection), make(chan struct{}, 1))}))
+		opts.DataDir = dir
+		opts.AllowList = []string{"192.0.2.128/25"}
+		opts.DenyList = []string{"192.0.2.0/24"}
+		serv, err := newServer(opts)
+		if err != nil {
+			t.Fatalf("newServer failed: %v", err)
+		}
+		return serv
+	}
+
+	serv := newTestServer()
+	for ip, denied := range map[string]bool{
+		"192.0.2.1":   true,
+		"192.0.2.129": false,
+		"192.0.3.1":   false,
+	} {
+		if serv.isDenied(net.ParseIP(ip)) != denied {
+			t.Errorf("expected isDenied(%s) to be %v", ip, denied)
+		}
+	}
+	p := newPeerBase(&net.TCPAddr{IP: net.ParseIP("192.0.2.129"), Port: 8444},
+		serv, peer.NewInventory(), &recordSend{}, true, false, 0)
+	if !p.allowed {
+		t.Error("peer in the allow list is not allowed")
+	}
+
+	serv.state.banned["198.51.100.1"] = time.Now().Add(time.Hour)
+	serv.saveBans()
+
+	serv = newTestServer()
+	if _, ok := serv.state.banned["198.51.100.1"]; !ok {
+		t.Error("ban was not restored")
+	}
+}
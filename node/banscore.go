@@ -0,0 +1,87 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// maxBanScoreHistory is the number of most recent penalties that are
+	// remembered for each peer.
+	maxBanScoreHistory = 10
+)
+
+// banScoreEvent records a penalty that was given to a peer.
+type banScoreEvent struct {
+	Time    time.Time
+	Reason  string
+	Penalty uint32
+	Score   uint32 // The score right after the penalty was given.
+}
+
+// banScore keeps track of how badly a peer has behaved. Penalties add to the
+// score, which decays exponentially over time so that a peer has to misbehave
+// repeatedly within a short time to be banned. It is not safe for concurrent
+// access.
+type banScore struct {
+	score    float64
+	updated  time.Time
+	halfLife time.Duration
+	history  []banScoreEvent
+}
+
+// decay returns the score at the given time.
+func (s *banScore) decay(now time.Time) float64 {
+	if s.score == 0 || !now.After(s.updated) {
+		return s.score
+	}
+	elapsed := now.Sub(s.updated)
+	return s.score * math.Exp2(-float64(elapsed)/float64(s.halfLife))
+}
+
+// Int returns the score at the given time.
+func (s *banScore) Int(now time.Time) uint32 {
+	return uint32(s.decay(now))
+}
+
+// Increase adds a penalty for the given reason to the score and returns the new
+// score.
+func (s *banScore) Increase(penalty uint32, reason string, now time.Time) uint32 {
+	s.score = s.decay(now) + float64(penalty)
+	s.updated = now
+
+	score := s.Int(now)
+	if len(s.history) == maxBanScoreHistory {
+		s.history = s.history[1:]
+	}
+	s.history = append(s.history, banScoreEvent{
+		Time:    now,
+		Reason:  reason,
+		Penalty: penalty,
+		Score:   score,
+	})
+	return score
+}
+
+// Copy returns a copy of the ban score.
+func (s *banScore) Copy() *banScore {
+	c := *s
+	c.history = s.History()
+	return &c
+}
+
+// History returns a copy of the most recent penalties, oldest first.
+func (s *banScore) History() []banScoreEvent {
+	history := make([]banScoreEvent, len(s.history))
+	copy(history, s.history)
+	return history
+}
+
+// newBanScore returns a new ban score which halves every halfLife.
+func newBanScore(halfLife time.Duration) *banScore {
+	return &banScore{halfLife: halfLife}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBanScore checks that penalties add up, that the score decays over time
+// and that the history of penalties is kept.
+func TestBanScore(t *testing.T) {
+	now := time.Now()
+	s := newBanScore(time.Minute)
+
+	if score := s.Int(now); score != 0 {
+		t.Errorf("expected initial score 0, got %d", score)
+	}
+
+	if score := s.Increase(40, "first", now); score != 40 {
+		t.Errorf("expected score 40, got %d", score)
+	}
+	if score := s.Increase(60, "second", now); score != 100 {
+		t.Errorf("expected score 100, got %d", score)
+	}
+
+	// The score halves every minute.
+	if score := s.Int(now.Add(time.Minute)); score != 50 {
+		t.Errorf("expected score 50 after one half-life, got %d", score)
+	}
+	if score := s.Int(now.Add(time.Hour)); score != 0 {
+		t.Errorf("expected score 0 after an hour, got %d", score)
+	}
+	if score := s.Increase(10, "third", now.Add(time.Minute*2)); score != 35 {
+		t.Errorf("expected score 35, got %d", score)
+	}
+
+	history := s.History()
+	if len(history) != 3 {
+		t.Fatalf("expected 3 penalties in history, got %d", len(history))
+	}
+	if history[2].Reason != "third" || history[2].Penalty != 10 ||
+		history[2].Score != 35 {
+		t.Errorf("unexpected penalty in history: %+v", history[2])
+	}
+
+	// Only the most recent penalties are kept.
+	for i := 0; i < maxBanScoreHistory; i++ {
+		s.Increase(1, "more", now.Add(time.Minute*2))
+	}
+	history = s.History()
+	if len(history) != maxBanScoreHistory {
+		t.Errorf("expected %d penalties in history, got %d",
+			maxBanScoreHistory, len(history))
+	}
+	if history[0].Reason != "more" {
+		t.Errorf("expected oldest penalties to be dropped, got %+v",
+			history[0])
+	}
+}
@@ -0,0 +1,100 @@
+// Originally derived from: btcsuite/btcd/discovery.go
+// Copyright (c) 2013-2014 The btcsuite developers
+
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	// dnsSeedInterval is the minimum time between queries of the DNS
+	// seeders when the address manager is running low on addresses.
+	dnsSeedInterval = time.Minute * 10
+
+	// dnsSeedStream is the stream of the peers returned by DNS seeders.
+	dnsSeedStream = 1
+
+	// secondsIn3Days and secondsIn4Days are used to give the addresses
+	// returned by DNS seeders timestamps between 3 and 7 days ago, so that
+	// addresses learned from peers are preferred.
+	secondsIn3Days int32 = 24 * 60 * 60 * 3
+	secondsIn4Days int32 = 24 * 60 * 60 * 4
+)
+
+// DefaultDNSSeeds are the DNS seeders which are queried for peers by default,
+// given as host:port. The port is that of the peers that a seeder returns.
+var DefaultDNSSeeds = []string{
+	"bootstrap8444.bitmessage.org:8444",
+	"bootstrap8080.bitmessage.org:8080",
+}
+
+// dnsDiscover looks up the peers returned by the DNS seeder, given as
+// host:port, with the lookup function.
+func dnsDiscover(seeder string, lookup func(string) ([]net.IP, error)) ([]*wire.NetAddress, error) {
+	host, portStr, err := net.SplitHostPort(seeder)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	randSource := rand.New(rand.NewSource(time.Now().UnixNano()))
+	addrs := make([]*wire.NetAddress, len(ips))
+	for i, ip := range ips {
+		addrs[i] = wire.NewNetAddressIPPort(ip, uint16(port), dnsSeedStream,
+			wire.SFNodeNetwork)
+		addrs[i].Timestamp = time.Now().Add(-1 * time.Second *
+			time.Duration(secondsIn3Days+randSource.Int31n(secondsIn4Days)))
+	}
+	return addrs, nil
+}
+
+// seedFromDNS queries the DNS seeders and adds the peers that they return to
+// the address manager. The lookups are done in the background. Nothing is done
+// if DNS seeding is disabled or the seeders were queried less than
+// dnsSeedInterval ago. It is invoked from the peerHandler goroutine.
+func (s *server) seedFromDNS() {
+	if len(s.cfg.DNSSeeds) == 0 ||
+		time.Now().Before(s.lastDNSSeed.Add(dnsSeedInterval)) {
+		return
+	}
+	s.lastDNSSeed = time.Now()
+
+	for _, seeder := range s.cfg.DNSSeeds {
+		go func(seeder string) {
+			addrs, err := dnsDiscover(seeder, s.cfg.Lookup)
+			if err != nil {
+				serverLog.Infof("DNS discovery failed on seed %s: %v",
+					seeder, err)
+				return
+			}
+
+			serverLog.Infof("%d addresses found from DNS seed %s",
+				len(addrs), seeder)
+			if len(addrs) == 0 {
+				return
+			}
+
+			// There is no address for the seeder itself, so all
+			// addresses are recorded as having come from the first one.
+			s.addrManager.AddAddresses(addrs, addrs[0])
+		}(seeder)
+	}
+}
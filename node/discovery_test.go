@@ -0,0 +1,95 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+// seedResolver is a stand-in for DNS which resolves the host names of seeders
+// to fixed addresses.
+type seedResolver map[string][]net.IP
+
+// lookup resolves host, like net.LookupIP.
+func (r seedResolver) lookup(host string) ([]net.IP, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return ips, nil
+}
+
+var testSeedResolver = seedResolver{
+	"seed1.example.com": {net.ParseIP("93.184.216.34"),
+		net.ParseIP("151.101.1.69")},
+	"seed2.example.com": {net.ParseIP("104.16.0.1")},
+	"empty.example.com": {},
+}
+
+func TestDNSDiscover(t *testing.T) {
+	addrs, err := dnsDiscover("seed1.example.com:8080", testSeedResolver.lookup)
+	if err != nil {
+		t.Fatalf("dnsDiscover failed: %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("expected 2 addresses, got %d", len(addrs))
+	}
+	for i, na := range addrs {
+		if !na.IP.Equal(testSeedResolver["seed1.example.com"][i]) ||
+			na.Port != 8080 || na.Stream != dnsSeedStream {
+			t.Errorf("unexpected address %v:%d in stream %d", na.IP, na.Port,
+				na.Stream)
+		}
+		age := time.Since(na.Timestamp)
+		if age < 3*24*time.Hour || age > 7*24*time.Hour {
+			t.Errorf("unexpected timestamp %v", na.Timestamp)
+		}
+	}
+
+	for _, seeder := range []string{"seed1.example.com", "seed1.example.com:x",
+		"missing.example.com:8444"} {
+		if _, err = dnsDiscover(seeder, testSeedResolver.lookup); err == nil {
+			t.Errorf("expected an error for %s", seeder)
+		}
+	}
+}
+
+func TestSeedFromDNS(t *testing.T) {
+	opts := testOptions(getMemDb([]*wire.MsgObject{}),
+		MockListen([]*MockListener{NewMockListener(
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8445},
+			make(chan peer.Connection), make(chan struct{}, 1))}))
+	opts.Lookup = testSeedResolver.lookup
+	opts.DNSSeeds = []string{"seed1.example.com:8444",
+		"seed2.example.com:8444", "empty.example.com:8444",
+		"missing.example.com:8444"}
+	serv, err := newServer(opts)
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+
+	// The lookups are done in the background.
+	serv.seedFromDNS()
+	for i := 0; serv.addrManager.NumAddresses() < 3; i++ {
+		if i == 100 {
+			t.Fatalf("expected 3 addresses from the seeders, got %d",
+				serv.addrManager.NumAddresses())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The seeders are not queried again right away.
+	lastSeed := serv.lastDNSSeed
+	serv.seedFromDNS()
+	if serv.lastDNSSeed != lastSeed {
+		t.Error("the seeders were queried again")
+	}
+}
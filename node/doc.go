@@ -0,0 +1,32 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package node implements a bitmessage node, which connects to peers, relays and
+stores objects, and serves RPC clients. It is the core of bmd, and can be
+embedded in other programs.
+
+A node is created from Options, which hold everything that bmd reads from its
+configuration, along with the object database and the functions used to dial
+peers, listen for peers and resolve host names:
+
+	opts := node.DefaultOptions()
+	opts.DB = db
+	opts.DataDir = dataDir
+	n, err := node.New(opts)
+	if err != nil {
+		return err
+	}
+	if err = n.Start(ctx); err != nil {
+		return err
+	}
+	defer n.Stop(ctx)
+
+The database is not closed when the node stops. Some of the options can be
+changed while the node is running with Reload.
+
+The package does not log anything until UseLogger is called for its
+subsystems.
+*/
+package node
@@ -0,0 +1,56 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"github.com/btcsuite/btclog"
+)
+
+// Subsystems of the node that log separately, as accepted by UseLogger.
+const (
+	PeerSubsystem   = "PEER"
+	ServerSubsystem = "SERVER"
+	RPCSubsystem    = "RPC"
+	DBSubsystem     = "DB"
+)
+
+// Loggers of each subsystem. They are initialized with no output filters,
+// which means that the package will not perform any logging by default until
+// the caller requests it.
+var (
+	peerLog   btclog.Logger
+	serverLog btclog.Logger
+	rpcLog    btclog.Logger
+	dbLog     btclog.Logger
+)
+
+// The default amount of logging is none.
+func init() {
+	DisableLog()
+}
+
+// DisableLog disables all library log output. Logging output is disabled by
+// default until UseLogger is called.
+func DisableLog() {
+	peerLog = btclog.Disabled
+	serverLog = btclog.Disabled
+	rpcLog = btclog.Disabled
+	dbLog = btclog.Disabled
+}
+
+// UseLogger uses a specified Logger to output the logging info of one of the
+// subsystems of the package. Unknown subsystems are ignored.
+func UseLogger(subsystem string, logger btclog.Logger) {
+	switch subsystem {
+	case PeerSubsystem:
+		peerLog = logger
+	case ServerSubsystem:
+		serverLog = logger
+	case RPCSubsystem:
+		rpcLog = logger
+	case DBSubsystem:
+		dbLog = logger
+	}
+}
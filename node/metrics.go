@@ -0,0 +1,377 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	// metricsContentType is the content type of the Prometheus text
+	// exposition format.
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// powTimeBuckets are the upper bounds in seconds of the buckets of the proof
+// of work verification time histogram.
+var powTimeBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+// rejectReasonLabels maps reject reasons to the values of the reason label of
+// the rejected objects counter.
+var rejectReasonLabels = map[objectRejectReason]string{
+	rejectTooLarge:  "too_large",
+	rejectExpired:   "expired",
+	rejectFarFuture: "far_future",
+	rejectStream:    "stream",
+	rejectVersion:   "version",
+	rejectMalformed: "malformed",
+	rejectPoW:       "pow",
+}
+
+// Reasons for rejecting objects before they are verified, as used in the
+// reason label of the rejected objects counter.
+const (
+	rejectLabelUnrequested = "unrequested"
+	rejectLabelQueueFull   = "queue_full"
+)
+
+// rejectReasonLabel returns the value of the reason label for a reject reason.
+func rejectReasonLabel(r objectRejectReason) string {
+	if s, ok := rejectReasonLabels[r]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// objectTypeLabel returns the value of the type label for an object type.
+func objectTypeLabel(objType wire.ObjectType) string {
+	switch objType {
+	case wire.ObjectTypeGetPubKey:
+		return "getpubkey"
+	case wire.ObjectTypePubKey:
+		return "pubkey"
+	case wire.ObjectTypeMsg:
+		return "msg"
+	case wire.ObjectTypeBroadcast:
+		return "broadcast"
+	default:
+		return "unknown"
+	}
+}
+
+// metricsCounterVec is a set of counters which are distinguished by the values
+// of their labels. It is safe for concurrent access.
+type metricsCounterVec struct {
+	labels []string
+	mtx    sync.Mutex
+	values map[string]uint64 // by label values joined with '\xff'.
+}
+
+// Add adds delta to the counter with the given label values, which must be
+// given in the same order as the labels of the vector.
+func (c *metricsCounterVec) Add(delta uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mtx.Lock()
+	c.values[key] += delta
+	c.mtx.Unlock()
+}
+
+// Get returns the value of the counter with the given label values.
+func (c *metricsCounterVec) Get(labelValues ...string) uint64 {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.values[key]
+}
+
+// write writes all counters of the vector, sorted by their label values.
+func (c *metricsCounterVec) write(w *metricsWriter, name, help string) {
+	c.mtx.Lock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	values := make(map[string]uint64, len(c.values))
+	for key, value := range c.values {
+		values[key] = value
+	}
+	c.mtx.Unlock()
+	sort.Strings(keys)
+
+	w.header(name, help, "counter")
+	for _, key := range keys {
+		labels := make([]string, 0, 2*len(c.labels))
+		for i, value := range strings.Split(key, "\xff") {
+			labels = append(labels, c.labels[i], value)
+		}
+		w.sample(name, float64(values[key]), labels...)
+	}
+}
+
+// newMetricsCounterVec returns a new counter vector with the given labels.
+func newMetricsCounterVec(labels ...string) *metricsCounterVec {
+	return &metricsCounterVec{
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+}
+
+// metricsHistogram counts observations, such as durations, in configurable
+// buckets. It is safe for concurrent access.
+type metricsHistogram struct {
+	buckets []float64 // upper bounds, sorted in increasing order.
+	mtx     sync.Mutex
+	counts  []uint64 // per bucket, not cumulative.
+	sum     float64
+	count   uint64
+}
+
+// Observe adds a single observation to the histogram.
+func (h *metricsHistogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mtx.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.mtx.Unlock()
+}
+
+// write writes the cumulative buckets, the sum and the count of the histogram.
+func (h *metricsHistogram) write(w *metricsWriter, name, help string) {
+	h.mtx.Lock()
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	sum, count := h.sum, h.count
+	h.mtx.Unlock()
+
+	w.header(name, help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		w.sample(name+"_bucket", float64(cumulative),
+			"le", formatMetricValue(bound))
+	}
+	w.sample(name+"_bucket", float64(count), "le", "+Inf")
+	w.sample(name+"_sum", sum)
+	w.sample(name+"_count", float64(count))
+}
+
+// newMetricsHistogram returns a new histogram with the given bucket upper
+// bounds, which must be sorted in increasing order.
+func newMetricsHistogram(buckets []float64) *metricsHistogram {
+	return &metricsHistogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// formatMetricValue formats a sample value as expected by Prometheus.
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsLabelEscaper escapes label values in the text exposition format.
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// metricsWriter writes metrics in the Prometheus text exposition format. The
+// first error encountered is remembered and ends all further output.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// header writes the help text and type of a metric.
+func (w *metricsWriter) header(name, help, typ string) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help,
+		name, typ)
+}
+
+// sample writes a single sample of a metric with labels given as alternating
+// names and values.
+func (w *metricsWriter) sample(name string, v float64, labels ...string) {
+	if w.err != nil {
+		return
+	}
+	w.w.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			w.w.WriteByte('{')
+		} else {
+			w.w.WriteByte(',')
+		}
+		fmt.Fprintf(w.w, `%s="%s"`, labels[i],
+			metricsLabelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) > 1 {
+		w.w.WriteByte('}')
+	}
+	_, w.err = fmt.Fprintf(w.w, " %s\n", formatMetricValue(v))
+}
+
+// gauge writes a metric with a single unlabeled value.
+func (w *metricsWriter) gauge(name, help string, v float64) {
+	w.header(name, help, "gauge")
+	w.sample(name, v)
+}
+
+// counter writes a metric with a single unlabeled value that only increases.
+func (w *metricsWriter) counter(name, help string, v float64) {
+	w.header(name, help, "counter")
+	w.sample(name, v)
+}
+
+// flush writes any buffered output and returns the first error encountered.
+func (w *metricsWriter) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// newMetricsWriter returns a new metricsWriter that writes to w.
+func newMetricsWriter(w io.Writer) *metricsWriter {
+	return &metricsWriter{w: bufio.NewWriter(w)}
+}
+
+// writeMetrics writes the current metrics of the server.
+func (s *server) writeMetrics(out io.Writer) error {
+	w := newMetricsWriter(out)
+
+	// Peers.
+	var inbound, outbound, persistent int
+	peers := s.Peers()
+	for _, p := range peers {
+		switch {
+		case p.inbound:
+			inbound++
+		case p.persistent:
+			persistent++
+		default:
+			outbound++
+		}
+	}
+	w.header("bmd_peers", "Number of connected peers.", "gauge")
+	w.sample("bmd_peers", float64(inbound), "direction", "inbound")
+	w.sample("bmd_peers", float64(outbound), "direction", "outbound")
+	w.sample("bmd_peers", float64(persistent), "direction", "persistent")
+
+	stats := s.PeerStats()
+	w.counter("bmd_sent_bytes_total", "Bytes sent to all peers.",
+		float64(stats.bytesSent))
+	w.counter("bmd_received_bytes_total", "Bytes received from all peers.",
+		float64(stats.bytesReceived))
+
+	w.header("bmd_peer_sent_bytes_total",
+		"Bytes sent to each connected peer.", "counter")
+	for _, p := range peers {
+		w.sample("bmd_peer_sent_bytes_total", float64(p.bytesSent),
+			"addr", p.addr)
+	}
+	w.header("bmd_peer_received_bytes_total",
+		"Bytes received from each connected peer.", "counter")
+	for _, p := range peers {
+		w.sample("bmd_peer_received_bytes_total", float64(p.bytesReceived),
+			"addr", p.addr)
+	}
+
+	// Objects.
+	om := s.objectManager
+	om.receivedObjects.write(w, "bmd_objects_received_total",
+		"Objects received from peers, by type.")
+	om.acceptedObjects.write(w, "bmd_objects_accepted_total",
+		"Objects received from peers that were valid and stored, by type.")
+	om.rejectedObjects.write(w, "bmd_objects_rejected_total",
+		"Objects received from peers that were rejected, by type and reason.")
+	om.verifier.powTime.write(w, "bmd_pow_verification_seconds",
+		"Time taken to verify the proof of work of objects.")
+
+	requested, verifying := om.PendingObjects()
+	w.gauge("bmd_objectmanager_queue_depth",
+		"Messages waiting to be handled by the object manager.",
+		float64(len(om.msgChan)))
+	w.gauge("bmd_objects_requested",
+		"Objects requested from peers but not yet received.",
+		float64(requested))
+	w.gauge("bmd_objects_verifying",
+		"Objects waiting to be verified.", float64(verifying))
+	w.counter("bmd_objects_dropped_total",
+		"Objects dropped because the verification queue was full.",
+		float64(om.DroppedObjects()))
+	prunedObjects, prunedBytes := om.PruneStats()
+	w.counter("bmd_pruned_objects_total",
+		"Expired objects removed from the database.", float64(prunedObjects))
+	w.counter("bmd_pruned_bytes_total",
+		"Bytes of expired objects removed from the database.",
+		float64(prunedBytes))
+
+	// Database.
+	objects, pubkeys, err := s.db.CountObjects()
+	if err != nil {
+		dbLog.Errorf("CountObjects, database error: %v", err)
+	} else {
+		w.gauge("bmd_database_objects", "Objects in the database.",
+			float64(objects))
+		w.gauge("bmd_database_pubkeys", "Public keys in the database.",
+			float64(pubkeys))
+	}
+
+	// RPC.
+	if s.rpcServer != nil {
+		clients, subscriptions := s.rpcServer.ClientStats()
+		w.gauge("bmd_rpc_clients", "Number of connected RPC clients.",
+			float64(clients))
+		w.header("bmd_rpc_subscriptions",
+			"Number of RPC clients subscribed to each type of object.",
+			"gauge")
+		for _, objType := range []wire.ObjectType{wire.ObjectTypeGetPubKey,
+			wire.ObjectTypePubKey, wire.ObjectTypeMsg,
+			wire.ObjectTypeBroadcast, rpcUnknownObjType} {
+			w.sample("bmd_rpc_subscriptions",
+				float64(subscriptions[objType]),
+				"type", objectTypeLabel(objType))
+		}
+	}
+
+	return w.flush()
+}
+
+// metricsHandler serves the metrics of the server over HTTP.
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := s.writeMetrics(w); err != nil {
+		serverLog.Debugf("Failed to write metrics to %s: %v", r.RemoteAddr,
+			err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetricsCounterVec(t *testing.T) {
+	c := newMetricsCounterVec("type", "reason")
+	c.Add(1, "msg", "pow")
+	c.Add(2, "msg", "pow")
+	c.Add(1, "broadcast", "expired")
+	c.Add(5, "pubkey", `a "quoted"`+"\nreason")
+
+	if got := c.Get("msg", "pow"); got != 3 {
+		t.Errorf("expected 3, got %d", got)
+	}
+	if got := c.Get("msg", "expired"); got != 0 {
+		t.Errorf("expected 0, got %d", got)
+	}
+
+	var buf bytes.Buffer
+	w := newMetricsWriter(&buf)
+	c.write(w, "test_rejected_total", "Rejected objects.")
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_rejected_total Rejected objects.
+# TYPE test_rejected_total counter
+test_rejected_total{type="broadcast",reason="expired"} 1
+test_rejected_total{type="msg",reason="pow"} 3
+test_rejected_total{type="pubkey",reason="a \"quoted\"\nreason"} 5
+`
+	if buf.String() != expected {
+		t.Errorf("expected output\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	h := newMetricsHistogram([]float64{0.01, 0.1, 1})
+	for _, v := range []float64{0.005, 0.01, 0.05, 0.5, 2} {
+		h.Observe(v)
+	}
+
+	var buf bytes.Buffer
+	w := newMetricsWriter(&buf)
+	h.write(w, "test_seconds", "Durations.")
+	w.gauge("test_gauge", "A gauge.", 1.5)
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.01"} 2
+test_seconds_bucket{le="0.1"} 3
+test_seconds_bucket{le="1"} 4
+test_seconds_bucket{le="+Inf"} 5
+test_seconds_sum 2.565
+test_seconds_count 5
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 1.5
+`
+	if buf.String() != expected {
+		t.Errorf("expected output\n%s\ngot\n%s", expected, buf.String())
+	}
+}
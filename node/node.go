@@ -0,0 +1,331 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/monetas/bmd/database"
+	"github.com/monetas/bmd/peer"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultPort is the port on which bitmessage nodes listen by default.
+	DefaultPort = "8444"
+
+	// MinRPCQueueSize is the smallest allowed value of the RPCQueueSize
+	// option. The queue must hold a batch of objects replayed to a
+	// subscriber, with as much room to spare for new objects.
+	MinRPCQueueSize = 2 * rpcCounterObjectsSize
+)
+
+// Options are the options of a node. Only the DB is required; DefaultOptions
+// returns sane values for the rest.
+type Options struct {
+	// DB is the object database. It is not closed when the node stops.
+	DB database.Db
+
+	// Dial connects to peers. It defaults to net.Dial.
+	Dial func(network, address string) (net.Conn, error)
+
+	// Listen creates the listeners for connections from peers. It defaults
+	// to peer.Listen.
+	Listen func(network, address string) (peer.Listener, error)
+
+	// Lookup resolves host names. It defaults to net.LookupIP.
+	Lookup func(host string) ([]net.IP, error)
+
+	// DataDir is the directory in which known peer addresses, bans and the
+	// use of the upload quota are stored.
+	DataDir string
+
+	// Listeners are the addresses on which to listen for connections from
+	// peers. The node does not listen if there are none.
+	Listeners []string
+
+	// ExternalIPs are the addresses, given as host or host:port, which are
+	// advertised to peers as ours instead of those of the local interfaces.
+	// The port defaults to that of the first listen address.
+	ExternalIPs []string
+
+	// Upnp is whether to map the listening port through a UPnP gateway, and
+	// advertise the external address of the gateway to peers.
+	Upnp bool
+
+	// AddPeers are peers to stay connected to, in addition to the default
+	// peers. ConnectPeers are peers to stay connected to instead of the
+	// default peers.
+	AddPeers     []string
+	ConnectPeers []string
+
+	// DNSSeeds are the DNS seeders, given as host:port, which are queried
+	// for peers at startup and whenever few addresses of peers are known.
+	// Their host names are resolved with Lookup. DNS seeding is disabled if
+	// there are none.
+	DNSSeeds []string
+
+	// MaxPeers is the maximum number of peers, and MaxOutbound the number of
+	// outbound peers to maintain in each stream.
+	MaxPeers    int
+	MaxOutbound int
+
+	// MaxUpPerPeer and MaxDownPerPeer are the rate limits of each peer, in
+	// bytes per second.
+	MaxUpPerPeer   int64
+	MaxDownPerPeer int64
+
+	// MaxUp and MaxDown are the rate limits of all peers together, in bytes
+	// per second. Peers take turns to use them. There is no limit if they
+	// are 0.
+	MaxUp   int64
+	MaxDown int64
+
+	// UploadQuota is the number of bytes that may be sent to peers in each
+	// QuotaPeriod. Once it is used up, only objects received within the last
+	// hour are sent to peers that request them, so that new objects are
+	// still relayed. The use of the quota is stored in DataDir. There is no
+	// quota if it is 0.
+	UploadQuota int64
+	QuotaPeriod QuotaPeriod
+
+	// BanDuration is how long misbehaving peers are banned for once their
+	// ban score reaches BanThreshold. Ban scores halve every BanHalfLife.
+	BanDuration  time.Duration
+	BanThreshold uint32
+	BanHalfLife  time.Duration
+
+	// The ban score penalties for sending objects with insufficient proof of
+	// work, for sending unrequested objects, for sending empty or oversized
+	// inv and addr messages and for violating the version handshake.
+	BanPoW         uint32
+	BanUnrequested uint32
+	BanMalformed   uint32
+	BanHandshake   uint32
+
+	// AllowList and DenyList are IP addresses and CIDR ranges of peers. No
+	// connections are made to or accepted from peers in the deny list.
+	// Peers in the allow list are exempt from the deny list, bans, ban
+	// scores and the MaxPeers limit.
+	AllowList []string
+	DenyList  []string
+
+	// Streams are the streams to take part in. ChildStreams is whether to
+	// take part in their child streams as well.
+	Streams      []uint32
+	ChildStreams bool
+
+	// PruneInterval is how often expired objects are removed from the
+	// database, and ExpiryMargin how long they are kept after they expire.
+	PruneInterval time.Duration
+	ExpiryMargin  time.Duration
+
+	// DisableRPC disables the RPC server. The rest of the options only
+	// apply to the RPC server.
+	DisableRPC bool
+
+	// RPCListeners are the addresses on which to listen for RPC clients.
+	// TLS is used with the certificate and key in RPCCert and RPCKey, which
+	// are generated if neither exists, unless DisableTLS is set.
+	RPCListeners []string
+	DisableTLS   bool
+	RPCCert      string
+	RPCKey       string
+
+	// RPCUser and RPCPass are the credentials of the admin RPC user, and
+	// RPCLimitUser and RPCLimitPass those of the limited RPC user.
+	// RPCCredentials is the path of a file with more RPC users.
+	RPCUser        string
+	RPCPass        string
+	RPCLimitUser   string
+	RPCLimitPass   string
+	RPCCredentials string
+
+	// RPCMaxClients is the maximum number of RPC clients. RPCQueueSize is
+	// the number of notifications that may wait to be sent to a client
+	// before it is disconnected, and RPCMaxInFlight the number that are
+	// sent to it at a time.
+	RPCMaxClients  int
+	RPCQueueSize   int
+	RPCMaxInFlight int
+
+	// RPCUnix is the path of a Unix domain socket to listen for RPC clients
+	// on, which is created with the permissions RPCUnixPerm. RPCUnixUsers
+	// maps the user ids of processes connecting to it to the RPC users that
+	// they are authenticated as.
+	RPCUnix      string
+	RPCUnixPerm  os.FileMode
+	RPCUnixUsers map[uint32]string
+}
+
+// DefaultOptions returns the default options of bmd, with the RPC server
+// disabled and without a database.
+func DefaultOptions() *Options {
+	return &Options{
+		Listeners:      []string{net.JoinHostPort("", DefaultPort)},
+		DNSSeeds:       DefaultDNSSeeds,
+		MaxPeers:       125,
+		MaxOutbound:    10,
+		MaxUpPerPeer:   1024 * 1024, // 1MBps
+		MaxDownPerPeer: 1024 * 1024,
+		BanDuration:    time.Hour * 24,
+		BanThreshold:   100,
+		BanHalfLife:    time.Minute * 10,
+		BanPoW:         20,
+		BanUnrequested: 10,
+		BanMalformed:   20,
+		BanHandshake:   25,
+		Streams:        []uint32{1},
+		PruneInterval:  time.Hour,
+		ExpiryMargin:   time.Hour * 3,
+		DisableRPC:     true,
+		RPCMaxClients:  25,
+		RPCQueueSize:   1000,
+		RPCMaxInFlight: 8,
+		RPCUnixPerm:    0600,
+	}
+}
+
+// validate checks that the options can be used to create a node.
+func (o *Options) validate() error {
+	if o.DB == nil {
+		return errors.New("no database given")
+	}
+	if o.MaxPeers < 1 {
+		return errors.New("MaxPeers may not be less than 1")
+	}
+	if o.BanThreshold == 0 {
+		return errors.New("BanThreshold may not be 0")
+	}
+	if o.BanHalfLife <= 0 {
+		return errors.New("BanHalfLife must be positive")
+	}
+	if o.PruneInterval <= 0 {
+		return errors.New("PruneInterval must be positive")
+	}
+	for _, stream := range o.Streams {
+		if stream == 0 {
+			return errors.New("stream numbers start at 1")
+		}
+	}
+	if o.MaxUp < 0 || o.MaxDown < 0 || o.UploadQuota < 0 {
+		return errors.New("bandwidth limits may not be negative")
+	}
+	if o.QuotaPeriod != QuotaDaily && o.QuotaPeriod != QuotaMonthly {
+		return errors.New("invalid QuotaPeriod")
+	}
+	if _, err := parseIPRanges(o.AllowList); err != nil {
+		return fmt.Errorf("invalid AllowList: %v", err)
+	}
+	if _, err := parseIPRanges(o.DenyList); err != nil {
+		return fmt.Errorf("invalid DenyList: %v", err)
+	}
+
+	if o.DisableRPC {
+		return nil
+	}
+	if o.RPCQueueSize < MinRPCQueueSize {
+		return errors.New("RPCQueueSize is too small")
+	}
+	if o.RPCMaxInFlight < 1 {
+		return errors.New("RPCMaxInFlight may not be less than 1")
+	}
+	if len(o.RPCUnixUsers) > 0 && o.RPCUnix == "" {
+		return errors.New("RPCUnixUsers requires RPCUnix")
+	}
+	if len(o.RPCUnixUsers) > 0 && !unixPeerCredSupported {
+		return errors.New("RPCUnixUsers is not supported on this platform")
+	}
+	return nil
+}
+
+// Node is a bitmessage node, which connects to peers, relays and stores
+// objects, and serves RPC clients.
+type Node struct {
+	server *server
+}
+
+// New returns a new node with the given options. The node listens on the
+// addresses in the options immediately, but does not connect to peers until
+// it is started. The options must not be modified afterwards; use Reload to
+// change them.
+func New(opts *Options) (*Node, error) {
+	o := *opts
+	if o.Dial == nil {
+		o.Dial = net.Dial
+	}
+	if o.Listen == nil {
+		o.Listen = peer.Listen
+	}
+	if o.Lookup == nil {
+		o.Lookup = net.LookupIP
+	}
+	if len(o.Streams) == 0 {
+		o.Streams = []uint32{1}
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	s, err := newServer(&o)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{server: s}, nil
+}
+
+// Start starts the node. It returns the error of ctx without starting the node
+// if ctx is already done.
+func (n *Node) Start(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	n.server.Start()
+	return nil
+}
+
+// Stop disconnects all peers and RPC clients and waits for the node to shut
+// down. If ctx is done first, its error is returned and the node finishes
+// shutting down in the background.
+func (n *Node) Stop(ctx context.Context) error {
+	if atomic.LoadInt32(&n.server.started) == 0 {
+		return errors.New("node not started")
+	}
+	if err := n.server.Stop(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		n.server.WaitForShutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitForShutdown blocks until the node has shut down.
+func (n *Node) WaitForShutdown() {
+	n.server.WaitForShutdown()
+}
+
+// MetricsHandler returns an HTTP handler which serves the metrics of the node
+// in the Prometheus text format.
+func (n *Node) MetricsHandler() http.Handler {
+	return http.HandlerFunc(n.server.metricsHandler)
+}
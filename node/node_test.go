@@ -0,0 +1,69 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmutil/wire"
+	"golang.org/x/net/context"
+)
+
+func TestNewNode(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Listeners = nil
+	opts.DNSSeeds = nil
+	opts.DataDir = os.TempDir()
+	if _, err := New(opts); err == nil {
+		t.Error("expected an error without a database")
+	}
+
+	opts.DB = getMemDb([]*wire.MsgObject{})
+	opts.BanThreshold = 0
+	if _, err := New(opts); err == nil {
+		t.Error("expected an error for a ban threshold of 0")
+	}
+	opts.BanThreshold = 100
+
+	opts.DisableRPC = false
+	opts.RPCQueueSize = MinRPCQueueSize - 1
+	if _, err := New(opts); err == nil {
+		t.Error("expected an error for a small RPC queue")
+	}
+	opts.DisableRPC = true
+
+	// Dial the persistent peer with a dialer that always fails, so that the
+	// test does not depend on the network.
+	opts.ConnectPeers = []string{"127.0.0.1:8444"}
+	opts.Dial = func(string, string) (net.Conn, error) {
+		return nil, errors.New("no network")
+	}
+	n, err := New(opts)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err = n.Stop(context.Background()); err == nil {
+		t.Error("expected an error stopping a node that was not started")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = n.Start(ctx); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	if err = n.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = n.Stop(ctx); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+}
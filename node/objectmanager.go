@@ -0,0 +1,635 @@
+// Originally derived from: btcsuite/btcd/blockmanager.go
+// Copyright (c) 2013-2015 the btcsuite developers.
+
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	// objectManagerQueueSize specifies the size of object manager msgChan.
+	objectManagerQueueSize = 50
+
+	// objectRequestTimeout specifies the duration after which a request for an
+	// object should time out and the peer be disconnected from. This is
+	// supposed to be a rough estimate, not an exact value. Requests are
+	// cleaned after every objectRequestTimeout/2 time.
+	objectRequestTimeout = time.Minute * 2
+)
+
+// newPeerMsg signifies a newly connected peer to the object manager.
+type newPeerMsg struct {
+	peer *bmpeer
+}
+
+// objectMsg packages a bitmessage object message and the peer it came from
+// together so the object manager has access to that information.
+type objectMsg struct {
+	object *wire.MsgObject
+	peer   *bmpeer
+}
+
+// invMsg packages a bitmessage inv message and the peer it came from together
+// so the object manager has access to that information.
+type invMsg struct {
+	inv  *wire.MsgInv
+	peer *bmpeer
+}
+
+// donePeerMsg signifies a newly disconnected peer to the object manager.
+type donePeerMsg struct {
+	peer *bmpeer
+}
+
+// pendingObjectsMsg asks the object manager for the number of objects that
+// have been requested from peers and that are waiting to be verified.
+type pendingObjectsMsg struct {
+	reply chan [2]int
+}
+
+// objectRequest represents the peer from which an object was requested along
+// with the timestamp. It also remembers the other peers that advertised the
+// object so that it can be requested from them if the first peer fails to
+// deliver it.
+type objectRequest struct {
+	peer        *bmpeer
+	timestamp   time.Time
+	advertisers []*bmpeer // in the order in which they advertised the object.
+	tried       []*bmpeer // peers the object was requested from before.
+}
+
+// requestedFrom returns whether the object was requested from the given peer.
+// Peers that have timed out may still deliver the object late.
+func (r *objectRequest) requestedFrom(p *bmpeer) bool {
+	if r.peer == p {
+		return true
+	}
+	for _, t := range r.tried {
+		if t == p {
+			return true
+		}
+	}
+	return false
+}
+
+// addAdvertiser records that the object was advertised by the given peer.
+func (r *objectRequest) addAdvertiser(p *bmpeer) {
+	if r.peer == p {
+		return
+	}
+	for _, a := range r.advertisers {
+		if a == p {
+			return
+		}
+	}
+	r.advertisers = append(r.advertisers, p)
+}
+
+// removePeer forgets about the given peer, which has disconnected.
+func (r *objectRequest) removePeer(p *bmpeer) {
+	for i, a := range r.advertisers {
+		if a == p {
+			r.advertisers = append(r.advertisers[:i], r.advertisers[i+1:]...)
+			break
+		}
+	}
+	for i, t := range r.tried {
+		if t == p {
+			r.tried = append(r.tried[:i], r.tried[i+1:]...)
+			break
+		}
+	}
+}
+
+// next moves the request on to the advertiser with the lowest latency. Peers
+// whose latency is not known yet come last. It returns false if there are no
+// advertisers left.
+func (r *objectRequest) next(now time.Time) bool {
+	if len(r.advertisers) == 0 {
+		return false
+	}
+	if r.peer != nil {
+		r.tried = append(r.tried, r.peer)
+	}
+
+	best, bestLatency := 0, time.Duration(math.MaxInt64)
+	for i, a := range r.advertisers {
+		latency := a.Latency()
+		if latency == 0 {
+			latency = math.MaxInt64
+		}
+		if latency < bestLatency {
+			best, bestLatency = i, latency
+		}
+	}
+
+	r.peer = r.advertisers[best]
+	r.advertisers = append(r.advertisers[:best], r.advertisers[best+1:]...)
+	r.timestamp = now
+	return true
+}
+
+// ObjectManager provides a concurrency safe object manager for handling all
+// incoming and outgoing.
+type ObjectManager struct {
+	server           *server
+	started          int32
+	shutdown         int32
+	requestedObjects map[wire.InvVect]*objectRequest
+	finishedRequests map[wire.InvVect]*objectRequest // may be delivered late.
+	verifyingObjects map[wire.InvVect]struct{}
+	verifier         *objectVerifier
+	msgChan          chan interface{}
+	prunedObjects    uint64             // atomic
+	prunedBytes      uint64             // atomic
+	receivedObjects  *metricsCounterVec // by type.
+	acceptedObjects  *metricsCounterVec // by type.
+	rejectedObjects  *metricsCounterVec // by type and reason.
+	wg               sync.WaitGroup
+	quit             chan struct{}
+}
+
+// handleNewPeerMsg deals with new peers that have signalled they may
+// be considered as a sync peer (they have already successfully negotiated). It
+// is invoked from the syncHandler goroutine.
+func (om *ObjectManager) handleNewPeerMsg(peers map[*bmpeer]struct{}, p *bmpeer) {
+	// Ignore if in the process of shutting down.
+	if atomic.LoadInt32(&om.shutdown) != 0 {
+		return
+	}
+
+	// Add the peer
+	peers[p] = struct{}{}
+}
+
+// handleDonePeerMsg deals with peers that have signalled they are done. It is
+// invoked from the syncHandler goroutine.
+func (om *ObjectManager) handleDonePeerMsg(peers map[*bmpeer]struct{}, p *bmpeer) {
+	// Remove the peer from the list of candidate peers.
+	delete(peers, p)
+
+	// Request objects that were requested from the peer from the next peer
+	// that advertised them. Objects which no other peer advertised will be
+	// fetched from elsewhere next time we get an inv.
+	now := time.Now()
+	retries := make(map[*bmpeer][]*wire.InvVect)
+	for invVect, req := range om.requestedObjects {
+		req.removePeer(p)
+		if req.peer != p {
+			continue
+		}
+		req.peer = nil
+		if !req.next(now) {
+			om.finishRequest(invVect, req, now)
+			continue
+		}
+		iv := invVect
+		retries[req.peer] = append(retries[req.peer], &iv)
+	}
+	om.pushRetries(retries)
+}
+
+// finishRequest stops requesting an object. The peers that it was requested
+// from may still deliver it late until objectRequestTimeout has passed, which
+// is not held against them.
+func (om *ObjectManager) finishRequest(invVect wire.InvVect,
+	req *objectRequest, now time.Time) {
+	delete(om.requestedObjects, invVect)
+	req.advertisers = nil
+	req.timestamp = now
+	om.finishedRequests[invVect] = req
+}
+
+// pushRetries requests objects from peers other than the ones that they were
+// originally requested from.
+func (om *ObjectManager) pushRetries(retries map[*bmpeer][]*wire.InvVect) {
+	for p, invList := range retries {
+		peerLog.Debugf(p.peer.PrependAddr(fmt.Sprint("Requesting ",
+			len(invList), " objects that other peers failed to deliver.")))
+		p.PushGetDataMsg(invList)
+	}
+}
+
+// handleObjectMsg handles object messages from all peers.
+func (om *ObjectManager) handleObjectMsg(omsg *objectMsg) {
+	invVect := wire.NewInvVect(omsg.object.InventoryHash())
+	objType := objectTypeLabel(omsg.object.ObjectType)
+	om.receivedObjects.Add(1, objType)
+
+	// Unrequested data is ignored and counts towards the ban score.
+	req, exists := om.requestedObjects[*invVect]
+	past, finished := om.finishedRequests[*invVect]
+	if !(exists && req.requestedFrom(omsg.peer)) &&
+		!(finished && past.requestedFrom(omsg.peer)) {
+		// An attacker could guess which objects are being requested from peers
+		// and send them before the actual peer the object was requested from,
+		// thus getting legitimate peers penalized. We want to prevent against such
+		// an attack by checking that objects came from peers that we requested
+		// from.
+		omsg.peer.addBanScore(om.server.config().BanUnrequested, fmt.Sprint(
+			"unrequested object ", invVect.Hash.String()[:8], " received"))
+		om.rejectedObjects.Add(1, objType, rejectLabelUnrequested)
+		return
+	}
+
+	// A peer whose request timed out may deliver the object after another
+	// peer did, which is ignored.
+	if _, ok := om.verifyingObjects[*invVect]; ok {
+		return
+	}
+	if haveInv, _ := om.haveInventory(invVect); haveInv {
+		return
+	}
+
+	if exists {
+		om.finishRequest(*invVect, req, time.Now())
+	}
+
+	// Hand the object over to the verifier. If it is too busy, the object is
+	// dropped. Since it is then neither stored nor requested, it will be
+	// requested again the next time that it is advertised to us.
+	if !om.verifier.Submit(omsg) {
+		peerLog.Warn(omsg.peer.peer.PrependAddr(fmt.Sprint("Object ",
+			invVect.Hash.String()[:8], " dropped because the verification ",
+			"queue is full.")))
+		om.rejectedObjects.Add(1, objType, rejectLabelQueueFull)
+		return
+	}
+	om.verifyingObjects[*invVect] = struct{}{}
+}
+
+// handleVerifiedObjectMsg handles objects from peers that have been checked by
+// the verifier. Valid objects are inserted into the database.
+func (om *ObjectManager) handleVerifiedObjectMsg(vmsg *verifiedObjectMsg) {
+	invVect := wire.NewInvVect(vmsg.object.InventoryHash())
+	delete(om.verifyingObjects, *invVect)
+	objType := objectTypeLabel(vmsg.object.ObjectType)
+
+	if rej := vmsg.rejection; rej != nil {
+		vmsg.peer.addRejectedObject(rej.Reason)
+		om.rejectedObjects.Add(1, objType, rejectReasonLabel(rej.Reason))
+		if rej.Reason == rejectPoW {
+			vmsg.peer.addBanScore(om.server.config().BanPoW, fmt.Sprint("object ",
+				invVect.Hash.String()[:8], " has ", rej))
+		}
+		peerLog.Debugf(vmsg.peer.peer.PrependAddr(fmt.Sprint("Object ",
+			invVect.Hash.String()[:8], " rejected: ", rej)))
+		return
+	}
+
+	if om.handleInsert(vmsg.object) != 0 {
+		om.acceptedObjects.Add(1, objType)
+	}
+
+	peerLog.Debugf(vmsg.peer.peer.PrependAddr(fmt.Sprint("Object ", invVect.Hash.String()[:8], " received.")))
+}
+
+func (om *ObjectManager) handleInsert(obj *wire.MsgObject) uint64 {
+	// Insert object into database.
+	counter, err := om.server.db.InsertObject(obj)
+	if err != nil {
+		dbLog.Errorf("failed to insert object: %v", err)
+		return 0
+	}
+
+	// Notify RPC server
+	if !om.server.cfg.DisableRPC {
+		om.server.rpcServer.NotifyObject(obj, counter)
+	}
+
+	// Advertise objects to other peers.
+	om.server.handleRelayInvMsg(wire.NewInvVect(obj.InventoryHash()),
+		uint32(obj.StreamNumber))
+
+	return counter
+}
+
+// haveInventory returns whether or not the inventory represented by the passed
+// inventory vector is known. This includes checking all of the various places
+// inventory can be.
+func (om *ObjectManager) haveInventory(invVect *wire.InvVect) (bool, error) {
+	return om.server.db.ExistsObject(&invVect.Hash)
+}
+
+// handleInvMsg handles inv messages from all peers.
+// We examine the inventory advertised by the remote peer and act accordingly.
+func (om *ObjectManager) handleInvMsg(imsg *invMsg) {
+	requestQueue := make([]*wire.InvVect, len(imsg.inv.InvList))
+
+	// Request the advertised inventory if we don't already have it.
+	var i int
+
+	for _, iv := range imsg.inv.InvList {
+		// Add inv to known inventory.
+		imsg.peer.inventory.AddKnown(iv)
+
+		// Objects that are being verified will be in the database soon.
+		if _, ok := om.verifyingObjects[*iv]; ok {
+			continue
+		}
+
+		// Request the inventory if we don't already have it.
+		haveInv, err := om.haveInventory(iv)
+		if err != nil {
+			continue
+		}
+
+		if haveInv {
+			continue
+		}
+
+		// If the object has already been requested from another peer,
+		// remember that this peer can provide it too in case the other
+		// peer does not deliver.
+		if req, ok := om.requestedObjects[*iv]; ok {
+			req.addAdvertiser(imsg.peer)
+			continue
+		}
+
+		// Add it to the request queue.
+		requestQueue[i] = iv
+		i++
+		om.requestedObjects[*iv] = &objectRequest{
+			peer:      imsg.peer,
+			timestamp: time.Now(),
+		}
+	}
+
+	if i == 0 {
+		return
+	}
+
+	peerLog.Debugf(imsg.peer.peer.PrependAddr(fmt.Sprint(i, " unknown hashes received.")))
+	// get inventory from specified peer
+	imsg.peer.PushGetDataMsg(requestQueue[:i])
+}
+
+// clearRequests is used to periodically clear out timed out requests. It's used
+// to prevent against a scenario in which a malicious peer advertises an inv
+// hash but does not send the object. This would effectively 'censor' the object
+// from the peer. To avoid this scenario, we record the timestamp of a request
+// and, once it times out, request the object from the next peer that
+// advertised it.
+func (om *ObjectManager) clearRequests() {
+	now := time.Now()
+	retries := make(map[*bmpeer][]*wire.InvVect)
+	for invVect, req := range om.requestedObjects {
+		// Skip requests that have not expired yet.
+		if now.Before(req.timestamp.Add(objectRequestTimeout)) {
+			continue
+		}
+
+		peerLog.Debugf(req.peer.peer.PrependAddr(fmt.Sprint("Request for ",
+			invVect.Hash.String()[:8], " timed out.")))
+
+		if !req.next(now) {
+			om.finishRequest(invVect, req, now)
+			continue
+		}
+		iv := invVect
+		retries[req.peer] = append(retries[req.peer], &iv)
+	}
+	om.pushRetries(retries)
+
+	// Late deliveries are no longer expected.
+	for invVect, req := range om.finishedRequests {
+		if !now.Before(req.timestamp.Add(objectRequestTimeout)) {
+			delete(om.finishedRequests, invVect)
+		}
+	}
+}
+
+// objectHandler is the main handler for the object manager. It must be run as a
+// goroutine. It processes inv messages in a separate goroutine from the peer
+// handlers.
+func (om *ObjectManager) objectHandler() {
+	candidatePeers := make(map[*bmpeer]struct{})
+	clearTick := time.NewTicker(objectRequestTimeout / 2)
+
+	for {
+		select {
+		case <-clearTick.C:
+			om.clearRequests()
+
+		case m := <-om.msgChan:
+			switch msg := m.(type) {
+			case *newPeerMsg:
+				om.handleNewPeerMsg(candidatePeers, msg.peer)
+
+			case *objectMsg:
+				om.handleObjectMsg(msg)
+
+			case *verifiedObjectMsg:
+				om.handleVerifiedObjectMsg(msg)
+
+			case *invMsg:
+				om.handleInvMsg(msg)
+
+			case *donePeerMsg:
+				om.handleDonePeerMsg(candidatePeers, msg.peer)
+
+			case *pendingObjectsMsg:
+				msg.reply <- [2]int{len(om.requestedObjects),
+					len(om.verifyingObjects)}
+			}
+
+		case <-om.quit:
+			clearTick.Stop()
+			om.wg.Done()
+			return
+		}
+	}
+}
+
+// pruneExpired removes expired objects from the database, notifies the RPC
+// server of the removed counters and updates the pruning statistics.
+func (om *ObjectManager) pruneExpired() {
+	removed, size, err := om.server.db.RemoveExpiredObjects(om.server.config().ExpiryMargin)
+	if err != nil {
+		dbLog.Errorf("failed to remove expired objects: %v", err)
+		return
+	}
+
+	var count uint64
+	for objType, counters := range removed {
+		count += uint64(len(counters))
+
+		// Notify RPC server
+		if !om.server.cfg.DisableRPC {
+			om.server.rpcServer.NotifyExpired(objType, counters)
+		}
+	}
+
+	atomic.AddUint64(&om.prunedObjects, count)
+	atomic.AddUint64(&om.prunedBytes, size)
+
+	if count > 0 {
+		dbLog.Infof("Pruned %d expired objects, reclaimed %d bytes.", count,
+			size)
+	}
+}
+
+// pruneHandler periodically removes expired objects from the database. It must
+// be run as a goroutine. It is kept separate from objectHandler so that a slow
+// database operation does not hold up processing of objects and inv messages.
+func (om *ObjectManager) pruneHandler() {
+	// Get rid of anything that expired while we were not running.
+	om.pruneExpired()
+
+	pruneTick := time.NewTicker(om.server.cfg.PruneInterval)
+
+	for {
+		select {
+		case <-pruneTick.C:
+			om.pruneExpired()
+
+		case <-om.quit:
+			pruneTick.Stop()
+			om.wg.Done()
+			return
+		}
+	}
+}
+
+// PruneStats returns the total number of expired objects and the total number
+// of bytes that have been removed from the database since the object manager
+// was started. It is safe for concurrent access.
+func (om *ObjectManager) PruneStats() (objects, bytes uint64) {
+	return atomic.LoadUint64(&om.prunedObjects),
+		atomic.LoadUint64(&om.prunedBytes)
+}
+
+// DroppedObjects returns the number of objects received from peers that were
+// dropped because the verification queue was full. It is safe for concurrent
+// access.
+func (om *ObjectManager) DroppedObjects() uint64 {
+	return om.verifier.Dropped()
+}
+
+// PendingObjects returns the number of objects that have been requested from
+// peers but not yet received and the number of objects that are waiting to be
+// verified.
+func (om *ObjectManager) PendingObjects() (requested, verifying int) {
+	// Ignore if we are shutting down.
+	if atomic.LoadInt32(&om.shutdown) != 0 {
+		return 0, 0
+	}
+
+	reply := make(chan [2]int, 1)
+	select {
+	case om.msgChan <- &pendingObjectsMsg{reply: reply}:
+	case <-om.quit:
+		return 0, 0
+	}
+
+	select {
+	case pending := <-reply:
+		return pending[0], pending[1]
+	case <-om.quit:
+		return 0, 0
+	}
+}
+
+// NewPeer informs the object manager of a newly active peer.
+func (om *ObjectManager) NewPeer(p *bmpeer) {
+	// Ignore if we are shutting down.
+	if atomic.LoadInt32(&om.shutdown) != 0 {
+		return
+	}
+
+	om.msgChan <- &newPeerMsg{peer: p}
+}
+
+// QueueObject adds the passed object message and peer to the object handling
+// queue.
+func (om *ObjectManager) QueueObject(object *wire.MsgObject, p *bmpeer) {
+	// Don't accept more objects if we're shutting down.
+	if atomic.LoadInt32(&om.shutdown) != 0 {
+		return
+	}
+
+	om.msgChan <- &objectMsg{object: object, peer: p}
+}
+
+// QueueInv adds the passed inv message and peer to the object handling queue.
+func (om *ObjectManager) QueueInv(inv *wire.MsgInv, p *bmpeer) {
+	// Ignore if we are shutting down.
+	if atomic.LoadInt32(&om.shutdown) != 0 {
+		return
+	}
+
+	om.msgChan <- &invMsg{inv: inv, peer: p}
+}
+
+// DonePeer informs the object manager that a peer has disconnected.
+func (om *ObjectManager) DonePeer(p *bmpeer) {
+	// Ignore if we are shutting down.
+	if atomic.LoadInt32(&om.shutdown) != 0 {
+		return
+	}
+
+	om.msgChan <- &donePeerMsg{peer: p}
+}
+
+// Start begins the core object handler which processes object messages.
+func (om *ObjectManager) Start() {
+	// Already started?
+	if atomic.AddInt32(&om.started, 1) != 1 {
+		return
+	}
+
+	om.verifier.Start()
+
+	om.wg.Add(2)
+	go om.objectHandler()
+	go om.pruneHandler()
+}
+
+// Stop gracefully shuts down the object manager by stopping all asynchronous
+// handlers and waiting for them to finish.
+func (om *ObjectManager) Stop() error {
+	if atomic.AddInt32(&om.shutdown, 1) != 1 {
+		return nil
+	}
+
+	close(om.quit)
+	om.verifier.Stop()
+	om.wg.Wait()
+	return nil
+}
+
+// newObjectManager returns a new bitmessage object manager. Use Start to begin
+// processing objects and inv messages asynchronously.
+func newObjectManager(s *server) *ObjectManager {
+	msgChan := make(chan interface{}, objectManagerQueueSize)
+
+	// Verification is CPU bound, so there is no point in having more workers
+	// than can run at once.
+	workers := runtime.GOMAXPROCS(0)
+
+	return &ObjectManager{
+		server:           s,
+		requestedObjects: make(map[wire.InvVect]*objectRequest),
+		finishedRequests: make(map[wire.InvVect]*objectRequest),
+		verifyingObjects: make(map[wire.InvVect]struct{}),
+		verifier: newObjectVerifier(workers,
+			workers*objectVerifyQueuePerWorker, s.streams, msgChan),
+		msgChan:         msgChan,
+		receivedObjects: newMetricsCounterVec("type"),
+		acceptedObjects: newMetricsCounterVec("type"),
+		rejectedObjects: newMetricsCounterVec("type", "reason"),
+		quit:            make(chan struct{}),
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+// TestObjectRequest checks that an object request moves on to the peers that
+// advertised the object in order, and that disconnected peers are skipped.
+func TestObjectRequest(t *testing.T) {
+	now := time.Now()
+	peers := []*bmpeer{&bmpeer{}, &bmpeer{}, &bmpeer{}, &bmpeer{}}
+
+	req := &objectRequest{peer: peers[0], timestamp: now}
+	req.addAdvertiser(peers[0]) // Already requested from this peer.
+	req.addAdvertiser(peers[1])
+	req.addAdvertiser(peers[2])
+	req.addAdvertiser(peers[1]) // Duplicate.
+	req.addAdvertiser(peers[3])
+
+	if len(req.advertisers) != 3 {
+		t.Fatalf("expected 3 advertisers, got %d", len(req.advertisers))
+	}
+
+	// The request times out.
+	later := now.Add(objectRequestTimeout)
+	if !req.next(later) {
+		t.Fatal("expected another advertiser")
+	}
+	if req.peer != peers[1] || !req.timestamp.Equal(later) {
+		t.Error("expected object to be requested from the second advertiser")
+	}
+
+	// The first peer may still deliver the object late.
+	if !req.requestedFrom(peers[0]) || !req.requestedFrom(peers[1]) {
+		t.Error("expected object to be requested from the first two peers")
+	}
+	if req.requestedFrom(peers[2]) {
+		t.Error("object was not yet requested from the third peer")
+	}
+
+	// The third peer disconnects, so the fourth is next.
+	req.removePeer(peers[2])
+	if !req.next(later) || req.peer != peers[3] {
+		t.Error("expected object to be requested from the fourth peer")
+	}
+
+	// There are no advertisers left.
+	if req.next(later) {
+		t.Error("expected no advertisers to be left")
+	}
+}
+
+// TestObjectRequestLatency checks that objects are requested from the
+// advertiser with the lowest known latency first.
+func TestObjectRequestLatency(t *testing.T) {
+	now := time.Now()
+	peers := []*bmpeer{&bmpeer{}, &bmpeer{}, &bmpeer{latency: time.Second},
+		&bmpeer{latency: time.Millisecond * 100}}
+
+	req := &objectRequest{peer: peers[0], timestamp: now}
+	for _, p := range peers[1:] {
+		req.addAdvertiser(p)
+	}
+
+	for _, expected := range []*bmpeer{peers[3], peers[2], peers[1]} {
+		if !req.next(now) || req.peer != expected {
+			t.Fatal("objects requested from advertisers in the wrong order")
+		}
+	}
+}
+
+// TestLateDelivery checks that peers which deliver an object after their
+// request timed out, or after another peer delivered it, are not penalized,
+// while peers that were never asked for the object are.
+func TestLateDelivery(t *testing.T) {
+	serv, err := newServer(testOptions(getMemDb([]*wire.MsgObject{}),
+		MockListen([]*MockListener{NewMockListener(
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8445},
+			make(chan peer.Connection), make(chan struct{}, 1))})))
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	om := serv.objectManager
+
+	newTestPeer := func(ip string) *bmpeer {
+		addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 8444}
+		send := &recordSend{}
+		p := newPeerBase(addr, serv, peer.NewInventory(), send, false,
+			false, 0)
+		p.peer = peer.NewPeer(p, remoteConn{addr: addr}, send)
+		return p
+	}
+	timedOut := newTestPeer("192.0.2.1")
+	retried := newTestPeer("192.0.2.2")
+	stranger := newTestPeer("192.0.2.3")
+
+	obj := testObj[0]
+	inv := wire.NewInvVect(obj.InventoryHash())
+	for _, p := range []*bmpeer{timedOut, retried} {
+		om.handleInvMsg(&invMsg{inv: &wire.MsgInv{
+			InvList: []*wire.InvVect{inv}}, peer: p})
+	}
+
+	// The request times out and moves on to the second peer.
+	om.requestedObjects[*inv].timestamp = time.Now().Add(-objectRequestTimeout)
+	om.clearRequests()
+	if req := om.requestedObjects[*inv]; req == nil || req.peer != retried {
+		t.Fatal("expected the object to be requested from the second peer")
+	}
+
+	// Both peers deliver, the one that timed out first.
+	om.handleObjectMsg(&objectMsg{object: obj, peer: timedOut})
+	if _, ok := om.verifyingObjects[*inv]; !ok {
+		t.Error("late object was not verified")
+	}
+	om.handleObjectMsg(&objectMsg{object: obj, peer: retried})
+	for i, p := range []*bmpeer{timedOut, retried} {
+		if score, _ := p.BanScore(); score != 0 {
+			t.Errorf("peer #%d has ban score %d", i, score)
+		}
+	}
+
+	// A peer that was never asked for the object is penalized.
+	om.handleObjectMsg(&objectMsg{object: obj, peer: stranger})
+	if score, _ := stranger.BanScore(); score == 0 {
+		t.Error("peer that sent an unrequested object was not penalized")
+	}
+
+	// Late deliveries are only expected until the request times out.
+	om.finishedRequests[*inv].timestamp = time.Now().Add(-objectRequestTimeout)
+	om.clearRequests()
+	om.handleObjectMsg(&objectMsg{object: obj, peer: retried})
+	if score, _ := retried.BanScore(); score == 0 {
+		t.Error("peer was not penalized for an object requested long ago")
+	}
+	if n := om.rejectedObjects.Get(objectTypeLabel(obj.ObjectType),
+		rejectLabelUnrequested); n != 2 {
+		t.Errorf("expected 2 unrequested objects, got %d", n)
+	}
+}
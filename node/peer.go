@@ -5,11 +5,12 @@
 // Use of this source code is governed by an ISC
 // license that can be found in the LICENSE file.
 
-package main
+package node
 
 import (
 	"errors"
 	"fmt"
+	"math"
 	prand "math/rand"
 	"net"
 	"strconv"
@@ -27,8 +28,6 @@ const (
 )
 
 var (
-	defaultStreamList = []uint32{1}
-
 	// userAgentName is the user agent name and is used to help identify
 	// ourselves to other bitmessage peers.
 	userAgentName = "bmd"
@@ -57,6 +56,7 @@ type bmpeer struct {
 	na                *wire.NetAddress
 	inbound           bool
 	knownAddresses    map[string]struct{}
+	addrMtx           sync.Mutex // protects knownAddresses.
 	StatsMtx          sync.Mutex // protects all statistics below here.
 	versionKnown      bool
 	versionSent       bool
@@ -65,6 +65,14 @@ type bmpeer struct {
 	protocolVersion   uint32
 	services          wire.ServiceFlag
 	userAgent         string
+	streams           []uint32 // streams shared with the peer.
+	rejectedObjects   map[objectRejectReason]uint64
+	banScore          *banScore
+	banned            bool
+	allowed           bool          // whether the peer is in the allow list.
+	latency           time.Duration // estimated round-trip time.
+	versionSentTime   time.Time
+	getDataSentTime   time.Time // zero if no getdata awaits its first object.
 }
 
 // VersionKnown returns the whether or not the version of a peer is known locally.
@@ -85,6 +93,165 @@ func (p *bmpeer) HandshakeComplete() bool {
 	return p.handshakeComplete
 }
 
+// inStream returns whether the peer takes part in the given stream along with
+// us. It is safe for concurrent access.
+func (p *bmpeer) inStream(stream uint32) bool {
+	p.StatsMtx.Lock()
+	defer p.StatsMtx.Unlock()
+
+	for _, st := range p.streams {
+		if st == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// addRejectedObject records that an object received from the peer was rejected
+// for the given reason. It is safe for concurrent access.
+func (p *bmpeer) addRejectedObject(reason objectRejectReason) {
+	p.StatsMtx.Lock()
+	defer p.StatsMtx.Unlock()
+
+	p.rejectedObjects[reason]++
+}
+
+// addBanScore adds a penalty for the given reason to the ban score of the
+// peer. If the score reaches the BanThreshold option, the peer is banned and
+// disconnected. Peers in the allow list are not penalized. It returns whether
+// the peer has been banned. It is safe for concurrent access.
+func (p *bmpeer) addBanScore(penalty uint32, reason string) bool {
+	// Allowed peers are never banned.
+	if penalty == 0 || p.allowed {
+		return p.Banned()
+	}
+
+	p.StatsMtx.Lock()
+	score := p.banScore.Increase(penalty, reason, time.Now())
+	cfg := p.server.config()
+	ban := !p.banned && score >= cfg.BanThreshold
+	if ban {
+		p.banned = true
+	}
+	p.StatsMtx.Unlock()
+
+	peerLog.Warn(p.peer.PrependAddr(fmt.Sprintf(
+		"Ban score increased by %d to %d: %s", penalty, score, reason)))
+
+	if ban {
+		peerLog.Warn(p.peer.PrependAddr(fmt.Sprintf(
+			"Banning for %s after reaching ban score %d.", cfg.BanDuration,
+			score)))
+		p.server.BanPeer(p)
+		p.disconnect()
+	}
+	return p.Banned()
+}
+
+// misbehave adds a penalty to the ban score of the peer for the protocol
+// violation described by err. err is returned if the peer has been banned, so
+// that the peer is disconnected. Otherwise nil is returned and the offending
+// message is ignored.
+func (p *bmpeer) misbehave(penalty uint32, err error) error {
+	if p.addBanScore(penalty, err.Error()) {
+		return err
+	}
+	return nil
+}
+
+// violateHandshake adds the handshake penalty to the ban score of the peer
+// and returns err, which causes the peer to be disconnected.
+func (p *bmpeer) violateHandshake(err error) error {
+	p.addBanScore(p.server.config().BanHandshake, err.Error())
+	return err
+}
+
+// Banned returns whether the peer has been banned. It is safe for concurrent
+// access.
+func (p *bmpeer) Banned() bool {
+	p.StatsMtx.Lock()
+	defer p.StatsMtx.Unlock()
+
+	return p.banned
+}
+
+// BanScore returns the current ban score of the peer along with the most
+// recent penalties that it was given. It is safe for concurrent access.
+func (p *bmpeer) BanScore() (uint32, []banScoreEvent) {
+	p.StatsMtx.Lock()
+	defer p.StatsMtx.Unlock()
+
+	return p.banScore.Int(time.Now()), p.banScore.History()
+}
+
+// addLatencySample updates the estimated round-trip time of the peer with a
+// newly measured one. The estimate is a moving average which gives the new
+// sample a weight of 1/8. StatsMtx must be held.
+func (p *bmpeer) addLatencySample(rtt time.Duration) {
+	if p.latency == 0 {
+		p.latency = rtt
+		return
+	}
+	p.latency += (rtt - p.latency) / 8
+}
+
+// Latency returns the estimated round-trip time to the peer, or 0 if it is not
+// known yet. It is measured as the time between sending a version message and
+// receiving the verack and between sending a getdata message and receiving the
+// first object in response. It is safe for concurrent access.
+func (p *bmpeer) Latency() time.Duration {
+	p.StatsMtx.Lock()
+	defer p.StatsMtx.Unlock()
+
+	return p.latency
+}
+
+// peerInfo describes the state of a peer.
+type peerInfo struct {
+	addr              string
+	inbound           bool
+	persistent        bool
+	handshakeComplete bool
+	userAgent         string
+	services          wire.ServiceFlag
+	protocolVersion   uint32
+	streams           []uint32
+	latency           time.Duration
+	banScore          uint32
+	bytesSent         uint64
+	bytesReceived     uint64
+	rejectedObjects   map[string]uint64 // by reason label.
+}
+
+// Info returns a description of the current state of the peer. It is safe for
+// concurrent access.
+func (p *bmpeer) Info() *peerInfo {
+	p.StatsMtx.Lock()
+	defer p.StatsMtx.Unlock()
+
+	streams := make([]uint32, len(p.streams))
+	copy(streams, p.streams)
+	rejected := make(map[string]uint64, len(p.rejectedObjects))
+	for reason, count := range p.rejectedObjects {
+		rejected[rejectReasonLabel(reason)] = count
+	}
+	return &peerInfo{
+		addr:              p.addr.String(),
+		inbound:           p.inbound,
+		persistent:        p.Persistent,
+		handshakeComplete: p.handshakeComplete,
+		userAgent:         p.userAgent,
+		services:          p.services,
+		protocolVersion:   p.protocolVersion,
+		streams:           streams,
+		latency:           p.latency,
+		banScore:          p.banScore.Int(time.Now()),
+		bytesSent:         p.peer.BytesWritten(),
+		bytesReceived:     p.peer.BytesRead(),
+		rejectedObjects:   rejected,
+	}
+}
+
 // disconnect disconnects the peer.
 func (p *bmpeer) disconnect() {
 	if !p.peer.Connected() {
@@ -144,7 +311,7 @@ func (p *bmpeer) PushVersionMsg() {
 	// Version message.
 	msg := wire.NewMsgVersion(
 		p.server.addrManager.GetBestLocalAddress(p.na), theirNa,
-		p.server.nonce, defaultStreamList)
+		p.server.nonce, p.server.streams)
 	msg.AddUserAgent(userAgentName, userAgentVersion)
 
 	msg.AddrYou.Services = wire.SFNodeNetwork
@@ -157,6 +324,7 @@ func (p *bmpeer) PushVersionMsg() {
 
 	p.StatsMtx.Lock()
 	p.versionSent = true
+	p.versionSentTime = time.Now()
 	p.StatsMtx.Unlock()
 	peerLog.Debug(p.peer.PrependAddr("Version message sent."))
 }
@@ -182,7 +350,7 @@ func (p *bmpeer) PushGetDataMsg(ivl []*wire.InvVect) {
 
 	x := 0
 	for len(ivl)-x > wire.MaxInvPerMsg {
-		p.QueueMessage(&wire.MsgInv{InvList: ivl[x : x+wire.MaxInvPerMsg]})
+		p.QueueMessage(&wire.MsgGetData{InvList: ivl[x : x+wire.MaxInvPerMsg]})
 		peerLog.Debug(p.peer.PrependAddr(fmt.Sprint("get data message sent with ", wire.MaxInvPerMsg, " hashes.")))
 		x += wire.MaxInvPerMsg
 	}
@@ -191,6 +359,14 @@ func (p *bmpeer) PushGetDataMsg(ivl []*wire.InvVect) {
 		p.QueueMessage(&wire.MsgGetData{InvList: ivl[x:]})
 		peerLog.Debug(p.peer.PrependAddr(fmt.Sprint("Get data message sent with ", len(ivl)-x, " hashes.")))
 	}
+
+	// Time the response for the latency estimate unless we're already waiting
+	// for one.
+	p.StatsMtx.Lock()
+	if p.getDataSentTime.IsZero() {
+		p.getDataSentTime = time.Now()
+	}
+	p.StatsMtx.Unlock()
 }
 
 // PushInvMsg creates and sends an Inv message and sends it to the remote peer.
@@ -229,6 +405,9 @@ func (p *bmpeer) PushAddrMsg(addresses []*wire.NetAddress) error {
 		return errors.New("Address list is empty.")
 	}
 
+	p.addrMtx.Lock()
+	defer p.addrMtx.Unlock()
+
 	r := prand.New(prand.NewSource(time.Now().UnixNano()))
 	numAdded := 0
 	msg := wire.NewMsgAddr()
@@ -265,6 +444,32 @@ func (p *bmpeer) PushAddrMsg(addresses []*wire.NetAddress) error {
 	return errors.New("No addresses added.")
 }
 
+// pushLocalAddr advertises the local address at which the peer can best reach
+// us, in the first stream that we share with it. Nothing is sent if we are not
+// listening or know of no routable local address.
+func (p *bmpeer) pushLocalAddr() {
+	if len(p.server.listeners) == 0 {
+		return
+	}
+	lna := p.server.addrManager.GetBestLocalAddress(p.na)
+	if !addrmgr.IsRoutable(lna) {
+		return
+	}
+
+	// Send a copy of the address, which is up to date.
+	na := *lna
+	na.Timestamp = time.Now()
+	p.StatsMtx.Lock()
+	na.Stream = p.streams[0]
+	p.StatsMtx.Unlock()
+
+	// Advertise the address again even if the peer has already heard of it.
+	p.addrMtx.Lock()
+	delete(p.knownAddresses, addrmgr.NetAddressKey(&na))
+	p.addrMtx.Unlock()
+	p.PushAddrMsg([]*wire.NetAddress{&na})
+}
+
 // QueueMessage takes a message and sends it to the remote peer.
 func (p *bmpeer) QueueMessage(msg wire.Message) {
 	p.send.QueueMessage(msg)
@@ -288,6 +493,18 @@ func (p *bmpeer) HandleVersionMsg(msg *wire.MsgVersion) error {
 		return errors.New("Self connection detected.")
 	}
 
+	// Find the streams that both we and the peer take part in. There is no
+	// point in staying connected if there are none.
+	streams := make([]uint32, 0, len(msg.StreamNumbers))
+	for _, stream := range msg.StreamNumbers {
+		if stream <= math.MaxUint32 && p.server.hasStream(uint32(stream)) {
+			streams = append(streams, uint32(stream))
+		}
+	}
+	if len(streams) == 0 {
+		return errors.New("No streams in common.")
+	}
+
 	// Updating a bunch of stats.
 	p.StatsMtx.Lock()
 
@@ -295,7 +512,7 @@ func (p *bmpeer) HandleVersionMsg(msg *wire.MsgVersion) error {
 	if p.versionKnown {
 		p.StatsMtx.Unlock()
 
-		return errors.New("Only one version message allowed per peer.")
+		return p.violateHandshake(errors.New("Only one version message allowed per peer."))
 	}
 	peerLog.Debug(p.peer.PrependAddr("Version msg received."))
 	p.versionKnown = true
@@ -307,16 +524,29 @@ func (p *bmpeer) HandleVersionMsg(msg *wire.MsgVersion) error {
 	// Set the remote peer's user agent.
 	p.userAgent = msg.UserAgent
 
+	// Negotiate the protocol version.
+	if msg.ProtocolVersion > 0 &&
+		uint32(msg.ProtocolVersion) < p.protocolVersion {
+		p.protocolVersion = uint32(msg.ProtocolVersion)
+	}
+
+	p.streams = streams
+
 	p.StatsMtx.Unlock()
 
+	// An outbound peer tells us the address from which we connected to it,
+	// which is our external address if we are behind a NAT.
+	if !p.inbound {
+		p.server.addPeerLocalAddress(&msg.AddrYou, p.addr)
+	}
+
 	// Inbound connections.
 	if p.inbound {
 		// Set up a NetAddress for the peer to be used with addrManager.
 		// We only do this inbound because outbound set this up
 		// at connection time and no point recomputing.
-		// We only use the first stream number for now because bitmessage has
-		// only one stream.
-		na, err := wire.NewNetAddress(p.addr, uint32(msg.StreamNumbers[0]), p.services)
+		// The peer is filed under the first stream that we have in common.
+		na, err := wire.NewNetAddress(p.addr, streams[0], p.services)
 		if err != nil {
 			return fmt.Errorf("Can't send version message: %s", err)
 		}
@@ -343,10 +573,14 @@ func (p *bmpeer) HandleVerAckMsg() error {
 	// If no version message has been sent disconnect.
 	if !p.versionSent {
 		peerLog.Error(p.peer.PrependAddr("Ver ack msg received before version sent."))
-		return errors.New("Version not yet received.")
+		return p.violateHandshake(errors.New("Version not yet received."))
 	}
 	peerLog.Debug(p.peer.PrependAddr("Ver ack msg received."))
 
+	p.StatsMtx.Lock()
+	p.addLatencySample(time.Since(p.versionSentTime))
+	p.StatsMtx.Unlock()
+
 	p.verAckReceived = true
 	p.server.addrManager.Connected(p.na)
 	p.handleInitialConnection()
@@ -359,17 +593,17 @@ func (p *bmpeer) HandleVerAckMsg() error {
 // QueueMessage with any appropriate responses.
 func (p *bmpeer) HandleInvMsg(msg *wire.MsgInv) error {
 	if !p.HandshakeComplete() {
-		return errors.New("Handshake not complete.")
+		return p.violateHandshake(errors.New("Handshake not complete."))
 	}
 
-	// Disconnect if the message is too big.
+	// Penalize the peer for messages that are too big or empty. They are
+	// ignored unless the peer is banned as a result.
 	if len(msg.InvList) > wire.MaxInvPerMsg {
-		return errors.New("Inv too big.")
+		return p.misbehave(p.server.config().BanMalformed, errors.New("Inv too big."))
 	}
 
-	// Disconnect if the message is too big.
 	if len(msg.InvList) == 0 {
-		return errors.New("Empty inv received.")
+		return p.misbehave(p.server.config().BanMalformed, errors.New("Empty inv received."))
 	}
 
 	peerLog.Debug(p.peer.PrependAddr(fmt.Sprint("Inv received with ", len(msg.InvList), " hashes.")))
@@ -382,11 +616,20 @@ func (p *bmpeer) HandleInvMsg(msg *wire.MsgInv) error {
 // is used to deliver object information.
 func (p *bmpeer) HandleGetDataMsg(msg *wire.MsgGetData) error {
 	if !p.HandshakeComplete() {
-		return errors.New("Handshake not complete.")
+		return p.violateHandshake(errors.New("Handshake not complete."))
 	}
 	peerLog.Debug(p.peer.PrependAddr(fmt.Sprint("GetData request received for ", len(msg.InvList), " objects.")))
 
-	err := p.send.QueueDataRequest(msg.InvList)
+	// Only fresh objects are sent once the upload quota is used up, so
+	// that they are still relayed.
+	invList := msg.InvList
+	if p.server.bandwidth.QuotaUsed() {
+		invList = p.server.bandwidth.FilterFresh(invList)
+		peerLog.Debug(p.peer.PrependAddr(fmt.Sprint("Upload quota used up, not sending ",
+			len(msg.InvList)-len(invList), " old objects.")))
+	}
+
+	err := p.send.QueueDataRequest(invList)
 	if err != nil {
 		return err
 	}
@@ -398,11 +641,18 @@ func (p *bmpeer) HandleGetDataMsg(msg *wire.MsgGetData) error {
 // the object manager.
 func (p *bmpeer) HandleObjectMsg(msg *wire.MsgObject) error {
 	if !p.HandshakeComplete() {
-		return errors.New("Handshake not complete.")
+		return p.violateHandshake(errors.New("Handshake not complete."))
 	}
 
 	p.inventory.AddRequest(-1)
 
+	p.StatsMtx.Lock()
+	if !p.getDataSentTime.IsZero() {
+		p.addLatencySample(time.Since(p.getDataSentTime))
+		p.getDataSentTime = time.Time{}
+	}
+	p.StatsMtx.Unlock()
+
 	p.server.objectManager.QueueObject(msg, p)
 	p.server.addrManager.Connected(p.na)
 
@@ -413,14 +663,20 @@ func (p *bmpeer) HandleObjectMsg(msg *wire.MsgObject) error {
 // is used to notify the server about advertised addresses.
 func (p *bmpeer) HandleAddrMsg(msg *wire.MsgAddr) error {
 	if !p.HandshakeComplete() {
-		return errors.New("Handshake not complete.")
+		return p.violateHandshake(errors.New("Handshake not complete."))
 	}
 
-	// A message that has no addresses is invalid.
+	// A message that has no addresses or too many of them is invalid. It is
+	// ignored unless the peer is banned as a result.
 	if len(msg.AddrList) == 0 {
-		return errors.New("Empty addr message received.")
+		return p.misbehave(p.server.config().BanMalformed, errors.New("Empty addr message received."))
+	}
+	if len(msg.AddrList) > wire.MaxAddrPerMsg {
+		return p.misbehave(p.server.config().BanMalformed, errors.New("Addr message too big."))
 	}
 
+	p.addrMtx.Lock()
+	addrs := make([]*wire.NetAddress, 0, len(msg.AddrList))
 	for _, na := range msg.AddrList {
 
 		// Set the timestamp to 5 days ago if it's more than 24 hours
@@ -433,15 +689,21 @@ func (p *bmpeer) HandleAddrMsg(msg *wire.MsgAddr) error {
 
 		// Add address to known addresses for this peer.
 		p.knownAddresses[addrmgr.NetAddressKey(na)] = struct{}{}
+
+		// Only addresses in streams that we take part in are of any use.
+		if p.server.hasStream(na.Stream) {
+			addrs = append(addrs, na)
+		}
 	}
 
 	peerLog.Debug(p.peer.PrependAddr(fmt.Sprint("addr message with ",
 		len(msg.AddrList), " addrs. Peer has ", len(p.knownAddresses), " addrs.")))
+	p.addrMtx.Unlock()
 
 	// Add addresses to server address manager. The address manager handles
 	// the details of things such as preventing duplicate addresses, max
 	// addresses, and last seen updates.
-	p.server.addrManager.AddAddresses(msg.AddrList, p.na)
+	p.server.addrManager.AddAddresses(addrs, p.na)
 	p.server.addrManager.Connected(p.na)
 	return nil
 }
@@ -460,12 +722,30 @@ func (p *bmpeer) handleInitialConnection() {
 	// Signal the object manager that a new peer has been connected.
 	p.server.objectManager.NewPeer(p)
 
-	// Send a big addr message.
-	p.PushAddrMsg(p.server.addrManager.AddressCache())
+	// Send a big addr message with the addresses in the streams that we share
+	// with the peer.
+	cache := p.server.addrManager.AddressCache()
+	addrs := make([]*wire.NetAddress, 0, len(cache))
+	for _, na := range cache {
+		if p.inStream(na.Stream) {
+			addrs = append(addrs, na)
+		}
+	}
+	p.PushAddrMsg(addrs)
+
+	// Let the peer know how to reach us.
+	p.pushLocalAddr()
 
-	// Send a big inv message.
+	// Send a big inv message with the objects in the streams that we share
+	// with the peer. Once the upload quota is used up, only fresh objects are
+	// advertised since no others are sent.
+	quotaUsed := p.server.bandwidth.QuotaUsed()
 	hashes, _ := p.server.db.FetchRandomInvHashes(wire.MaxInvPerMsg,
-		func(*wire.ShaHash, *wire.MsgObject) bool { return true })
+		func(hash *wire.ShaHash, obj *wire.MsgObject) bool {
+			return uint64(obj.StreamNumber) <= math.MaxUint32 &&
+				p.inStream(uint32(obj.StreamNumber)) &&
+				(!quotaUsed || p.server.bandwidth.IsFresh(hash))
+		})
 	invVectList := make([]*wire.InvVect, len(hashes))
 	for i, hash := range hashes {
 		invVectList[i] = &wire.InvVect{Hash: hash}
@@ -488,6 +768,9 @@ func newPeerBase(addr net.Addr, s *server, inventory *peer.Inventory,
 		send:            send,
 		addr:            addr,
 		knownAddresses:  make(map[string]struct{}),
+		rejectedObjects: make(map[objectRejectReason]uint64),
+		banScore:        newBanScore(s.config().BanHalfLife),
+		allowed:         s.isAllowed(addrIP(addr)),
 		inbound:         inbound,
 		Persistent:      persistent,
 		RetryCount:      retries,
@@ -507,10 +790,6 @@ func newInboundPeer(s *server, conn peer.Connection) *bmpeer {
 	return bmp
 }
 
-// Can be swapped out for testing purposes.
-// TODO handle this more elegantly eventually.
-var NewConn = peer.NewConnection
-
 // newOutbountPeer returns a new outbound bitmessage peer for the provided server and
 // address and connects to it asynchronously. If the connection is successful
 // then the peer will also be started.
@@ -539,7 +818,9 @@ func newOutboundPeer(addr string, s *server, stream uint32, persistent bool, ret
 	}
 
 	tcpAddr := &net.TCPAddr{IP: net.ParseIP(host), Port: int(port)}
-	conn := NewConn(tcpAddr, int64(cfg.MaxDownPerPeer), int64(cfg.MaxUpPerPeer))
+	cfg := s.config()
+	conn := s.limitConn(s.newConn(tcpAddr, cfg.MaxDownPerPeer,
+		cfg.MaxUpPerPeer))
 	inventory := peer.NewInventory()
 	sq := peer.NewSend(inventory, s.db)
 	logic := newPeerBase(tcpAddr, s, inventory, sq, false, persistent, retryCount)
@@ -2,7 +2,7 @@
 // Use of this source code is governed by an ISC
 // license that can be found in the LICENSE file.
 
-package main
+package node
 
 import (
 	"encoding/binary"
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"os"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -752,6 +753,20 @@ func getMemDb(msgs []*wire.MsgObject) database.Db {
 	return db
 }
 
+// testOptions returns the default options with the given database and listen
+// function, listening on all interfaces and without DNS seeding.
+func testOptions(db database.Db, listen func(string, string) (peer.Listener, error)) *Options {
+	opts := DefaultOptions()
+	opts.DB = db
+	opts.Dial = net.Dial
+	opts.Listen = listen
+	opts.Lookup = net.LookupIP
+	opts.DataDir = os.TempDir()
+	opts.Listeners = []string{net.JoinHostPort("", "8445")}
+	opts.DNSSeeds = nil
+	return opts
+}
+
 var expires = time.Now().Add(2 * time.Minute)
 
 //var expired = time.Now().Add(-10 * time.Minute).Add(-3 * time.Hour)
@@ -816,12 +831,12 @@ var testObj = []*wire.MsgObject{
 		[]byte{21, 22, 23, 24, 25, 26, 27, 28, 79},
 		[]byte{20, 21, 22, 23, 24, 25, 26, 27, 79},
 		[]byte{19, 20, 21, 22, 23, 24, 25, 26, 79}).ToMsgObject(),
-	wire.NewMsgBroadcast(876, expires, 1, 1, &shahash[0],
+	wire.NewMsgBroadcast(876, expires, 4, 1, &shahash[0],
 		[]byte{90, 87, 66, 45, 3, 2, 120, 101, 78, 78, 78, 7, 85, 55, 2, 23},
 		1, 1, 2, &pubkey[0], &pubkey[1], 3, 5, &ripehash[1], 1,
 		[]byte{27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40, 41},
 		[]byte{42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56}).ToMsgObject(),
-	wire.NewMsgBroadcast(876, expires, 1, 1, &shahash[1],
+	wire.NewMsgBroadcast(876, expires, 4, 1, &shahash[1],
 		[]byte{90, 87, 66, 45, 3, 2, 120, 101, 78, 78, 78, 7, 85, 55},
 		1, 1, 2, &pubkey[2], &pubkey[3], 3, 5, &ripehash[0], 1,
 		[]byte{27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40},
@@ -917,26 +932,17 @@ func TestOutboundPeerHandshake(t *testing.T) {
 		}
 	}
 
-	// Load config.
-	var err error
-	cfg, _, err = loadConfig(true)
-	if err != nil {
-		t.Fatalf("Config failed to load.")
-	}
-	cfg.MaxPeers = 1
-	defer backendLog.Flush()
-
 	for testCase, response := range responses {
-		NewConn = handshakePeerBuilder(response)
-
 		// Create server and start it.
-		listeners := []string{net.JoinHostPort("", "8445")}
-		serv, err := newServer(listeners, getMemDb([]*wire.MsgObject{}),
+		opts := testOptions(getMemDb([]*wire.MsgObject{}),
 			MockListen([]*MockListener{
 				NewMockListener(localAddr, make(chan peer.Connection), make(chan struct{}, 1))}))
+		opts.MaxPeers = 1
+		serv, err := newServer(opts)
 		if err != nil {
 			t.Fatalf("Server failed to start: %s", err)
 		}
+		serv.newConn = handshakePeerBuilder(response)
 		serv.start([]*DefaultPeer{&DefaultPeer{"5.45.99.75:8444", 1, true}})
 
 		go func() {
@@ -953,7 +959,6 @@ func TestOutboundPeerHandshake(t *testing.T) {
 		<-testDone
 	}
 
-	NewConn = peer.NewConnection
 }
 
 // Test cases:
@@ -1024,23 +1029,14 @@ func TestInboundPeerHandshake(t *testing.T) {
 		},
 	}
 
-	// Load config.
-	var err error
-	cfg, _, err = loadConfig(true)
-	if err != nil {
-		t.Fatalf("Config failed to load.")
-	}
-	cfg.MaxPeers = 1
-	defer backendLog.Flush()
-
 	for testCase, open := range openingMsg {
 
 		// Create server and start it.
-		listeners := []string{net.JoinHostPort("", "8445")}
-		var err error
-		serv, err := newServer(listeners, getMemDb([]*wire.MsgObject{}),
+		opts := testOptions(getMemDb([]*wire.MsgObject{}),
 			MockListen([]*MockListener{
 				NewMockListener(localAddr, incoming, make(chan struct{}))}))
+		opts.MaxPeers = 1
+		serv, err := newServer(opts)
 		if err != nil {
 			t.Fatalf("Server failed to start: %s", err)
 		}
@@ -1128,25 +1124,17 @@ func TestProcessAddr(t *testing.T) {
 		},
 	}
 
-	// Load config.
-	var err error
-	cfg, _, err = loadConfig(true)
-	if err != nil {
-		t.Fatalf("Config failed to load.")
-	}
-	cfg.MaxPeers = 1
-	defer backendLog.Flush()
-
 	for testCase, addrTest := range AddrTests {
 
 		// Add some addresses to the address manager.
 		addrs := make([]*wire.NetAddress, addrTest.NumAddrs)
 
 		// Create server and start it.
-		listeners := []string{net.JoinHostPort("", "8445")}
-		serv, err := newServer(listeners, getMemDb([]*wire.MsgObject{}),
+		opts := testOptions(getMemDb([]*wire.MsgObject{}),
 			MockListen([]*MockListener{
 				NewMockListener(localAddr, incoming, make(chan struct{}))}))
+		opts.MaxPeers = 1
+		serv, err := newServer(opts)
 		if err != nil {
 			t.Fatal("Server failed to start.")
 		}
@@ -1322,23 +1310,15 @@ func TestProcessInvAndObjectExchange(t *testing.T) {
 	localAddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8333}
 	remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 8333}
 
-	// Load config.
-	var err error
-	cfg, _, err = loadConfig(true)
-	if err != nil {
-		t.Fatalf("Config failed to load.")
-	}
-	cfg.MaxPeers = 1
-	defer backendLog.Flush()
-
 	for testCase, test := range tests {
 		// Define the objects that will go in the database.
 		// Create server and start it.
-		listeners := []string{net.JoinHostPort("", "8445")}
 		db := getMemDb(test.peerDB)
-		serv, err := newServer(listeners, db,
+		opts := testOptions(db,
 			MockListen([]*MockListener{
 				NewMockListener(localAddr, incoming, make(chan struct{}))}))
+		opts.MaxPeers = 1
+		serv, err := newServer(opts)
 		if err != nil {
 			t.Fatal("Server failed to start.")
 		}
@@ -1372,3 +1352,29 @@ func TestProcessInvAndObjectExchange(t *testing.T) {
 		}
 	}
 }
+
+// TestPeerInfoRejectedObjects checks that the objects rejected from a peer are
+// reported by reason in its info.
+func TestPeerInfoRejectedObjects(t *testing.T) {
+	serv, err := newServer(testOptions(getMemDb([]*wire.MsgObject{}),
+		MockListen([]*MockListener{NewMockListener(
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8445},
+			make(chan peer.Connection), make(chan struct{}, 1))})))
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8444}
+	send := &recordSend{}
+	p := newPeerBase(addr, serv, peer.NewInventory(), send, false, false, 0)
+	p.peer = peer.NewPeer(p, remoteConn{addr: addr}, send)
+
+	p.addRejectedObject(rejectPoW)
+	p.addRejectedObject(rejectExpired)
+	p.addRejectedObject(rejectPoW)
+
+	rejected := p.Info().rejectedObjects
+	if len(rejected) != 2 || rejected["pow"] != 2 || rejected["expired"] != 1 {
+		t.Errorf("expected 2 pow and 1 expired rejections, got %v", rejected)
+	}
+}
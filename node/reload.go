@@ -0,0 +1,304 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+// reloadableOption is a group of options which can be changed while the node
+// is running, along with the function that applies their new values.
+type reloadableOption struct {
+	fields []string // names of the fields of Options.
+	apply  func(s *server, newOpts *Options) error
+}
+
+// reloadableOptions are the options which are applied by Reload. Changes to
+// any other options are ignored.
+var reloadableOptions = []*reloadableOption{
+	{[]string{"BanDuration", "BanThreshold", "BanHalfLife", "BanPoW",
+		"BanUnrequested", "BanMalformed", "BanHandshake"}, applyBanOptions},
+	{[]string{"MaxPeers", "MaxOutbound"}, applyPeerLimits},
+	{[]string{"AddPeers", "ConnectPeers"}, applyPersistentPeers},
+	{[]string{"AllowList", "DenyList"}, applyIPLists},
+	{[]string{"MaxUpPerPeer", "MaxDownPerPeer"}, applyBandwidthLimits},
+	{[]string{"MaxUp", "MaxDown", "UploadQuota", "QuotaPeriod"},
+		applyUploadQuota},
+	{[]string{"ExpiryMargin"}, applyExpiryMargin},
+	{[]string{"RPCUser", "RPCPass", "RPCLimitUser", "RPCLimitPass",
+		"RPCCredentials"}, applyRPCCredentials},
+	{[]string{"RPCMaxClients", "RPCQueueSize", "RPCMaxInFlight"},
+		applyRPCLimits},
+}
+
+// ReloadableOptions returns the names of the fields of Options which are
+// applied by Reload.
+func ReloadableOptions() []string {
+	var fields []string
+	for _, opt := range reloadableOptions {
+		fields = append(fields, opt.fields...)
+	}
+	return fields
+}
+
+// applyBanOptions changes the penalties and thresholds used to ban peers. The
+// half life of ban scores only changes for peers that connect afterwards.
+func applyBanOptions(s *server, newOpts *Options) error {
+	if newOpts.BanThreshold == 0 {
+		return errors.New("BanThreshold may not be 0")
+	}
+	if newOpts.BanHalfLife <= 0 {
+		return errors.New("BanHalfLife must be positive")
+	}
+
+	s.updateConfig(func(cfg *Options) {
+		cfg.BanDuration = newOpts.BanDuration
+		cfg.BanThreshold = newOpts.BanThreshold
+		cfg.BanHalfLife = newOpts.BanHalfLife
+		cfg.BanPoW = newOpts.BanPoW
+		cfg.BanUnrequested = newOpts.BanUnrequested
+		cfg.BanMalformed = newOpts.BanMalformed
+		cfg.BanHandshake = newOpts.BanHandshake
+	})
+	return nil
+}
+
+// applyPeerLimits changes the number of peers that the node connects to.
+// Existing peers are not disconnected if the limits are lowered.
+func applyPeerLimits(s *server, newOpts *Options) error {
+	if newOpts.MaxPeers < 1 {
+		return errors.New("MaxPeers may not be less than 1")
+	}
+
+	s.updateConfig(func(cfg *Options) {
+		cfg.MaxPeers = newOpts.MaxPeers
+		cfg.MaxOutbound = newOpts.MaxOutbound
+	})
+	s.SetPeerLimits(newOpts.MaxPeers, newOpts.MaxOutbound)
+	return nil
+}
+
+// applyPersistentPeers connects to peers that were added to the AddPeers and
+// ConnectPeers options and disconnects those that were removed.
+func applyPersistentPeers(s *server, newOpts *Options) error {
+	cfg := s.config()
+	oldAddrs := make(map[string]struct{})
+	for _, addr := range persistentPeerAddrs(&cfg) {
+		oldAddrs[addr] = struct{}{}
+	}
+	newAddrs := make(map[string]struct{})
+	for _, addr := range persistentPeerAddrs(newOpts) {
+		newAddrs[addr] = struct{}{}
+	}
+
+	var err error
+	for addr := range oldAddrs {
+		if _, ok := newAddrs[addr]; ok {
+			continue
+		}
+		// The peer may already have been removed over RPC.
+		if e := s.RemoveAddr(addr); e != nil {
+			serverLog.Debugf("Failed to remove peer %s: %v", addr, e)
+		}
+	}
+	for addr := range newAddrs {
+		if _, ok := oldAddrs[addr]; ok {
+			continue
+		}
+		if e := s.AddAddr(addr, s.streams[0], true); e != nil {
+			serverLog.Warnf("Failed to add peer %s: %v", addr, e)
+			err = errors.New("not all peers could be added")
+		}
+	}
+
+	s.updateConfig(func(cfg *Options) {
+		cfg.AddPeers = newOpts.AddPeers
+		cfg.ConnectPeers = newOpts.ConnectPeers
+	})
+	return err
+}
+
+// applyIPLists replaces the allow and deny lists, including any changes made
+// over RPC, and disconnects the peers that are now denied. Peers that are
+// already connected are not affected by changes to the allow list.
+func applyIPLists(s *server, newOpts *Options) error {
+	allow, err := parseIPRanges(newOpts.AllowList)
+	if err != nil {
+		return err
+	}
+	deny, err := parseIPRanges(newOpts.DenyList)
+	if err != nil {
+		return err
+	}
+
+	s.allowList.Set(allow)
+	s.denyList.Set(deny)
+	s.updateConfig(func(cfg *Options) {
+		cfg.AllowList = newOpts.AllowList
+		cfg.DenyList = newOpts.DenyList
+	})
+	s.disconnectDenied()
+	return nil
+}
+
+// applyBandwidthLimits changes the rate limits of peers that connect
+// afterwards.
+func applyBandwidthLimits(s *server, newOpts *Options) error {
+	s.updateConfig(func(cfg *Options) {
+		cfg.MaxUpPerPeer = newOpts.MaxUpPerPeer
+		cfg.MaxDownPerPeer = newOpts.MaxDownPerPeer
+	})
+	return nil
+}
+
+// applyUploadQuota changes the rate limits of all peers together and the upload
+// quota. They apply to connected peers at once.
+func applyUploadQuota(s *server, newOpts *Options) error {
+	if newOpts.MaxUp < 0 || newOpts.MaxDown < 0 || newOpts.UploadQuota < 0 {
+		return errors.New("bandwidth limits may not be negative")
+	}
+	if newOpts.QuotaPeriod != QuotaDaily &&
+		newOpts.QuotaPeriod != QuotaMonthly {
+		return errors.New("invalid QuotaPeriod")
+	}
+
+	s.bandwidth.up.SetRate(newOpts.MaxUp)
+	s.bandwidth.down.SetRate(newOpts.MaxDown)
+	s.bandwidth.SetQuota(newOpts.UploadQuota, newOpts.QuotaPeriod)
+	s.updateConfig(func(cfg *Options) {
+		cfg.MaxUp = newOpts.MaxUp
+		cfg.MaxDown = newOpts.MaxDown
+		cfg.UploadQuota = newOpts.UploadQuota
+		cfg.QuotaPeriod = newOpts.QuotaPeriod
+	})
+	return nil
+}
+
+// applyExpiryMargin changes how long expired objects are kept, starting with
+// the next time that the database is pruned.
+func applyExpiryMargin(s *server, newOpts *Options) error {
+	s.updateConfig(func(cfg *Options) {
+		cfg.ExpiryMargin = newOpts.ExpiryMargin
+	})
+	return nil
+}
+
+// applyRPCCredentials reloads the RPC users. The old users are kept if the new
+// ones can not be loaded. Clients that are already authenticated stay
+// connected, but are subject to the permissions of their new user.
+func applyRPCCredentials(s *server, newOpts *Options) error {
+	if s.rpcServer == nil {
+		return errors.New("the RPC server is disabled")
+	}
+
+	setCredentials := func(opts *Options) {
+		s.updateConfig(func(cfg *Options) {
+			cfg.RPCUser = opts.RPCUser
+			cfg.RPCPass = opts.RPCPass
+			cfg.RPCLimitUser = opts.RPCLimitUser
+			cfg.RPCLimitPass = opts.RPCLimitPass
+			cfg.RPCCredentials = opts.RPCCredentials
+		})
+	}
+
+	old := s.config()
+	setCredentials(newOpts)
+	err := s.rpcServer.ReloadCredentials()
+	if err != nil {
+		setCredentials(&old)
+	}
+	return err
+}
+
+// applyRPCLimits changes the limits of RPC clients. The queue size and the
+// number of notifications in flight only change for clients that connect
+// afterwards.
+func applyRPCLimits(s *server, newOpts *Options) error {
+	if newOpts.RPCQueueSize < MinRPCQueueSize {
+		return errors.New("RPCQueueSize is too small")
+	}
+	if newOpts.RPCMaxInFlight < 1 {
+		return errors.New("RPCMaxInFlight may not be less than 1")
+	}
+
+	s.updateConfig(func(cfg *Options) {
+		cfg.RPCMaxClients = newOpts.RPCMaxClients
+		cfg.RPCQueueSize = newOpts.RPCQueueSize
+		cfg.RPCMaxInFlight = newOpts.RPCMaxInFlight
+	})
+	return nil
+}
+
+// config returns a copy of the options of the server. The options that Reload
+// changes must only be read through it.
+func (s *server) config() Options {
+	s.cfgMtx.RLock()
+	defer s.cfgMtx.RUnlock()
+	return *s.cfg
+}
+
+// updateConfig changes the options of the server with the given function.
+func (s *server) updateConfig(update func(cfg *Options)) {
+	s.cfgMtx.Lock()
+	update(s.cfg)
+	s.cfgMtx.Unlock()
+}
+
+// changed returns the names of the fields of the option group which differ
+// between the two sets of options.
+func (opt *reloadableOption) changed(oldOpts, newOpts *Options) []string {
+	var changed []string
+	oldVal := reflect.ValueOf(oldOpts).Elem()
+	newVal := reflect.ValueOf(newOpts).Elem()
+	for _, field := range opt.fields {
+		if !reflect.DeepEqual(oldVal.FieldByName(field).Interface(),
+			newVal.FieldByName(field).Interface()) {
+			changed = append(changed, field)
+		}
+	}
+	return changed
+}
+
+// Reload applies the changes in opts that can be made while the node is
+// running: the ban options, the peer limits, the persistent peers, the allow
+// and deny lists, the bandwidth limits, the upload quota, ExpiryMargin, the RPC
+// users and the RPC client limits. Changes to any other options are ignored.
+// Groups of options that can not be applied are logged and keep their old
+// values, and an error is returned. It is safe for concurrent access.
+func (n *Node) Reload(opts *Options) error {
+	s := n.server
+	if atomic.LoadInt32(&s.shutdown) != 0 {
+		return errors.New("node is shutting down")
+	}
+
+	s.reloadMtx.Lock()
+	defer s.reloadMtx.Unlock()
+
+	cfg := s.config()
+	var failed []string
+	for _, opt := range reloadableOptions {
+		fields := opt.changed(&cfg, opts)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if err := opt.apply(s, opts); err != nil {
+			serverLog.Errorf("Failed to apply changes to %s: %v",
+				strings.Join(fields, ", "), err)
+			failed = append(failed, fields...)
+			continue
+		}
+		serverLog.Debugf("Applied changes to %s", strings.Join(fields, ", "))
+	}
+
+	if len(failed) > 0 {
+		return errors.New("failed to apply changes to " +
+			strings.Join(failed, ", "))
+	}
+	return nil
+}
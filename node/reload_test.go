@@ -0,0 +1,92 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+func TestReloadableOptions(t *testing.T) {
+	typ := reflect.TypeOf(Options{})
+	seen := make(map[string]bool)
+	for _, opt := range reloadableOptions {
+		for _, field := range opt.fields {
+			if _, ok := typ.FieldByName(field); !ok {
+				t.Errorf("Options has no field %s", field)
+			}
+			if seen[field] {
+				t.Errorf("field %s is listed twice", field)
+			}
+			seen[field] = true
+		}
+	}
+	if fields := ReloadableOptions(); len(fields) != len(seen) {
+		t.Errorf("expected %d reloadable options, got %v", len(seen),
+			fields)
+	}
+
+	oldOpts := DefaultOptions()
+	newOpts := DefaultOptions()
+	newOpts.Listeners = nil
+	newOpts.BanDuration = time.Minute
+	newOpts.BanPoW = 1
+
+	var changed []string
+	for _, opt := range reloadableOptions {
+		changed = append(changed, opt.changed(oldOpts, newOpts)...)
+	}
+	expected := []string{"BanDuration", "BanPoW"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changed)
+	}
+}
+
+// TestReloadConcurrent checks that options can be reloaded while other
+// goroutines read them. It is meant to be run with the race detector.
+func TestReloadConcurrent(t *testing.T) {
+	serv, err := newServer(testOptions(getMemDb([]*wire.MsgObject{}),
+		MockListen([]*MockListener{NewMockListener(
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8445},
+			make(chan peer.Connection), make(chan struct{}, 1))})))
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	n := &Node{server: serv}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8444}
+		for i := 0; i < 100; i++ {
+			newPeerBase(addr, serv, peer.NewInventory(), &recordSend{},
+				true, false, 0)
+			if serv.config().BanThreshold == 0 {
+				t.Error("read BanThreshold 0")
+			}
+		}
+	}()
+
+	opts := serv.config()
+	for i := 1; i <= 100; i++ {
+		opts.BanThreshold = uint32(i)
+		opts.ExpiryMargin = time.Duration(i) * time.Minute
+		if err = n.Reload(&opts); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+	}
+	<-done
+
+	if cfg := serv.config(); cfg.BanThreshold != 100 ||
+		cfg.ExpiryMargin != 100*time.Minute {
+		t.Errorf("expected the last options, got BanThreshold %d and "+
+			"ExpiryMargin %v", cfg.BanThreshold, cfg.ExpiryMargin)
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// rpcPasswordHashPrefix identifies the only supported password hash
+	// scheme in the credentials file.
+	rpcPasswordHashPrefix = "pbkdf2-sha256"
+
+	// rpcPasswordHashIterations is the number of PBKDF2 iterations used to
+	// hash the passwords of users given on the command line.
+	rpcPasswordHashIterations = 4096
+
+	// rpcPermissionAdmin is the permission that allows a user to call every
+	// method.
+	rpcPermissionAdmin = "admin"
+)
+
+// rpcPermissionGroups maps the names of groups of methods that can be given to
+// users in the credentials file to the methods they allow. Methods can also be
+// given individually.
+var rpcPermissionGroups = map[string][]string{
+	"send":  {rpcHandleSendObject},
+	"query": {rpcHandleGetIdentity, rpcHandleGetInfo},
+	"subscribe": {
+		rpcHandleSubscribeMessages,
+		rpcHandleSubscribeBroadcasts,
+		rpcHandleSubscribeGetpubkeys,
+		rpcHandleSubscribePubkeys,
+		rpcHandleSubscribeUnknownObjs,
+		rpcHandleUnsubscribeMessages,
+		rpcHandleUnsubscribeBroadcasts,
+		rpcHandleUnsubscribeGetpubkeys,
+		rpcHandleUnsubscribePubkeys,
+		rpcHandleUnsubscribeUnknownObjs,
+		rpcHandleListSubscriptions,
+	},
+	"peers": {
+		rpcHandleBanScores,
+		rpcHandleGetPeers,
+		rpcHandleAddPeer,
+		rpcHandleDisconnectPeer,
+		rpcHandleBanPeer,
+		rpcHandleUnbanPeer,
+		rpcHandleGetBanList,
+		rpcHandleAddIPRange,
+		rpcHandleRemoveIPRange,
+	},
+}
+
+// rpcLimitedPermissions are the permissions of the limited user given with
+// --rpclimituser.
+var rpcLimitedPermissions = []string{"send", "query", "subscribe"}
+
+// pbkdf2SHA256 derives a key of keyLen bytes from the password and salt as
+// specified in RFC 2898, using HMAC-SHA256 as the pseudorandom function.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var index [4]byte
+	key := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(index[:], uint32(block))
+		prf.Write(index[:])
+		key = prf.Sum(key)
+		t := key[len(key)-hashLen:]
+		copy(u, t)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return key[:keyLen]
+}
+
+// rpcPasswordHash is a salted password hash.
+type rpcPasswordHash struct {
+	iterations int
+	salt       []byte
+	hash       []byte
+}
+
+// Check returns whether the password matches the hash. The comparison is
+// time-constant.
+func (h *rpcPasswordHash) Check(password string) bool {
+	hash := pbkdf2SHA256([]byte(password), h.salt, h.iterations, len(h.hash))
+	return subtle.ConstantTimeCompare(hash, h.hash) == 1
+}
+
+// String returns the hash in the format used in the credentials file.
+func (h *rpcPasswordHash) String() string {
+	return strings.Join([]string{rpcPasswordHashPrefix,
+		strconv.Itoa(h.iterations),
+		base64.StdEncoding.EncodeToString(h.salt),
+		base64.StdEncoding.EncodeToString(h.hash)}, "$")
+}
+
+// newRPCDummyPasswordHash returns a hash with the given number of iterations
+// that no password matches.
+func newRPCDummyPasswordHash(iterations int) *rpcPasswordHash {
+	return &rpcPasswordHash{
+		iterations: iterations,
+		salt:       make([]byte, 16),
+		hash:       make([]byte, sha256.Size),
+	}
+}
+
+// newRPCPasswordHash hashes the password with a random salt.
+func newRPCPasswordHash(password string, iterations int) (*rpcPasswordHash,
+	error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &rpcPasswordHash{
+		iterations: iterations,
+		salt:       salt,
+		hash:       pbkdf2SHA256([]byte(password), salt, iterations, sha256.Size),
+	}, nil
+}
+
+// parseRPCPasswordHash parses a password hash of the form
+// pbkdf2-sha256$<iterations>$<base64 salt>$<base64 hash>.
+func parseRPCPasswordHash(s string) (*rpcPasswordHash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 4 || parts[0] != rpcPasswordHashPrefix {
+		return nil, fmt.Errorf("password hash must be of the form "+
+			"%s$<iterations>$<salt>$<hash>", rpcPasswordHashPrefix)
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("invalid number of iterations %s", parts[1])
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(hash) == 0 {
+		return nil, errors.New("invalid hash")
+	}
+
+	return &rpcPasswordHash{
+		iterations: iterations,
+		salt:       salt,
+		hash:       hash,
+	}, nil
+}
+
+// rpcUser is a user of the RPC server and the methods it may call.
+type rpcUser struct {
+	username string
+	password *rpcPasswordHash
+	methods  map[string]struct{} // nil if the user may call every method.
+}
+
+// Allowed returns whether the user may call the given method.
+func (u *rpcUser) Allowed(method string) bool {
+	if u.methods == nil {
+		return true
+	}
+	_, ok := u.methods[method]
+	return ok
+}
+
+// newRPCUser returns a user with the given permissions, which are names of
+// methods or of groups of methods.
+func newRPCUser(username string, password *rpcPasswordHash,
+	permissions []string) (*rpcUser, error) {
+	u := &rpcUser{
+		username: username,
+		password: password,
+		methods:  make(map[string]struct{}),
+	}
+
+	known := make(map[string]struct{})
+	for _, methods := range rpcPermissionGroups {
+		for _, method := range methods {
+			known[method] = struct{}{}
+		}
+	}
+
+	for _, perm := range permissions {
+		if perm == rpcPermissionAdmin {
+			u.methods = nil
+			return u, nil
+		}
+		if methods, ok := rpcPermissionGroups[perm]; ok {
+			for _, method := range methods {
+				u.methods[method] = struct{}{}
+			}
+			continue
+		}
+		if _, ok := known[perm]; !ok {
+			return nil, fmt.Errorf("unknown permission %s for user %s", perm,
+				username)
+		}
+		u.methods[perm] = struct{}{}
+	}
+	return u, nil
+}
+
+// rpcCredentialsFile is the format of the credentials file.
+type rpcCredentialsFile struct {
+	Users []struct {
+		Username    string   `json:"username"`
+		Password    string   `json:"password"`
+		Permissions []string `json:"permissions"`
+	} `json:"users"`
+}
+
+// rpcCredentials holds the users of the RPC server.
+type rpcCredentials struct {
+	users   map[string]*rpcUser
+	dummy   *rpcPasswordHash // checked against the password of unknown users.
+	modTime time.Time        // of the credentials file when it was read.
+}
+
+// Authenticate returns the user with the given username and password, or nil
+// if there is none.
+func (c *rpcCredentials) Authenticate(username, password string) *rpcUser {
+	u, ok := c.users[username]
+	if !ok {
+		// Hash the password anyway so that the time taken does not reveal
+		// whether the user exists.
+		c.dummy.Check(password)
+		return nil
+	}
+	if !u.password.Check(password) {
+		return nil
+	}
+	return u
+}
+
+// add adds a user, returning an error if there is already a user with the same
+// name. The dummy hash is made as slow to check as the slowest password hash.
+func (c *rpcCredentials) add(u *rpcUser) error {
+	if _, ok := c.users[u.username]; ok {
+		return fmt.Errorf("user %s is defined more than once", u.username)
+	}
+	c.users[u.username] = u
+	if u.password.iterations > c.dummy.iterations {
+		c.dummy = newRPCDummyPasswordHash(u.password.iterations)
+	}
+	return nil
+}
+
+// loadRPCCredentials returns the users given by the rpcuser and rpclimituser
+// options and those in the credentials file, if there is one.
+func loadRPCCredentials(opts *Options) (*rpcCredentials, error) {
+	c := &rpcCredentials{
+		users: make(map[string]*rpcUser),
+		dummy: newRPCDummyPasswordHash(rpcPasswordHashIterations),
+	}
+
+	legacy := []struct {
+		username, password string
+		permissions        []string
+	}{
+		{opts.RPCUser, opts.RPCPass, []string{rpcPermissionAdmin}},
+		{opts.RPCLimitUser, opts.RPCLimitPass, rpcLimitedPermissions},
+	}
+	for _, l := range legacy {
+		if l.username == "" || l.password == "" {
+			continue
+		}
+		hash, err := newRPCPasswordHash(l.password, rpcPasswordHashIterations)
+		if err != nil {
+			return nil, err
+		}
+		u, err := newRPCUser(l.username, hash, l.permissions)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.add(u); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.RPCCredentials == "" {
+		return c, nil
+	}
+
+	fi, err := os.Stat(opts.RPCCredentials)
+	if err != nil {
+		return nil, err
+	}
+	c.modTime = fi.ModTime()
+
+	data, err := ioutil.ReadFile(opts.RPCCredentials)
+	if err != nil {
+		return nil, err
+	}
+	var file rpcCredentialsFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.RPCCredentials, err)
+	}
+
+	for _, fu := range file.Users {
+		if fu.Username == "" {
+			return nil, fmt.Errorf("%s: user without a name",
+				opts.RPCCredentials)
+		}
+		hash, err := parseRPCPasswordHash(fu.Password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %s: %v", opts.RPCCredentials,
+				fu.Username, err)
+		}
+		u, err := newRPCUser(fu.Username, hash, fu.Permissions)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", opts.RPCCredentials, err)
+		}
+		if err = c.add(u); err != nil {
+			return nil, fmt.Errorf("%s: %v", opts.RPCCredentials, err)
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPBKDF2SHA256 checks the key derivation against known test vectors.
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		keyLen     int
+		key        string
+	}{
+		{"password", "salt", 1, 32,
+			"120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, 32,
+			"ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, 32,
+			"c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt",
+			4096, 40, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1f" +
+				"b8dd53e1c635518c7dac47e9"},
+	}
+
+	for i, test := range tests {
+		key := pbkdf2SHA256([]byte(test.password), []byte(test.salt),
+			test.iterations, test.keyLen)
+		if hex.EncodeToString(key) != test.key {
+			t.Errorf("for case #%d expected %s got %x", i, test.key, key)
+		}
+	}
+}
+
+// TestRPCPasswordHash checks that password hashes can be written, parsed and
+// checked, and that malformed hashes are rejected.
+func TestRPCPasswordHash(t *testing.T) {
+	hash, err := newRPCPasswordHash("secret", 10)
+	if err != nil {
+		t.Fatalf("newRPCPasswordHash failed: %v", err)
+	}
+	parsed, err := parseRPCPasswordHash(hash.String())
+	if err != nil {
+		t.Fatalf("parseRPCPasswordHash failed: %v", err)
+	}
+	if !parsed.Check("secret") {
+		t.Error("password did not match its hash")
+	}
+	if parsed.Check("Secret") {
+		t.Error("wrong password matched the hash")
+	}
+
+	invalid := []string{
+		"",
+		"secret",
+		"sha256$10$c2FsdA==$aGFzaA==",
+		"pbkdf2-sha256$0$c2FsdA==$aGFzaA==",
+		"pbkdf2-sha256$ten$c2FsdA==$aGFzaA==",
+		"pbkdf2-sha256$10$!$aGFzaA==",
+		"pbkdf2-sha256$10$c2FsdA==$",
+		"pbkdf2-sha256$10$c2FsdA==$aGFzaA==$",
+	}
+	for i, s := range invalid {
+		if _, err := parseRPCPasswordHash(s); err == nil {
+			t.Errorf("for case #%d expected error for %q", i, s)
+		}
+	}
+}
+
+// TestRPCUserPermissions checks that permission groups and individual methods
+// are expanded correctly.
+func TestRPCUserPermissions(t *testing.T) {
+	tests := []struct {
+		permissions []string
+		allowed     []string
+		denied      []string
+	}{
+		{[]string{rpcPermissionAdmin},
+			[]string{rpcHandleSendObject, rpcHandleBanPeer}, nil},
+		{[]string{"send"},
+			[]string{rpcHandleSendObject},
+			[]string{rpcHandleGetIdentity, rpcHandleSubscribeMessages}},
+		{[]string{"subscribe", rpcHandleGetInfo},
+			[]string{rpcHandleSubscribePubkeys, rpcHandleListSubscriptions,
+				rpcHandleGetInfo},
+			[]string{rpcHandleSendObject, rpcHandleGetIdentity}},
+		{rpcLimitedPermissions,
+			[]string{rpcHandleSendObject, rpcHandleGetIdentity,
+				rpcHandleUnsubscribeBroadcasts},
+			[]string{rpcHandleBanScores, rpcHandleAddPeer}},
+		{[]string{"peers"},
+			[]string{rpcHandleBanPeer, rpcHandleGetBanList,
+				rpcHandleAddIPRange, rpcHandleRemoveIPRange},
+			[]string{rpcHandleSendObject, rpcHandleGetInfo}},
+		{[]string{rpcHandleGetBanList},
+			[]string{rpcHandleGetBanList},
+			[]string{rpcHandleAddIPRange, rpcHandleRemoveIPRange}},
+		{nil, nil, []string{rpcHandleSendObject, rpcHandleGetInfo}},
+	}
+
+	for i, test := range tests {
+		u, err := newRPCUser("user", nil, test.permissions)
+		if err != nil {
+			t.Errorf("for case #%d got error %v", i, err)
+			continue
+		}
+		for _, method := range test.allowed {
+			if !u.Allowed(method) {
+				t.Errorf("for case #%d expected %s to be allowed", i, method)
+			}
+		}
+		for _, method := range test.denied {
+			if u.Allowed(method) {
+				t.Errorf("for case #%d expected %s to be denied", i, method)
+			}
+		}
+	}
+
+	if _, err := newRPCUser("user", nil, []string{"everything"}); err == nil {
+		t.Error("expected error for an unknown permission")
+	}
+}
+
+// TestLoadRPCCredentials checks that users are loaded from the command line
+// options and the credentials file.
+func TestLoadRPCCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpcauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := newRPCPasswordHash("sendpass", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "credentials.json")
+	data := `{"users": [{"username": "sender", "password": "` + hash.String() +
+		`", "permissions": ["send"]}]}`
+	if err = ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &Options{
+		RPCUser:        "admin",
+		RPCPass:        "adminpass",
+		RPCCredentials: file,
+	}
+
+	creds, err := loadRPCCredentials(opts)
+	if err != nil {
+		t.Fatalf("loadRPCCredentials failed: %v", err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		method   string
+		success  bool
+	}{
+		{"admin", "adminpass", rpcHandleBanPeer, true},
+		{"admin", "sendpass", "", false},
+		{"sender", "sendpass", rpcHandleSendObject, true},
+		{"sender", "adminpass", "", false},
+		{"nobody", "sendpass", "", false},
+	}
+	for i, test := range tests {
+		u := creds.Authenticate(test.username, test.password)
+		if (u != nil) != test.success {
+			t.Errorf("for case #%d expected success %v", i, test.success)
+			continue
+		}
+		if u != nil && !u.Allowed(test.method) {
+			t.Errorf("for case #%d expected %s to be allowed", i, test.method)
+		}
+	}
+	if u := creds.Authenticate("sender", "sendpass"); u.Allowed(rpcHandleBanPeer) {
+		t.Error("sender is allowed to ban peers")
+	}
+
+	// Unknown users are checked against a hash as slow as the slowest one.
+	if creds.dummy.iterations != rpcPasswordHashIterations {
+		t.Errorf("expected %d iterations for unknown users, got %d",
+			rpcPasswordHashIterations, creds.dummy.iterations)
+	}
+	hash, err = newRPCPasswordHash("slowpass", 2*rpcPasswordHashIterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := newRPCUser("slow", hash, []string{"send"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = creds.add(u); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if creds.dummy.iterations != 2*rpcPasswordHashIterations {
+		t.Errorf("expected %d iterations for unknown users, got %d",
+			2*rpcPasswordHashIterations, creds.dummy.iterations)
+	}
+
+	// A user defined both on the command line and in the file is an error.
+	opts.RPCUser = "sender"
+	if _, err = loadRPCCredentials(opts); err == nil {
+		t.Error("expected error for a duplicate user")
+	}
+	opts.RPCUser = "admin"
+
+	// Malformed files are rejected.
+	if err = ioutil.WriteFile(file, []byte(`{"users": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadRPCCredentials(opts); err == nil {
+		t.Error("expected error for a malformed credentials file")
+	}
+}
+
+// TestRPCCredentialsModified checks that the credentials file is reloaded when
+// it is modified, and that a file which fails to load is not read again until
+// it is modified.
+func TestRPCCredentialsModified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpcauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := newRPCPasswordHash("pass", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "credentials.json")
+	write := func(data string, modTime time.Time) {
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	user := func(name string) string {
+		return `{"users": [{"username": "` + name + `", "password": "` +
+			hash.String() + `", "permissions": ["send"]}]}`
+	}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write(user("first"), start)
+	opts := &Options{RPCCredentials: file}
+	creds, err := loadRPCCredentials(opts)
+	if err != nil {
+		t.Fatalf("loadRPCCredentials failed: %v", err)
+	}
+	s := &rpcServer{server: &server{cfg: opts}, creds: creds}
+
+	// A broken file keeps the old users.
+	write(`{"users": [`, start.Add(time.Minute))
+	if c := s.credentials(); c != creds {
+		t.Error("users changed after loading a broken file")
+	}
+
+	// It is not read again while its modification time stays the same.
+	write(user("second"), start.Add(time.Minute))
+	if c := s.credentials(); c != creds {
+		t.Error("broken file was read again without being modified")
+	}
+
+	write(user("second"), start.Add(2*time.Minute))
+	if _, ok := s.credentials().users["second"]; !ok {
+		t.Error("modified file was not reloaded")
+	}
+}
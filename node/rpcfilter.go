@@ -0,0 +1,160 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/monetas/bmutil"
+	"github.com/monetas/bmutil/identity"
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	// taggedBroadcastVersion is the first version of broadcasts that carry
+	// the tag of the address that sent them.
+	taggedBroadcastVersion = 5
+
+	// taggedAddressVersion is the first version of addresses whose pubkeys
+	// and broadcasts are identified by tag rather than by ripe.
+	taggedAddressVersion = 4
+)
+
+// rpcObjectFilter matches pubkeys and broadcasts against the tags and address
+// ripes that a client is interested in. Objects that cannot be matched without
+// decrypting them, such as untagged broadcasts, always match. A nil filter
+// matches every object.
+type rpcObjectFilter struct {
+	tags  map[wire.ShaHash]struct{}
+	ripes map[[wire.RipeHashSize]byte]struct{}
+}
+
+// Match returns whether the object should be delivered to the client.
+func (f *rpcObjectFilter) Match(obj *wire.MsgObject) bool {
+	if f == nil {
+		return true
+	}
+
+	switch obj.ObjectType {
+	case wire.ObjectTypePubKey:
+		return f.matchPubKey(obj)
+	case wire.ObjectTypeBroadcast:
+		return f.matchBroadcast(obj)
+	default:
+		return true
+	}
+}
+
+// matchPubKey returns whether the pubkey object has one of the tags or belongs
+// to one of the addresses in the filter.
+func (f *rpcObjectFilter) matchPubKey(obj *wire.MsgObject) bool {
+	msg := new(wire.MsgPubKey)
+	if err := msg.Decode(bytes.NewReader(wire.EncodeMessage(obj))); err != nil {
+		return false
+	}
+
+	switch msg.Version {
+	case wire.SimplePubKeyVersion:
+		fallthrough
+	case wire.ExtendedPubKeyVersion:
+		id, err := identity.FromPubKeyMsg(msg)
+		if err != nil { // invalid encryption/signing keys
+			return false
+		}
+		if _, ok := f.ripes[id.Address.Ripe]; ok {
+			return true
+		}
+		tag, err := wire.NewShaHash(id.Address.Tag())
+		if err != nil {
+			return false
+		}
+		_, ok := f.tags[*tag]
+		return ok
+	case wire.EncryptedPubKeyVersion:
+		if msg.Tag == nil {
+			return false
+		}
+		_, ok := f.tags[*msg.Tag]
+		return ok
+	}
+	return false
+}
+
+// matchBroadcast returns whether the broadcast has one of the tags in the
+// filter. Untagged broadcasts always match.
+func (f *rpcObjectFilter) matchBroadcast(obj *wire.MsgObject) bool {
+	msg := new(wire.MsgBroadcast)
+	if err := msg.Decode(bytes.NewReader(wire.EncodeMessage(obj))); err != nil {
+		return false
+	}
+
+	if msg.Version < taggedBroadcastVersion {
+		return true
+	}
+	if msg.Tag == nil {
+		return false
+	}
+	_, ok := f.tags[*msg.Tag]
+	return ok
+}
+
+// newRPCObjectFilter returns a filter for the given base64 encoded tags and
+// ripes. Version 4 pubkeys and version 5 broadcasts carry only a tag, so the
+// tag of the version 4 address in each of the given streams is added for every
+// ripe. nil is returned if both are empty, so that every object matches.
+func newRPCObjectFilter(tags, ripes []string,
+	streams []uint32) (*rpcObjectFilter, error) {
+	if len(tags) == 0 && len(ripes) == 0 {
+		return nil, nil
+	}
+
+	f := &rpcObjectFilter{
+		tags:  make(map[wire.ShaHash]struct{}, len(tags)),
+		ripes: make(map[[wire.RipeHashSize]byte]struct{}, len(ripes)),
+	}
+
+	for _, t := range tags {
+		b, err := base64.StdEncoding.DecodeString(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %s: %v", t, err)
+		}
+		tag, err := wire.NewShaHash(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %s: %v", t, err)
+		}
+		f.tags[*tag] = struct{}{}
+	}
+
+	for _, r := range ripes {
+		b, err := base64.StdEncoding.DecodeString(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ripe %s: %v", r, err)
+		}
+		if len(b) != wire.RipeHashSize {
+			return nil, fmt.Errorf("invalid ripe %s: %d bytes, expected %d",
+				r, len(b), wire.RipeHashSize)
+		}
+		var ripe [wire.RipeHashSize]byte
+		copy(ripe[:], b)
+		f.ripes[ripe] = struct{}{}
+
+		for _, stream := range streams {
+			addr := &bmutil.Address{
+				Version: taggedAddressVersion,
+				Stream:  uint64(stream),
+				Ripe:    ripe,
+			}
+			tag, err := wire.NewShaHash(addr.Tag())
+			if err != nil {
+				return nil, fmt.Errorf("invalid ripe %s: %v", r, err)
+			}
+			f.tags[*tag] = struct{}{}
+		}
+	}
+
+	return f, nil
+}
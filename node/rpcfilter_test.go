@@ -0,0 +1,90 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/monetas/bmutil"
+	"github.com/monetas/bmutil/wire"
+)
+
+// TestRPCObjectFilter checks that pubkeys and broadcasts are matched against
+// the tags in a filter.
+func TestRPCObjectFilter(t *testing.T) {
+	taggedBroadcast := func(tag *wire.ShaHash) *wire.MsgObject {
+		return wire.NewMsgBroadcast(876, expires, taggedBroadcastVersion, 1,
+			tag, []byte{90, 87, 66, 45, 3, 2, 120, 101, 78, 78, 78, 7, 85, 55},
+			1, 1, 2, &pubkey[0], &pubkey[1], 3, 5, &ripehash[0], 1,
+			[]byte{27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40},
+			[]byte{42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55}).
+			ToMsgObject()
+	}
+
+	filter, err := newRPCObjectFilter(
+		[]string{base64.StdEncoding.EncodeToString(shahash[0][:])}, nil, nil)
+	if err != nil {
+		t.Fatalf("newRPCObjectFilter failed: %v", err)
+	}
+
+	tests := []struct {
+		obj   *wire.MsgObject
+		match bool
+	}{
+		{testObj[0], true},                    // getpubkey
+		{testObj[2], true},                    // pubkey with the tag
+		{testObj[3], false},                   // pubkey with another tag
+		{testObj[4], true},                    // msg
+		{testObj[6], true},                    // untagged broadcast
+		{taggedBroadcast(&shahash[0]), true},  // broadcast with the tag
+		{taggedBroadcast(&shahash[1]), false}, // broadcast with another tag
+		{testObj[8], true},                    // unknown object
+	}
+
+	for i, test := range tests {
+		if match := filter.Match(test.obj); match != test.match {
+			t.Errorf("for case #%d expected match %v, got %v", i, test.match,
+				match)
+		}
+
+		// A nil filter matches everything.
+		var nilFilter *rpcObjectFilter
+		if !nilFilter.Match(test.obj) {
+			t.Errorf("for case #%d nil filter did not match", i)
+		}
+	}
+
+	// A ripe matches the tag of the version 4 address in the served streams.
+	addr := &bmutil.Address{Version: taggedAddressVersion, Stream: 1,
+		Ripe: [wire.RipeHashSize]byte(ripehash[0])}
+	addrTag, err := wire.NewShaHash(addr.Tag())
+	if err != nil {
+		t.Fatalf("NewShaHash failed: %v", err)
+	}
+	ripeFilter, err := newRPCObjectFilter(nil,
+		[]string{base64.StdEncoding.EncodeToString(ripehash[0][:])},
+		[]uint32{1})
+	if err != nil {
+		t.Fatalf("newRPCObjectFilter failed: %v", err)
+	}
+	if !ripeFilter.Match(taggedBroadcast(addrTag)) {
+		t.Error("ripe filter did not match a broadcast with the address tag")
+	}
+	if ripeFilter.Match(taggedBroadcast(&shahash[0])) {
+		t.Error("ripe filter matched a broadcast with another tag")
+	}
+
+	// Invalid tags and ripes are rejected.
+	if _, err := newRPCObjectFilter([]string{"AAAA"}, nil, nil); err == nil {
+		t.Error("expected error for a tag of the wrong length")
+	}
+	if _, err := newRPCObjectFilter(nil, []string{"!"}, nil); err == nil {
+		t.Error("expected error for a ripe that is not base64")
+	}
+	if _, err := newRPCObjectFilter(nil, nil, nil); err != nil {
+		t.Errorf("expected no error for an empty filter, got %v", err)
+	}
+}
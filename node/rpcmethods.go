@@ -0,0 +1,659 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/monetas/bmd/database"
+	"github.com/monetas/bmutil"
+	"github.com/monetas/bmutil/wire"
+)
+
+// RPCAuthArgs contains arguments for Authenticate.
+type RPCAuthArgs struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// handleAuth authenticates a websocket client using the supplied username and
+// password. If the supplied authentication does not match any user of the RPC
+// server, an error is returned.
+//
+// The credentials file is reloaded first if it has been modified.
+//
+// The function sets the values of isAuthenticated and username for the client.
+// The methods the client may call are determined by the permissions of the
+// user.
+func (s *rpcServer) handleAuth(client *rpc2.Client, in *RPCAuthArgs, success *bool) error {
+	c := client.State
+
+	user := s.credentials().Authenticate(in.Username, in.Password)
+	if user != nil {
+		c.Set(rpcStateIsAuthenticated, true)
+		c.Set(rpcStateUsername, user.username)
+		*success = true
+		return nil
+	}
+
+	*success = false
+	state := rpcConstructState(client)
+	rpcLog.Warnf("RPC authentication failure from %s.", state.remoteAddr)
+
+	return nil
+}
+
+// objectsSend sends the requested object into the Bitmessage network. in is
+// a base64 representation of the object.
+func (s *rpcServer) sendObject(client *rpc2.Client, in string, counter *uint64) error {
+	if err := s.restrict(client, rpcHandleSendObject); err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(in)
+	if err != nil {
+		return errors.New("base64 decode failed")
+	}
+
+	// Check whether the object is valid.
+	obj, err := wire.DecodeMsgObject(data)
+	if err != nil {
+		return fmt.Errorf("invalid object: %v", err)
+	}
+	now := time.Now()
+	if rej := validateObject(obj, s.server.streams, now); rej != nil {
+		return fmt.Errorf("invalid object: %v", rej)
+	}
+
+	// Check whether the PoW is valid.
+	if rej := checkObjectPoW(obj, now); rej != nil {
+		return fmt.Errorf("invalid object: %v", rej)
+	}
+
+	// Relay object to object manager which will handle insertion and
+	// advertisement.
+	*counter = s.server.objectManager.handleInsert(obj)
+	if *counter == 0 {
+		return errors.New("failed to insert and advertise object")
+	}
+	return nil
+}
+
+// RPCGetIDOut contains the output of GetIdentity.
+type RPCGetIDOut struct {
+	Address            string `json:"address"`
+	NonceTrialsPerByte uint64 `json:"nonceTrialsPerByte"`
+	ExtraBytes         uint64 `json:"extraBytes"`
+	// base64 encoded bytes
+	SigningKey    string `json:"signingKey"`
+	EncryptionKey string `json:"encryptionKey"`
+}
+
+// handleGetId returns the stored public key associated with the given
+// Bitmessage address.
+func (s *rpcServer) getID(client *rpc2.Client, addr string, id *RPCGetIDOut) error {
+	if err := s.restrict(client, rpcHandleGetIdentity); err != nil {
+		return err
+	}
+
+	address, err := bmutil.DecodeAddress(addr)
+	if err != nil {
+		return fmt.Errorf("address decode failed: %v", err)
+	}
+
+	pubID, err := s.server.db.FetchIdentityByAddress(address)
+	if err == database.ErrNonexistentObject {
+		return errors.New("identity not found")
+	} else if err != nil {
+		rpcLog.Errorf("FetchIdentityByAddress, database error: %v", err)
+		return errors.New("database error")
+	}
+	id.Address = addr
+	id.NonceTrialsPerByte = pubID.NonceTrialsPerByte
+	id.ExtraBytes = pubID.ExtraBytes
+	id.EncryptionKey = base64.StdEncoding.EncodeToString(
+		pubID.EncryptionKey.SerializeUncompressed())
+	id.SigningKey = base64.StdEncoding.EncodeToString(
+		pubID.SigningKey.SerializeUncompressed())
+	return nil
+}
+
+// RPCCounters contains the current counter for each type of object.
+type RPCCounters struct {
+	Messages       uint64 `json:"messages"`
+	Broadcasts     uint64 `json:"broadcasts"`
+	Getpubkeys     uint64 `json:"getpubkeys"`
+	Pubkeys        uint64 `json:"pubkeys"`
+	UnknownObjects uint64 `json:"unknownObjects"`
+}
+
+// RPCGetInfoOut contains the output of GetInfo.
+type RPCGetInfoOut struct {
+	Version          string      `json:"version"`
+	Uptime           int64       `json:"uptime"` // In seconds.
+	ProtocolVersion  uint32      `json:"protocolVersion"`
+	Streams          []uint32    `json:"streams"`
+	Listeners        []string    `json:"listeners"`
+	InboundPeers     int         `json:"inboundPeers"`
+	OutboundPeers    int         `json:"outboundPeers"`
+	Counters         RPCCounters `json:"counters"`
+	Objects          uint64      `json:"objects"`
+	Pubkeys          uint64      `json:"pubkeys"`
+	BytesSent        uint64      `json:"bytesSent"`
+	BytesReceived    uint64      `json:"bytesReceived"`
+	RequestedObjects int         `json:"requestedObjects"`
+	VerifyingObjects int         `json:"verifyingObjects"`
+	DroppedObjects   uint64      `json:"droppedObjects"`
+	PrunedObjects    uint64      `json:"prunedObjects"`
+	PrunedBytes      uint64      `json:"prunedBytes"`
+}
+
+// getInfo returns the status of bmd and statistics about its peers and
+// database.
+func (s *rpcServer) getInfo(client *rpc2.Client, _ *struct{},
+	out *RPCGetInfoOut) error {
+	if err := s.restrict(client, rpcHandleGetInfo); err != nil {
+		return err
+	}
+
+	counters := []struct {
+		objType wire.ObjectType
+		counter *uint64
+	}{
+		{wire.ObjectTypeMsg, &out.Counters.Messages},
+		{wire.ObjectTypeBroadcast, &out.Counters.Broadcasts},
+		{wire.ObjectTypeGetPubKey, &out.Counters.Getpubkeys},
+		{wire.ObjectTypePubKey, &out.Counters.Pubkeys},
+		{wire.ObjectType(4), &out.Counters.UnknownObjects},
+	}
+	for _, c := range counters {
+		counter, err := s.server.db.GetCounter(c.objType)
+		if err != nil {
+			rpcLog.Errorf("GetCounter, database error: %v", err)
+			return errors.New("database error")
+		}
+		*c.counter = counter
+	}
+
+	objects, pubkeys, err := s.server.db.CountObjects()
+	if err != nil {
+		rpcLog.Errorf("CountObjects, database error: %v", err)
+		return errors.New("database error")
+	}
+
+	out.Version = Version()
+	out.Uptime = int64(time.Since(s.server.startTime) / time.Second)
+	out.ProtocolVersion = maxProtocolVersion
+	out.Streams = s.server.streams
+	out.Listeners = make([]string, len(s.server.listeners))
+	for i, listener := range s.server.listeners {
+		out.Listeners[i] = listener.Addr().String()
+	}
+
+	stats := s.server.PeerStats()
+	out.InboundPeers = stats.inbound
+	out.OutboundPeers = stats.outbound
+	out.BytesSent = stats.bytesSent
+	out.BytesReceived = stats.bytesReceived
+
+	out.Objects = objects
+	out.Pubkeys = pubkeys
+	out.RequestedObjects, out.VerifyingObjects =
+		s.server.objectManager.PendingObjects()
+	out.DroppedObjects = s.server.objectManager.DroppedObjects()
+	out.PrunedObjects, out.PrunedBytes = s.server.objectManager.PruneStats()
+	return nil
+}
+
+// RPCBanScoreEvent is a penalty given to a peer for misbehaving.
+type RPCBanScoreEvent struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Penalty uint32    `json:"penalty"`
+	Score   uint32    `json:"score"`
+}
+
+// RPCBanScore contains the ban score of a peer and its most recent penalties.
+type RPCBanScore struct {
+	Address   string             `json:"address"`
+	Connected bool               `json:"connected"`
+	Score     uint32             `json:"score"`
+	History   []RPCBanScoreEvent `json:"history"`
+}
+
+// RPCBanScoresOut contains the output of GetBanScores.
+type RPCBanScoresOut struct {
+	Peers []RPCBanScore `json:"peers"`
+}
+
+// getBanScores returns the ban scores of all connected peers and of recently
+// disconnected peers that misbehaved.
+func (s *rpcServer) getBanScores(client *rpc2.Client, _ *struct{},
+	out *RPCBanScoresOut) error {
+	if err := s.restrict(client, rpcHandleBanScores); err != nil {
+		return err
+	}
+
+	scores := s.server.BanScores()
+	out.Peers = make([]RPCBanScore, len(scores))
+	for i, score := range scores {
+		history := make([]RPCBanScoreEvent, len(score.history))
+		for j, e := range score.history {
+			history[j] = RPCBanScoreEvent{
+				Time:    e.Time,
+				Reason:  e.Reason,
+				Penalty: e.Penalty,
+				Score:   e.Score,
+			}
+		}
+		out.Peers[i] = RPCBanScore{
+			Address:   score.addr,
+			Connected: score.connected,
+			Score:     score.score,
+			History:   history,
+		}
+	}
+	return nil
+}
+
+// RPCPeerInfo describes a connected peer.
+type RPCPeerInfo struct {
+	Address           string            `json:"address"`
+	Inbound           bool              `json:"inbound"`
+	Persistent        bool              `json:"persistent"`
+	HandshakeComplete bool              `json:"handshakeComplete"`
+	UserAgent         string            `json:"userAgent"`
+	Services          uint64            `json:"services"`
+	ProtocolVersion   uint32            `json:"protocolVersion"`
+	Streams           []uint32          `json:"streams"`
+	Latency           int64             `json:"latency"` // In milliseconds.
+	BanScore          uint32            `json:"banScore"`
+	BytesSent         uint64            `json:"bytesSent"`
+	BytesReceived     uint64            `json:"bytesReceived"`
+	RejectedObjects   map[string]uint64 `json:"rejectedObjects"` // By reason.
+}
+
+// RPCGetPeersOut contains the output of GetPeers.
+type RPCGetPeersOut struct {
+	Peers []RPCPeerInfo `json:"peers"`
+}
+
+// getPeers returns a description of every connected peer.
+func (s *rpcServer) getPeers(client *rpc2.Client, _ *struct{},
+	out *RPCGetPeersOut) error {
+	if err := s.restrict(client, rpcHandleGetPeers); err != nil {
+		return err
+	}
+
+	peers := s.server.Peers()
+	out.Peers = make([]RPCPeerInfo, len(peers))
+	for i, p := range peers {
+		out.Peers[i] = RPCPeerInfo{
+			Address:           p.addr,
+			Inbound:           p.inbound,
+			Persistent:        p.persistent,
+			HandshakeComplete: p.handshakeComplete,
+			UserAgent:         p.userAgent,
+			Services:          uint64(p.services),
+			ProtocolVersion:   p.protocolVersion,
+			Streams:           p.streams,
+			Latency:           int64(p.latency / time.Millisecond),
+			BanScore:          p.banScore,
+			BytesSent:         p.bytesSent,
+			BytesReceived:     p.bytesReceived,
+			RejectedObjects:   p.rejectedObjects,
+		}
+	}
+	return nil
+}
+
+// RPCAddPeerArgs contains the input for AddPeer.
+type RPCAddPeerArgs struct {
+	Address   string `json:"address"`
+	Stream    uint32 `json:"stream"`
+	Permanent bool   `json:"permanent"`
+}
+
+// addPeer connects to a new peer. If the peer is permanent, bmd reconnects to
+// it whenever the connection is lost.
+func (s *rpcServer) addPeer(client *rpc2.Client, args *RPCAddPeerArgs,
+	_ *struct{}) error {
+	if err := s.restrict(client, rpcHandleAddPeer); err != nil {
+		return err
+	}
+
+	stream := args.Stream
+	if stream == 0 {
+		stream = s.server.streams[0]
+	}
+	if !s.server.hasStream(stream) {
+		return fmt.Errorf("stream %d is not served", stream)
+	}
+	if _, _, err := net.SplitHostPort(args.Address); err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+	return s.server.AddAddr(args.Address, stream, args.Permanent)
+}
+
+// disconnectPeer disconnects the peer with the given address. A permanent peer
+// is removed so that bmd does not reconnect to it.
+func (s *rpcServer) disconnectPeer(client *rpc2.Client, addr string,
+	_ *struct{}) error {
+	if err := s.restrict(client, rpcHandleDisconnectPeer); err != nil {
+		return err
+	}
+	return s.server.DisconnectAddr(addr)
+}
+
+// banPeer bans the given IP address and disconnects all peers from it.
+func (s *rpcServer) banPeer(client *rpc2.Client, ip string, _ *struct{}) error {
+	if err := s.restrict(client, rpcHandleBanPeer); err != nil {
+		return err
+	}
+	return s.server.BanHost(ip)
+}
+
+// unbanPeer lifts the ban of the given IP address.
+func (s *rpcServer) unbanPeer(client *rpc2.Client, ip string, _ *struct{}) error {
+	if err := s.restrict(client, rpcHandleUnbanPeer); err != nil {
+		return err
+	}
+	return s.server.UnbanHost(ip)
+}
+
+// RPCBan is a banned IP address and the end of its ban.
+type RPCBan struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// RPCGetBanListOut contains the output of GetBanList.
+type RPCGetBanListOut struct {
+	Bans  []RPCBan `json:"bans"`
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// getBanList returns the banned IP addresses, sorted by address, and the IP
+// ranges in the allow and deny lists.
+func (s *rpcServer) getBanList(client *rpc2.Client, _ *struct{},
+	out *RPCGetBanListOut) error {
+	if err := s.restrict(client, rpcHandleGetBanList); err != nil {
+		return err
+	}
+
+	bans := s.server.Bans()
+	out.Bans = make([]RPCBan, 0, len(bans))
+	for host, until := range bans {
+		out.Bans = append(out.Bans, RPCBan{IP: host, Until: until})
+	}
+	sort.Sort(rpcBansByIP(out.Bans))
+	out.Allow = s.server.allowList.Ranges()
+	out.Deny = s.server.denyList.Ranges()
+	return nil
+}
+
+// rpcBansByIP sorts bans by IP address.
+type rpcBansByIP []RPCBan
+
+func (b rpcBansByIP) Len() int           { return len(b) }
+func (b rpcBansByIP) Less(i, j int) bool { return b[i].IP < b[j].IP }
+func (b rpcBansByIP) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// RPCIPRangeArgs contains the input for AddIPRange and RemoveIPRange. List is
+// "allow" or "deny", and Range an IP address or CIDR range.
+type RPCIPRangeArgs struct {
+	List  string `json:"list"`
+	Range string `json:"range"`
+}
+
+// addIPRange adds an IP address or CIDR range to the allow or deny list. Peers
+// in a range added to the deny list are disconnected.
+func (s *rpcServer) addIPRange(client *rpc2.Client, args *RPCIPRangeArgs,
+	_ *struct{}) error {
+	if err := s.restrict(client, rpcHandleAddIPRange); err != nil {
+		return err
+	}
+	return s.server.AddIPRange(args.List, args.Range)
+}
+
+// removeIPRange removes an IP address or CIDR range from the allow or deny
+// list.
+func (s *rpcServer) removeIPRange(client *rpc2.Client, args *RPCIPRangeArgs,
+	_ *struct{}) error {
+	if err := s.restrict(client, rpcHandleRemoveIPRange); err != nil {
+		return err
+	}
+	return s.server.RemoveIPRange(args.List, args.Range)
+}
+
+// RPCSubscribeArgs contains the input for Subscribe methods. Tags and Ripes
+// are base64 encoded and may only be given when subscribing to pubkeys or
+// broadcasts, in which case only objects matching one of them are sent.
+type RPCSubscribeArgs struct {
+	FromCounter uint64   `json:"fromCounter"`
+	Tags        []string `json:"tags,omitempty"`
+	Ripes       []string `json:"ripes,omitempty"`
+}
+
+// rpcUnknownObjType is the object type under which subscriptions to unknown
+// objects are tracked.
+// XXX just a hack
+const rpcUnknownObjType = wire.ObjectType(999999)
+
+// RPCReceiveArgs contains the input for Receive methods on the client side.
+type RPCReceiveArgs struct {
+	Object  string `json:"object"`
+	Counter uint64 `json:"counter"`
+}
+
+// RPCExpiredArgs contains the input for Expired methods on the client side.
+type RPCExpiredArgs struct {
+	Counters []uint64 `json:"counters"`
+}
+
+// subscribeMessages subscribes the client to receiving objects of type message
+// as soon as they are received by bmd. On the client side, ReceiveMessage RPC
+// method is called.
+func (s *rpcServer) subscribeMessages(client *rpc2.Client, args *RPCSubscribeArgs,
+	_ *struct{}) error {
+	return s.handleSubscribe(client, rpcHandleSubscribeMessages,
+		wire.ObjectTypeMsg, args, rpcEvtNewMessage, rpcClientHandleMessage,
+		rpcEvtExpiredMessage, rpcClientHandleExpiredMessage)
+}
+
+// subscribeBroadcasts subscribes the client to receiving objects of type
+// broadcast as soon as they are received by bmd. On the client side,
+// ReceiveBroadcast RPC method is called.
+func (s *rpcServer) subscribeBroadcasts(client *rpc2.Client, args *RPCSubscribeArgs,
+	_ *struct{}) error {
+	return s.handleSubscribe(client, rpcHandleSubscribeBroadcasts,
+		wire.ObjectTypeBroadcast, args, rpcEvtNewBroadcast,
+		rpcClientHandleBroadcast, rpcEvtExpiredBroadcast,
+		rpcClientHandleExpiredBroadcast)
+}
+
+// subscribeGetpubkeys subscribes the client to receiving objects of type
+// getpubkey as soon as they are received by bmd. On the client side,
+// ReceiveGetpubkey RPC method is called.
+func (s *rpcServer) subscribeGetpubkeys(client *rpc2.Client, args *RPCSubscribeArgs,
+	_ *struct{}) error {
+	return s.handleSubscribe(client, rpcHandleSubscribeGetpubkeys,
+		wire.ObjectTypeGetPubKey, args, rpcEvtNewGetpubkey,
+		rpcClientHandleGetpubkey, rpcEvtExpiredGetpubkey,
+		rpcClientHandleExpiredGetpubkey)
+}
+
+// subscribePubkeys subscribes the client to receiving objects of type
+// pubkey as soon as they are received by bmd. On the client side,
+// ReceivePubkey RPC method is called.
+func (s *rpcServer) subscribePubkeys(client *rpc2.Client, args *RPCSubscribeArgs,
+	_ *struct{}) error {
+	return s.handleSubscribe(client, rpcHandleSubscribePubkeys,
+		wire.ObjectTypePubKey, args, rpcEvtNewPubkey, rpcClientHandlePubkey,
+		rpcEvtExpiredPubkey, rpcClientHandleExpiredPubkey)
+}
+
+// subscribeUnknownObjects subscribes the client to receiving objects of unknown
+// type as soon as they are received by bmd. On the client side,
+// ReceiveUnknownObject RPC method is called.
+func (s *rpcServer) subscribeUnknownObjects(client *rpc2.Client, args *RPCSubscribeArgs,
+	_ *struct{}) error {
+	return s.handleSubscribe(client, rpcHandleSubscribeUnknownObjs,
+		rpcUnknownObjType, args, rpcEvtNewUnknownObj, rpcClientHandleUnknownObj,
+		rpcEvtExpiredUnknownObj, rpcClientHandleExpiredUnknownObj)
+}
+
+// handleSubscribe subscribes the client to new objects of the given type, sent
+// to clientHandler, and to the counters of those that expire, sent to
+// expiredHandler. Objects already in the database starting from the requested
+// counter are sent as well.
+func (s *rpcServer) handleSubscribe(client *rpc2.Client, method string,
+	objType wire.ObjectType, args *RPCSubscribeArgs, evt string,
+	clientHandler string, expiredEvt string, expiredHandler string) error {
+	// Make sure only permitted users can subscribe to objects.
+	if err := s.restrict(client, method); err != nil {
+		return err
+	}
+	state := rpcConstructState(client)
+
+	filter, err := newRPCObjectFilter(args.Tags, args.Ripes,
+		s.server.streams)
+	if err != nil {
+		return err
+	}
+	if filter != nil && objType != wire.ObjectTypePubKey &&
+		objType != wire.ObjectTypeBroadcast {
+		return errors.New("filters are only supported for pubkeys and broadcasts")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subscriber, ok := s.clients[client]
+	if !ok {
+		return errors.New("client not connected")
+	}
+
+	// Objects already in the database are replayed from the requested counter
+	// before new objects are sent. Listeners are only added for a new
+	// subscription so that the client does not receive the same object more
+	// than once.
+	sub, isNew := subscriber.subscribe(objType, clientHandler, filter,
+		args.FromCounter)
+	if isNew {
+		s.evtMgr.On(evt, func(out *rpcObjectEvent) {
+			subscriber.NotifyObject(sub, out)
+		}, state.eventsID)
+
+		s.evtMgr.On(expiredEvt, func(out *RPCExpiredArgs) {
+			subscriber.NotifyExpired(expiredHandler, out)
+		}, state.eventsID)
+	}
+	return nil
+}
+
+// unsubscribeMessages stops sending new and expired messages to the client.
+func (s *rpcServer) unsubscribeMessages(client *rpc2.Client, _ *struct{},
+	_ *struct{}) error {
+	return s.handleUnsubscribe(client, rpcHandleUnsubscribeMessages,
+		wire.ObjectTypeMsg, rpcEvtNewMessage, rpcEvtExpiredMessage)
+}
+
+// unsubscribeBroadcasts stops sending new and expired broadcasts to the client.
+func (s *rpcServer) unsubscribeBroadcasts(client *rpc2.Client, _ *struct{},
+	_ *struct{}) error {
+	return s.handleUnsubscribe(client, rpcHandleUnsubscribeBroadcasts,
+		wire.ObjectTypeBroadcast, rpcEvtNewBroadcast, rpcEvtExpiredBroadcast)
+}
+
+// unsubscribeGetpubkeys stops sending new and expired getpubkey requests to
+// the client.
+func (s *rpcServer) unsubscribeGetpubkeys(client *rpc2.Client, _ *struct{},
+	_ *struct{}) error {
+	return s.handleUnsubscribe(client, rpcHandleUnsubscribeGetpubkeys,
+		wire.ObjectTypeGetPubKey, rpcEvtNewGetpubkey, rpcEvtExpiredGetpubkey)
+}
+
+// unsubscribePubkeys stops sending new and expired pubkeys to the client.
+func (s *rpcServer) unsubscribePubkeys(client *rpc2.Client, _ *struct{},
+	_ *struct{}) error {
+	return s.handleUnsubscribe(client, rpcHandleUnsubscribePubkeys,
+		wire.ObjectTypePubKey, rpcEvtNewPubkey, rpcEvtExpiredPubkey)
+}
+
+// unsubscribeUnknownObjects stops sending new and expired objects of unknown
+// type to the client.
+func (s *rpcServer) unsubscribeUnknownObjects(client *rpc2.Client, _ *struct{},
+	_ *struct{}) error {
+	return s.handleUnsubscribe(client, rpcHandleUnsubscribeUnknownObjs,
+		rpcUnknownObjType, rpcEvtNewUnknownObj, rpcEvtExpiredUnknownObj)
+}
+
+// handleUnsubscribe removes the listeners for evt and expiredEvt that were
+// added when the client subscribed to objects of the given type. An error is
+// returned if the client is not subscribed.
+func (s *rpcServer) handleUnsubscribe(client *rpc2.Client, method string,
+	objType wire.ObjectType, evt string, expiredEvt string) error {
+	if err := s.restrict(client, method); err != nil {
+		return err
+	}
+	state := rpcConstructState(client)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subscriber, ok := s.clients[client]
+	if !ok || !subscriber.unsubscribe(objType) {
+		return errors.New("not subscribed")
+	}
+	s.evtMgr.RemoveListener(evt, state.eventsID)
+	s.evtMgr.RemoveListener(expiredEvt, state.eventsID)
+	return nil
+}
+
+// RPCListSubscriptionsOut contains the output of ListSubscriptions.
+type RPCListSubscriptionsOut struct {
+	Subscriptions []string `json:"subscriptions"`
+}
+
+// listSubscriptions returns the kinds of objects that the client is subscribed
+// to, named as in the Subscribe methods.
+func (s *rpcServer) listSubscriptions(client *rpc2.Client, _ *struct{},
+	out *RPCListSubscriptionsOut) error {
+	if err := s.restrict(client, rpcHandleListSubscriptions); err != nil {
+		return err
+	}
+
+	names := []struct {
+		objType wire.ObjectType
+		method  string
+	}{
+		{wire.ObjectTypeMsg, rpcHandleSubscribeMessages},
+		{wire.ObjectTypeBroadcast, rpcHandleSubscribeBroadcasts},
+		{wire.ObjectTypeGetPubKey, rpcHandleSubscribeGetpubkeys},
+		{wire.ObjectTypePubKey, rpcHandleSubscribePubkeys},
+		{rpcUnknownObjType, rpcHandleSubscribeUnknownObjs},
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	subscriber, ok := s.clients[client]
+	out.Subscriptions = make([]string, 0, len(names))
+	for _, name := range names {
+		if ok && subscriber.subscribed(name.objType) {
+			out.Subscriptions = append(out.Subscriptions,
+				strings.TrimPrefix(name.method, rpcSubscribePrefix))
+		}
+	}
+	return nil
+}
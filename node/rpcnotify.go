@@ -0,0 +1,414 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/base64"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/monetas/bmd/database"
+	"github.com/monetas/bmutil/wire"
+)
+
+// rpcReplayPollInterval is how often a replay checks whether there is room for
+// more objects in the queue of the subscriber.
+const rpcReplayPollInterval = time.Millisecond * 10
+
+// rpcDelivery is a call to a method on the client side that is waiting to be
+// made.
+type rpcDelivery struct {
+	method string
+	args   interface{}
+}
+
+// rpcObjectEvent is emitted for each new object. The object is included so
+// that subscribers can filter it.
+type rpcObjectEvent struct {
+	object *wire.MsgObject
+	args   *RPCReceiveArgs
+}
+
+// rpcSubscription keeps track of the objects of one type that are sent to a
+// client. Objects already in the database are replayed first. Until the replay
+// has caught up, new objects are left to the replay, which finds them in the
+// database; afterwards they are sent as they arrive, skipping those the replay
+// has already sent.
+type rpcSubscription struct {
+	mtx           sync.Mutex
+	objType       wire.ObjectType
+	clientHandler string
+	filter        *rpcObjectFilter
+	replaying     bool
+	replayEnd     uint64        // highest counter sent by the replay.
+	replayStop    chan struct{} // closed to stop the current replay.
+}
+
+// rpcSubscriber delivers the objects a client is subscribed to. Calls to the
+// client are queued and at most maxInFlight of them are made at a time, so
+// that a slow client does not hold up notifications to other clients. A
+// client whose queue fills up is disconnected. Replays wait for room in the
+// queue and leave the last rpcCounterObjectsSize places to new objects and to
+// the last batch of a replay.
+type rpcSubscriber struct {
+	client        *rpc2.Client
+	remoteAddr    string
+	db            database.Db
+	mtx           sync.Mutex
+	subscriptions map[wire.ObjectType]*rpcSubscription
+	replayMtx     sync.Mutex // held while a replay switches over.
+	queue         chan *rpcDelivery
+	maxInFlight   int
+	started       int32
+	shutdown      int32
+	disconnected  int32
+	wg            sync.WaitGroup
+	quit          chan struct{}
+}
+
+// deliverHandler makes the queued calls to the client. It must be run as a
+// goroutine.
+func (s *rpcSubscriber) deliverHandler() {
+	defer s.wg.Done()
+
+	done := make(chan *rpc2.Call, s.maxInFlight)
+	inFlight := 0
+
+	for {
+		// Stop taking calls off the queue while too many are in flight.
+		queue := s.queue
+		if inFlight >= s.maxInFlight {
+			queue = nil
+		}
+
+		select {
+		case d := <-queue:
+			s.client.Go(d.method, d.args, nil, done)
+			inFlight++
+
+		case call := <-done:
+			inFlight--
+			if call.Error != nil {
+				rpcLog.Infof("failed to call %s on client %s: %v",
+					call.Method, s.remoteAddr, call.Error)
+				s.disconnect()
+			}
+
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// disconnect closes the connection to the client. The subscriber is stopped
+// once the RPC server is notified of the disconnection.
+func (s *rpcSubscriber) disconnect() {
+	if atomic.AddInt32(&s.disconnected, 1) != 1 {
+		return
+	}
+	go s.client.Close()
+}
+
+// enqueue queues a call to the client without blocking. If the queue is full,
+// the client has fallen too far behind and is disconnected.
+func (s *rpcSubscriber) enqueue(d *rpcDelivery) bool {
+	select {
+	case s.queue <- d:
+		return true
+	default:
+		rpcLog.Warnf("Client %s fell too far behind, disconnecting.",
+			s.remoteAddr)
+		s.disconnect()
+		return false
+	}
+}
+
+// enqueueWait queues a call to the client, waiting for room in the queue. It
+// returns false if stop is closed or the subscriber is stopped first.
+func (s *rpcSubscriber) enqueueWait(d *rpcDelivery, stop chan struct{}) bool {
+	select {
+	case s.queue <- d:
+		return true
+	case <-stop:
+		return false
+	case <-s.quit:
+		return false
+	}
+}
+
+// waitForRoom waits until there are at least n free places in the queue. It
+// returns false if stop is closed or the subscriber is stopped first.
+func (s *rpcSubscriber) waitForRoom(n int, stop chan struct{}) bool {
+	for cap(s.queue)-len(s.queue) < n {
+		select {
+		case <-time.After(rpcReplayPollInterval):
+		case <-stop:
+			return false
+		case <-s.quit:
+			return false
+		}
+	}
+	return true
+}
+
+// fetchObjects fetches up to rpcCounterObjectsSize objects of the subscribed
+// type starting from the given counter. It returns the deliveries for those
+// that match the filter of the subscription, in counter order, along with the
+// highest counter fetched and whether a full batch was fetched.
+func (s *rpcSubscriber) fetchObjects(sub *rpcSubscription,
+	filter *rpcObjectFilter, from uint64) ([]*rpcDelivery, uint64, bool, error) {
+	objs, _, err := s.db.FetchObjectsFromCounter(sub.objType, from,
+		rpcCounterObjectsSize)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	counters := make([]uint64, 0, len(objs))
+	for counter := range objs {
+		counters = append(counters, counter)
+	}
+	sort.Sort(counterSlice(counters))
+
+	var last uint64
+	deliveries := make([]*rpcDelivery, 0, len(counters))
+	for _, counter := range counters {
+		last = counter
+		if !filter.Match(objs[counter]) {
+			continue
+		}
+		deliveries = append(deliveries, &rpcDelivery{
+			method: sub.clientHandler,
+			args: &RPCReceiveArgs{
+				Object: base64.StdEncoding.EncodeToString(
+					wire.EncodeMessage(objs[counter])),
+				Counter: counter,
+			},
+		})
+	}
+	return deliveries, last, len(objs) == rpcCounterObjectsSize, nil
+}
+
+// replay sends the objects of the subscribed type that are already in the
+// database, starting from the given counter, and then switches the
+// subscription over to new objects. It must be run as a goroutine.
+func (s *rpcSubscriber) replay(sub *rpcSubscription, filter *rpcObjectFilter,
+	from uint64, stop chan struct{}) {
+	defer s.wg.Done()
+
+	for {
+		for {
+			deliveries, last, full, err := s.fetchObjects(sub, filter, from)
+			if err != nil {
+				rpcLog.Errorf("FetchObjectsFromCounter, database error: %v", err)
+				s.disconnect()
+				return
+			}
+			if !full {
+				break
+			}
+
+			for _, d := range deliveries {
+				if !s.waitForRoom(rpcCounterObjectsSize+1, stop) ||
+					!s.enqueueWait(d, stop) {
+					return
+				}
+			}
+			from = last + 1
+		}
+
+		var more bool
+		if from, more = s.switchOver(sub, filter, from, stop); !more {
+			return
+		}
+	}
+}
+
+// switchOver sends the few objects left to replay, starting from the given
+// counter, and switches the subscription over to new objects. The objects are
+// fetched while holding the lock of the subscription so that no new object is
+// missed. If a whole batch was fetched because many new objects arrived in the
+// meantime, the subscription is not switched over, and switchOver returns the
+// counter from which to continue the replay and true.
+func (s *rpcSubscriber) switchOver(sub *rpcSubscription,
+	filter *rpcObjectFilter, from uint64, stop chan struct{}) (uint64, bool) {
+	// Wait for room for a whole batch, which only one replay at a time may
+	// use.
+	s.replayMtx.Lock()
+	defer s.replayMtx.Unlock()
+	if !s.waitForRoom(rpcCounterObjectsSize, stop) {
+		return 0, false
+	}
+
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+
+	select {
+	case <-stop:
+		return 0, false
+	default:
+	}
+
+	deliveries, last, full, err := s.fetchObjects(sub, filter, from)
+	if err != nil {
+		rpcLog.Errorf("FetchObjectsFromCounter, database error: %v", err)
+		s.disconnect()
+		return 0, false
+	}
+	for _, d := range deliveries {
+		if !s.enqueue(d) {
+			return 0, false
+		}
+	}
+	if full {
+		return last + 1, true
+	}
+
+	sub.replaying = false
+	if last > sub.replayEnd {
+		sub.replayEnd = last
+	}
+	return 0, false
+}
+
+// subscribe subscribes the client to objects of the given type that match the
+// filter, replaying those in the database starting from fromCounter. It returns
+// the subscription and whether it is new. Subscribing again replaces the filter
+// and restarts the replay from the new counter.
+func (s *rpcSubscriber) subscribe(objType wire.ObjectType, clientHandler string,
+	filter *rpcObjectFilter, fromCounter uint64) (*rpcSubscription, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sub, ok := s.subscriptions[objType]
+	if !ok {
+		sub = &rpcSubscription{
+			objType:       objType,
+			clientHandler: clientHandler,
+		}
+		s.subscriptions[objType] = sub
+	}
+
+	// The subscriber may be stopped if the client has just disconnected.
+	if atomic.LoadInt32(&s.shutdown) != 0 {
+		return sub, !ok
+	}
+
+	sub.mtx.Lock()
+	if sub.replaying {
+		close(sub.replayStop)
+	}
+	stop := make(chan struct{})
+	sub.filter = filter
+	sub.replaying = true
+	sub.replayEnd = 0
+	sub.replayStop = stop
+	sub.mtx.Unlock()
+
+	s.wg.Add(1)
+	go s.replay(sub, filter, fromCounter, stop)
+
+	return sub, !ok
+}
+
+// unsubscribe removes the subscription to objects of the given type. It returns
+// false if the client is not subscribed.
+func (s *rpcSubscriber) unsubscribe(objType wire.ObjectType) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sub, ok := s.subscriptions[objType]
+	if !ok {
+		return false
+	}
+	delete(s.subscriptions, objType)
+
+	sub.mtx.Lock()
+	if sub.replaying {
+		close(sub.replayStop)
+		sub.replaying = false
+	}
+	sub.mtx.Unlock()
+	return true
+}
+
+// subscribed returns whether the client is subscribed to objects of the given
+// type.
+func (s *rpcSubscriber) subscribed(objType wire.ObjectType) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, ok := s.subscriptions[objType]
+	return ok
+}
+
+// NotifyObject queues a new object for the client if it matches the filter of
+// the subscription, unless the replay has sent or will send it.
+func (s *rpcSubscriber) NotifyObject(sub *rpcSubscription, evt *rpcObjectEvent) {
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+
+	if sub.replaying || evt.args.Counter <= sub.replayEnd ||
+		!sub.filter.Match(evt.object) {
+		return
+	}
+	s.enqueue(&rpcDelivery{method: sub.clientHandler, args: evt.args})
+}
+
+// NotifyExpired queues the counters of expired objects for the client.
+func (s *rpcSubscriber) NotifyExpired(expiredHandler string,
+	out *RPCExpiredArgs) {
+	s.enqueue(&rpcDelivery{method: expiredHandler, args: out})
+}
+
+// Start starts delivering calls to the client.
+func (s *rpcSubscriber) Start() {
+	// Already started?
+	if atomic.AddInt32(&s.started, 1) != 1 {
+		return
+	}
+
+	s.wg.Add(1)
+	go s.deliverHandler()
+}
+
+// Stop stops delivering calls to the client and waits for any replays to
+// finish. Calls that are still queued are discarded.
+func (s *rpcSubscriber) Stop() {
+	if atomic.AddInt32(&s.shutdown, 1) != 1 {
+		return
+	}
+
+	// Hold the lock so that no replay is started while stopping.
+	s.mtx.Lock()
+	close(s.quit)
+	s.mtx.Unlock()
+	s.wg.Wait()
+}
+
+// newRPCSubscriber returns a new subscriber for the given client which queues
+// at most queueSize calls and makes at most maxInFlight calls at a time. Use
+// Start to begin delivering calls.
+func newRPCSubscriber(client *rpc2.Client, remoteAddr string, db database.Db,
+	queueSize, maxInFlight int) *rpcSubscriber {
+	return &rpcSubscriber{
+		client:        client,
+		remoteAddr:    remoteAddr,
+		db:            db,
+		subscriptions: make(map[wire.ObjectType]*rpcSubscription),
+		queue:         make(chan *rpcDelivery, queueSize),
+		maxInFlight:   maxInFlight,
+		quit:          make(chan struct{}),
+	}
+}
+
+// counterSlice implements sort.Interface to sort counters in ascending order.
+type counterSlice []uint64
+
+func (c counterSlice) Len() int           { return len(c) }
+func (c counterSlice) Less(i, j int) bool { return c[i] < c[j] }
+func (c counterSlice) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
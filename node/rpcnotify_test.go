@@ -0,0 +1,205 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+	"github.com/monetas/bmutil/wire"
+)
+
+// TestRPCSubscriberReplay checks that objects replayed from the database and
+// new objects inserted during the replay are each delivered exactly once.
+func TestRPCSubscriberReplay(t *testing.T) {
+	db := getMemDb([]*wire.MsgObject{})
+	insert := func(nonce int) (*wire.MsgObject, uint64) {
+		obj := wire.NewMsgUnknownObject(uint64(nonce), time.Now().Add(time.Hour),
+			wire.ObjectType(4), 1, 1, []byte{1, 2, 3}).ToMsgObject()
+		counter, err := db.InsertObject(obj)
+		if err != nil {
+			t.Fatalf("InsertObject failed: %v", err)
+		}
+		return obj, counter
+	}
+
+	// More objects than the queue holds are in the database before
+	// subscribing.
+	queueSize := MinRPCQueueSize
+	old := queueSize*3 + 10
+	total := old + 50
+	for i := 0; i < old; i++ {
+		insert(i)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	client := rpc2.NewClientWithCodec(jsonrpc.NewJSONCodec(serverConn))
+	remote := rpc2.NewClientWithCodec(jsonrpc.NewJSONCodec(clientConn))
+	received := make(chan uint64, total*2)
+	remote.Handle(rpcClientHandleUnknownObj, func(_ *rpc2.Client,
+		args *RPCReceiveArgs, _ *struct{}) error {
+		received <- args.Counter
+		return nil
+	})
+	expired := make(chan struct{}, total)
+	remote.Handle(rpcClientHandleExpiredMessage, func(_ *rpc2.Client,
+		args *RPCExpiredArgs, _ *struct{}) error {
+		expired <- struct{}{}
+		return nil
+	})
+	go client.Run()
+	go remote.Run()
+	defer remote.Close()
+	defer client.Close()
+
+	s := newRPCSubscriber(client, "pipe", db, queueSize, 4)
+	s.Start()
+	defer s.Stop()
+
+	sub, isNew := s.subscribe(rpcUnknownObjType, rpcClientHandleUnknownObj, nil,
+		1)
+	if !isNew {
+		t.Error("expected a new subscription")
+	}
+
+	// Insert new objects while the replay is running and notify the
+	// subscriber the way the RPC server does. Notifications for other
+	// subscriptions are queued at the same time.
+	for i := old; i < total; i++ {
+		obj, counter := insert(i)
+		s.NotifyObject(sub, &rpcObjectEvent{
+			object: obj,
+			args:   &RPCReceiveArgs{Counter: counter},
+		})
+		s.NotifyExpired(rpcClientHandleExpiredMessage,
+			&RPCExpiredArgs{Counters: []uint64{uint64(i)}})
+	}
+
+	seen := make(map[uint64]bool)
+	for len(seen) < total {
+		select {
+		case counter := <-received:
+			if seen[counter] {
+				t.Fatalf("counter %d was delivered twice", counter)
+			}
+			seen[counter] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out after receiving %d of %d objects", len(seen),
+				total)
+		}
+	}
+	for counter := uint64(1); counter <= uint64(total); counter++ {
+		if !seen[counter] {
+			t.Errorf("counter %d was not delivered", counter)
+		}
+	}
+
+	select {
+	case counter := <-received:
+		t.Errorf("counter %d was delivered twice", counter)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// The client kept up, so it was not disconnected.
+	for i := old; i < total; i++ {
+		select {
+		case <-expired:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out after receiving %d of %d expired "+
+				"notifications", i-old, total-old)
+		}
+	}
+	if atomic.LoadInt32(&s.disconnected) != 0 {
+		t.Error("client was disconnected")
+	}
+}
+
+// TestRPCSubscriberSwitchOver checks that a replay which is held up by a slow
+// client before switching over to new objects still delivers every object
+// inserted in the meantime, even if they are more than a batch.
+func TestRPCSubscriberSwitchOver(t *testing.T) {
+	db := getMemDb([]*wire.MsgObject{})
+	insert := func(nonce int) (*wire.MsgObject, uint64) {
+		obj := wire.NewMsgUnknownObject(uint64(nonce), time.Now().Add(time.Hour),
+			wire.ObjectType(4), 1, 1, []byte{1, 2, 3}).ToMsgObject()
+		counter, err := db.InsertObject(obj)
+		if err != nil {
+			t.Fatalf("InsertObject failed: %v", err)
+		}
+		return obj, counter
+	}
+
+	old := 5
+	total := old + 2*rpcCounterObjectsSize + 10
+	for i := 0; i < old; i++ {
+		insert(i)
+	}
+
+	// The client does not answer any call until release is closed.
+	serverConn, clientConn := net.Pipe()
+	client := rpc2.NewClientWithCodec(jsonrpc.NewJSONCodec(serverConn))
+	remote := rpc2.NewClientWithCodec(jsonrpc.NewJSONCodec(clientConn))
+	release := make(chan struct{})
+	received := make(chan uint64, total*2)
+	remote.Handle(rpcClientHandleUnknownObj, func(_ *rpc2.Client,
+		args *RPCReceiveArgs, _ *struct{}) error {
+		<-release
+		received <- args.Counter
+		return nil
+	})
+	remote.Handle(rpcClientHandleExpiredMessage, func(_ *rpc2.Client,
+		args *RPCExpiredArgs, _ *struct{}) error {
+		<-release
+		return nil
+	})
+	go client.Run()
+	go remote.Run()
+	defer remote.Close()
+	defer client.Close()
+
+	queueSize := MinRPCQueueSize
+	s := newRPCSubscriber(client, "pipe", db, queueSize, 1)
+	s.Start()
+	defer s.Stop()
+
+	// Fill the queue so far that the replay has to wait for room before it
+	// switches over.
+	for i := 0; i < queueSize-rpcCounterObjectsSize/2; i++ {
+		s.NotifyExpired(rpcClientHandleExpiredMessage,
+			&RPCExpiredArgs{Counters: []uint64{uint64(i)}})
+	}
+	sub, _ := s.subscribe(rpcUnknownObjType, rpcClientHandleUnknownObj, nil, 1)
+	time.Sleep(time.Millisecond * 50)
+
+	for i := old; i < total; i++ {
+		obj, counter := insert(i)
+		s.NotifyObject(sub, &rpcObjectEvent{
+			object: obj,
+			args:   &RPCReceiveArgs{Counter: counter},
+		})
+	}
+	close(release)
+
+	seen := make(map[uint64]bool)
+	for len(seen) < total {
+		select {
+		case counter := <-received:
+			if seen[counter] {
+				t.Fatalf("counter %d was delivered twice", counter)
+			}
+			seen[counter] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out after receiving %d of %d objects", len(seen),
+				total)
+		}
+	}
+	if atomic.LoadInt32(&s.disconnected) != 0 {
+		t.Error("client was disconnected")
+	}
+}
@@ -5,13 +5,13 @@
 // Use of this source code is governed by an ISC
 // license that can be found in the LICENSE file.
 
-package main
+package node
 
 import (
-	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	prand "math/rand"
 	"net"
@@ -49,10 +49,27 @@ const (
 	rpcEvtNewPubkey     = "newPubkey"
 	rpcEvtNewUnknownObj = "newUnknownObject"
 
+	// RPC server local expired object event handlers.
+	rpcEvtExpiredMessage    = "expiredMessage"
+	rpcEvtExpiredBroadcast  = "expiredBroadcast"
+	rpcEvtExpiredGetpubkey  = "expiredGetpubkey"
+	rpcEvtExpiredPubkey     = "expiredPubkey"
+	rpcEvtExpiredUnknownObj = "expiredUnknownObject"
+
 	// Methods defined on RPC server
-	rpcHandleAuth        = "Authenticate"
-	rpcHandleSendObject  = "SendObject"
-	rpcHandleGetIdentity = "GetIdentity"
+	rpcHandleAuth           = "Authenticate"
+	rpcHandleSendObject     = "SendObject"
+	rpcHandleGetIdentity    = "GetIdentity"
+	rpcHandleGetInfo        = "GetInfo"
+	rpcHandleBanScores      = "GetBanScores"
+	rpcHandleGetPeers       = "GetPeers"
+	rpcHandleAddPeer        = "AddPeer"
+	rpcHandleDisconnectPeer = "DisconnectPeer"
+	rpcHandleBanPeer        = "BanPeer"
+	rpcHandleUnbanPeer      = "UnbanPeer"
+	rpcHandleGetBanList     = "GetBanList"
+	rpcHandleAddIPRange     = "AddIPRange"
+	rpcHandleRemoveIPRange  = "RemoveIPRange"
 
 	rpcSubscribePrefix            = "Subscribe"
 	rpcHandleSubscribeMessages    = rpcSubscribePrefix + "Messages"
@@ -61,6 +78,14 @@ const (
 	rpcHandleSubscribePubkeys     = rpcSubscribePrefix + "Pubkeys"
 	rpcHandleSubscribeUnknownObjs = rpcSubscribePrefix + "UnknownObjects"
 
+	rpcUnsubscribePrefix            = "Unsubscribe"
+	rpcHandleUnsubscribeMessages    = rpcUnsubscribePrefix + "Messages"
+	rpcHandleUnsubscribeBroadcasts  = rpcUnsubscribePrefix + "Broadcasts"
+	rpcHandleUnsubscribeGetpubkeys  = rpcUnsubscribePrefix + "Getpubkeys"
+	rpcHandleUnsubscribePubkeys     = rpcUnsubscribePrefix + "Pubkeys"
+	rpcHandleUnsubscribeUnknownObjs = rpcUnsubscribePrefix + "UnknownObjects"
+	rpcHandleListSubscriptions      = "ListSubscriptions"
+
 	// Methods defined on RPC client
 	rpcClientObjectHandlePrefix = "Receive"
 	rpcClientHandleMessage      = rpcClientObjectHandlePrefix + "Message"
@@ -69,10 +94,17 @@ const (
 	rpcClientHandlePubkey       = rpcClientObjectHandlePrefix + "Pubkey"
 	rpcClientHandleUnknownObj   = rpcClientObjectHandlePrefix + "UnknownObject"
 
+	rpcClientExpiredHandlePrefix     = "Expired"
+	rpcClientHandleExpiredMessage    = rpcClientExpiredHandlePrefix + "Messages"
+	rpcClientHandleExpiredBroadcast  = rpcClientExpiredHandlePrefix + "Broadcasts"
+	rpcClientHandleExpiredGetpubkey  = rpcClientExpiredHandlePrefix + "Getpubkeys"
+	rpcClientHandleExpiredPubkey     = rpcClientExpiredHandlePrefix + "Pubkeys"
+	rpcClientHandleExpiredUnknownObj = rpcClientExpiredHandlePrefix + "UnknownObjects"
+
 	// Various states contained in client.State
 	rpcStateRemoteAddr      = "remoteAddr"      // string
 	rpcStateIsAuthenticated = "isAuthenticated" // bool
-	rpcStateIsAdmin         = "isAdmin"         // bool
+	rpcStateUsername        = "username"        // string
 	rpcStateEventsID        = "eventsID"        // int
 )
 
@@ -92,7 +124,7 @@ var (
 type rpcClientState struct {
 	remoteAddr      string
 	isAuthenticated bool
-	isAdmin         bool
+	username        string
 	// a psuedorandom value used to associate client with subscribed events
 	eventsID int
 }
@@ -110,8 +142,8 @@ func rpcConstructState(client *rpc2.Client) *rpcClientState {
 	isAuth, _ := client.State.Get(rpcStateIsAuthenticated)
 	state.isAuthenticated = isAuth.(bool)
 
-	isAdmin, _ := client.State.Get(rpcStateIsAdmin)
-	state.isAdmin = isAdmin.(bool)
+	username, _ := client.State.Get(rpcStateUsername)
+	state.username = username.(string)
 
 	return state
 }
@@ -119,18 +151,20 @@ func rpcConstructState(client *rpc2.Client) *rpcClientState {
 // rpcServer holds the items the rpc server may need to access (config,
 // shutdown, main server, etc.)
 type rpcServer struct {
-	server       *server
-	rpcSrv       *rpc2.Server
-	listeners    []net.Listener
-	evtMgr       *eventemitter.EventEmitter
-	limitauthsha [sha256.Size]byte
-	authsha      [sha256.Size]byte
-	mutex        sync.RWMutex
-	clients      map[*rpc2.Client]struct{}
-	started      int32
-	shutdown     int32
-	wg           sync.WaitGroup
-	quit         chan int
+	server    *server
+	rpcSrv    *rpc2.Server
+	listeners []net.Listener
+	evtMgr    *eventemitter.EventEmitter
+	creds     *rpcCredentials
+	badCreds  time.Time // mod time of a credentials file that failed to load.
+	credsMtx  sync.RWMutex
+	unixUsers map[uint32]string // RPC users of Unix domain socket clients.
+	mutex     sync.RWMutex
+	clients   map[*rpc2.Client]*rpcSubscriber
+	started   int32
+	shutdown  int32
+	wg        sync.WaitGroup
+	quit      chan int
 }
 
 // addHandlers is responsible for adding RPC method handlers to the underlying
@@ -150,6 +184,18 @@ func (s *rpcServer) addHandlers() {
 	s.rpcSrv.Handle(rpcHandleGetIdentity, s.getID)
 
 	// Statistics
+	s.rpcSrv.Handle(rpcHandleGetInfo, s.getInfo)
+	s.rpcSrv.Handle(rpcHandleBanScores, s.getBanScores)
+	s.rpcSrv.Handle(rpcHandleGetPeers, s.getPeers)
+
+	// Peers
+	s.rpcSrv.Handle(rpcHandleAddPeer, s.addPeer)
+	s.rpcSrv.Handle(rpcHandleDisconnectPeer, s.disconnectPeer)
+	s.rpcSrv.Handle(rpcHandleBanPeer, s.banPeer)
+	s.rpcSrv.Handle(rpcHandleUnbanPeer, s.unbanPeer)
+	s.rpcSrv.Handle(rpcHandleGetBanList, s.getBanList)
+	s.rpcSrv.Handle(rpcHandleAddIPRange, s.addIPRange)
+	s.rpcSrv.Handle(rpcHandleRemoveIPRange, s.removeIPRange)
 
 	// Notifications
 	s.rpcSrv.Handle(rpcHandleSubscribeMessages, s.subscribeMessages)
@@ -157,13 +203,25 @@ func (s *rpcServer) addHandlers() {
 	s.rpcSrv.Handle(rpcHandleSubscribeGetpubkeys, s.subscribeGetpubkeys)
 	s.rpcSrv.Handle(rpcHandleSubscribePubkeys, s.subscribePubkeys)
 	s.rpcSrv.Handle(rpcHandleSubscribeUnknownObjs, s.subscribeUnknownObjects)
+	s.rpcSrv.Handle(rpcHandleUnsubscribeMessages, s.unsubscribeMessages)
+	s.rpcSrv.Handle(rpcHandleUnsubscribeBroadcasts, s.unsubscribeBroadcasts)
+	s.rpcSrv.Handle(rpcHandleUnsubscribeGetpubkeys, s.unsubscribeGetpubkeys)
+	s.rpcSrv.Handle(rpcHandleUnsubscribePubkeys, s.unsubscribePubkeys)
+	s.rpcSrv.Handle(rpcHandleUnsubscribeUnknownObjs, s.unsubscribeUnknownObjects)
+	s.rpcSrv.Handle(rpcHandleListSubscriptions, s.listSubscriptions)
 
 }
 
 // onClientConnect is run for each client that connects to the RPC server.
 func (s *rpcServer) onClientConnect(client *rpc2.Client) {
+	state := rpcConstructState(client)
+	cfg := s.server.config()
+	subscriber := newRPCSubscriber(client, state.remoteAddr, s.server.db,
+		cfg.RPCQueueSize, cfg.RPCMaxInFlight)
+	subscriber.Start()
+
 	s.mutex.Lock()
-	s.clients[client] = struct{}{}
+	s.clients[client] = subscriber
 	s.mutex.Unlock()
 
 	// Enforce no authentication timeout.
@@ -176,13 +234,13 @@ func (s *rpcServer) onClientConnect(client *rpc2.Client) {
 		}
 	}()
 
-	state := rpcConstructState(client)
 	rpcLog.Infof("Client %s connected", state.remoteAddr)
 }
 
 // onClientDisconnect is run for each client that disconnects from the RPC server.
 func (s *rpcServer) onClientDisconnect(client *rpc2.Client) {
 	s.mutex.Lock()
+	subscriber := s.clients[client]
 	delete(s.clients, client)
 	s.mutex.Unlock()
 
@@ -196,10 +254,29 @@ func (s *rpcServer) onClientDisconnect(client *rpc2.Client) {
 	s.evtMgr.RemoveListener(rpcEvtNewGetpubkey, id)
 	s.evtMgr.RemoveListener(rpcEvtNewPubkey, id)
 	s.evtMgr.RemoveListener(rpcEvtNewUnknownObj, id)
+	s.evtMgr.RemoveListener(rpcEvtExpiredMessage, id)
+	s.evtMgr.RemoveListener(rpcEvtExpiredBroadcast, id)
+	s.evtMgr.RemoveListener(rpcEvtExpiredGetpubkey, id)
+	s.evtMgr.RemoveListener(rpcEvtExpiredPubkey, id)
+	s.evtMgr.RemoveListener(rpcEvtExpiredUnknownObj, id)
+
+	if subscriber != nil {
+		subscriber.Stop()
+	}
 
 	rpcLog.Infof("Client %s disconnected", state.remoteAddr)
 }
 
+// filesExists reports whether the named file or directory exists.
+func fileExists(name string) bool {
+	if _, err := os.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return false
+		}
+	}
+	return true
+}
+
 // genCertPair generates a key/cert pair to the paths provided.
 func genCertPair(certFile, keyFile string) error {
 	rpcLog.Infof("Generating TLS certificates...")
@@ -232,9 +309,10 @@ func (s *rpcServer) limitConnections(w http.ResponseWriter, remoteAddr string) b
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	if int(len(s.clients)+1) > cfg.RPCMaxClients {
+	maxClients := s.server.config().RPCMaxClients
+	if int(len(s.clients)+1) > maxClients {
 		rpcLog.Infof("Max RPC clients exceeded [%d] - disconnecting client %s",
-			cfg.RPCMaxClients, remoteAddr)
+			maxClients, remoteAddr)
 		http.Error(w, "503 Too busy. Try again later.",
 			http.StatusServiceUnavailable)
 		return true
@@ -242,32 +320,103 @@ func (s *rpcServer) limitConnections(w http.ResponseWriter, remoteAddr string) b
 	return false
 }
 
-// restrictAuth restricts access of the client, returning an error if the client
-// is not already authenticated.
-func (s *rpcServer) restrictAuth(client *rpc2.Client) error {
+// restrict restricts access of the client, returning an error if the client
+// is not authenticated as a user that may call the given method. Permissions
+// are looked up on each call so that changes to the credentials, including
+// those to the credentials file, take effect immediately.
+func (s *rpcServer) restrict(client *rpc2.Client, method string) error {
 	state := rpcConstructState(client)
 	if !state.isAuthenticated {
 		return errAccessDenied
 	}
+
+	user, ok := s.credentials().users[state.username]
+	if !ok || !user.Allowed(method) {
+		return errAccessDenied
+	}
 	return nil
 }
 
-// restrictAdmin restricts access of the client, returning an error if the
-// client is not already authenticated as an admin.
-func (s *rpcServer) restrictAdmin(client *rpc2.Client) error {
-	state := rpcConstructState(client)
-	if !state.isAdmin {
-		return errAccessDenied
+// ReloadCredentials reloads the RPC users and their permissions. If the
+// credentials cannot be loaded, the current ones are kept and an error is
+// returned.
+func (s *rpcServer) ReloadCredentials() error {
+	cfg := s.server.config()
+	creds, err := loadRPCCredentials(&cfg)
+	if err != nil {
+		return err
 	}
+
+	s.credsMtx.Lock()
+	s.creds = creds
+	s.credsMtx.Unlock()
+
+	rpcLog.Infof("Loaded %d RPC users", len(creds.users))
 	return nil
 }
 
+// credentials returns the current RPC users, first reloading the credentials
+// file if it has been modified since it was last read. A file that fails to
+// load is not read again until it is modified.
+func (s *rpcServer) credentials() *rpcCredentials {
+	s.credsMtx.RLock()
+	creds := s.creds
+	badCreds := s.badCreds
+	s.credsMtx.RUnlock()
+
+	path := s.server.config().RPCCredentials
+	if path == "" {
+		return creds
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.ModTime().Equal(creds.modTime) ||
+		fi.ModTime().Equal(badCreds) {
+		return creds
+	}
+
+	if err = s.ReloadCredentials(); err != nil {
+		s.credsMtx.Lock()
+		s.badCreds = fi.ModTime()
+		s.credsMtx.Unlock()
+		rpcLog.Errorf("Failed to reload RPC credentials, keeping the old "+
+			"ones: %v", err)
+		return creds
+	}
+
+	s.credsMtx.RLock()
+	defer s.credsMtx.RUnlock()
+	return s.creds
+}
+
+// ClientStats returns the number of connected clients and the number of
+// clients subscribed to each type of object, with subscriptions to unknown
+// objects under rpcUnknownObjType.
+func (s *rpcServer) ClientStats() (int, map[wire.ObjectType]int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	subscriptions := make(map[wire.ObjectType]int)
+	for _, subscriber := range s.clients {
+		for _, objType := range []wire.ObjectType{wire.ObjectTypeGetPubKey,
+			wire.ObjectTypePubKey, wire.ObjectTypeMsg,
+			wire.ObjectTypeBroadcast, rpcUnknownObjType} {
+			if subscriber.subscribed(objType) {
+				subscriptions[objType]++
+			}
+		}
+	}
+	return len(s.clients), subscriptions
+}
+
 // NotifyObject is used to notify the RPC server of any new objects so that it
 // can send those onwards to the client.
 func (s *rpcServer) NotifyObject(msg *wire.MsgObject, counter uint64) {
-	out := &RPCReceiveArgs{
-		Object:  base64.StdEncoding.EncodeToString(wire.EncodeMessage(msg)),
-		Counter: counter,
+	out := &rpcObjectEvent{
+		object: msg,
+		args: &RPCReceiveArgs{
+			Object:  base64.StdEncoding.EncodeToString(wire.EncodeMessage(msg)),
+			Counter: counter,
+		},
 	}
 
 	switch msg.ObjectType {
@@ -284,6 +433,28 @@ func (s *rpcServer) NotifyObject(msg *wire.MsgObject, counter uint64) {
 	}
 }
 
+// NotifyExpired is used to notify the RPC server of objects that were removed
+// from the database because they expired, so that it can tell interested
+// clients to discard them.
+func (s *rpcServer) NotifyExpired(objType wire.ObjectType, counters []uint64) {
+	out := &RPCExpiredArgs{
+		Counters: counters,
+	}
+
+	switch objType {
+	case wire.ObjectTypeBroadcast:
+		s.evtMgr.Emit(rpcEvtExpiredBroadcast, out)
+	case wire.ObjectTypeGetPubKey:
+		s.evtMgr.Emit(rpcEvtExpiredGetpubkey, out)
+	case wire.ObjectTypeMsg:
+		s.evtMgr.Emit(rpcEvtExpiredMessage, out)
+	case wire.ObjectTypePubKey:
+		s.evtMgr.Emit(rpcEvtExpiredPubkey, out)
+	default:
+		s.evtMgr.Emit(rpcEvtExpiredUnknownObj, out)
+	}
+}
+
 // newRPCServer returns a new instance of the rpcServer struct.
 func newRPCServer(listenAddrs []string, s *server) (*rpcServer, error) {
 	rpc := rpcServer{
@@ -291,30 +462,27 @@ func newRPCServer(listenAddrs []string, s *server) (*rpcServer, error) {
 		rpcSrv:  rpc2.NewServer(),   // Create the underlying RPC server.
 		evtMgr:  eventemitter.New(), // Event manager.
 		quit:    make(chan int),
-		clients: make(map[*rpc2.Client]struct{}),
+		clients: make(map[*rpc2.Client]*rpcSubscriber),
 	}
 
-	if cfg.RPCUser != "" && cfg.RPCPass != "" {
-		login := cfg.RPCUser + ":" + cfg.RPCPass
-		rpc.authsha = sha256.Sum256([]byte(login))
-	}
-	if cfg.RPCLimitUser != "" && cfg.RPCLimitPass != "" {
-		login := cfg.RPCLimitUser + ":" + cfg.RPCLimitPass
-		rpc.limitauthsha = sha256.Sum256([]byte(login))
+	creds, err := loadRPCCredentials(s.cfg)
+	if err != nil {
+		return nil, err
 	}
+	rpc.creds = creds
 
 	// Setup TLS if not disabled.
 	listenFunc := net.Listen
-	if !cfg.DisableTLS {
+	if !s.cfg.DisableTLS {
 		// Generate the TLS cert and key file if both don't already
 		// exist.
-		if !fileExists(cfg.RPCKey) && !fileExists(cfg.RPCCert) {
-			err := genCertPair(cfg.RPCCert, cfg.RPCKey)
+		if !fileExists(s.cfg.RPCKey) && !fileExists(s.cfg.RPCCert) {
+			err := genCertPair(s.cfg.RPCCert, s.cfg.RPCKey)
 			if err != nil {
 				return nil, err
 			}
 		}
-		keypair, err := tls.LoadX509KeyPair(cfg.RPCCert, cfg.RPCKey)
+		keypair, err := tls.LoadX509KeyPair(s.cfg.RPCCert, s.cfg.RPCKey)
 		if err != nil {
 			return nil, err
 		}
@@ -355,6 +523,25 @@ func newRPCServer(listenAddrs []string, s *server) (*rpcServer, error) {
 		}
 		listeners = append(listeners, listener)
 	}
+
+	// Listen on a Unix domain socket if requested. Connections to it are
+	// local, so TLS is not used.
+	if s.cfg.RPCUnix != "" {
+		rpc.unixUsers = s.cfg.RPCUnixUsers
+		for uid, username := range rpc.unixUsers {
+			if _, ok := creds.users[username]; !ok {
+				return nil, fmt.Errorf("RPC user %s for uid %d does not "+
+					"exist", username, uid)
+			}
+		}
+
+		listener, err := listenRPCUnix(s.cfg.RPCUnix, s.cfg.RPCUnixPerm)
+		if err != nil {
+			rpcLog.Warnf("Can't listen on %s: %v", s.cfg.RPCUnix, err)
+		} else {
+			listeners = append(listeners, listener)
+		}
+	}
 	if len(listeners) == 0 {
 		return nil, errors.New("RPC: No valid listen address")
 	}
@@ -391,6 +578,11 @@ func (s *rpcServer) Stop() error {
 	s.evtMgr.RemoveListeners(rpcEvtNewGetpubkey)
 	s.evtMgr.RemoveListeners(rpcEvtNewPubkey)
 	s.evtMgr.RemoveListeners(rpcEvtNewUnknownObj)
+	s.evtMgr.RemoveListeners(rpcEvtExpiredMessage)
+	s.evtMgr.RemoveListeners(rpcEvtExpiredBroadcast)
+	s.evtMgr.RemoveListeners(rpcEvtExpiredGetpubkey)
+	s.evtMgr.RemoveListeners(rpcEvtExpiredPubkey)
+	s.evtMgr.RemoveListeners(rpcEvtExpiredUnknownObj)
 
 	close(s.quit)
 	s.wg.Wait()
@@ -415,7 +607,7 @@ func (s *rpcServer) Start() {
 	}
 
 	rpcServeMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Enforce cfg.RPCMaxClients
+		// Enforce RPCMaxClients
 		if s.limitConnections(w, r.RemoteAddr) {
 			return
 		}
@@ -433,9 +625,21 @@ func (s *rpcServer) Start() {
 		state := rpc2.NewState()
 		state.Set(rpcStateRemoteAddr, r.RemoteAddr)
 		state.Set(rpcStateEventsID, prand.Int())
-		state.Set(rpcStateIsAdmin, false)
+		state.Set(rpcStateUsername, "")
 		state.Set(rpcStateIsAuthenticated, false)
 
+		// Clients on the Unix domain socket have no network address and are
+		// authenticated by their user id if it is mapped to an RPC user.
+		if conn, ok := ws.UnderlyingConn().(*rpcUnixConn); ok {
+			state.Set(rpcStateRemoteAddr, "unix:"+s.server.cfg.RPCUnix)
+			if username, ok := s.unixUsers[conn.uid]; ok && conn.hasUID {
+				state.Set(rpcStateUsername, username)
+				state.Set(rpcStateIsAuthenticated, true)
+				rpcLog.Debugf("Authenticated Unix domain socket client "+
+					"with uid %d as %s", conn.uid, username)
+			}
+		}
+
 		s.rpcSrv.ServeCodecWithState(jsonrpc.NewJSONCodec(ws.UnderlyingConn()),
 			state)
 	})
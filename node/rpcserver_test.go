@@ -0,0 +1,566 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+	"github.com/gorilla/websocket"
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	rpcLoc = "ws://localhost:8442/"
+
+	rpcAdminUser = "admin"
+	rpcAdminPass = "admin"
+
+	rpcLimitUser = "limit"
+	rpcLimitPass = "limit"
+)
+
+var serv *server
+
+var subscribeArgs = &RPCSubscribeArgs{
+	FromCounter: 0,
+}
+
+func rpcTests(client *rpc2.Client, t *testing.T) {
+	// Do not change test order. Tests depend on previous tests successfully
+	// finishing.
+	testRPCAuth(client, t)
+	testRPCSendObject(client, t)
+	testRPCSubscriptions(client, t)
+	testRPCExpired(client, t)
+	testRPCUnsubscribe(client, t)
+	testRPCGetInfo(client, t)
+	testRPCBanScores(client, t)
+	testRPCPeers(client, t)
+	testRPCBanList(client, t)
+}
+
+// testRPCAuth tests authentication failures for all RPC methods and also
+// Authenticate method.
+func testRPCAuth(client *rpc2.Client, t *testing.T) {
+	// Test access denied.
+	failTests := []struct {
+		method string
+		args   interface{}
+	}{
+		{rpcHandleSendObject, "Y="},
+		{rpcHandleGetIdentity, "BM-asd5s"},
+		{rpcHandleGetInfo, nil},
+		{rpcHandleBanScores, nil},
+		{rpcHandleGetPeers, nil},
+		{rpcHandleAddPeer, &RPCAddPeerArgs{Address: "127.0.0.1:8444"}},
+		{rpcHandleDisconnectPeer, "127.0.0.1:8444"},
+		{rpcHandleBanPeer, "127.0.0.1"},
+		{rpcHandleUnbanPeer, "127.0.0.1"},
+		{rpcHandleGetBanList, nil},
+		{rpcHandleAddIPRange, &RPCIPRangeArgs{List: "deny", Range: "192.0.2.0/24"}},
+		{rpcHandleRemoveIPRange, &RPCIPRangeArgs{List: "deny", Range: "192.0.2.0/24"}},
+		{rpcHandleSubscribeMessages, subscribeArgs},
+		{rpcHandleSubscribeBroadcasts, subscribeArgs},
+		{rpcHandleSubscribeGetpubkeys, subscribeArgs},
+		{rpcHandleSubscribePubkeys, subscribeArgs},
+		{rpcHandleSubscribeUnknownObjs, subscribeArgs},
+		{rpcHandleUnsubscribePubkeys, nil},
+		{rpcHandleListSubscriptions, nil},
+	}
+
+	for _, test := range failTests {
+		err := client.Call(test.method, test.args, nil)
+		if err.Error() != errAccessDenied.Error() { // auth failure
+			t.Errorf("for %s expected %v got %v", test.method, errAccessDenied,
+				err)
+		}
+	}
+
+	// Test Authenticate.
+	authTests := []struct {
+		username string
+		password string
+		success  bool
+	}{
+		{"", "", false},
+		{"sadsadadoijsad", "asdfsafafdfasdfdf", false},
+		{rpcLimitUser, rpcLimitPass, true},
+		{rpcAdminUser, rpcAdminPass, true},
+	}
+
+	for i, test := range authTests {
+		args := &RPCAuthArgs{
+			Username: test.username,
+			Password: test.password,
+		}
+		var res bool
+		err := client.Call(rpcHandleAuth, args, &res)
+
+		if err != nil {
+			t.Errorf("for case #%d got error %v", i, err)
+		}
+		if test.success != res {
+			t.Errorf("for case #%d expected %v got %v", i, test.success, res)
+		}
+	}
+}
+
+// Test SendObject.
+func testRPCSendObject(client *rpc2.Client, t *testing.T) {
+
+	// invalid base64 encoding
+	err := client.Call(rpcHandleSendObject, "aodisad093predikif", nil)
+	if err == nil {
+		t.Error("got no error for invalid base64 encoding")
+	}
+
+	errorTests := [][]byte{
+		[]byte{},                       // empty
+		[]byte{0x00, 0x00, 0x00, 0x00}, // invalid object
+		[]byte{ // expired
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xe0, 0xf3, // Nonce
+			0x00, 0x00, 0x00, 0x00, 0x49, 0x5f, 0xab, 0x29, // 64-bit Timestamp
+			0x00, 0x00, 0x00, 0x00, // object type
+			0x03, // Version
+			0x01, // Stream Number
+		},
+		[]byte{ // invalid stream
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xe0, 0xf3, // Nonce
+			0x00, 0x00, 0x00, 0xff, 0x49, 0x5f, 0xab, 0x29, // 64-bit Timestamp
+			0x00, 0x00, 0x00, 0x00, // object type
+			0x03, // Version
+			0x05, // Stream Number
+		},
+		[]byte{ // invalid PoW
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xe0, 0xf3, // Nonce
+			0x00, 0x00, 0x00, 0xff, 0x49, 0x5f, 0xab, 0x29, // 64-bit Timestamp
+			0x00, 0x00, 0x00, 0x00, // object type
+			0x03, // Version
+			0x01, // Stream Number
+		},
+	}
+
+	for i, test := range errorTests {
+		err = client.Call(rpcHandleSendObject,
+			base64.StdEncoding.EncodeToString(test), nil)
+		if err == nil {
+			t.Errorf("for case #%d got no error", i)
+		}
+	}
+
+	// Insert valid object.
+	data := wire.EncodeMessage(testObj[0]) // getpubkey
+	err = client.Call(rpcHandleSendObject,
+		base64.StdEncoding.EncodeToString(data), nil)
+	if err != nil {
+		t.Errorf("for valid SendObject got error %v", err)
+	}
+	hash := testObj[0].InventoryHash()
+
+	// Check if advertised.
+	if ok, err := serv.objectManager.haveInventory(wire.NewInvVect(hash)); !ok {
+		t.Error("server doesn't have new object in inventory, error:", err)
+	}
+}
+
+func testRPCSubscriptions(client *rpc2.Client, t *testing.T) {
+	// Test if old objects are sent OK when subscribing.
+	var received int32
+
+	// Receive Getpubkey inserted in previous test.
+	client.Handle(rpcClientHandleGetpubkey, func(client *rpc2.Client,
+		args *RPCReceiveArgs, _ *struct{}) error {
+		b, err := base64.StdEncoding.DecodeString(args.Object)
+		if err != nil {
+			t.Fatal("invalid base64 encoding")
+		}
+		data := wire.EncodeMessage(testObj[0]) // getpubkey
+		if !bytes.Equal(data, b) {
+			t.Errorf("invalid getpubkey bytes, expected %v got %v", data, b)
+		}
+		t.Logf("Received getpubkey: counter=%d, byte length=%d\n", args.Counter,
+			len(b))
+		atomic.StoreInt32(&received, 1)
+		return nil
+	})
+
+	err := client.Call(rpcHandleSubscribeGetpubkeys, subscribeArgs, nil)
+	if err != nil {
+		t.Error("SubscribeGetpubkeys failed: ", err)
+	}
+
+	// Wait for received==1
+	timer := time.NewTimer(time.Millisecond * 20)
+	<-timer.C
+
+	if atomic.LoadInt32(&received) != 1 {
+		t.Error("did not receive getpubkey from sendOldObjects")
+	}
+
+	// Test if objects inserted after subscribing are handled correctly.
+	atomic.StoreInt32(&received, 0)
+	data := wire.EncodeMessage(testObj[2]) // pubkey
+
+	client.Handle(rpcClientHandlePubkey, func(client *rpc2.Client,
+		args *RPCReceiveArgs, _ *struct{}) error {
+		b, err := base64.StdEncoding.DecodeString(args.Object)
+		if err != nil {
+			t.Fatal("invalid base64 encoding")
+		}
+		if !bytes.Equal(data, b) {
+			t.Errorf("invalid pubkey bytes, expected %v got %v", data, b)
+		}
+		t.Logf("Received pubkey: counter=%d, byte length=%d\n", args.Counter,
+			len(b))
+		atomic.StoreInt32(&received, 1)
+		return nil
+	})
+
+	err = client.Call(rpcHandleSubscribePubkeys, subscribeArgs, nil)
+	if err != nil {
+		t.Error("SubscribePubkeys failed: ", err)
+	}
+
+	err = client.Call(rpcHandleSendObject,
+		base64.StdEncoding.EncodeToString(data), nil)
+	if err != nil {
+		t.Errorf("for valid SendObject got error %v", err)
+	}
+
+	timer.Reset(time.Millisecond * 20)
+	<-timer.C
+	timer.Stop()
+
+	if atomic.LoadInt32(&received) != 1 {
+		t.Error("did not receive pubkey from handleSubscribe")
+	}
+}
+
+// testRPCExpired tests whether subscribed clients are notified about objects
+// that have been pruned from the database.
+func testRPCExpired(client *rpc2.Client, t *testing.T) {
+	var received int32
+	counters := []uint64{2, 5}
+
+	client.Handle(rpcClientHandleExpiredPubkey, func(client *rpc2.Client,
+		args *RPCExpiredArgs, _ *struct{}) error {
+		if !reflect.DeepEqual(args.Counters, counters) {
+			t.Errorf("invalid expired counters, expected %v got %v", counters,
+				args.Counters)
+		}
+		atomic.StoreInt32(&received, 1)
+		return nil
+	})
+
+	// The client subscribed to pubkeys in the previous test.
+	serv.rpcServer.NotifyExpired(wire.ObjectTypePubKey, counters)
+
+	timer := time.NewTimer(time.Millisecond * 20)
+	<-timer.C
+
+	if atomic.LoadInt32(&received) != 1 {
+		t.Error("did not receive expired pubkey counters from NotifyExpired")
+	}
+}
+
+// testRPCUnsubscribe tests ListSubscriptions, that subscribing twice does not
+// deliver objects twice and that unsubscribing stops delivery.
+func testRPCUnsubscribe(client *rpc2.Client, t *testing.T) {
+	var received int32
+	counters := []uint64{2, 5}
+
+	client.Handle(rpcClientHandleExpiredPubkey, func(client *rpc2.Client,
+		args *RPCExpiredArgs, _ *struct{}) error {
+		atomic.AddInt32(&received, 1)
+		return nil
+	})
+
+	checkSubscriptions := func(expected []string) {
+		var out RPCListSubscriptionsOut
+		err := client.Call(rpcHandleListSubscriptions, nil, &out)
+		if err != nil {
+			t.Fatalf("ListSubscriptions failed: %v", err)
+		}
+		if !reflect.DeepEqual(out.Subscriptions, expected) {
+			t.Errorf("expected subscriptions %v got %v", expected,
+				out.Subscriptions)
+		}
+	}
+
+	// The client subscribed to getpubkeys and pubkeys in previous tests.
+	checkSubscriptions([]string{"Getpubkeys", "Pubkeys"})
+
+	// Subscribing again must not add another listener. Use a high counter so
+	// that no old objects are sent.
+	err := client.Call(rpcHandleSubscribePubkeys,
+		&RPCSubscribeArgs{FromCounter: 1000}, nil)
+	if err != nil {
+		t.Error("SubscribePubkeys failed: ", err)
+	}
+	checkSubscriptions([]string{"Getpubkeys", "Pubkeys"})
+
+	serv.rpcServer.NotifyExpired(wire.ObjectTypePubKey, counters)
+	time.Sleep(time.Millisecond * 20)
+	if n := atomic.LoadInt32(&received); n != 1 {
+		t.Errorf("expected expired pubkey counters once, got %d times", n)
+	}
+
+	err = client.Call(rpcHandleUnsubscribePubkeys, nil, nil)
+	if err != nil {
+		t.Error("UnsubscribePubkeys failed: ", err)
+	}
+	checkSubscriptions([]string{"Getpubkeys"})
+
+	atomic.StoreInt32(&received, 0)
+	serv.rpcServer.NotifyExpired(wire.ObjectTypePubKey, counters)
+	time.Sleep(time.Millisecond * 20)
+	if n := atomic.LoadInt32(&received); n != 0 {
+		t.Errorf("expected no expired pubkey counters, got %d", n)
+	}
+
+	err = client.Call(rpcHandleUnsubscribePubkeys, nil, nil)
+	if err == nil {
+		t.Error("UnsubscribePubkeys succeeded when not subscribed")
+	}
+}
+
+// testRPCGetInfo tests GetInfo. The server has no peers.
+func testRPCGetInfo(client *rpc2.Client, t *testing.T) {
+	var out RPCGetInfoOut
+	err := client.Call(rpcHandleGetInfo, nil, &out)
+	if err != nil {
+		t.Fatalf("GetInfo failed: %v", err)
+	}
+	if out.Version != Version() {
+		t.Errorf("expected version %s, got %s", Version(), out.Version)
+	}
+	if out.ProtocolVersion != maxProtocolVersion {
+		t.Errorf("expected protocol version %d, got %d", maxProtocolVersion,
+			out.ProtocolVersion)
+	}
+	if len(out.Listeners) != len(serv.listeners) {
+		t.Errorf("expected %d listeners, got %d", len(serv.listeners),
+			len(out.Listeners))
+	}
+	if out.InboundPeers != 0 || out.OutboundPeers != 0 {
+		t.Errorf("expected no peers, got %d inbound and %d outbound",
+			out.InboundPeers, out.OutboundPeers)
+	}
+
+	// Objects were sent in previous tests.
+	c := out.Counters
+	if c.Messages+c.Broadcasts+c.Getpubkeys+c.Pubkeys+c.UnknownObjects == 0 {
+		t.Error("expected object counters to have been incremented")
+	}
+}
+
+// testRPCBanScores tests GetBanScores. The server has no peers, so no ban
+// scores are expected.
+func testRPCBanScores(client *rpc2.Client, t *testing.T) {
+	var out RPCBanScoresOut
+	err := client.Call(rpcHandleBanScores, nil, &out)
+	if err != nil {
+		t.Fatalf("GetBanScores failed: %v", err)
+	}
+	if len(out.Peers) != 0 {
+		t.Errorf("expected no ban scores, got %d", len(out.Peers))
+	}
+}
+
+// testRPCPeers tests GetPeers, DisconnectPeer, BanPeer and UnbanPeer. The
+// server has no peers.
+func testRPCPeers(client *rpc2.Client, t *testing.T) {
+	var out RPCGetPeersOut
+	err := client.Call(rpcHandleGetPeers, nil, &out)
+	if err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	if len(out.Peers) != 0 {
+		t.Errorf("expected no peers, got %d", len(out.Peers))
+	}
+
+	if err = client.Call(rpcHandleDisconnectPeer, "127.0.0.1:8444",
+		nil); err == nil {
+		t.Error("DisconnectPeer of an unknown peer succeeded")
+	}
+
+	tests := []struct {
+		method  string
+		ip      string
+		success bool
+	}{
+		{rpcHandleBanPeer, "not an ip", false},
+		{rpcHandleUnbanPeer, "192.0.2.1", false},
+		{rpcHandleBanPeer, "192.0.2.1", true},
+		{rpcHandleUnbanPeer, "192.0.2.1", true},
+		{rpcHandleUnbanPeer, "192.0.2.1", false},
+	}
+
+	for i, test := range tests {
+		err := client.Call(test.method, test.ip, nil)
+		if test.success && err != nil {
+			t.Errorf("for case #%d %s failed: %v", i, test.method, err)
+		} else if !test.success && err == nil {
+			t.Errorf("for case #%d %s succeeded, expected failure", i,
+				test.method)
+		}
+	}
+}
+
+// testRPCBanList tests GetBanList, AddIPRange and RemoveIPRange.
+func testRPCBanList(client *rpc2.Client, t *testing.T) {
+	tests := []struct {
+		method  string
+		args    interface{}
+		success bool
+	}{
+		{rpcHandleAddIPRange, &RPCIPRangeArgs{"deny", "192.0.2.0/24"}, true},
+		{rpcHandleAddIPRange, &RPCIPRangeArgs{"deny", "192.0.2.0/24"}, false},
+		{rpcHandleAddIPRange, &RPCIPRangeArgs{"other", "192.0.2.0/24"}, false},
+		{rpcHandleAddIPRange, &RPCIPRangeArgs{"allow", "not an ip"}, false},
+		{rpcHandleAddIPRange, &RPCIPRangeArgs{"allow", "192.0.2.1"}, true},
+		{rpcHandleBanPeer, "192.0.2.1", false}, // allowed.
+		{rpcHandleBanPeer, "198.51.100.1", true},
+	}
+
+	for i, test := range tests {
+		err := client.Call(test.method, test.args, nil)
+		if test.success && err != nil {
+			t.Errorf("for case #%d %s failed: %v", i, test.method, err)
+		} else if !test.success && err == nil {
+			t.Errorf("for case #%d %s succeeded, expected failure", i,
+				test.method)
+		}
+	}
+
+	var out RPCGetBanListOut
+	if err := client.Call(rpcHandleGetBanList, nil, &out); err != nil {
+		t.Fatalf("GetBanList failed: %v", err)
+	}
+	if len(out.Bans) != 1 || out.Bans[0].IP != "198.51.100.1" ||
+		out.Bans[0].Until.Before(time.Now()) {
+		t.Errorf("unexpected bans %v", out.Bans)
+	}
+	if !reflect.DeepEqual(out.Allow, []string{"192.0.2.1/32"}) {
+		t.Errorf("unexpected allow list %v", out.Allow)
+	}
+	if !reflect.DeepEqual(out.Deny, []string{"192.0.2.0/24"}) {
+		t.Errorf("unexpected deny list %v", out.Deny)
+	}
+
+	// Clean up.
+	tests = []struct {
+		method  string
+		args    interface{}
+		success bool
+	}{
+		{rpcHandleUnbanPeer, "198.51.100.1", true},
+		{rpcHandleRemoveIPRange, &RPCIPRangeArgs{"allow", "192.0.2.1"}, true},
+		{rpcHandleRemoveIPRange, &RPCIPRangeArgs{"deny", "192.0.2.0/24"}, true},
+		{rpcHandleRemoveIPRange, &RPCIPRangeArgs{"deny", "192.0.2.0/24"}, false},
+	}
+	for i, test := range tests {
+		err := client.Call(test.method, test.args, nil)
+		if test.success && err != nil {
+			t.Errorf("for cleanup case #%d %s failed: %v", i, test.method, err)
+		} else if !test.success && err == nil {
+			t.Errorf("for cleanup case #%d %s succeeded, expected failure", i,
+				test.method)
+		}
+	}
+}
+
+func TestRPCConnection(t *testing.T) {
+	// Address for mock listener to pass to server. The server
+	// needs at least one listener or it won't start so we mock it.
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8442}
+
+	// Generate config.
+	opts := testOptions(getMemDb([]*wire.MsgObject{}),
+		MockListen([]*MockListener{
+			NewMockListener(remoteAddr, make(chan peer.Connection), make(chan struct{}, 1))}))
+	opts.MaxPeers = 0
+	opts.RPCPass = rpcAdminUser
+	opts.RPCUser = rpcAdminPass
+	opts.RPCLimitUser = rpcLimitUser
+	opts.RPCLimitPass = rpcLimitPass
+	opts.DisableRPC = false
+	opts.DisableTLS = true
+	opts.RPCMaxClients = 1
+
+	// Load rpc listeners.
+	addrs, err := net.LookupHost("localhost")
+	if err != nil {
+		t.Fatal("Could not look up localhost.")
+	}
+	opts.RPCListeners = make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = net.JoinHostPort(addr, "8442")
+		opts.RPCListeners = append(opts.RPCListeners, addr)
+	}
+
+	// Create a server.
+	serv, err = newServer(opts)
+	if err != nil {
+		t.Fatalf("Server creation failed: %s", err)
+	}
+
+	serv.start([]*DefaultPeer{})
+
+	ws, _, err := websocket.DefaultDialer.Dial(rpcLoc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := rpc2.NewClientWithCodec(jsonrpc.NewJSONCodec(ws.UnderlyingConn()))
+
+	go client.Run()
+
+	rpcTests(client, t)
+	client.Close() // we're done
+	ws.Close()
+
+	// Test for authentication timeout.
+	ws, _, err = websocket.DefaultDialer.Dial(rpcLoc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = rpc2.NewClientWithCodec(jsonrpc.NewJSONCodec(ws.UnderlyingConn()))
+	go client.Run()
+
+	// wait, give 10ms wiggling room
+	<-time.NewTimer(time.Second*rpcAuthTimeoutSeconds + time.Millisecond*10).C
+
+	select {
+	case <-client.DisconnectNotify():
+	// do nothing
+	default:
+		t.Error("did not disconnect due to auth timeout")
+	}
+
+	// Test for RPCMaxClients
+	ws, _, err = websocket.DefaultDialer.Dial(rpcLoc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = websocket.DefaultDialer.Dial(rpcLoc, nil)
+	if err == nil {
+		t.Error("RPCMaxClients isn't enforced. Second connection was successful.")
+	}
+
+	// Cleanup.
+	serv.Stop()
+	serv.WaitForShutdown()
+}
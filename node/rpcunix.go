@@ -0,0 +1,102 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// rpcUnixConn is a connection accepted on the RPC Unix domain socket, along
+// with the user id of the process on the other end, if it could be determined.
+type rpcUnixConn struct {
+	net.Conn
+	uid    uint32
+	hasUID bool
+}
+
+// rpcUnixListener accepts connections on the RPC Unix domain socket and looks
+// up the credentials of the connecting processes.
+type rpcUnixListener struct {
+	*net.UnixListener
+	path string
+}
+
+// Accept waits for and returns the next connection as an *rpcUnixConn.
+func (l *rpcUnixListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &rpcUnixConn{Conn: conn}
+	c.uid, err = unixPeerUID(conn)
+	if err != nil {
+		rpcLog.Debugf("Unable to get credentials of RPC client on %s: %v",
+			l.Addr(), err)
+	} else {
+		c.hasUID = true
+	}
+	return c, nil
+}
+
+// Close stops listening and removes the socket. The socket was bound under a
+// different name, so the listener does not remove it by itself.
+func (l *rpcUnixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// listenRPCUnix listens for RPC connections on a Unix domain socket at the
+// given path, which is created with the given permissions. A socket left over
+// from a previous run is removed first. The socket is bound and its permissions
+// set inside a private directory before it is moved into place, so that no
+// other user can connect to it before it is restricted.
+func listenRPCUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".bmd-rpc")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, filepath.Base(path))
+	addr, err := net.ResolveUnixAddr("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(tmpPath, perm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &rpcUnixListener{UnixListener: listener, path: path}, nil
+}
+
+// errPeerCredUnsupported is returned when the credentials of the process on the
+// other end of a Unix domain socket cannot be determined on this platform.
+var errPeerCredUnsupported = errors.New("peer credentials are not supported " +
+	"on this platform")
@@ -0,0 +1,31 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"net"
+	"syscall"
+)
+
+// unixPeerCredSupported is whether the credentials of the process on the other
+// end of a Unix domain socket can be determined on this platform.
+const unixPeerCredSupported = true
+
+// unixPeerUID returns the user id of the process on the other end of the
+// connection.
+func unixPeerUID(conn *net.UnixConn) (uint32, error) {
+	f, err := conn.File()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	cred, err := syscall.GetsockoptUcred(int(f.Fd()), syscall.SOL_SOCKET,
+		syscall.SO_PEERCRED)
+	if err != nil {
+		return 0, err
+	}
+	return cred.Uid, nil
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package node
+
+import "net"
+
+// unixPeerCredSupported is whether the credentials of the process on the other
+// end of a Unix domain socket can be determined on this platform.
+const unixPeerCredSupported = false
+
+// unixPeerUID returns the user id of the process on the other end of the
+// connection.
+func unixPeerUID(conn *net.UnixConn) (uint32, error) {
+	return 0, errPeerCredUnsupported
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRPCUnixListener checks that the RPC Unix domain socket is created with
+// the requested permissions, that the user id of clients is determined and that
+// the socket is removed when the listener is closed.
+func TestRPCUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpcunix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bmd.sock")
+
+	// A regular file in the way is not removed.
+	if err = ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = listenRPCUnix(path, 0600); err == nil {
+		t.Error("expected error when the path is a regular file")
+	}
+	os.Remove(path)
+
+	// A socket left over from a previous run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenRPCUnix(path, 0660)
+	if err != nil {
+		t.Fatalf("listenRPCUnix failed: %v", err)
+	}
+	defer listener.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("expected permissions 0660, got %o", fi.Mode().Perm())
+	}
+
+	// The private directory the socket was bound in is removed.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected only the socket in %s, got %d files", dir,
+			len(files))
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("Accept failed: %v", err)
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	conn, ok := (<-accepted).(*rpcUnixConn)
+	if !ok {
+		t.Fatal("accepted connection is not an *rpcUnixConn")
+	}
+	defer conn.Close()
+	if conn.hasUID != unixPeerCredSupported {
+		t.Errorf("expected hasUID %v, got %v", unixPeerCredSupported,
+			conn.hasUID)
+	}
+	if conn.hasUID && conn.uid != uint32(os.Getuid()) {
+		t.Errorf("expected uid %d, got %d", os.Getuid(), conn.uid)
+	}
+
+	listener.Close()
+	if _, err = os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,1443 @@
+// Originally derived from: btcsuite/btcd/server.go
+// Copyright (c) 2013-2015 Conformal Systems LLC.
+
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/monetas/bmd/addrmgr"
+	"github.com/monetas/bmd/database"
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	// supportedServices describes which services are supported by the
+	// server.
+	supportedServices = wire.SFNodeNetwork
+
+	// connectionRetryInterval is the amount of time to wait in between
+	// retries when connecting to persistent peers.
+	connectionRetryInterval = time.Second * 10
+
+	// advertiseInterval is how often our own address is advertised to the
+	// peers that we are connected to.
+	advertiseInterval = time.Hour * 24
+
+	// peerAddrConfirmations is the number of peers with different IP
+	// addresses that must report the same address for us before it is
+	// advertised.
+	peerAddrConfirmations = 3
+
+	// maxPeerAddrs is the maximum number of addresses reported by peers that
+	// are kept track of.
+	maxPeerAddrs = 16
+)
+
+// The peerState is used by the server to keep track of what the peers it is
+// connected to are up to.
+type peerState struct {
+	peers            map[*bmpeer]struct{}
+	outboundPeers    map[*bmpeer]struct{}
+	persistentPeers  map[*bmpeer]struct{}
+	banned           map[string]time.Time
+	banScores        map[string]*banScore // of disconnected peers, by host.
+	outboundGroups   map[string]int
+	outboundStreams  map[uint32]int
+	maxPeers         int
+	maxOutboundPeers int
+	bytesSent        uint64 // by disconnected peers.
+	bytesReceived    uint64 // by disconnected peers.
+}
+
+// Count returns the total number of peers.
+func (p *peerState) Count() int {
+	return len(p.peers) + len(p.outboundPeers) + len(p.persistentPeers)
+}
+
+// OutboundCount returns the number of outbound peers.
+func (p *peerState) OutboundCount() int {
+	return len(p.outboundPeers) + len(p.persistentPeers)
+}
+
+// NeedMoreOutbound returns whether more outbound peers are needed in the given
+// stream.
+func (p *peerState) NeedMoreOutbound(stream uint32) bool {
+	return p.outboundStreams[stream] < p.maxOutboundPeers &&
+		p.Count() < p.maxPeers
+}
+
+// forAllOutboundPeers is a helper function that runs closure on all outbound
+// peers known to peerState
+func (p *peerState) forAllOutboundPeers(closure func(p *bmpeer)) {
+	for e := range p.outboundPeers {
+		closure(e)
+	}
+	for e := range p.persistentPeers {
+		closure(e)
+	}
+}
+
+// forAllPeers is a helper function that runs closure on all peers known to
+// peerState.
+func (p *peerState) forAllPeers(closure func(p *bmpeer)) {
+	for e := range p.peers {
+		closure(e)
+	}
+	p.forAllOutboundPeers(closure)
+}
+
+// setLimits sets the maximum number of peers and of outbound peers in each
+// stream. The number of outbound peers may not exceed the number of peers.
+func (p *peerState) setLimits(maxPeers, maxOutbound int) {
+	p.maxPeers = maxPeers
+	p.maxOutboundPeers = maxOutbound
+	if p.maxPeers < p.maxOutboundPeers {
+		p.maxOutboundPeers = p.maxPeers
+	}
+}
+
+func newPeerState(maxPeers, maxOutbound int) *peerState {
+	p := &peerState{
+		peers:           make(map[*bmpeer]struct{}),
+		persistentPeers: make(map[*bmpeer]struct{}),
+		outboundPeers:   make(map[*bmpeer]struct{}),
+		banned:          make(map[string]time.Time),
+		banScores:       make(map[string]*banScore),
+		outboundGroups:  make(map[string]int),
+		outboundStreams: make(map[uint32]int),
+	}
+	p.setLimits(maxPeers, maxOutbound)
+	return p
+}
+
+// DefaultPeer represents a peer that the server connects to by default.
+type DefaultPeer struct {
+	addr      string
+	stream    uint32
+	permanent bool
+}
+
+// The list of default peers.
+var defaultPeers = []*DefaultPeer{
+	&DefaultPeer{"5.45.99.75:8444", 1, true},
+	&DefaultPeer{"75.167.159.54:8444", 1, true},
+	&DefaultPeer{"95.165.168.168:8444", 1, true},
+	&DefaultPeer{"85.180.139.241:8444", 1, true},
+	&DefaultPeer{"158.222.211.81:8080", 1, true},
+	&DefaultPeer{"178.62.12.187:8448", 1, true},
+	&DefaultPeer{"24.188.198.204:8111", 1, true},
+	&DefaultPeer{"109.147.204.113:1195", 1, true},
+	&DefaultPeer{"178.11.46.221:8444", 1, true},
+}
+
+// server provides a bitmssage server for handling communications to and from
+// bitcoin peers.
+type server struct {
+	cfg           *Options
+	cfgMtx        sync.RWMutex // protects the options changed by Reload.
+	reloadMtx     sync.Mutex   // serializes calls to Reload.
+	nonce         uint64
+	listeners     []peer.Listener
+	started       int32 // atomic
+	shutdown      int32 // atomic
+	shutdownSched int32 // atomic
+	addrManager   *addrmgr.AddrManager
+	objectManager *ObjectManager
+	state         *peerState
+	newPeers      chan *bmpeer
+	donePeers     chan *bmpeer
+	banPeers      chan *bmpeer
+	wakeup        chan struct{}
+	query         chan interface{}
+	wg            sync.WaitGroup
+	quit          chan struct{}
+	db            database.Db
+	rpcServer     *rpcServer
+	streams       []uint32 // streams we take part in, in order of preference.
+	startTime     time.Time
+	lastDNSSeed   time.Time // only accessed from the peerHandler goroutine.
+	allowList     *ipList
+	denyList      *ipList
+	bandwidth     *bandwidth
+	peerAddrMtx   sync.Mutex
+	peerAddrs     map[string]map[string]struct{} // reporting hosts, by IP.
+
+	// newConn creates the connections of outbound peers.
+	newConn func(addr net.Addr, maxDown, maxUp int64) peer.Connection
+
+	// discoverNAT finds the UPnP gateway through which the listening port is
+	// mapped.
+	discoverNAT func() (*upnpNAT, error)
+}
+
+// randomUint16Number returns a random uint16 in a specified input range. Note
+// that the range is in zeroth ordering; if you pass it 1800, you will get
+// values from 0 to 1800.
+func randomUint16Number(max uint16) uint16 {
+	// In order to avoid modulo bias and ensure every possible outcome in
+	// [0, max) has equal probability, the random number must be sampled
+	// from a random source that has a range limited to a multiple of the
+	// modulus.
+	var randomNumber uint16
+	var limitRange = (math.MaxUint16 / max) * max
+	for {
+		binary.Read(rand.Reader, binary.LittleEndian, &randomNumber)
+		if randomNumber < limitRange {
+			return (randomNumber % max)
+		}
+	}
+}
+
+// serviceStreams returns the streams that bmd takes part in given the streams
+// from the configuration and whether their child streams should be included.
+// The configured streams come first and duplicates are removed.
+func serviceStreams(streams []uint32, children bool) []uint32 {
+	list := make([]uint32, 0, len(streams)*3)
+	seen := make(map[uint32]struct{})
+	add := func(stream uint32) {
+		if _, ok := seen[stream]; !ok {
+			seen[stream] = struct{}{}
+			list = append(list, stream)
+		}
+	}
+
+	for _, stream := range streams {
+		add(stream)
+	}
+	if children {
+		for _, stream := range streams {
+			// The children of stream n are 2n and 2n+1.
+			if stream <= math.MaxUint32/2 {
+				add(stream * 2)
+				add(stream*2 + 1)
+			}
+		}
+	}
+	return list
+}
+
+// hasStream returns whether the server takes part in the given stream.
+func (s *server) hasStream(stream uint32) bool {
+	for _, st := range s.streams {
+		if st == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAddPeerMsg deals with adding new peers. It is invoked from the
+// peerHandler goroutine.
+func (s *server) handleAddPeerMsg(p *bmpeer) bool {
+	if p == nil {
+		return false
+	}
+
+	// Ignore new peers if we're shutting down.
+	if atomic.LoadInt32(&s.shutdown) != 0 {
+		p.disconnect()
+		return false
+	}
+
+	// Disconnect banned and denied peers, unless they are allowed.
+	host, _, err := net.SplitHostPort(p.addr.String())
+	if err != nil {
+		p.disconnect()
+		return false
+	}
+	if banEnd, ok := s.state.banned[host]; ok && !p.allowed {
+		if time.Now().Before(banEnd) {
+			p.disconnect()
+			return false
+		}
+
+		delete(s.state.banned, host)
+	}
+	if s.isDenied(addrIP(p.addr)) {
+		peerLog.Debugf("Refusing peer %s in the deny list.", p.addr)
+		p.disconnect()
+		return false
+	}
+
+	// TODO: Check for max peers from a single IP.
+
+	// Limit max number of total peers. Allowed peers are exempt.
+	if s.state.Count() >= s.state.maxPeers && !p.allowed {
+		p.disconnect()
+		// TODO(oga) how to handle permanent peers here?
+		// they should be rescheduled.
+		return false
+	}
+
+	// Carry over the ban score of an earlier connection from the same host
+	// so that peers can't get rid of their penalties by reconnecting.
+	if score, ok := s.state.banScores[host]; ok {
+		p.StatsMtx.Lock()
+		p.banScore = score
+		p.StatsMtx.Unlock()
+		delete(s.state.banScores, host)
+	}
+	peerLog.Infof(p.peer.PrependAddr("added to server."))
+
+	// Add the new peer and start it.
+	if p.inbound {
+		s.state.peers[p] = struct{}{}
+		p.Start()
+	} else {
+		s.state.outboundGroups[addrmgr.GroupKey(p.na)]++
+		s.state.outboundStreams[p.na.Stream]++
+		if p.Persistent {
+			s.state.persistentPeers[p] = struct{}{}
+		} else {
+			s.state.outboundPeers[p] = struct{}{}
+		}
+	}
+
+	return true
+}
+
+// handleDonePeerMsg deals with peers that have signalled they are done. It is
+// invoked from the peerHandler goroutine.
+func (s *server) handleDonePeerMsg(p *bmpeer) {
+	s.rememberBanScore(p)
+	s.state.bytesSent += p.peer.BytesWritten()
+	s.state.bytesReceived += p.peer.BytesRead()
+
+	var list map[*bmpeer]struct{}
+	if p.Persistent {
+		list = s.state.persistentPeers
+		peerLog.Info(p.peer.PrependAddr("Removed from server. "), len(list), " persistent peers remain.")
+	} else if p.inbound {
+		list = s.state.peers
+		peerLog.Info(p.peer.PrependAddr("Removed from server. "), len(list), " inbound peers remain.")
+	} else {
+		list = s.state.outboundPeers
+		peerLog.Info(p.peer.PrependAddr("Removed from server. "), len(list)-1, " outbound peers remain.")
+	}
+
+	// The peer may have already been removed, for example by RemoveAddr.
+	if _, ok := list[p]; !ok {
+		return
+	}
+	delete(list, p)
+
+	// Issue an asynchronous reconnect if the peer was a
+	// persistent outbound connection.
+	if !p.inbound && p.Persistent && atomic.LoadInt32(&s.shutdown) == 0 {
+		// TODO eventually we shouldn't work with addresses represented as strings at all.
+		list[newOutboundPeer(p.addr.String(), s, p.na.Stream, true, p.RetryCount+1)] = struct{}{}
+		peerLog.Infof(p.peer.PrependAddr("Reconnected."))
+		return
+	}
+
+	// The peer no longer counts towards the outbound peers of its group
+	// and stream.
+	if !p.inbound {
+		s.state.outboundGroups[addrmgr.GroupKey(p.na)]--
+		s.state.outboundStreams[p.na.Stream]--
+	}
+}
+
+// removePeer disconnects a peer and removes it from the peer state so that it
+// is not reconnected even if it is persistent. It is invoked from the
+// peerHandler goroutine.
+func (s *server) removePeer(p *bmpeer) {
+	// Keep group and stream counts ok since we remove from the list now.
+	if !p.inbound {
+		s.state.outboundGroups[addrmgr.GroupKey(p.na)]--
+		s.state.outboundStreams[p.na.Stream]--
+	}
+	delete(s.state.peers, p)
+	delete(s.state.outboundPeers, p)
+	delete(s.state.persistentPeers, p)
+	p.disconnect()
+}
+
+// rememberBanScore keeps the ban score of a peer that is done so that it can
+// be restored if the peer reconnects. Scores that have decayed to zero are
+// forgotten. It is invoked from the peerHandler goroutine.
+func (s *server) rememberBanScore(p *bmpeer) {
+	now := time.Now()
+	for host, score := range s.state.banScores {
+		if score.Int(now) == 0 {
+			delete(s.state.banScores, host)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(p.addr.String())
+	if err != nil {
+		return
+	}
+
+	p.StatsMtx.Lock()
+	score := p.banScore.Copy()
+	p.StatsMtx.Unlock()
+
+	if score.Int(now) > 0 {
+		s.state.banScores[host] = score
+	}
+}
+
+// handleBanPeerMsg deals with banning peers. It is invoked from the
+// peerHandler goroutine.
+func (s *server) handleBanPeerMsg(p *bmpeer) {
+	host, _, err := net.SplitHostPort(p.addr.String())
+	if err != nil {
+		return
+	}
+	s.state.banned[host] = time.Now().Add(s.config().BanDuration)
+	s.saveBans()
+
+	// Log the penalties which led to the ban.
+	_, history := p.BanScore()
+	for _, e := range history {
+		serverLog.Infof("Ban score history of %s: %s: %s (+%d, score %d)",
+			host, e.Time.Format(time.RFC3339), e.Reason, e.Penalty, e.Score)
+	}
+	serverLog.Infof("Banned %s until %s.", host,
+		s.state.banned[host].Format(time.RFC3339))
+}
+
+// listenPort returns the port on which the server listens for peers.
+func (s *server) listenPort() (int, error) {
+	for _, listener := range s.listeners {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+			return addr.Port, nil
+		}
+	}
+	return 0, errors.New("not listening on TCP")
+}
+
+// addPeerLocalAddress registers the IP address by which the peer at the given
+// address knows us as a local address, with the port on which we listen. So
+// that a single peer can not choose the address we advertise, it is registered
+// only once it has been reported by peerAddrConfirmations peers with different
+// IP addresses. The address is given the lowest priority, since it comes from
+// peers. It is safe for concurrent access.
+func (s *server) addPeerLocalAddress(addrYou *wire.NetAddress, from net.Addr) {
+	host, _, err := net.SplitHostPort(from.String())
+	if err != nil {
+		return
+	}
+	port, err := s.listenPort()
+	if err != nil {
+		return
+	}
+
+	ip := addrYou.IP.String()
+	s.peerAddrMtx.Lock()
+	hosts, ok := s.peerAddrs[ip]
+	if !ok {
+		if len(s.peerAddrs) >= maxPeerAddrs && !s.forgetPeerAddr() {
+			s.peerAddrMtx.Unlock()
+			return
+		}
+		hosts = make(map[string]struct{})
+		s.peerAddrs[ip] = hosts
+	}
+	confirmed := false
+	if _, ok = hosts[host]; !ok && len(hosts) < peerAddrConfirmations {
+		hosts[host] = struct{}{}
+		confirmed = len(hosts) == peerAddrConfirmations
+	}
+	s.peerAddrMtx.Unlock()
+	if !confirmed {
+		return
+	}
+
+	na := wire.NewNetAddressIPPort(addrYou.IP, uint16(port), s.streams[0],
+		supportedServices)
+	err = s.addrManager.AddLocalAddress(na, addrmgr.PeerPrio)
+	if err != nil {
+		serverLog.Debugf("Not adding address %s reported by peer: %v",
+			addrYou.IP, err)
+	}
+}
+
+// forgetPeerAddr forgets the address reported by the fewest peers to make room
+// for another one. It returns false if all addresses have been registered
+// already. s.peerAddrMtx must be held.
+func (s *server) forgetPeerAddr() bool {
+	var fewest string
+	count := peerAddrConfirmations
+	for ip, hosts := range s.peerAddrs {
+		if len(hosts) < count {
+			fewest, count = ip, len(hosts)
+		}
+	}
+	if count == peerAddrConfirmations {
+		return false
+	}
+	delete(s.peerAddrs, fewest)
+	return true
+}
+
+// handleRelayInvMsg deals with relaying inventory of an object in the given
+// stream to peers in that stream that are not already known to have it. It is
+// invoked from the peerHandler goroutine.
+func (s *server) handleRelayInvMsg(inv *wire.InvVect, stream uint32) {
+	// The object is still sent to peers once the upload quota is used up.
+	s.bandwidth.AddFresh(&inv.Hash)
+
+	s.state.forAllPeers(func(p *bmpeer) {
+		if !p.inStream(stream) {
+			return
+		}
+
+		// Queue the inventory to be relayed with the next batch.
+		// It will be ignored if the peer is already known to
+		// have the inventory.
+		p.send.QueueInventory([]*wire.InvVect{inv})
+	})
+}
+
+type getConnCountMsg struct {
+	reply chan int32
+}
+
+type addNodeMsg struct {
+	addr      string
+	stream    uint32
+	permanent bool
+	reply     chan error
+}
+
+type delNodeMsg struct {
+	addr  string
+	reply chan error
+}
+
+type getAddedNodesMsg struct {
+	reply chan []*bmpeer
+}
+
+// peerBanScore is the ban score of a peer along with the most recent
+// penalties that it was given.
+type peerBanScore struct {
+	addr      string
+	connected bool
+	score     uint32
+	history   []banScoreEvent
+}
+
+type getBanScoresMsg struct {
+	reply chan []*peerBanScore
+}
+
+type getPeersMsg struct {
+	reply chan []*peerInfo
+}
+
+// peerStats contains the number of connected peers and the total number of
+// bytes sent to and received from peers since the server was started.
+type peerStats struct {
+	inbound       int
+	outbound      int
+	bytesSent     uint64
+	bytesReceived uint64
+}
+
+type getPeerStatsMsg struct {
+	reply chan *peerStats
+}
+
+type disconnectNodeMsg struct {
+	addr  string
+	reply chan error
+}
+
+type banHostMsg struct {
+	host  string
+	reply chan error
+}
+
+type unbanHostMsg struct {
+	host  string
+	reply chan error
+}
+
+type getBansMsg struct {
+	reply chan map[string]time.Time
+}
+
+type disconnectDeniedMsg struct {
+	reply chan struct{}
+}
+
+type setPeerLimitsMsg struct {
+	maxPeers    int
+	maxOutbound int
+	reply       chan struct{}
+}
+
+// AddNewPeer adds an ip address to the peer handler and adds permanent connections
+// to the set of persistant peers.
+// This function exists to add initial peers to the address manager before the
+// peerHandler go routine has entered its main loop.
+func (s *server) AddNewPeer(addr string, stream uint32, permanent bool) error {
+	serverLog.Debug("Creating peer at ", addr, ", stream: ", stream)
+
+	if !s.hasStream(stream) {
+		return fmt.Errorf("not taking part in stream %d", stream)
+	}
+
+	// XXX(oga) duplicate oneshots?
+	if permanent {
+		for p := range s.state.persistentPeers {
+			if p.addr.String() == addr {
+				return errors.New("peer already connected")
+			}
+		}
+	}
+	// TODO(oga) if too many, nuke a non-perm peer.
+	if !s.handleAddPeerMsg(newOutboundPeer(addr, s, stream, permanent, 0)) {
+		return errors.New("failed to add peer")
+	}
+
+	return nil
+}
+
+// handleQuery is the central handler for all queries and commands from other
+// goroutines related to the peer state.
+func (s *server) handleQuery(querymsg interface{}) {
+	switch msg := querymsg.(type) {
+	case getConnCountMsg:
+		nconnected := int32(0)
+		s.state.forAllPeers(func(p *bmpeer) {
+			// TODO
+			//if p.Connected() {
+			nconnected++
+			//}
+		})
+		msg.reply <- nconnected
+
+	case addNodeMsg:
+		msg.reply <- s.AddNewPeer(msg.addr, msg.stream, msg.permanent)
+
+	case delNodeMsg:
+		found := false
+		for p := range s.state.persistentPeers {
+			if p.addr.String() == msg.addr {
+				// This is ok because we are not continuing
+				// to iterate so won't corrupt the loop.
+				s.removePeer(p)
+				found = true
+				break
+			}
+		}
+
+		if found {
+			msg.reply <- nil
+		} else {
+			msg.reply <- errors.New("peer not found")
+		}
+
+	// Disconnect a peer of any kind without reconnecting to it.
+	case disconnectNodeMsg:
+		var found []*bmpeer
+		s.state.forAllPeers(func(p *bmpeer) {
+			if p.addr.String() == msg.addr {
+				found = append(found, p)
+			}
+		})
+		for _, p := range found {
+			s.removePeer(p)
+		}
+
+		if len(found) > 0 {
+			msg.reply <- nil
+		} else {
+			msg.reply <- errors.New("peer not found")
+		}
+
+	// Ban a host and disconnect all peers from it.
+	case banHostMsg:
+		s.state.banned[msg.host] = time.Now().Add(s.config().BanDuration)
+		var found []*bmpeer
+		s.state.forAllPeers(func(p *bmpeer) {
+			if host, _, err := net.SplitHostPort(p.addr.String()); err == nil &&
+				host == msg.host {
+				found = append(found, p)
+			}
+		})
+		for _, p := range found {
+			s.removePeer(p)
+		}
+		s.saveBans()
+		serverLog.Infof("Banned %s until %s.", msg.host,
+			s.state.banned[msg.host].Format(time.RFC3339))
+		msg.reply <- nil
+
+	// Lift the ban of a host and forget its ban score.
+	case unbanHostMsg:
+		if _, ok := s.state.banned[msg.host]; !ok {
+			msg.reply <- errors.New("host not banned")
+			return
+		}
+		delete(s.state.banned, msg.host)
+		delete(s.state.banScores, msg.host)
+		s.saveBans()
+		serverLog.Infof("Unbanned %s.", msg.host)
+		msg.reply <- nil
+
+	// Request the hosts that are banned and the end of their bans.
+	case getBansMsg:
+		now := time.Now()
+		bans := make(map[string]time.Time, len(s.state.banned))
+		for host, until := range s.state.banned {
+			if until.After(now) {
+				bans[host] = until
+			}
+		}
+		msg.reply <- bans
+
+	// Disconnect the peers in the deny list, after it has been changed.
+	case disconnectDeniedMsg:
+		var found []*bmpeer
+		s.state.forAllPeers(func(p *bmpeer) {
+			if s.isDenied(addrIP(p.addr)) {
+				found = append(found, p)
+			}
+		})
+		for _, p := range found {
+			serverLog.Infof("Disconnecting %s in the deny list.", p.addr)
+			s.removePeer(p)
+		}
+		msg.reply <- struct{}{}
+
+	// Change the maximum number of peers and the number of outbound peers
+	// to maintain in each stream.
+	case setPeerLimitsMsg:
+		s.state.setLimits(msg.maxPeers, msg.maxOutbound)
+		msg.reply <- struct{}{}
+
+	// Request the number of peers and the traffic exchanged with them.
+	case getPeerStatsMsg:
+		stats := &peerStats{
+			inbound:       len(s.state.peers),
+			outbound:      s.state.OutboundCount(),
+			bytesSent:     s.state.bytesSent,
+			bytesReceived: s.state.bytesReceived,
+		}
+		s.state.forAllPeers(func(p *bmpeer) {
+			stats.bytesSent += p.peer.BytesWritten()
+			stats.bytesReceived += p.peer.BytesRead()
+		})
+		msg.reply <- stats
+
+	// Request a description of all peers.
+	case getPeersMsg:
+		peers := make([]*peerInfo, 0, s.state.Count())
+		s.state.forAllPeers(func(p *bmpeer) {
+			peers = append(peers, p.Info())
+		})
+		msg.reply <- peers
+
+	// Request a list of the persistent (added) peers.
+	case getAddedNodesMsg:
+		// Respond with a slice of the relavent peers.
+		peers := make([]*bmpeer, 0, len(s.state.persistentPeers))
+		for p := range s.state.persistentPeers {
+			peers = append(peers, p)
+		}
+		msg.reply <- peers
+
+	// Request the ban scores of connected peers and of disconnected peers
+	// which are still remembered.
+	case getBanScoresMsg:
+		now := time.Now()
+		scores := make([]*peerBanScore, 0,
+			s.state.Count()+len(s.state.banScores))
+		s.state.forAllPeers(func(p *bmpeer) {
+			score, history := p.BanScore()
+			scores = append(scores, &peerBanScore{
+				addr:      p.addr.String(),
+				connected: true,
+				score:     score,
+				history:   history,
+			})
+		})
+		for host, score := range s.state.banScores {
+			scores = append(scores, &peerBanScore{
+				addr:    host,
+				score:   score.Int(now),
+				history: score.History(),
+			})
+		}
+		msg.reply <- scores
+	}
+}
+
+// listenHandler is the main listener which accepts incoming connections for the
+// server. It must be run as a goroutine.
+func (s *server) listenHandler(listener peer.Listener) {
+	for atomic.LoadInt32(&s.shutdown) == 0 {
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		if s.isDenied(addrIP(conn.RemoteAddr())) {
+			serverLog.Debugf("Refusing connection from %s in the deny list.",
+				conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		s.newPeers <- newInboundPeer(s, s.limitConn(conn))
+	}
+	s.wg.Done()
+}
+
+// peerHandler is used to handle peer operations such as adding and removing
+// peers to and from the server, banning peers, and broadcasting messages to
+// peers. It must be run in a goroutine.
+func (s *server) peerHandler() {
+	serverLog.Info("Peer handler started.")
+	// Start the address manager, needed by peers.
+	// This is done here since their lifecycle is closely tied
+	// to this handler and rather than adding more channels to sychronize
+	// things, it's easier and slightly faster to simply start and stop
+	// them in this handler.
+	s.addrManager.Start()
+	s.objectManager.Start()
+
+	// Add peers discovered through DNS to the address manager.
+	s.seedFromDNS()
+
+	// if nothing else happens, wake us up soon.
+	time.AfterFunc(10*time.Second, func() { s.wakeup <- struct{}{} })
+
+	advertiseTicker := time.NewTicker(advertiseInterval)
+	defer advertiseTicker.Stop()
+
+	for {
+		select {
+		// Shutdown the peer handler.
+		case <-s.quit:
+			// Shutdown peers.
+			s.state.forAllPeers(func(p *bmpeer) {
+				p.disconnect()
+			})
+			s.addrManager.Stop()
+			s.objectManager.Stop()
+			s.wg.Done()
+			return
+
+		// New peers connected to the server.
+		case p := <-s.newPeers:
+			s.handleAddPeerMsg(p)
+
+		// Disconnected peers.
+		case p := <-s.donePeers:
+			s.handleDonePeerMsg(p)
+
+		// Peer to ban.
+		case p := <-s.banPeers:
+			s.handleBanPeerMsg(p)
+
+		// Used by timers below to wake us back up.
+		case <-s.wakeup:
+			// left intentionally blank
+
+		// Advertise our own address again, so that peers that have
+		// been connected for long keep passing it on.
+		case <-advertiseTicker.C:
+			s.state.forAllPeers(func(p *bmpeer) {
+				if p.HandshakeComplete() {
+					p.pushLocalAddr()
+				}
+			})
+
+		case qmsg := <-s.query:
+			s.handleQuery(qmsg)
+		}
+
+		// Only try connect to more peers if we actually need more.
+		if atomic.LoadInt32(&s.shutdown) != 0 {
+			continue
+		}
+		needMore := false
+		for _, stream := range s.streams {
+			s.connectOutbound(stream)
+			if s.state.NeedMoreOutbound(stream) {
+				needMore = true
+			}
+		}
+
+		// We need more peers, wake up in ten seconds and try again. Ask the
+		// DNS seeders for more addresses if we are running out of them.
+		if needMore {
+			if s.addrManager.NeedMoreAddresses() {
+				s.seedFromDNS()
+			}
+			serverLog.Error("Unable to connect to new peers. Retrying in 10 seconds.")
+			time.AfterFunc(10*time.Second, func() {
+				s.wakeup <- struct{}{}
+			})
+		}
+	}
+}
+
+// connectOutbound attempts to connect to new outbound peers in the given
+// stream until there are enough of them or no suitable addresses are left. It
+// is invoked from the peerHandler goroutine.
+func (s *server) connectOutbound(stream uint32) {
+	tries := 0
+	for s.state.NeedMoreOutbound(stream) &&
+		atomic.LoadInt32(&s.shutdown) == 0 {
+
+		addr := s.addrManager.GetAddress(stream)
+		if addr == nil {
+			break
+		}
+
+		key := addrmgr.GroupKey(addr.NetAddress())
+		// Address will not be invalid, local or unroutable
+		// because addrmanager rejects those on addition.
+		// Just check that we don't already have an address
+		// in the same group so that we are not connecting
+		// to the same network segment at the expense of
+		// others.
+		if s.state.outboundGroups[key] != 0 {
+			break
+		}
+
+		tries++
+
+		// After 100 bad tries exit the loop and we'll try again
+		// later.
+		if tries > 100 {
+			break
+		}
+
+		// Skip addresses in the deny list.
+		if s.isDenied(addr.NetAddress().IP) {
+			continue
+		}
+
+		// XXX if we have limited that address skip
+
+		// only allow recent nodes (10mins) after we failed 30
+		// times
+		if time.Now().Before(addr.LastAttempt().Add(10*time.Minute)) &&
+			tries < 30 {
+			serverLog.Debug("Continuing because last attempt is too soon. ")
+			continue
+		}
+
+		addrStr := addrmgr.NetAddressKey(addr.NetAddress())
+		serverLog.Info("need more peers; attempting to connect to ", addrStr)
+
+		tries = 0
+		// any failure will be due to banned peers etc. we have
+		// already checked that we have room for more peers.
+		s.handleAddPeerMsg(newOutboundPeer(addrStr, s, stream, false, 0))
+	}
+}
+
+// BanPeer bans a peer that has already been connected to the server by ip.
+func (s *server) BanPeer(p *bmpeer) {
+	select {
+	case s.banPeers <- p:
+	case <-s.quit:
+	}
+}
+
+// ConnectedCount returns the number of currently connected peers.
+func (s *server) ConnectedCount() int32 {
+	replyChan := make(chan int32)
+
+	s.query <- getConnCountMsg{reply: replyChan}
+
+	return <-replyChan
+}
+
+// AddedNodeInfo returns an array of structures
+// describing the persistent (added) nodes.
+func (s *server) AddedNodeInfo() []*bmpeer {
+	replyChan := make(chan []*bmpeer)
+	s.query <- getAddedNodesMsg{reply: replyChan}
+	return <-replyChan
+}
+
+// BanScores returns the ban scores of connected peers and of recently
+// disconnected peers that misbehaved.
+func (s *server) BanScores() []*peerBanScore {
+	replyChan := make(chan []*peerBanScore)
+	s.query <- getBanScoresMsg{reply: replyChan}
+	return <-replyChan
+}
+
+// Peers returns a description of every peer.
+func (s *server) Peers() []*peerInfo {
+	replyChan := make(chan []*peerInfo)
+	s.query <- getPeersMsg{reply: replyChan}
+	return <-replyChan
+}
+
+// PeerStats returns the number of connected peers and the total number of
+// bytes sent to and received from peers.
+func (s *server) PeerStats() *peerStats {
+	replyChan := make(chan *peerStats)
+	s.query <- getPeerStatsMsg{reply: replyChan}
+	return <-replyChan
+}
+
+// DisconnectAddr disconnects the peer at `addr', which may be inbound or
+// outbound. Persistent peers are removed so that they are not reconnected. An
+// error will be returned if the peer was not found.
+func (s *server) DisconnectAddr(addr string) error {
+	replyChan := make(chan error)
+	s.query <- disconnectNodeMsg{addr: addr, reply: replyChan}
+	return <-replyChan
+}
+
+// BanHost bans the given IP address for the BanDuration option and disconnects
+// any peers from it.
+func (s *server) BanHost(host string) error {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("'%s' is not a valid IP address", host)
+	}
+	if s.isAllowed(ip) {
+		return fmt.Errorf("%s is in the allow list", ip)
+	}
+
+	replyChan := make(chan error)
+	s.query <- banHostMsg{host: ip.String(), reply: replyChan}
+	return <-replyChan
+}
+
+// UnbanHost lifts the ban of the given IP address. An error will be returned if
+// the address was not banned.
+func (s *server) UnbanHost(host string) error {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("'%s' is not a valid IP address", host)
+	}
+
+	replyChan := make(chan error)
+	s.query <- unbanHostMsg{host: ip.String(), reply: replyChan}
+	return <-replyChan
+}
+
+// Bans returns the hosts that are banned and the end of their bans.
+func (s *server) Bans() map[string]time.Time {
+	replyChan := make(chan map[string]time.Time)
+	s.query <- getBansMsg{reply: replyChan}
+	return <-replyChan
+}
+
+// AddIPRange adds an IP address or CIDR range to the allow or deny list, given
+// by name. Peers in a range added to the deny list are disconnected unless
+// they are allowed. Peers that are already connected are not affected by
+// changes to the allow list.
+func (s *server) AddIPRange(list, r string) error {
+	l, err := s.ipListByName(list)
+	if err != nil {
+		return err
+	}
+	ipNet, err := l.Add(r)
+	if err != nil {
+		return err
+	}
+	serverLog.Infof("Added %s to the %s list.", ipNet, list)
+
+	if l == s.denyList {
+		s.disconnectDenied()
+	}
+	return nil
+}
+
+// RemoveIPRange removes an IP address or CIDR range from the allow or deny
+// list, given by name.
+func (s *server) RemoveIPRange(list, r string) error {
+	l, err := s.ipListByName(list)
+	if err != nil {
+		return err
+	}
+	if err = l.Remove(r); err != nil {
+		return err
+	}
+	serverLog.Infof("Removed %s from the %s list.", r, list)
+	return nil
+}
+
+// disconnectDenied disconnects the peers in the deny list which are not in the
+// allow list.
+func (s *server) disconnectDenied() {
+	replyChan := make(chan struct{})
+	s.query <- disconnectDeniedMsg{reply: replyChan}
+	<-replyChan
+}
+
+// SetPeerLimits changes the maximum number of peers and the number of outbound
+// peers that the server tries to maintain in each stream. Existing peers are
+// not disconnected if there are more of them.
+func (s *server) SetPeerLimits(maxPeers, maxOutbound int) {
+	replyChan := make(chan struct{})
+	s.query <- setPeerLimitsMsg{maxPeers: maxPeers, maxOutbound: maxOutbound,
+		reply: replyChan}
+	<-replyChan
+}
+
+// AddAddr adds `addr' as a new outbound peer. If permanent is true then the
+// peer will be persistent and reconnect if the connection is lost.
+// It is an error to call this with an already existing peer.
+func (s *server) AddAddr(addr string, stream uint32, permanent bool) error {
+	replyChan := make(chan error)
+
+	s.query <- addNodeMsg{addr: addr, stream: stream, permanent: permanent, reply: replyChan}
+
+	return <-replyChan
+}
+
+// RemoveAddr removes `addr' from the list of persistent peers if present.
+// An error will be returned if the peer was not found.
+func (s *server) RemoveAddr(addr string) error {
+	replyChan := make(chan error)
+
+	s.query <- delNodeMsg{addr: addr, reply: replyChan}
+
+	return <-replyChan
+}
+
+// persistentPeerAddrs returns the addresses given by the AddPeers and
+// ConnectPeers options without duplicates.
+func persistentPeerAddrs(opts *Options) []string {
+	addrs := make([]string, 0, len(opts.AddPeers)+len(opts.ConnectPeers))
+	seen := make(map[string]struct{})
+	for _, list := range [][]string{opts.AddPeers, opts.ConnectPeers} {
+		for _, addr := range list {
+			if _, ok := seen[addr]; !ok {
+				addrs = append(addrs, addr)
+				seen[addr] = struct{}{}
+			}
+		}
+	}
+	return addrs
+}
+
+// Start begins accepting connections from peers. It connects to the peers given
+// by the ConnectPeers option if there are any, and otherwise to the default
+// peers and those given by the AddPeers option.
+func (s *server) Start() {
+	cfg := s.config()
+	var startPeers []*DefaultPeer
+	if len(cfg.ConnectPeers) == 0 {
+		startPeers = append(startPeers, defaultPeers...)
+	}
+	for _, addr := range persistentPeerAddrs(&cfg) {
+		startPeers = append(startPeers, &DefaultPeer{addr, s.streams[0], true})
+	}
+	s.start(startPeers)
+}
+
+// start is the real start function. It takes parameters that can be exposed
+// for testing purposes.
+func (s *server) start(startPeers []*DefaultPeer) {
+	// Already started?
+	if atomic.AddInt32(&s.started, 1) != 1 {
+		return
+	}
+
+	s.startTime = time.Now()
+
+	// Start all the listeners. There will not be any if listening is
+	// disabled.
+	for _, listener := range s.listeners {
+		s.wg.Add(1)
+		go s.listenHandler(listener)
+	}
+
+	// Start the peer handler which in turn starts the address manager and object manager.
+	s.wg.Add(1)
+	go s.peerHandler()
+
+	// Keep track of the upload quota.
+	s.wg.Add(1)
+	go s.bandwidthHandler()
+
+	// Map the listening port through UPnP.
+	if s.cfg.Upnp && len(s.listeners) > 0 {
+		s.wg.Add(1)
+		go s.upnpHandler()
+	}
+
+	for _, dp := range startPeers {
+		s.AddNewPeer(dp.addr, dp.stream, dp.permanent)
+	}
+
+	// Start RPC server.
+	if !s.cfg.DisableRPC {
+		s.wg.Add(1)
+		s.rpcServer.Start()
+	}
+}
+
+// Stop gracefully shuts down the server by stopping and disconnecting all
+// peers and the main listener.
+func (s *server) Stop() error {
+	// Make sure this only happens once.
+	if atomic.AddInt32(&s.shutdown, 1) != 1 {
+		return nil
+	}
+
+	// Stop all the listeners. There will not be any listeners if
+	// listening is disabled.
+	for _, listener := range s.listeners {
+		err := listener.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Stop RPC server.
+	if !s.cfg.DisableRPC {
+		err := s.rpcServer.Stop()
+		s.wg.Done()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Signal the remaining goroutines to quit.
+	close(s.quit)
+	return nil
+}
+
+// WaitForShutdown blocks until the main listener and peer handlers are stopped.
+func (s *server) WaitForShutdown() {
+	s.wg.Wait()
+}
+
+// parseListeners splits the list of listen addresses passed in addrs into
+// IPv4 and IPv6 slices and returns them. This allows easy creation of the
+// listeners on the correct interface "tcp4" and "tcp6". It also properly
+// detects addresses which apply to "all interfaces" and adds the address to
+// both slices.
+func parseListeners(addrs []string) ([]string, []string, bool, error) {
+	ipv4ListenAddrs := make([]string, 0, len(addrs)*2)
+	ipv6ListenAddrs := make([]string, 0, len(addrs)*2)
+	haveWildcard := false
+
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			// Shouldn't happen due to already being normalized.
+			return nil, nil, false, err
+		}
+
+		// Empty host or host of * on plan9 is both IPv4 and IPv6.
+		if host == "" || (host == "*" && runtime.GOOS == "plan9") {
+			ipv4ListenAddrs = append(ipv4ListenAddrs, addr)
+			ipv6ListenAddrs = append(ipv6ListenAddrs, addr)
+			haveWildcard = true
+			continue
+		}
+
+		// Parse the IP.
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, nil, false, fmt.Errorf("'%s' is not a "+
+				"valid IP address", host)
+		}
+
+		// To4 returns nil when the IP is not an IPv4 address, so use
+		// this determine the address type.
+		if ip.To4() == nil {
+			ipv6ListenAddrs = append(ipv6ListenAddrs, addr)
+		} else {
+			ipv4ListenAddrs = append(ipv4ListenAddrs, addr)
+		}
+	}
+	return ipv4ListenAddrs, ipv6ListenAddrs, haveWildcard, nil
+}
+
+// newServer returns a new bmd Server configured with the given options. Use
+// start to begin accepting connections from peers.
+func newServer(opts *Options) (*server, error) {
+	nonce, err := wire.RandomUint64()
+	if err != nil {
+		return nil, err
+	}
+
+	amgr := addrmgr.New(opts.DataDir, opts.Lookup)
+	streams := serviceStreams(opts.Streams, opts.ChildStreams)
+
+	allowList, err := newIPList(opts.AllowList)
+	if err != nil {
+		return nil, err
+	}
+	denyList, err := newIPList(opts.DenyList)
+	if err != nil {
+		return nil, err
+	}
+
+	var listeners []peer.Listener
+	ipv4Addrs, ipv6Addrs, wildcard, err := parseListeners(opts.Listeners)
+	if err != nil {
+		return nil, err
+	}
+	listeners = make([]peer.Listener, 0, len(ipv4Addrs)+len(ipv6Addrs))
+
+	// Local addresses are advertised with the port of the first listen
+	// address, unless they give their own.
+	port := uint64(0)
+	if len(opts.Listeners) > 0 {
+		_, portStr, _ := net.SplitHostPort(opts.Listeners[0])
+		port, _ = strconv.ParseUint(portStr, 10, 16)
+	}
+	if port == 0 {
+		port, _ = strconv.ParseUint(DefaultPort, 10, 16)
+	}
+
+	// The addresses of local interfaces are not advertised if external IPs
+	// were given.
+	discover := true
+	if len(opts.ExternalIPs) != 0 {
+		discover = false
+
+		for _, sip := range opts.ExternalIPs {
+			eport := uint16(port)
+			host, portstr, err := net.SplitHostPort(sip)
+			if err != nil {
+				// no port, use default.
+				host = sip
+			} else {
+				p, err := strconv.ParseUint(portstr, 10, 16)
+				if err != nil {
+					serverLog.Warnf("Can not parse port from %s for "+
+						"externalip: %v", sip, err)
+					continue
+				}
+				eport = uint16(p)
+			}
+			na, err := amgr.HostToNetAddress(host, eport, streams[0],
+				supportedServices)
+			if err != nil {
+				serverLog.Warnf("Not adding %s as externalip: %v", sip, err)
+				continue
+			}
+
+			err = amgr.AddLocalAddress(na, addrmgr.ManualPrio)
+			if err != nil {
+				serverLog.Warnf("Skipping specified external IP: %v", err)
+			}
+		}
+	}
+
+	if discover && wildcard {
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			ip, _, err := net.ParseCIDR(a.String())
+			if err != nil {
+				continue
+			}
+			// The stream of a local address is not sent to peers, so
+			// the first stream that we serve will do.
+			na := wire.NewNetAddressIPPort(ip,
+				uint16(port), streams[0], wire.SFNodeNetwork)
+			amgr.AddLocalAddress(na, addrmgr.InterfacePrio)
+		}
+	}
+
+	for _, addr := range ipv4Addrs {
+		listener, err := opts.Listen("tcp4", addr)
+		if err != nil {
+			continue
+		}
+		listeners = append(listeners, listener)
+
+		if discover {
+			if na, err := amgr.DeserializeNetAddress(addr); err == nil {
+				err = amgr.AddLocalAddress(na, addrmgr.BoundPrio)
+				if err != nil {
+				}
+			}
+		}
+	}
+
+	for _, addr := range ipv6Addrs {
+		listener, err := opts.Listen("tcp6", addr)
+		if err != nil {
+			continue
+		}
+		listeners = append(listeners, listener)
+		if discover {
+			if na, err := amgr.DeserializeNetAddress(addr); err == nil {
+				err = amgr.AddLocalAddress(na, addrmgr.BoundPrio)
+			}
+		}
+	}
+
+	// Listening is disabled if no listen addresses were given.
+	if len(opts.Listeners) > 0 && len(listeners) == 0 {
+		return nil, errors.New("no valid listen address")
+	}
+
+	s := server{
+		cfg:         opts,
+		nonce:       nonce,
+		listeners:   listeners,
+		addrManager: amgr,
+		state:       newPeerState(opts.MaxPeers, opts.MaxOutbound),
+		newPeers:    make(chan *bmpeer, opts.MaxPeers),
+		donePeers:   make(chan *bmpeer, opts.MaxPeers),
+		banPeers:    make(chan *bmpeer, opts.MaxPeers),
+		wakeup:      make(chan struct{}),
+		query:       make(chan interface{}),
+		quit:        make(chan struct{}),
+		db:          opts.DB,
+		streams:     streams,
+		allowList:   allowList,
+		denyList:    denyList,
+		bandwidth:   newBandwidth(opts),
+		peerAddrs:   make(map[string]map[string]struct{}),
+	}
+	s.newConn = func(addr net.Addr, maxDown, maxUp int64) peer.Connection {
+		return peer.NewDialConnection(addr, maxDown, maxUp, s.cfg.Dial)
+	}
+	s.discoverNAT = func() (*upnpNAT, error) {
+		return discoverUPnP(ssdpAddr)
+	}
+	s.objectManager = newObjectManager(&s)
+
+	// Restore the use of the upload quota and the bans from the last run.
+	if err = s.bandwidth.load(s.quotaPath()); err != nil {
+		serverLog.Warnf("Failed to load the use of the upload quota: %v", err)
+	}
+	bans, err := loadBans(s.banListPath())
+	if err != nil {
+		serverLog.Warnf("Failed to load bans: %v", err)
+	} else {
+		s.state.banned = bans
+		if len(bans) > 0 {
+			serverLog.Infof("Loaded %d bans.", len(bans))
+		}
+	}
+
+	if !opts.DisableRPC {
+		s.rpcServer, err = newRPCServer(opts.RPCListeners, &s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &s, nil
+}
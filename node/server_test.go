@@ -0,0 +1,176 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+// TestServiceStreams checks that the list of streams to take part in is
+// built correctly from the configuration.
+func TestServiceStreams(t *testing.T) {
+	tests := []struct {
+		streams  []uint32
+		children bool
+		expected []uint32
+	}{
+		{[]uint32{1}, false, []uint32{1}},
+		{[]uint32{1}, true, []uint32{1, 2, 3}},
+		{[]uint32{3, 1, 3}, false, []uint32{3, 1}},
+		{[]uint32{1, 2}, true, []uint32{1, 2, 3, 4, 5}},
+		{[]uint32{math.MaxUint32}, true, []uint32{math.MaxUint32}},
+	}
+
+	for i, test := range tests {
+		streams := serviceStreams(test.streams, test.children)
+		if !reflect.DeepEqual(streams, test.expected) {
+			t.Errorf("for case #%d expected %v, got %v", i, test.expected,
+				streams)
+		}
+	}
+}
+
+// recordSend is a send queue which records the messages queued on it.
+type recordSend struct {
+	mtx  sync.Mutex
+	msgs []wire.Message
+}
+
+func (rs *recordSend) QueueMessage(msg wire.Message) error {
+	rs.mtx.Lock()
+	rs.msgs = append(rs.msgs, msg)
+	rs.mtx.Unlock()
+	return nil
+}
+
+func (rs *recordSend) QueueDataRequest([]*wire.InvVect) error {
+	return nil
+}
+
+func (rs *recordSend) QueueInventory([]*wire.InvVect) error {
+	return nil
+}
+
+func (rs *recordSend) Start(peer.Connection) {}
+
+func (rs *recordSend) Running() bool {
+	return true
+}
+
+func (rs *recordSend) Stop() {}
+
+// remoteConn is a connection of which only the remote address is known.
+type remoteConn struct {
+	peer.Connection
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// TestLocalAddresses checks that external IPs and addresses reported by peers
+// are registered as local addresses, and that the best one is advertised.
+func TestLocalAddresses(t *testing.T) {
+	newTestServer := func(externalIPs []string) *server {
+		opts := testOptions(getMemDb([]*wire.MsgObject{}),
+			MockListen([]*MockListener{NewMockListener(
+				&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8445},
+				make(chan peer.Connection), make(chan struct{}, 1))}))
+		opts.Listeners = []string{"127.0.0.1:8445"}
+		opts.ExternalIPs = externalIPs
+		serv, err := newServer(opts)
+		if err != nil {
+			t.Fatalf("newServer failed: %v", err)
+		}
+		return serv
+	}
+	remote := wire.NewNetAddressIPPort(net.ParseIP("8.8.8.8"), 8444, 1, 0)
+	addrYou := wire.NewNetAddressIPPort(net.ParseIP("93.184.216.34"), 51234,
+		1, 0)
+
+	reporter := func(i int) net.Addr {
+		return &net.TCPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 8444}
+	}
+
+	// The address reported by peers is used with our listening port if
+	// there is nothing better, but only once enough peers with different
+	// IP addresses agree on it.
+	serv := newTestServer(nil)
+	for i := 1; i < peerAddrConfirmations; i++ {
+		serv.addPeerLocalAddress(addrYou, reporter(i))
+		serv.addPeerLocalAddress(addrYou, reporter(i))
+	}
+	na := serv.addrManager.GetBestLocalAddress(remote)
+	if na.IP.Equal(addrYou.IP) {
+		t.Errorf("address reported by %d peers is advertised",
+			peerAddrConfirmations-1)
+	}
+	serv.addPeerLocalAddress(addrYou, reporter(peerAddrConfirmations))
+	na = serv.addrManager.GetBestLocalAddress(remote)
+	if !na.IP.Equal(addrYou.IP) || na.Port != 8445 {
+		t.Errorf("expected %s:8445, got %s:%d", addrYou.IP, na.IP, na.Port)
+	}
+
+	// Only so many reported addresses are kept track of, and those that
+	// are advertised are not forgotten.
+	for i := 0; i < 2*maxPeerAddrs; i++ {
+		serv.addPeerLocalAddress(wire.NewNetAddressIPPort(
+			net.IPv4(93, 184, 217, byte(i)), 8444, 1, 0), reporter(1))
+	}
+	if len(serv.peerAddrs) != maxPeerAddrs {
+		t.Errorf("expected %d reported addresses, got %d", maxPeerAddrs,
+			len(serv.peerAddrs))
+	}
+	if _, ok := serv.peerAddrs[addrYou.IP.String()]; !ok {
+		t.Error("advertised address was forgotten")
+	}
+
+	// External IPs are preferred, and invalid ones are skipped.
+	serv = newTestServer([]string{"93.184.216.35:8555", "93.184.216.36:x"})
+	for i := 1; i <= peerAddrConfirmations; i++ {
+		serv.addPeerLocalAddress(addrYou, reporter(i))
+	}
+	na = serv.addrManager.GetBestLocalAddress(remote)
+	if !na.IP.Equal(net.ParseIP("93.184.216.35")) || na.Port != 8555 {
+		t.Errorf("expected 93.184.216.35:8555, got %s:%d", na.IP, na.Port)
+	}
+
+	// The best local address is advertised to a peer each time, in the
+	// stream that we share with it.
+	send := &recordSend{}
+	conn := remoteConn{addr: &net.TCPAddr{IP: remote.IP, Port: 8444}}
+	p := newPeerBase(conn.addr, serv, peer.NewInventory(), send, false,
+		false, 0)
+	p.peer = peer.NewPeer(p, conn, send)
+	p.na = remote
+	p.streams = []uint32{2}
+	p.pushLocalAddr()
+	p.pushLocalAddr()
+
+	if len(send.msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(send.msgs))
+	}
+	for _, msg := range send.msgs {
+		addr, ok := msg.(*wire.MsgAddr)
+		if !ok || len(addr.AddrList) != 1 {
+			t.Fatalf("expected an addr message with 1 address, got %v", msg)
+		}
+		na := addr.AddrList[0]
+		if !na.IP.Equal(net.ParseIP("93.184.216.35")) || na.Port != 8555 ||
+			na.Stream != 2 || time.Since(na.Timestamp) > time.Minute {
+			t.Errorf("unexpected address %s:%d in stream %d at %v", na.IP,
+				na.Port, na.Stream, na.Timestamp)
+		}
+	}
+}
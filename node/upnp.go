@@ -0,0 +1,484 @@
+// Originally derived from: btcsuite/btcd/upnp.go
+// Copyright (c) 2013-2014 The btcsuite developers
+
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// The UPnP code was taken from Taipei Torrent, whose license is below:
+//
+// Copyright (c) 2010 Jack Palevich. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package node
+
+// Just enough UPnP to be able to forward ports.
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monetas/bmd/addrmgr"
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	// ssdpAddr is the multicast address on which UPnP devices are
+	// discovered.
+	ssdpAddr = "239.255.255.250:1900"
+
+	// upnpDiscoverTimeout is how long to wait for a gateway to answer each
+	// discovery request.
+	upnpDiscoverTimeout = time.Second * 3
+
+	// upnpRequestTimeout is how long to wait for each HTTP request made to a
+	// gateway.
+	upnpRequestTimeout = time.Second * 5
+
+	// upnpLeaseDuration is how long a port mapping lasts unless it is
+	// renewed, and upnpRenewInterval how often it is renewed.
+	upnpLeaseDuration = time.Minute * 20
+	upnpRenewInterval = time.Minute * 15
+
+	// wanIPConnection is the UPnP service which maps ports.
+	wanIPConnection = "urn:schemas-upnp-org:service:WANIPConnection:1"
+)
+
+// upnpClient makes the HTTP requests to gateways, so that an unresponsive
+// gateway does not hold up the server.
+var upnpClient = &http.Client{Timeout: upnpRequestTimeout}
+
+// upnpNAT is an internet gateway device which maps ports through UPnP.
+type upnpNAT struct {
+	serviceURL string
+	ourIP      string
+}
+
+// discoverUPnP searches for an internet gateway device by sending SSDP
+// requests to the given address, which is normally ssdpAddr.
+func discoverUPnP(addr string) (*upnpNAT, error) {
+	ssdp, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	socket := conn.(*net.UDPConn)
+	defer socket.Close()
+
+	st := "ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n"
+	message := []byte("M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		st +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n")
+	answerBytes := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		if _, err = socket.WriteToUDP(message, ssdp); err != nil {
+			return nil, err
+		}
+		err = socket.SetReadDeadline(time.Now().Add(upnpDiscoverTimeout))
+		if err != nil {
+			return nil, err
+		}
+		n, _, err := socket.ReadFromUDP(answerBytes)
+		if err != nil {
+			continue
+		}
+		answer := string(answerBytes[:n])
+		if !strings.Contains(answer, "\r\n"+st) {
+			continue
+		}
+
+		// HTTP header field names are case-insensitive.
+		// http://www.w3.org/Protocols/rfc2616/rfc2616-sec4.html#sec4.2
+		locString := "\r\nlocation: "
+		locIndex := strings.Index(strings.ToLower(answer), locString)
+		if locIndex < 0 {
+			continue
+		}
+		loc := answer[locIndex+len(locString):]
+		endIndex := strings.Index(loc, "\r\n")
+		if endIndex < 0 {
+			continue
+		}
+		locURL := strings.TrimSpace(loc[:endIndex])
+
+		serviceURL, err := getServiceURL(locURL)
+		if err != nil {
+			return nil, err
+		}
+		ourIP, err := getOurIP(serviceURL)
+		if err != nil {
+			return nil, err
+		}
+		return &upnpNAT{serviceURL: serviceURL, ourIP: ourIP}, nil
+	}
+	return nil, errors.New("UPnP port discovery failed")
+}
+
+// service represents the Service type in an UPnP xml description.
+// Only the parts we care about are present and thus the xml may have more
+// fields than present in the structure.
+type service struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// deviceList represents the deviceList type in an UPnP xml description.
+type deviceList struct {
+	XMLName xml.Name `xml:"deviceList"`
+	Device  []device `xml:"device"`
+}
+
+// serviceList represents the serviceList type in an UPnP xml description.
+type serviceList struct {
+	XMLName xml.Name  `xml:"serviceList"`
+	Service []service `xml:"service"`
+}
+
+// device represents the device type in an UPnP xml description.
+type device struct {
+	XMLName     xml.Name    `xml:"device"`
+	DeviceType  string      `xml:"deviceType"`
+	DeviceList  deviceList  `xml:"deviceList"`
+	ServiceList serviceList `xml:"serviceList"`
+}
+
+// specVersion represents the specVersion in a UPnP xml description.
+type specVersion struct {
+	XMLName xml.Name `xml:"specVersion"`
+	Major   int      `xml:"major"`
+	Minor   int      `xml:"minor"`
+}
+
+// root represents the Root document for a UPnP xml description.
+type root struct {
+	XMLName     xml.Name `xml:"root"`
+	SpecVersion specVersion
+	Device      device
+}
+
+// getChildDevice searches the children of device for a device with the given
+// type.
+func getChildDevice(d *device, deviceType string) *device {
+	for i := range d.DeviceList.Device {
+		if d.DeviceList.Device[i].DeviceType == deviceType {
+			return &d.DeviceList.Device[i]
+		}
+	}
+	return nil
+}
+
+// getChildService searches the service list of device for a service with the
+// given type.
+func getChildService(d *device, serviceType string) *service {
+	for i := range d.ServiceList.Service {
+		if d.ServiceList.Service[i].ServiceType == serviceType {
+			return &d.ServiceList.Service[i]
+		}
+	}
+	return nil
+}
+
+// getOurIP returns the local IP address from which the host of serviceURL is
+// reached.
+func getOurIP(serviceURL string) (string, error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return "", err
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+
+	// No packets are sent by connecting a UDP socket.
+	conn, err := net.Dial("udp4", host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	ip, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	return ip, err
+}
+
+// getServiceURL parses the xml description at the given root url to find the
+// url for the WANIPConnection service to be used for port forwarding.
+func getServiceURL(rootURL string) (string, error) {
+	r, err := upnpClient.Get(rootURL)
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+	if r.StatusCode >= 400 {
+		return "", errors.New(r.Status)
+	}
+	var root root
+	if err = xml.NewDecoder(r.Body).Decode(&root); err != nil {
+		return "", err
+	}
+	a := &root.Device
+	if a.DeviceType != "urn:schemas-upnp-org:device:InternetGatewayDevice:1" {
+		return "", errors.New("no InternetGatewayDevice")
+	}
+	b := getChildDevice(a, "urn:schemas-upnp-org:device:WANDevice:1")
+	if b == nil {
+		return "", errors.New("no WANDevice")
+	}
+	c := getChildDevice(b, "urn:schemas-upnp-org:device:WANConnectionDevice:1")
+	if c == nil {
+		return "", errors.New("no WANConnectionDevice")
+	}
+	d := getChildService(c, wanIPConnection)
+	if d == nil {
+		return "", errors.New("no WANIPConnection")
+	}
+	return combineURL(rootURL, d.ControlURL)
+}
+
+// combineURL resolves the control url of a service, which may be relative,
+// against the url of the description in which it was found.
+func combineURL(rootURL, subURL string) (string, error) {
+	base, err := url.Parse(rootURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(subURL)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// soapBody represents the <s:Body> element in a SOAP reply.
+// fields we don't care about are elided.
+type soapBody struct {
+	XMLName xml.Name `xml:"Body"`
+	Data    []byte   `xml:",innerxml"`
+}
+
+// soapEnvelope represents the <s:Envelope> element in a SOAP reply.
+// fields we don't care about are elided.
+type soapEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    soapBody `xml:"Body"`
+}
+
+// soapRequest performs a soap request with the given parameters and returns
+// the xml replied stripped of the soap headers. in the case that the request is
+// unsuccessful the an error is returned.
+func soapRequest(serviceURL, function, message string) ([]byte, error) {
+	fullMessage := "<?xml version=\"1.0\" ?>" +
+		"<s:Envelope xmlns:s=\"http://schemas.xmlsoap.org/soap/envelope/\" s:encodingStyle=\"http://schemas.xmlsoap.org/soap/encoding/\">\r\n" +
+		"<s:Body>" + message + "</s:Body></s:Envelope>"
+
+	req, err := http.NewRequest("POST", serviceURL, strings.NewReader(fullMessage))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml ; charset=\"utf-8\"")
+	req.Header.Set("User-Agent", "Darwin/10.0.0, UPnP/1.0, MiniUPnPc/1.3")
+	req.Header.Set("SOAPAction", "\""+wanIPConnection+"#"+function+"\"")
+	req.Header.Set("Connection", "Close")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Pragma", "no-cache")
+
+	r, err := upnpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode >= 400 {
+		return nil, errors.New("error " + strconv.Itoa(r.StatusCode) +
+			" for " + function)
+	}
+	var reply soapEnvelope
+	if err = xml.NewDecoder(r.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	return reply.Body.Data, nil
+}
+
+// getExternalIPAddressResponse represents the XML response to a
+// GetExternalIPAddress SOAP request.
+type getExternalIPAddressResponse struct {
+	XMLName           xml.Name `xml:"GetExternalIPAddressResponse"`
+	ExternalIPAddress string   `xml:"NewExternalIPAddress"`
+}
+
+// GetExternalAddress returns the external IP address of the gateway.
+func (n *upnpNAT) GetExternalAddress() (net.IP, error) {
+	message := "<u:GetExternalIPAddress xmlns:u=\"" + wanIPConnection + "\"/>\r\n"
+	response, err := soapRequest(n.serviceURL, "GetExternalIPAddress",
+		message)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply getExternalIPAddressResponse
+	if err = xml.Unmarshal(response, &reply); err != nil {
+		return nil, err
+	}
+	addr := net.ParseIP(reply.ExternalIPAddress)
+	if addr == nil {
+		return nil, errors.New("unable to parse ip address")
+	}
+	return addr, nil
+}
+
+// AddPortMapping maps externalPort on the gateway to internalPort on this
+// host for the given lease duration, and returns the mapped external port.
+func (n *upnpNAT) AddPortMapping(protocol string, externalPort,
+	internalPort int, description string, lease time.Duration) (int, error) {
+	message := "<u:AddPortMapping xmlns:u=\"" + wanIPConnection + "\">\r\n" +
+		"<NewRemoteHost></NewRemoteHost>" +
+		"<NewExternalPort>" + strconv.Itoa(externalPort) + "</NewExternalPort>" +
+		"<NewProtocol>" + strings.ToUpper(protocol) + "</NewProtocol>" +
+		"<NewInternalPort>" + strconv.Itoa(internalPort) + "</NewInternalPort>" +
+		"<NewInternalClient>" + n.ourIP + "</NewInternalClient>" +
+		"<NewEnabled>1</NewEnabled>" +
+		"<NewPortMappingDescription>" + description +
+		"</NewPortMappingDescription>" +
+		"<NewLeaseDuration>" + strconv.Itoa(int(lease/time.Second)) +
+		"</NewLeaseDuration></u:AddPortMapping>"
+
+	// TODO: check response to see if the port was forwarded. If the port
+	// was not forwarded, try again with a different external port.
+	if _, err := soapRequest(n.serviceURL, "AddPortMapping",
+		message); err != nil {
+		return 0, err
+	}
+	return externalPort, nil
+}
+
+// DeletePortMapping removes a port mapping from the gateway.
+func (n *upnpNAT) DeletePortMapping(protocol string, externalPort,
+	internalPort int) error {
+	message := "<u:DeletePortMapping xmlns:u=\"" + wanIPConnection + "\">\r\n" +
+		"<NewRemoteHost></NewRemoteHost><NewExternalPort>" +
+		strconv.Itoa(externalPort) +
+		"</NewExternalPort><NewProtocol>" + strings.ToUpper(protocol) +
+		"</NewProtocol>" + "</u:DeletePortMapping>"
+
+	_, err := soapRequest(n.serviceURL, "DeletePortMapping", message)
+	return err
+}
+
+// upnpHandler maps the port on which the server listens through a UPnP
+// gateway and registers the external address of the gateway with the address
+// manager, so that it is advertised to peers. The mapping is renewed every
+// upnpRenewInterval and removed when the server shuts down. It must be run as
+// a goroutine.
+func (s *server) upnpHandler() {
+	defer s.wg.Done()
+
+	port, err := s.listenPort()
+	if err != nil {
+		serverLog.Warnf("Can't map a port through UPnP: %v", err)
+		return
+	}
+
+	var nat *upnpNAT
+	var externalIP net.IP
+	description := fmt.Sprintf("bmd listen port %d", port)
+
+	// Go off immediately, and renew the lease thereafter.
+	timer := time.NewTimer(0)
+out:
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(upnpRenewInterval)
+
+			// Look for a gateway until one is found.
+			if nat == nil {
+				nat, err = s.discoverNAT()
+				if err != nil {
+					serverLog.Warnf("Can't discover UPnP gateway: %v", err)
+					continue
+				}
+			}
+
+			_, err = nat.AddPortMapping("tcp", port, port, description,
+				upnpLeaseDuration)
+			if err != nil {
+				serverLog.Warnf("Can't add UPnP port mapping: %v", err)
+				continue
+			}
+
+			// Check the external address on every renewal in case it
+			// has changed.
+			ip, err := nat.GetExternalAddress()
+			if err != nil {
+				serverLog.Warnf("UPnP can't get external address: %v", err)
+				continue
+			}
+			if ip.Equal(externalIP) {
+				continue
+			}
+			externalIP = ip
+
+			// The stream of a local address is not sent to peers, so
+			// the first stream that we serve will do.
+			na := wire.NewNetAddressIPPort(ip, uint16(port), s.streams[0],
+				supportedServices)
+			err = s.addrManager.AddLocalAddress(na, addrmgr.UpnpPrio)
+			if err != nil {
+				serverLog.Warnf("Can't add UPnP address %s: %v",
+					addrmgr.NetAddressKey(na), err)
+				continue
+			}
+			serverLog.Infof("Successfully bound via UPnP to %s",
+				addrmgr.NetAddressKey(na))
+
+		case <-s.quit:
+			break out
+		}
+	}
+	timer.Stop()
+
+	if nat == nil {
+		return
+	}
+	if err = nat.DeletePortMapping("tcp", port, port); err != nil {
+		serverLog.Warnf("Unable to remove UPnP port mapping: %v", err)
+	} else {
+		serverLog.Debugf("Successfully removed UPnP port mapping")
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmd/peer"
+	"github.com/monetas/bmutil/wire"
+)
+
+// igdDescription is the description of the fake internet gateway device.
+const igdDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+// portMapping is a port mapping made on the fake internet gateway device.
+type portMapping struct {
+	ExternalPort int    `xml:"NewExternalPort"`
+	Protocol     string `xml:"NewProtocol"`
+	InternalPort int    `xml:"NewInternalPort"`
+	Client       string `xml:"NewInternalClient"`
+	Lease        int    `xml:"NewLeaseDuration"`
+}
+
+// igdRequest is a SOAP request to the fake internet gateway device.
+type igdRequest struct {
+	Body struct {
+		Add    *portMapping `xml:"AddPortMapping"`
+		Delete *portMapping `xml:"DeletePortMapping"`
+	}
+}
+
+// fakeIGD is an internet gateway device which answers SSDP requests and maps
+// ports on the local host.
+type fakeIGD struct {
+	ssdp       *net.UDPConn
+	http       *httptest.Server
+	externalIP string
+
+	mtx      sync.Mutex
+	mappings map[int]*portMapping // by external port.
+}
+
+func newFakeIGD(externalIP string) (*fakeIGD, error) {
+	ssdp, err := net.ListenUDP("udp4",
+		&net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		return nil, err
+	}
+
+	igd := &fakeIGD{
+		ssdp:       ssdp,
+		externalIP: externalIP,
+		mappings:   make(map[int]*portMapping),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, igdDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", igd.control)
+	igd.http = httptest.NewServer(mux)
+
+	go igd.answerSSDP()
+	return igd, nil
+}
+
+// ssdpAddr returns the address on which the device answers SSDP requests.
+func (igd *fakeIGD) ssdpAddr() string {
+	return igd.ssdp.LocalAddr().String()
+}
+
+// answerSSDP answers search requests with the location of the description of
+// the device until it is closed.
+func (igd *fakeIGD) answerSSDP() {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := igd.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+			continue
+		}
+		answer := "HTTP/1.1 200 OK\r\n" +
+			"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+			"Location: " + igd.http.URL + "/rootDesc.xml\r\n\r\n"
+		igd.ssdp.WriteToUDP([]byte(answer), addr)
+	}
+}
+
+// control handles SOAP requests to the WANIPConnection service.
+func (igd *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	var req igdRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	igd.mtx.Lock()
+	defer igd.mtx.Unlock()
+
+	action := r.Header.Get("SOAPAction")
+	var response string
+	switch {
+	case strings.HasSuffix(action, "#GetExternalIPAddress\""):
+		response = "<u:GetExternalIPAddressResponse xmlns:u=\"" +
+			wanIPConnection + "\"><NewExternalIPAddress>" + igd.externalIP +
+			"</NewExternalIPAddress></u:GetExternalIPAddressResponse>"
+	case strings.HasSuffix(action, "#AddPortMapping\"") && req.Body.Add != nil:
+		igd.mappings[req.Body.Add.ExternalPort] = req.Body.Add
+	case strings.HasSuffix(action, "#DeletePortMapping\"") && req.Body.Delete != nil:
+		if _, ok := igd.mappings[req.Body.Delete.ExternalPort]; !ok {
+			http.Error(w, "no such mapping", http.StatusInternalServerError)
+			return
+		}
+		delete(igd.mappings, req.Body.Delete.ExternalPort)
+	default:
+		http.Error(w, "invalid action", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "<?xml version=\"1.0\"?>"+
+		"<s:Envelope xmlns:s=\"http://schemas.xmlsoap.org/soap/envelope/\">"+
+		"<s:Body>"+response+"</s:Body></s:Envelope>")
+}
+
+// mapping returns the mapping of the given external port, or nil if there is
+// none.
+func (igd *fakeIGD) mapping(port int) *portMapping {
+	igd.mtx.Lock()
+	defer igd.mtx.Unlock()
+	return igd.mappings[port]
+}
+
+func (igd *fakeIGD) Close() {
+	igd.ssdp.Close()
+	igd.http.Close()
+}
+
+func TestUPnP(t *testing.T) {
+	igd, err := newFakeIGD("93.184.216.34")
+	if err != nil {
+		t.Fatalf("newFakeIGD failed: %v", err)
+	}
+	defer igd.Close()
+
+	nat, err := discoverUPnP(igd.ssdpAddr())
+	if err != nil {
+		t.Fatalf("discoverUPnP failed: %v", err)
+	}
+	if nat.serviceURL != igd.http.URL+"/ctl/IPConn" {
+		t.Errorf("unexpected service URL %s", nat.serviceURL)
+	}
+	if nat.ourIP != "127.0.0.1" {
+		t.Errorf("unexpected local IP %s", nat.ourIP)
+	}
+
+	ip, err := nat.GetExternalAddress()
+	if err != nil {
+		t.Fatalf("GetExternalAddress failed: %v", err)
+	}
+	if !ip.Equal(net.ParseIP(igd.externalIP)) {
+		t.Errorf("expected external address %s, got %s", igd.externalIP, ip)
+	}
+
+	port, err := nat.AddPortMapping("tcp", 8445, 8444, "test", time.Minute)
+	if err != nil {
+		t.Fatalf("AddPortMapping failed: %v", err)
+	}
+	if port != 8445 {
+		t.Errorf("expected external port 8445, got %d", port)
+	}
+	expected := portMapping{8445, "TCP", 8444, "127.0.0.1", 60}
+	if m := igd.mapping(8445); m == nil || *m != expected {
+		t.Errorf("expected mapping %v, got %v", expected, m)
+	}
+
+	if err = nat.DeletePortMapping("tcp", 8445, 8444); err != nil {
+		t.Fatalf("DeletePortMapping failed: %v", err)
+	}
+	if m := igd.mapping(8445); m != nil {
+		t.Errorf("mapping %v was not removed", m)
+	}
+	if err = nat.DeletePortMapping("tcp", 8445, 8444); err == nil {
+		t.Error("expected an error removing a mapping twice")
+	}
+}
+
+func TestUPnPHandler(t *testing.T) {
+	igd, err := newFakeIGD("93.184.216.34")
+	if err != nil {
+		t.Fatalf("newFakeIGD failed: %v", err)
+	}
+	defer igd.Close()
+
+	opts := testOptions(getMemDb([]*wire.MsgObject{}),
+		MockListen([]*MockListener{NewMockListener(
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8445},
+			make(chan peer.Connection), make(chan struct{}, 1))}))
+	opts.Upnp = true
+	serv, err := newServer(opts)
+	if err != nil {
+		t.Fatalf("newServer failed: %v", err)
+	}
+	serv.discoverNAT = func() (*upnpNAT, error) {
+		return discoverUPnP(igd.ssdpAddr())
+	}
+
+	serv.wg.Add(1)
+	go serv.upnpHandler()
+
+	// The external address is advertised once the port is mapped.
+	remote := wire.NewNetAddressIPPort(net.ParseIP("8.8.8.8"), 8444, 1, 0)
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("the external address of the gateway was not advertised")
+		}
+		na := serv.addrManager.GetBestLocalAddress(remote)
+		if na.IP.Equal(net.ParseIP(igd.externalIP)) {
+			if na.Port != 8445 {
+				t.Errorf("expected port 8445, got %d", na.Port)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if igd.mapping(8445) == nil {
+		t.Error("the listening port was not mapped")
+	}
+
+	// The mapping is removed on shutdown.
+	close(serv.quit)
+	serv.wg.Wait()
+	if m := igd.mapping(8445); m != nil {
+		t.Errorf("mapping %v was not removed", m)
+	}
+}
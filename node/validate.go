@@ -0,0 +1,188 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/monetas/bmutil/pow"
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	// maxObjectSize is the maximum size in bytes of an encoded object that we
+	// are willing to accept and relay.
+	maxObjectSize = 1 << 18 // 256 KiB
+
+	// maxObjectTTL is the maximum time an object is allowed to live on the
+	// network before it expires.
+	maxObjectTTL = time.Hour * 24 * 28
+
+	// objectExpirySlack is the extra time beyond maxObjectTTL that we tolerate
+	// to allow for clock differences between nodes.
+	objectExpirySlack = time.Hour * 3
+)
+
+// objectRejectReason identifies the reason that an object failed validation.
+type objectRejectReason int
+
+const (
+	// rejectTooLarge means that the encoded object exceeds maxObjectSize.
+	rejectTooLarge objectRejectReason = iota
+
+	// rejectExpired means that the expiry time of the object has passed.
+	rejectExpired
+
+	// rejectFarFuture means that the object expires too far in the future.
+	rejectFarFuture
+
+	// rejectStream means that the object belongs to a stream we don't serve.
+	rejectStream
+
+	// rejectVersion means that the object version is not valid for its type.
+	rejectVersion
+
+	// rejectMalformed means that the payload of the object could not be
+	// decoded according to its type.
+	rejectMalformed
+
+	// rejectPoW means that the object has insufficient proof of work.
+	rejectPoW
+)
+
+// rejectReasonStrings is a map of reject reasons back to their constant names
+// for pretty printing.
+var rejectReasonStrings = map[objectRejectReason]string{
+	rejectTooLarge:  "too large",
+	rejectExpired:   "expired",
+	rejectFarFuture: "expires too far in the future",
+	rejectStream:    "invalid stream",
+	rejectVersion:   "invalid version",
+	rejectMalformed: "malformed",
+	rejectPoW:       "invalid proof of work",
+}
+
+// String returns the objectRejectReason in human-readable form.
+func (r objectRejectReason) String() string {
+	if s, ok := rejectReasonStrings[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown reason (%d)", int(r))
+}
+
+// objectRejection describes why an object was rejected. It implements the
+// error interface.
+type objectRejection struct {
+	Reason objectRejectReason
+	Detail string
+}
+
+// Error returns the rejection in human-readable form.
+func (e *objectRejection) Error() string {
+	if e.Detail == "" {
+		return e.Reason.String()
+	}
+	return e.Reason.String() + ": " + e.Detail
+}
+
+// rejectObject creates an objectRejection with the given reason and a detail
+// message formatted according to a format specifier.
+func rejectObject(reason objectRejectReason, format string,
+	a ...interface{}) *objectRejection {
+	return &objectRejection{
+		Reason: reason,
+		Detail: fmt.Sprintf(format, a...),
+	}
+}
+
+// objectVersionRange is the range of versions that are valid for an object
+// type, inclusive at both ends.
+type objectVersionRange struct {
+	min, max uint64
+}
+
+// objectVersions maps known object types to the versions that are valid for
+// them. Objects of unknown types are not checked.
+var objectVersions = map[wire.ObjectType]objectVersionRange{
+	// The version of a getpubkey is that of the requested address.
+	wire.ObjectTypeGetPubKey: {2, 4},
+	wire.ObjectTypePubKey: {wire.SimplePubKeyVersion,
+		wire.EncryptedPubKeyVersion},
+	wire.ObjectTypeMsg: {1, 1},
+	// Version 4 broadcasts are untagged and version 5 broadcasts are tagged.
+	// Earlier versions are no longer in use on the network.
+	wire.ObjectTypeBroadcast: {4, 5},
+}
+
+// validateObject checks whether the given object is fit to be stored and
+// relayed. It checks the size of the object, its expiry time, whether it
+// belongs to one of the given streams, its version and whether its payload can
+// be decoded. The proof of work is not checked; use checkObjectPoW for that.
+// nil is returned if the object is valid.
+func validateObject(obj *wire.MsgObject, streams []uint32,
+	now time.Time) *objectRejection {
+	data := wire.EncodeMessage(obj)
+	if len(data) > maxObjectSize {
+		return rejectObject(rejectTooLarge, "%d bytes, max %d", len(data),
+			maxObjectSize)
+	}
+
+	if now.After(obj.ExpiresTime) {
+		return rejectObject(rejectExpired, "expired at %s", obj.ExpiresTime)
+	}
+	if obj.ExpiresTime.After(now.Add(maxObjectTTL + objectExpirySlack)) {
+		return rejectObject(rejectFarFuture, "expires at %s", obj.ExpiresTime)
+	}
+
+	var inStream bool
+	for _, stream := range streams {
+		if uint64(obj.StreamNumber) == uint64(stream) {
+			inStream = true
+			break
+		}
+	}
+	if !inStream {
+		return rejectObject(rejectStream, "stream %d", obj.StreamNumber)
+	}
+
+	// Objects of unknown type are relayed without further inspection.
+	versions, ok := objectVersions[obj.ObjectType]
+	if !ok {
+		return nil
+	}
+	if uint64(obj.Version) < versions.min || uint64(obj.Version) > versions.max {
+		return rejectObject(rejectVersion, "version %d for object of type %s",
+			obj.Version, obj.ObjectType)
+	}
+
+	var msg wire.Message
+	switch obj.ObjectType {
+	case wire.ObjectTypeGetPubKey:
+		msg = new(wire.MsgGetPubKey)
+	case wire.ObjectTypePubKey:
+		msg = new(wire.MsgPubKey)
+	case wire.ObjectTypeMsg:
+		msg = new(wire.MsgMsg)
+	case wire.ObjectTypeBroadcast:
+		msg = new(wire.MsgBroadcast)
+	}
+	if err := msg.Decode(bytes.NewReader(data)); err != nil {
+		return rejectObject(rejectMalformed, "%v", err)
+	}
+
+	return nil
+}
+
+// checkObjectPoW checks whether the object has sufficient proof of work. nil
+// is returned if it does.
+func checkObjectPoW(obj *wire.MsgObject, now time.Time) *objectRejection {
+	if !pow.Check(obj, pow.DefaultExtraBytes, pow.DefaultNonceTrialsPerByte,
+		now) {
+		return &objectRejection{Reason: rejectPoW}
+	}
+	return nil
+}
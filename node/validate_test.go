@@ -0,0 +1,97 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/monetas/bmutil/wire"
+)
+
+// TestValidateObject checks that validateObject accepts valid objects and
+// rejects invalid ones with the correct reason.
+func TestValidateObject(t *testing.T) {
+	now := time.Now()
+	streams := []uint32{1}
+
+	// All test objects are valid.
+	for i, obj := range testObj {
+		if rej := validateObject(obj, streams, now); rej != nil {
+			t.Errorf("for test object #%d got rejection %v", i, rej)
+		}
+	}
+
+	tests := []struct {
+		obj    *wire.MsgObject
+		reason objectRejectReason
+	}{
+		{
+			wire.NewMsgUnknownObject(0, now.Add(time.Hour), wire.ObjectType(4),
+				1, 1, make([]byte, maxObjectSize)).ToMsgObject(),
+			rejectTooLarge,
+		},
+		{
+			wire.NewMsgUnknownObject(0, now.Add(-time.Minute), wire.ObjectType(4),
+				1, 1, []byte{1, 2, 3}).ToMsgObject(),
+			rejectExpired,
+		},
+		{
+			wire.NewMsgUnknownObject(0, now.Add(maxObjectTTL+objectExpirySlack+
+				time.Minute), wire.ObjectType(4), 1, 1, []byte{1, 2, 3}).ToMsgObject(),
+			rejectFarFuture,
+		},
+		{
+			wire.NewMsgUnknownObject(0, now.Add(time.Hour), wire.ObjectType(4),
+				1, 2, []byte{1, 2, 3}).ToMsgObject(),
+			rejectStream,
+		},
+		{
+			wire.NewMsgUnknownObject(0, now.Add(time.Hour), wire.ObjectTypeMsg,
+				2, 1, []byte{1, 2, 3}).ToMsgObject(),
+			rejectVersion,
+		},
+		{
+			wire.NewMsgUnknownObject(0, now.Add(time.Hour), wire.ObjectTypeBroadcast,
+				1, 1, []byte{1, 2, 3}).ToMsgObject(),
+			rejectVersion,
+		},
+		{ // A getpubkey which is too short to hold a tag.
+			wire.NewMsgUnknownObject(0, now.Add(time.Hour), wire.ObjectTypeGetPubKey,
+				4, 1, []byte{1, 2, 3}).ToMsgObject(),
+			rejectMalformed,
+		},
+	}
+
+	for i, test := range tests {
+		rej := validateObject(test.obj, streams, now)
+		if rej == nil {
+			t.Errorf("for case #%d got no rejection, expected %s", i,
+				test.reason)
+			continue
+		}
+		if rej.Reason != test.reason {
+			t.Errorf("for case #%d expected rejection %s, got %s", i,
+				test.reason, rej.Reason)
+		}
+	}
+}
+
+// TestCheckObjectPoW checks that objects without a valid proof of work are
+// rejected.
+func TestCheckObjectPoW(t *testing.T) {
+	now := time.Now()
+
+	if rej := checkObjectPoW(testObj[0], now); rej != nil {
+		t.Errorf("for object with valid PoW got rejection %v", rej)
+	}
+
+	obj := wire.NewMsgUnknownObject(0, now.Add(time.Hour), wire.ObjectType(4),
+		1, 1, []byte{1, 2, 3}).ToMsgObject()
+	rej := checkObjectPoW(obj, now)
+	if rej == nil || rej.Reason != rejectPoW {
+		t.Errorf("expected rejection %s, got %v", rejectPoW, rej)
+	}
+}
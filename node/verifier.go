@@ -0,0 +1,172 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// objectVerifyQueuePerWorker is the number of objects per verification
+	// worker that may be waiting to be verified. Objects received while the
+	// queue is full are dropped.
+	objectVerifyQueuePerWorker = 16
+)
+
+// verifyJob is an object waiting to be verified. The result is sent on done
+// once a worker has checked the object.
+type verifyJob struct {
+	msg  *objectMsg
+	done chan *objectRejection
+}
+
+// verifiedObjectMsg is sent to the object manager once an object received from
+// a peer has been verified. rejection is nil if the object is valid.
+type verifiedObjectMsg struct {
+	*objectMsg
+	rejection *objectRejection
+}
+
+// objectVerifier checks objects received from peers in a pool of worker
+// goroutines so that checking the proof of work of large objects does not hold
+// up the object manager. Results are delivered in the order in which the
+// objects were submitted.
+type objectVerifier struct {
+	started  int32
+	shutdown int32
+	workers  int
+	streams  []uint32
+	jobs     chan *verifyJob // objects waiting for a worker.
+	pending  chan *verifyJob // objects waiting for their result to be delivered.
+	output   chan<- interface{}
+	dropped  uint64            // atomic
+	powTime  *metricsHistogram // in seconds.
+	wg       sync.WaitGroup
+	quit     chan struct{}
+}
+
+// worker verifies objects until the verifier is stopped. It must be run as a
+// goroutine.
+func (v *objectVerifier) worker() {
+	defer v.wg.Done()
+
+	for {
+		select {
+		case job := <-v.jobs:
+			now := time.Now()
+			rej := validateObject(job.msg.object, v.streams, now)
+			if rej == nil {
+				start := time.Now()
+				rej = checkObjectPoW(job.msg.object, now)
+				v.powTime.Observe(time.Since(start).Seconds())
+			}
+			job.done <- rej
+
+		case <-v.quit:
+			return
+		}
+	}
+}
+
+// deliverHandler waits for the result of each object in the order in which
+// they were submitted and sends it on the output channel. It must be run as a
+// goroutine.
+func (v *objectVerifier) deliverHandler() {
+	defer v.wg.Done()
+
+	for {
+		var job *verifyJob
+		select {
+		case job = <-v.pending:
+		case <-v.quit:
+			return
+		}
+
+		var rej *objectRejection
+		select {
+		case rej = <-job.done:
+		case <-v.quit:
+			return
+		}
+
+		select {
+		case v.output <- &verifiedObjectMsg{objectMsg: job.msg, rejection: rej}:
+		case <-v.quit:
+			return
+		}
+	}
+}
+
+// Submit queues an object for verification. It returns false without queueing
+// the object if the queue is full. Submit must not be called from more than one
+// goroutine at a time.
+func (v *objectVerifier) Submit(msg *objectMsg) bool {
+	job := &verifyJob{msg: msg, done: make(chan *objectRejection, 1)}
+
+	select {
+	case v.pending <- job:
+	default:
+		atomic.AddUint64(&v.dropped, 1)
+		return false
+	}
+
+	// This never blocks because every job in the jobs channel is also either
+	// in the pending channel or held by deliverHandler.
+	v.jobs <- job
+	return true
+}
+
+// Dropped returns the number of objects that were dropped because the queue
+// was full. It is safe for concurrent access.
+func (v *objectVerifier) Dropped() uint64 {
+	return atomic.LoadUint64(&v.dropped)
+}
+
+// Start starts the verification workers and the goroutine that delivers their
+// results.
+func (v *objectVerifier) Start() {
+	// Already started?
+	if atomic.AddInt32(&v.started, 1) != 1 {
+		return
+	}
+
+	v.wg.Add(v.workers + 1)
+	for i := 0; i < v.workers; i++ {
+		go v.worker()
+	}
+	go v.deliverHandler()
+}
+
+// Stop shuts down the verifier and waits for its goroutines to finish. Objects
+// that are still queued are discarded.
+func (v *objectVerifier) Stop() {
+	if atomic.AddInt32(&v.shutdown, 1) != 1 {
+		return
+	}
+
+	close(v.quit)
+	v.wg.Wait()
+}
+
+// newObjectVerifier returns a new object verifier that checks objects with the
+// given number of workers, accepting objects in the given streams. At most
+// queueSize objects may be waiting for their results to be delivered. Results
+// are sent on output as *verifiedObjectMsg. Use Start to begin verifying
+// objects.
+func newObjectVerifier(workers, queueSize int, streams []uint32,
+	output chan<- interface{}) *objectVerifier {
+	return &objectVerifier{
+		workers: workers,
+		streams: streams,
+		// deliverHandler holds one job outside of the pending channel.
+		jobs:    make(chan *verifyJob, queueSize+1),
+		pending: make(chan *verifyJob, queueSize),
+		output:  output,
+		powTime: newMetricsHistogram(powTimeBuckets),
+		quit:    make(chan struct{}),
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/monetas/bmutil/wire"
+)
+
+// TestObjectVerifier checks that the verifier delivers results in the order in
+// which objects were submitted and that they match those of validateObject and
+// checkObjectPoW.
+func TestObjectVerifier(t *testing.T) {
+	streams := []uint32{1}
+	now := time.Now()
+
+	// Mix invalid objects in with the valid test objects.
+	objects := make([]*wire.MsgObject, 0, len(testObj)*2)
+	for _, obj := range testObj {
+		objects = append(objects, obj, wire.NewMsgUnknownObject(0,
+			now.Add(time.Hour), wire.ObjectType(4), 1, 2,
+			[]byte{1, 2, 3}).ToMsgObject())
+	}
+
+	output := make(chan interface{}, len(objects))
+	v := newObjectVerifier(4, len(objects), streams, output)
+	v.Start()
+	defer v.Stop()
+
+	for i, obj := range objects {
+		if !v.Submit(&objectMsg{object: obj}) {
+			t.Fatalf("object #%d was not accepted", i)
+		}
+	}
+
+	for i, obj := range objects {
+		var vmsg *verifiedObjectMsg
+		select {
+		case m := <-output:
+			vmsg = m.(*verifiedObjectMsg)
+		case <-time.After(time.Second * 10):
+			t.Fatalf("timed out waiting for object #%d", i)
+		}
+
+		if vmsg.object != obj {
+			t.Fatalf("result #%d is out of order", i)
+		}
+
+		expected := validateObject(obj, streams, now)
+		if expected == nil {
+			expected = checkObjectPoW(obj, now)
+		}
+		if (expected == nil) != (vmsg.rejection == nil) ||
+			(expected != nil && expected.Reason != vmsg.rejection.Reason) {
+			t.Errorf("for object #%d expected rejection %v, got %v", i,
+				expected, vmsg.rejection)
+		}
+	}
+}
+
+// TestObjectVerifierOverflow checks that objects are dropped when the queue is
+// full.
+func TestObjectVerifierOverflow(t *testing.T) {
+	// The verifier is not started so nothing leaves the queue.
+	v := newObjectVerifier(1, 2, []uint32{1}, make(chan interface{}))
+
+	for i := 0; i < 2; i++ {
+		if !v.Submit(&objectMsg{object: testObj[i]}) {
+			t.Fatalf("object #%d was not accepted", i)
+		}
+	}
+	if v.Submit(&objectMsg{object: testObj[2]}) {
+		t.Error("object was accepted into a full queue")
+	}
+	if v.Dropped() != 1 {
+		t.Errorf("expected 1 dropped object, got %d", v.Dropped())
+	}
+}
@@ -5,7 +5,7 @@
 // Use of this source code is governed by an ISC
 // license that can be found in the LICENSE file.
 
-package main
+package node
 
 import (
 	"bytes"
@@ -29,13 +29,14 @@ const (
 )
 
 // appBuild is defined as a variable so it can be overridden during the build
-// process with '-ldflags "-X main.appBuild foo' if needed.  It MUST only
-// contain characters from semanticAlphabet per the semantic versioning spec.
+// process with '-ldflags "-X github.com/monetas/bmd/node.appBuild foo' if
+// needed.  It MUST only contain characters from semanticAlphabet per the
+// semantic versioning spec.
 var appBuild string
 
-// version returns the application version as a properly formed string per the
+// Version returns the application version as a properly formed string per the
 // semantic versioning 2.0.0 spec (http://semver.org/).
-func version() string {
+func Version() string {
 	// Start with the major, minor, and patch versions.
 	version := fmt.Sprintf("%d.%d.%d", appMajor, appMinor, appPatch)
 
@@ -44,10 +44,9 @@ type connection struct {
 	lastRead      time.Time
 	lastWrite     time.Time
 	timeConnected time.Time
-	idleTimeout   time.Duration
-	idleTimer     *time.Timer
 	maxUp         *maxrate.MaxRate
 	maxDown       *maxrate.MaxRate
+	dial          func(string, string) (net.Conn, error)
 }
 
 // WriteMessage sends a bitmessage p2p message along the tcp connection.
@@ -102,8 +101,6 @@ func (pc *connection) ReadMessage() (wire.Message, error) {
 
 	pc.maxDown.Transfer(float64(n))
 
-	pc.idleTimer.Reset(pc.idleTimeout)
-
 	return msg, nil
 }
 
@@ -125,13 +122,17 @@ func (pc *connection) BytesRead() uint64 {
 
 // LastWrite returns the last time that a message was written.
 func (pc *connection) LastWrite() time.Time {
+	pc.receivedMtx.Lock()
 	t := pc.lastWrite
+	pc.receivedMtx.Unlock()
 	return t
 }
 
 // LastRead returns the last time that a message was read.
 func (pc *connection) LastRead() time.Time {
+	pc.receivedMtx.Lock()
 	t := pc.lastRead
+	pc.receivedMtx.Unlock()
 	return t
 }
 
@@ -150,8 +151,6 @@ func (pc *connection) Close() {
 		pc.conn = nil
 		conn.Close()
 	}
-
-	pc.idleTimer.Stop()
 }
 
 // Connected returns whether the connection is connected to a remote peer.
@@ -167,13 +166,15 @@ func (pc *connection) Connect() error {
 		return errors.New("already connected")
 	}
 
-	conn, err := dial("tcp", pc.addr.String())
+	d := pc.dial
+	if d == nil {
+		d = dial
+	}
+	conn, err := d("tcp", pc.addr.String())
 	if err != nil {
 		return err
 	}
 
-	pc.idleTimer.Reset(pc.idleTimeout)
-
 	pc.timeConnected = time.Now()
 	pc.conn = conn
 	return nil
@@ -186,18 +187,21 @@ func SetDialer(dialer func(string, string) (net.Conn, error)) {
 
 // NewConnection creates a new *connection.
 func NewConnection(addr net.Addr, maxDown, maxUp int64) Connection {
-	pc := &connection{
-		addr:        addr,
-		idleTimeout: time.Minute * pingTimeoutMinutes,
-		maxDown:     maxrate.New(float64(maxDown), 1),
-		maxUp:       maxrate.New(float64(maxUp), 1),
+	return &connection{
+		addr:    addr,
+		maxDown: maxrate.New(float64(maxDown), 1),
+		maxUp:   maxrate.New(float64(maxUp), 1),
 	}
+}
 
-	pc.idleTimer = time.AfterFunc(pc.idleTimeout, func() {
-		pc.WriteMessage(&wire.MsgPong{})
-	})
-
-	pc.idleTimer.Stop()
-
-	return pc
+// NewDialConnection creates a new *connection which connects to the remote
+// peer with the given dialer rather than the one set with SetDialer.
+func NewDialConnection(addr net.Addr, maxDown, maxUp int64,
+	dialer func(string, string) (net.Conn, error)) Connection {
+	return &connection{
+		addr:    addr,
+		maxDown: maxrate.New(float64(maxDown), 1),
+		maxUp:   maxrate.New(float64(maxUp), 1),
+		dial:    dialer,
+	}
 }
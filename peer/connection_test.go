@@ -202,6 +202,14 @@ func TestDial(t *testing.T) {
 	if err == nil {
 		t.Errorf("Error expected dialing failed connection.")
 	}
+
+	// A connection with its own dialer does not use the global one.
+	conn = peer.NewDialConnection(remoteAddr, maxUpload, maxDownload,
+		dialNewMockConn(localAddr, false, false))
+	err = conn.Connect()
+	if err != nil {
+		t.Errorf("Error %s returned.", err)
+	}
 }
 
 // This tests error cases that are returned for connections which have not
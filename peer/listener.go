@@ -6,10 +6,8 @@ package peer
 
 import (
 	"net"
-	"time"
 
 	"github.com/DanielKrawisz/maxrate"
-	"github.com/monetas/bmutil/wire"
 )
 
 // Listener represents an open port listening for bitmessage connections.
@@ -37,19 +35,12 @@ func (pl *listener) Accept() (Connection, error) {
 		return nil, err
 	}
 
-	connection := &connection{
-		conn:        conn,
-		addr:        conn.RemoteAddr(),
-		idleTimeout: time.Minute * pingTimeoutMinutes,
-		maxDown:     maxrate.New(float64(pl.maxDown), 1),
-		maxUp:       maxrate.New(float64(pl.maxUp), 1),
-	}
-
-	connection.idleTimer = time.AfterFunc(connection.idleTimeout, func() {
-		connection.WriteMessage(&wire.MsgPong{})
-	})
-
-	return connection, nil
+	return &connection{
+		conn:    conn,
+		addr:    conn.RemoteAddr(),
+		maxDown: maxrate.New(float64(pl.maxDown), 1),
+		maxUp:   maxrate.New(float64(pl.maxUp), 1),
+	}, nil
 }
 
 // Close closes the listener.
@@ -43,6 +43,10 @@ const (
 	// pingTimeoutMinutes is the number of minutes since we last sent a
 	// message requiring a reply before we will ping a host.
 	pingTimeoutMinutes = 5
+
+	// pingCheckInterval is how often we check whether the connection has been
+	// quiet for long enough that a keepalive ping should be sent.
+	pingCheckInterval = time.Second * 30
 )
 
 // Peer handles and routes incoming messages and manages other peer components.
@@ -54,6 +58,7 @@ type Peer struct {
 	started    int32 // only to be used atomically
 	starting   int32
 	disconnect int32
+	done       chan struct{} // closed when inHandler exits.
 }
 
 // Connected returns whether or not the peer is currently connected.
@@ -103,7 +108,9 @@ func (p *Peer) Start() error {
 	p.send.Start(p.conn)
 
 	// Start processing input and output.
+	p.done = make(chan struct{})
 	go p.inHandler(negotiateTimeoutSeconds, idleTimeoutMinutes)
+	go p.pingHandler(p.done)
 	return nil
 }
 
@@ -193,6 +200,45 @@ out:
 	// Ensure connection is closed and notify the server that the peer is
 	// done.
 	p.Disconnect()
+	if p.done != nil {
+		close(p.done)
+	}
+}
+
+// pingHandler keeps the connection alive by sending a pong message whenever
+// nothing has been written to the remote peer for pingTimeoutMinutes. Without
+// it, the idle timer of the remote peer would disconnect us from a peer that is
+// alive but has nothing to say. Bitmessage has no ping message which requires a
+// reply, so the pong itself is the keepalive. It must be run as a goroutine and
+// returns when done is closed.
+func (p *Peer) pingHandler(done <-chan struct{}) {
+	pingTicker := time.NewTicker(pingCheckInterval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case <-pingTicker.C:
+			if time.Since(p.conn.LastWrite()) < pingTimeoutMinutes*time.Minute {
+				continue
+			}
+			if err := p.send.QueueMessage(&wire.MsgPong{}); err != nil {
+				log.Debug(p.PrependAddr(fmt.Sprint("Unable to send keepalive: ", err)))
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// BytesWritten returns the total number of bytes written to the remote peer.
+func (p *Peer) BytesWritten() uint64 {
+	return p.conn.BytesWritten()
+}
+
+// BytesRead returns the total number of bytes read from the remote peer.
+func (p *Peer) BytesRead() uint64 {
+	return p.conn.BytesRead()
 }
 
 // PrependAddr is a helper function for logging that adds the ip address to
@@ -0,0 +1,135 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/monetas/bmd/node"
+)
+
+// reloadableFields are the fields of config which are applied when the
+// configuration is reloaded. Changes to any other options only take effect
+// after a restart. Apart from the debug level, they are applied by the node
+// and have the same names as the fields of node.Options.
+var reloadableFields = append([]string{"DebugLevel"},
+	node.ReloadableOptions()...)
+
+// isReloadable returns whether a field of config is applied when the
+// configuration is reloaded.
+func isReloadable(field string) bool {
+	for _, f := range reloadableFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// changedOptions returns the names of the fields of config which differ
+// between the two configurations.
+func changedOptions(oldCfg, newCfg *config) []string {
+	var changed []string
+	oldVal := reflect.ValueOf(oldCfg).Elem()
+	newVal := reflect.ValueOf(newCfg).Elem()
+	for i := 0; i < oldVal.NumField(); i++ {
+		field := oldVal.Type().Field(i)
+		if field.PkgPath != "" {
+			// Unexported fields are derived from the others.
+			continue
+		}
+		if !reflect.DeepEqual(oldVal.Field(i).Interface(),
+			newVal.Field(i).Interface()) {
+			changed = append(changed, field.Name)
+		}
+	}
+	return changed
+}
+
+// optionName returns the name of the command line option for a field of
+// config.
+func optionName(field string) string {
+	f, ok := reflect.TypeOf(config{}).FieldByName(field)
+	if !ok {
+		return field
+	}
+	if name := f.Tag.Get("long"); name != "" {
+		return name
+	}
+	return strings.ToLower(field)
+}
+
+// optionNames returns the names of the command line options for fields of
+// config, separated by commas.
+func optionNames(fields []string) string {
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = optionName(field)
+	}
+	return strings.Join(names, ", ")
+}
+
+// applyConfig applies the changes from the current configuration to newCfg
+// that can be made while bmd is running and reports those that require bmd
+// to be restarted.
+func applyConfig(n *node.Node, newCfg *config) {
+	changed := changedOptions(cfg, newCfg)
+
+	var reloaded, restart []string
+	for _, field := range changed {
+		if isReloadable(field) {
+			reloaded = append(reloaded, field)
+		} else {
+			restart = append(restart, field)
+		}
+	}
+
+	// The node compares the options with its own, so that changes which
+	// could not be applied before are tried again.
+	err := n.Reload(nodeOptions(newCfg))
+
+	// Keep the new values of the reloaded options, so that the options
+	// which require a restart are reported again next time.
+	oldDebugLevel := cfg.DebugLevel
+	oldVal := reflect.ValueOf(cfg).Elem()
+	newVal := reflect.ValueOf(newCfg).Elem()
+	for _, field := range reloaded {
+		oldVal.FieldByName(field).Set(newVal.FieldByName(field))
+	}
+
+	// The debug level is the only option that is applied here.
+	if oldDebugLevel != cfg.DebugLevel {
+		setLogLevels(defaultLogLevel)
+		if e := parseAndSetDebugLevels(cfg.DebugLevel); e != nil {
+			bmdLog.Errorf("Failed to set debug level: %v", e)
+		}
+	}
+
+	switch {
+	case err != nil:
+		bmdLog.Errorf("Failed to apply the new configuration: %v", err)
+	case len(reloaded) > 0:
+		bmdLog.Infof("Applied changes to %s", optionNames(reloaded))
+	case len(restart) == 0:
+		bmdLog.Info("Configuration unchanged")
+	}
+
+	if len(restart) > 0 {
+		bmdLog.Warnf("Changes to %s will not take effect until bmd is "+
+			"restarted", optionNames(restart))
+	}
+}
+
+// reloadNodeConfig reads the configuration again and applies it to the
+// running node. The current configuration is kept if the new one is invalid.
+func reloadNodeConfig(n *node.Node) {
+	newCfg, err := reloadConfig()
+	if err != nil {
+		bmdLog.Errorf("Failed to reload configuration: %v", err)
+		return
+	}
+	applyConfig(n, newCfg)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/monetas/bmd/node"
+)
+
+func TestChangedOptions(t *testing.T) {
+	oldCfg := &config{
+		DebugLevel:  "info",
+		BanDuration: time.Hour,
+		AddPeers:    []string{"1.2.3.4:8444"},
+		Listeners:   []string{":8444"},
+	}
+	newCfg := *oldCfg
+	newCfg.lookup = func(string) ([]net.IP, error) { return nil, nil }
+
+	if changed := changedOptions(oldCfg, &newCfg); len(changed) != 0 {
+		t.Errorf("expected no changes, got %v", changed)
+	}
+
+	newCfg.DebugLevel = "debug"
+	newCfg.AddPeers = []string{"1.2.3.4:8444", "5.6.7.8:8444"}
+	newCfg.Listeners = []string{":8445"}
+	expected := []string{"AddPeers", "Listeners", "DebugLevel"}
+	changed := changedOptions(oldCfg, &newCfg)
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changed)
+	}
+	if names := optionNames(changed); names != "addpeer, listen, debuglevel" {
+		t.Errorf("unexpected option names %s", names)
+	}
+}
+
+func TestReloadableFields(t *testing.T) {
+	typ := reflect.TypeOf(config{})
+	optsType := reflect.TypeOf(node.Options{})
+	seen := make(map[string]bool)
+	for _, field := range reloadableFields {
+		if _, ok := typ.FieldByName(field); !ok {
+			t.Errorf("config has no field %s", field)
+		}
+		if _, ok := optsType.FieldByName(field); !ok && field != "DebugLevel" {
+			t.Errorf("node.Options has no field %s", field)
+		}
+		if seen[field] {
+			t.Errorf("field %s is listed twice", field)
+		}
+		seen[field] = true
+	}
+}
+
+func TestParseDebugLevels(t *testing.T) {
+	levels, err := parseDebugLevels("debug")
+	if err != nil {
+		t.Fatalf("parseDebugLevels failed: %v", err)
+	}
+	if len(levels) != len(subsystemLoggers) || levels["PEER"] != "debug" {
+		t.Errorf("unexpected levels %v", levels)
+	}
+
+	levels, err = parseDebugLevels("PEER=trace,SERVER=warn")
+	if err != nil {
+		t.Fatalf("parseDebugLevels failed: %v", err)
+	}
+	expected := map[string]string{"PEER": "trace", "SERVER": "warn"}
+	if !reflect.DeepEqual(levels, expected) {
+		t.Errorf("expected levels %v, got %v", expected, levels)
+	}
+
+	for _, invalid := range []string{"loud", "PEER=loud", "NOPE=info",
+		"PEER=info,debug"} {
+		if _, err := parseDebugLevels(invalid); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
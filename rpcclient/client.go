@@ -0,0 +1,759 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package rpcclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+	"github.com/gorilla/websocket"
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	// defaultBufferSize is the default number of objects that are buffered
+	// for each subscription.
+	defaultBufferSize = 100
+
+	// maxConnectionRetryInterval is the maximum time to wait between
+	// attempts to reconnect to bmd.
+	maxConnectionRetryInterval = time.Minute
+)
+
+var (
+	// connectionRetryInterval is the time to wait before the first attempt
+	// to reconnect to bmd. It is increased by the same amount for each
+	// failed attempt, up to maxConnectionRetryInterval.
+	connectionRetryInterval = time.Second * 5
+
+	// ErrNotConnected is returned by calls made while the client is not
+	// connected to bmd.
+	ErrNotConnected = errors.New("not connected to bmd")
+
+	// ErrClientShutdown is returned by calls made after the client has been
+	// closed.
+	ErrClientShutdown = errors.New("client has been shut down")
+
+	// ErrAuthFailed is returned by New if bmd rejects the username and
+	// password.
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrAlreadySubscribed is returned when subscribing to a kind of object
+	// that the client is already subscribed to.
+	ErrAlreadySubscribed = errors.New("already subscribed")
+)
+
+// Config describes how to connect to bmd.
+type Config struct {
+	// Host is the host:port of the RPC server. It is ignored if UnixSocket is
+	// set.
+	Host string
+
+	// UnixSocket is the path of the Unix domain socket of the RPC server.
+	UnixSocket string
+
+	// User and Pass are the credentials to authenticate with. If User is
+	// empty, the client does not authenticate, which is only useful on a Unix
+	// domain socket that authenticates clients by their user id.
+	User string
+	Pass string
+
+	// DisableTLS connects without TLS. TLS is never used on a Unix domain
+	// socket.
+	DisableTLS bool
+
+	// Certificates are the PEM encoded certificates trusted to verify the
+	// RPC server, such as the contents of bmd's rpc.cert. If empty, the
+	// system roots are used.
+	Certificates []byte
+
+	// DisableAutoReconnect stops the client from reconnecting when the
+	// connection is lost. Subscriptions are closed instead.
+	DisableAutoReconnect bool
+
+	// BufferSize is the number of objects buffered for each subscription.
+	// It defaults to 100.
+	BufferSize int
+}
+
+// Subscription delivers the objects of one kind that bmd sends to the client.
+type Subscription struct {
+	client    *Client
+	kind      Kind
+	filter    *Filter
+	mtx       sync.Mutex
+	objects   chan *Object
+	expired   chan []uint64
+	closed    bool
+	closeOnce sync.Once
+	quit      chan struct{}
+
+	// rpc2 handles each object in its own goroutine, so objects are put in
+	// pending as they are read from the connection and delivered in that
+	// order. The subscription is renewed from the first object that has
+	// not been delivered, and objects received again are dropped.
+	counterMtx sync.Mutex
+	turn       *sync.Cond // signaled when an object is no longer pending.
+	next       uint64     // counter following the last one received.
+	pending    []uint64   // counters received but not delivered yet.
+}
+
+// Kind returns the kind of objects the subscription is for.
+func (s *Subscription) Kind() Kind {
+	return s.kind
+}
+
+// Objects returns the channel on which objects are delivered. It is closed
+// when the subscription ends.
+func (s *Subscription) Objects() <-chan *Object {
+	return s.objects
+}
+
+// Expired returns the channel on which the counters of expired objects are
+// delivered. It is closed when the subscription ends.
+func (s *Subscription) Expired() <-chan []uint64 {
+	return s.expired
+}
+
+// Unsubscribe ends the subscription.
+func (s *Subscription) Unsubscribe() error {
+	return s.client.unsubscribe(s)
+}
+
+// received records that bmd sent the object with the given counter and
+// returns whether it is new. It must be called in the order in which objects
+// are read from the connection.
+func (s *Subscription) received(counter uint64) bool {
+	s.counterMtx.Lock()
+	defer s.counterMtx.Unlock()
+
+	if counter < s.next {
+		return false
+	}
+	s.pending = append(s.pending, counter)
+	s.next = counter + 1
+	return true
+}
+
+// waitTurn waits until the objects received before the one with the given
+// counter are no longer pending, or the subscription ends.
+func (s *Subscription) waitTurn(counter uint64) {
+	s.counterMtx.Lock()
+	for len(s.pending) > 0 && s.pending[0] != counter && !s.isClosing() {
+		s.turn.Wait()
+	}
+	s.counterMtx.Unlock()
+}
+
+// finish removes the object with the given counter from the pending objects.
+func (s *Subscription) finish(counter uint64) {
+	s.counterMtx.Lock()
+	for i, c := range s.pending {
+		if c == counter {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	s.turn.Broadcast()
+	s.counterMtx.Unlock()
+}
+
+// isClosing returns whether the subscription is ending.
+func (s *Subscription) isClosing() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliverObject sends an object on the Objects channel after the objects
+// received before it, waiting until it is received or the subscription ends.
+func (s *Subscription) deliverObject(obj *Object) {
+	s.waitTurn(obj.Counter)
+	defer s.finish(obj.Counter)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.objects <- obj:
+	case <-s.quit:
+	}
+}
+
+// deliverExpired sends counters on the Expired channel, waiting until they are
+// received or the subscription ends.
+func (s *Subscription) deliverExpired(counters []uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.expired <- counters:
+	case <-s.quit:
+	}
+}
+
+// fromCounter returns the counter of the first object that has not been
+// delivered yet, or the one following the last object received if all have
+// been delivered.
+func (s *Subscription) fromCounter() uint64 {
+	s.counterMtx.Lock()
+	defer s.counterMtx.Unlock()
+
+	if len(s.pending) > 0 {
+		return s.pending[0]
+	}
+	return s.next
+}
+
+// close ends the subscription and closes its channels.
+func (s *Subscription) close() {
+	s.closeOnce.Do(func() {
+		// Unblock any delivery in progress before taking the lock.
+		close(s.quit)
+		s.counterMtx.Lock()
+		s.turn.Broadcast()
+		s.counterMtx.Unlock()
+
+		s.mtx.Lock()
+		s.closed = true
+		close(s.objects)
+		close(s.expired)
+		s.mtx.Unlock()
+	})
+}
+
+// newSubscription returns a new subscription to the given kind of objects.
+func newSubscription(c *Client, kind Kind, fromCounter uint64,
+	filter *Filter) *Subscription {
+	s := &Subscription{
+		client:  c,
+		kind:    kind,
+		filter:  filter,
+		objects: make(chan *Object, c.config.BufferSize),
+		expired: make(chan []uint64, c.config.BufferSize),
+		quit:    make(chan struct{}),
+		next:    fromCounter,
+	}
+	s.turn = sync.NewCond(&s.counterMtx)
+	return s
+}
+
+// clientCodec passes the objects sent by bmd to their subscriptions as they are
+// read from the connection, before rpc2 handles them concurrently.
+type clientCodec struct {
+	rpc2.Codec
+	client *Client
+	method string // method of the request being read.
+}
+
+// ReadHeader reads the header of the next request or response.
+func (c *clientCodec) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
+	err := c.Codec.ReadHeader(req, resp)
+	c.method = req.Method
+	return err
+}
+
+// ReadRequestBody reads the arguments of a request.
+func (c *clientCodec) ReadRequestBody(body interface{}) error {
+	err := c.Codec.ReadRequestBody(body)
+	if args, ok := body.(*ReceiveArgs); ok && err == nil {
+		c.client.received(c.method, args)
+	}
+	return err
+}
+
+// Client is a client of the bmd RPC server.
+type Client struct {
+	config        *Config
+	dialer        *websocket.Dialer
+	url           string
+	mtx           sync.Mutex
+	conn          *rpc2.Client // nil while disconnected.
+	subscriptions map[Kind]*Subscription
+	shutdown      int32
+	wg            sync.WaitGroup
+	quit          chan struct{}
+}
+
+// addr returns the address of the RPC server, for logging.
+func (c *Client) addr() string {
+	if c.config.UnixSocket != "" {
+		return c.config.UnixSocket
+	}
+	return c.config.Host
+}
+
+// connect dials the RPC server and authenticates.
+func (c *Client) connect() (*rpc2.Client, error) {
+	ws, _, err := c.dialer.Dial(c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := rpc2.NewClientWithCodec(&clientCodec{
+		Codec:  jsonrpc.NewJSONCodec(ws.UnderlyingConn()),
+		client: c,
+	})
+	for i := range kindMethods {
+		kind := Kind(i)
+		conn.Handle(kindMethods[kind].receive, func(_ *rpc2.Client,
+			args *ReceiveArgs, _ *struct{}) error {
+			c.handleReceive(kind, args)
+			return nil
+		})
+		conn.Handle(kindMethods[kind].expired, func(_ *rpc2.Client,
+			args *ExpiredArgs, _ *struct{}) error {
+			c.handleExpired(kind, args)
+			return nil
+		})
+	}
+	go conn.Run()
+
+	if c.config.User == "" {
+		return conn, nil
+	}
+
+	var success bool
+	err = conn.Call(methodAuth, &AuthArgs{
+		Username: c.config.User,
+		Password: c.config.Pass,
+	}, &success)
+	if err == nil && !success {
+		err = ErrAuthFailed
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// subscription returns the subscription to the given kind of objects, or nil.
+func (c *Client) subscription(kind Kind) *Subscription {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.subscriptions[kind]
+}
+
+// received sets the subscription of an object sent by bmd with the given
+// method, unless there is none or the object was received before.
+func (c *Client) received(method string, args *ReceiveArgs) {
+	for i := range kindMethods {
+		if kindMethods[i].receive != method {
+			continue
+		}
+		if sub := c.subscription(Kind(i)); sub != nil &&
+			sub.received(args.Counter) {
+			args.sub = sub
+		}
+		return
+	}
+}
+
+// handleReceive delivers an object sent by bmd to its subscription.
+func (c *Client) handleReceive(kind Kind, args *ReceiveArgs) {
+	sub := args.sub
+	if sub == nil {
+		return
+	}
+
+	obj, err := wire.DecodeMsgObject(args.Object)
+	if err != nil {
+		log.Warnf("Received invalid %s object with counter %d: %v", kind,
+			args.Counter, err)
+		sub.finish(args.Counter)
+		return
+	}
+	sub.deliverObject(&Object{Object: obj, Counter: args.Counter})
+}
+
+// handleExpired delivers the counters of expired objects sent by bmd to their
+// subscription.
+func (c *Client) handleExpired(kind Kind, args *ExpiredArgs) {
+	sub := c.subscription(kind)
+	if sub == nil {
+		return
+	}
+	sub.deliverExpired(args.Counters)
+}
+
+// resubscribe renews the subscriptions on a new connection, starting from the
+// first object not delivered yet. Subscriptions that cannot be renewed are
+// closed.
+func (c *Client) resubscribe(conn *rpc2.Client) {
+	c.mtx.Lock()
+	subs := make([]*Subscription, 0, len(c.subscriptions))
+	for _, sub := range c.subscriptions {
+		subs = append(subs, sub)
+	}
+	c.mtx.Unlock()
+
+	for _, sub := range subs {
+		err := conn.Call(kindMethods[sub.kind].subscribe,
+			newSubscribeArgs(sub.fromCounter(), sub.filter), nil)
+		if err != nil {
+			log.Errorf("Failed to resubscribe to %s: %v", sub.kind, err)
+			c.removeSubscription(sub)
+			sub.close()
+		}
+	}
+}
+
+// reconnect attempts to reconnect to bmd with increasing delays until it
+// succeeds or the client is closed, in which case it returns nil.
+func (c *Client) reconnect() *rpc2.Client {
+	for retries := 1; ; retries++ {
+		interval := connectionRetryInterval * time.Duration(retries)
+		if interval > maxConnectionRetryInterval {
+			interval = maxConnectionRetryInterval
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-c.quit:
+			return nil
+		}
+
+		conn, err := c.connect()
+		if err != nil {
+			log.Infof("Failed to reconnect to %s: %v", c.addr(), err)
+			continue
+		}
+		c.resubscribe(conn)
+
+		c.mtx.Lock()
+		c.conn = conn
+		c.mtx.Unlock()
+
+		log.Infof("Reconnected to %s", c.addr())
+		return conn
+	}
+}
+
+// connectionHandler watches the connection to bmd and reconnects when it is
+// lost. It must be run as a goroutine.
+func (c *Client) connectionHandler(conn *rpc2.Client) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-conn.DisconnectNotify():
+		case <-c.quit:
+			conn.Close()
+			return
+		}
+
+		c.mtx.Lock()
+		c.conn = nil
+		c.mtx.Unlock()
+
+		if c.config.DisableAutoReconnect {
+			log.Infof("Disconnected from %s", c.addr())
+			c.closeSubscriptions()
+			return
+		}
+
+		log.Infof("Disconnected from %s, reconnecting", c.addr())
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+// call calls a method on the RPC server.
+func (c *Client) call(method string, args interface{}, reply interface{}) error {
+	if atomic.LoadInt32(&c.shutdown) != 0 {
+		return ErrClientShutdown
+	}
+
+	c.mtx.Lock()
+	conn := c.conn
+	c.mtx.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.Call(method, args, reply)
+}
+
+// SendObject sends the object onto the network and returns its counter.
+func (c *Client) SendObject(obj *wire.MsgObject) (uint64, error) {
+	var counter uint64
+	err := c.call(methodSendObject,
+		base64.StdEncoding.EncodeToString(wire.EncodeMessage(obj)), &counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter, nil
+}
+
+// GetIdentity returns the public identity of the given Bitmessage address.
+func (c *Client) GetIdentity(address string) (*Identity, error) {
+	id := new(Identity)
+	if err := c.call(methodGetIdentity, address, id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// GetInfo returns the status of bmd.
+func (c *Client) GetInfo() (*Info, error) {
+	info := new(Info)
+	if err := c.call(methodGetInfo, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// GetBanScores returns the ban scores of connected peers and of recently
+// disconnected peers that misbehaved.
+func (c *Client) GetBanScores() ([]BanScore, error) {
+	out := new(banScoresOut)
+	if err := c.call(methodGetBanScores, nil, out); err != nil {
+		return nil, err
+	}
+	return out.Peers, nil
+}
+
+// GetPeers returns details about all connected peers.
+func (c *Client) GetPeers() ([]PeerInfo, error) {
+	out := new(getPeersOut)
+	if err := c.call(methodGetPeers, nil, out); err != nil {
+		return nil, err
+	}
+	return out.Peers, nil
+}
+
+// AddPeer connects to the peer at the given host:port in the given stream, or
+// in the first stream served by bmd if stream is 0. If permanent is true, bmd
+// reconnects to the peer whenever the connection is lost.
+func (c *Client) AddPeer(address string, stream uint32, permanent bool) error {
+	return c.call(methodAddPeer, &addPeerArgs{
+		Address:   address,
+		Stream:    stream,
+		Permanent: permanent,
+	}, nil)
+}
+
+// DisconnectPeer disconnects the peer at the given address.
+func (c *Client) DisconnectPeer(address string) error {
+	return c.call(methodDisconnectPeer, address, nil)
+}
+
+// BanPeer bans the given IP address and disconnects all peers from it.
+func (c *Client) BanPeer(ip string) error {
+	return c.call(methodBanPeer, ip, nil)
+}
+
+// UnbanPeer lifts the ban of the given IP address.
+func (c *Client) UnbanPeer(ip string) error {
+	return c.call(methodUnbanPeer, ip, nil)
+}
+
+// GetBanList returns the banned IP addresses and the IP ranges in the allow and
+// deny lists.
+func (c *Client) GetBanList() (*BanList, error) {
+	list := new(BanList)
+	if err := c.call(methodGetBanList, nil, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// AddIPRange adds an IP address or CIDR range to AllowList or DenyList. Peers
+// in a range added to the deny list are disconnected.
+func (c *Client) AddIPRange(list, r string) error {
+	return c.call(methodAddIPRange, &ipRangeArgs{List: list, Range: r}, nil)
+}
+
+// RemoveIPRange removes an IP address or CIDR range from AllowList or
+// DenyList.
+func (c *Client) RemoveIPRange(list, r string) error {
+	return c.call(methodRemoveIPRange, &ipRangeArgs{List: list, Range: r},
+		nil)
+}
+
+// ListSubscriptions returns the kinds of objects that bmd sends to the client,
+// as named in the Subscribe methods.
+func (c *Client) ListSubscriptions() ([]string, error) {
+	out := new(listSubscriptionsOut)
+	if err := c.call(methodListSubscriptions, nil, out); err != nil {
+		return nil, err
+	}
+	return out.Subscriptions, nil
+}
+
+// subscribe subscribes to the given kind of objects that match the filter,
+// starting from the given counter.
+func (c *Client) subscribe(kind Kind, fromCounter uint64,
+	filter *Filter) (*Subscription, error) {
+	if atomic.LoadInt32(&c.shutdown) != 0 {
+		return nil, ErrClientShutdown
+	}
+
+	// Add the subscription before subscribing so that no object sent by bmd
+	// is missed.
+	sub := newSubscription(c, kind, fromCounter, filter)
+	c.mtx.Lock()
+	if _, ok := c.subscriptions[kind]; ok {
+		c.mtx.Unlock()
+		return nil, ErrAlreadySubscribed
+	}
+	c.subscriptions[kind] = sub
+	c.mtx.Unlock()
+
+	err := c.call(kindMethods[kind].subscribe,
+		newSubscribeArgs(fromCounter, filter), nil)
+	if err != nil {
+		c.removeSubscription(sub)
+		sub.close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// removeSubscription removes the subscription from the client, unless it has
+// already been replaced.
+func (c *Client) removeSubscription(sub *Subscription) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.subscriptions[sub.kind] == sub {
+		delete(c.subscriptions, sub.kind)
+	}
+}
+
+// unsubscribe ends the subscription and tells bmd to stop sending its objects.
+func (c *Client) unsubscribe(sub *Subscription) error {
+	c.removeSubscription(sub)
+	sub.close()
+
+	// bmd forgets the subscriptions of disconnected clients.
+	err := c.call(kindMethods[sub.kind].unsubscribe, nil, nil)
+	if err == ErrNotConnected || err == ErrClientShutdown {
+		return nil
+	}
+	return err
+}
+
+// closeSubscriptions ends all subscriptions.
+func (c *Client) closeSubscriptions() {
+	c.mtx.Lock()
+	subs := c.subscriptions
+	c.subscriptions = make(map[Kind]*Subscription)
+	c.mtx.Unlock()
+
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+// SubscribeMessages subscribes to messages, starting from the given counter.
+func (c *Client) SubscribeMessages(fromCounter uint64) (*Subscription, error) {
+	return c.subscribe(Messages, fromCounter, nil)
+}
+
+// SubscribeBroadcasts subscribes to broadcasts that match the filter, which
+// may be nil, starting from the given counter.
+func (c *Client) SubscribeBroadcasts(fromCounter uint64,
+	filter *Filter) (*Subscription, error) {
+	return c.subscribe(Broadcasts, fromCounter, filter)
+}
+
+// SubscribeGetpubkeys subscribes to getpubkey requests, starting from the
+// given counter.
+func (c *Client) SubscribeGetpubkeys(fromCounter uint64) (*Subscription, error) {
+	return c.subscribe(Getpubkeys, fromCounter, nil)
+}
+
+// SubscribePubkeys subscribes to pubkeys that match the filter, which may be
+// nil, starting from the given counter.
+func (c *Client) SubscribePubkeys(fromCounter uint64,
+	filter *Filter) (*Subscription, error) {
+	return c.subscribe(Pubkeys, fromCounter, filter)
+}
+
+// SubscribeUnknownObjects subscribes to objects of unknown type, starting from
+// the given counter.
+func (c *Client) SubscribeUnknownObjects(fromCounter uint64) (*Subscription,
+	error) {
+	return c.subscribe(UnknownObjects, fromCounter, nil)
+}
+
+// Close disconnects from bmd and ends all subscriptions.
+func (c *Client) Close() {
+	if atomic.AddInt32(&c.shutdown, 1) != 1 {
+		return
+	}
+
+	close(c.quit)
+	c.wg.Wait()
+	c.closeSubscriptions()
+}
+
+// New connects to bmd as described by the config and authenticates.
+func New(config *Config) (*Client, error) {
+	cfg := *config
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultBufferSize
+	}
+
+	c := &Client{
+		config:        &cfg,
+		dialer:        &websocket.Dialer{},
+		subscriptions: make(map[Kind]*Subscription),
+		quit:          make(chan struct{}),
+	}
+
+	switch {
+	case cfg.UnixSocket != "":
+		c.url = "ws://localhost/"
+		c.dialer.NetDial = func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", cfg.UnixSocket)
+		}
+	case cfg.DisableTLS:
+		c.url = "ws://" + cfg.Host + "/"
+	default:
+		c.url = "wss://" + cfg.Host + "/"
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if len(cfg.Certificates) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(cfg.Certificates) {
+				return nil, errors.New("no valid certificates")
+			}
+			tlsConfig.RootCAs = pool
+		}
+		c.dialer.TLSClientConfig = tlsConfig
+	}
+
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	c.wg.Add(1)
+	go c.connectionHandler(conn)
+
+	return c, nil
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package rpcclient
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+	"github.com/gorilla/websocket"
+	"github.com/monetas/bmutil/wire"
+)
+
+const (
+	testUser = "user"
+	testPass = "pass"
+)
+
+// mockServer is a minimal bmd RPC server. Each subscription to messages is
+// answered with three objects starting from the requested counter, after which
+// sent receives a value.
+type mockServer struct {
+	*httptest.Server
+	clients      chan *rpc2.Client
+	subscribed   chan uint64
+	sent         chan struct{}
+	unsubscribed chan struct{}
+}
+
+func newMockServer(t *testing.T) *mockServer {
+	s := &mockServer{
+		clients:      make(chan *rpc2.Client, 10),
+		subscribed:   make(chan uint64, 10),
+		sent:         make(chan struct{}, 10),
+		unsubscribed: make(chan struct{}, 10),
+	}
+
+	srv := rpc2.NewServer()
+	srv.OnConnect(func(client *rpc2.Client) {
+		s.clients <- client
+	})
+	srv.Handle(methodAuth, func(_ *rpc2.Client, args *AuthArgs,
+		success *bool) error {
+		*success = args.Username == testUser && args.Password == testPass
+		return nil
+	})
+	srv.Handle(methodSendObject, func(_ *rpc2.Client, obj string,
+		counter *uint64) error {
+		if obj == "" {
+			return errors.New("base64 decode failed")
+		}
+		*counter = 1
+		return nil
+	})
+	srv.Handle(kindMethods[Messages].subscribe, func(client *rpc2.Client,
+		args *SubscribeArgs, _ *struct{}) error {
+		s.subscribed <- args.FromCounter
+		go func() {
+			for i := uint64(0); i < 3; i++ {
+				obj := wire.NewMsgUnknownObject(i, time.Now().Add(time.Hour),
+					wire.ObjectTypeMsg, 1, 1, []byte{1, 2, 3}).ToMsgObject()
+				err := client.Call(kindMethods[Messages].receive,
+					&ReceiveArgs{
+						Object:  wire.EncodeMessage(obj),
+						Counter: args.FromCounter + i,
+					}, nil)
+				if err != nil {
+					t.Errorf("failed to send object: %v", err)
+				}
+			}
+			s.sent <- struct{}{}
+		}()
+		return nil
+	})
+	srv.Handle(kindMethods[Messages].unsubscribe, func(_ *rpc2.Client,
+		_ *struct{}, _ *struct{}) error {
+		s.unsubscribed <- struct{}{}
+		return nil
+	})
+
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		srv.ServeCodecWithState(jsonrpc.NewJSONCodec(ws.UnderlyingConn()),
+			rpc2.NewState())
+	}))
+	return s
+}
+
+// receiveObjects checks that the subscription delivers objects with the given
+// counters.
+func receiveObjects(t *testing.T, sub *Subscription, counters ...uint64) {
+	seen := make(map[uint64]bool)
+	for range counters {
+		select {
+		case obj := <-sub.Objects():
+			seen[obj.Counter] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for objects, got %v", seen)
+		}
+	}
+	for _, counter := range counters {
+		if !seen[counter] {
+			t.Errorf("object with counter %d was not delivered", counter)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	connectionRetryInterval = time.Millisecond * 10
+
+	server := newMockServer(t)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// Wrong credentials are rejected.
+	_, err := New(&Config{
+		Host:       host,
+		User:       testUser,
+		Pass:       "wrong",
+		DisableTLS: true,
+	})
+	if err != ErrAuthFailed {
+		t.Errorf("expected %v, got %v", ErrAuthFailed, err)
+	}
+	<-server.clients
+
+	client, err := New(&Config{
+		Host:       host,
+		User:       testUser,
+		Pass:       testPass,
+		DisableTLS: true,
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	conn := <-server.clients
+
+	obj := wire.NewMsgUnknownObject(0, time.Now().Add(time.Hour),
+		wire.ObjectTypeMsg, 1, 1, []byte{1, 2, 3}).ToMsgObject()
+	counter, err := client.SendObject(obj)
+	if err != nil {
+		t.Errorf("SendObject failed: %v", err)
+	}
+	if counter != 1 {
+		t.Errorf("expected counter 1, got %d", counter)
+	}
+
+	sub, err := client.SubscribeMessages(5)
+	if err != nil {
+		t.Fatalf("SubscribeMessages failed: %v", err)
+	}
+	if from := <-server.subscribed; from != 5 {
+		t.Errorf("expected subscription from 5, got %d", from)
+	}
+	receiveObjects(t, sub, 5, 6, 7)
+	<-server.sent
+
+	if _, err = client.SubscribeMessages(1); err != ErrAlreadySubscribed {
+		t.Errorf("expected %v, got %v", ErrAlreadySubscribed, err)
+	}
+
+	// After the connection is lost, the client reconnects and resumes the
+	// subscription after the last object received.
+	conn.Close()
+	select {
+	case <-server.clients:
+	case <-time.After(time.Second * 5):
+		t.Fatal("client did not reconnect")
+	}
+	if from := <-server.subscribed; from != 8 {
+		t.Errorf("expected subscription from 8, got %d", from)
+	}
+	receiveObjects(t, sub, 8, 9, 10)
+	<-server.sent
+
+	// Unsubscribing closes the channels.
+	if err = sub.Unsubscribe(); err != nil {
+		t.Errorf("Unsubscribe failed: %v", err)
+	}
+	<-server.unsubscribed
+	if _, ok := <-sub.Objects(); ok {
+		t.Error("Objects channel was not closed")
+	}
+
+	client.Close()
+	if _, err = client.SendObject(obj); err != ErrClientShutdown {
+		t.Errorf("expected %v, got %v", ErrClientShutdown, err)
+	}
+}
+
+// TestSubscriptionOrder checks that objects handled out of order are delivered
+// in the order in which they were read from the connection, and that a
+// subscription renewed while they are in flight resumes from the first object
+// not delivered without delivering any object twice.
+func TestSubscriptionOrder(t *testing.T) {
+	c := &Client{
+		config:        &Config{BufferSize: 10},
+		subscriptions: make(map[Kind]*Subscription),
+	}
+	sub := newSubscription(c, Messages, 5, nil)
+	c.subscriptions[Messages] = sub
+	defer sub.close()
+
+	obj := wire.EncodeMessage(wire.NewMsgUnknownObject(0,
+		time.Now().Add(time.Hour), wire.ObjectTypeMsg, 1, 1,
+		[]byte{1, 2, 3}).ToMsgObject())
+	read := func(counter uint64) *ReceiveArgs {
+		args := &ReceiveArgs{Object: obj, Counter: counter}
+		c.received(kindMethods[Messages].receive, args)
+		return args
+	}
+
+	// Objects 5 and 6 are read, but 6 is handled first.
+	first, second := read(5), read(6)
+	done := make(chan struct{})
+	go func() {
+		c.handleReceive(Messages, second)
+		close(done)
+	}()
+	select {
+	case obj := <-sub.Objects():
+		t.Errorf("object %d was delivered before object 5", obj.Counter)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// The connection is lost while both are in flight, so bmd sends them
+	// again.
+	if from := sub.fromCounter(); from != 5 {
+		t.Errorf("expected to resubscribe from 5, got %d", from)
+	}
+	again := []*ReceiveArgs{read(5), read(6), read(7)}
+	for _, args := range again[:2] {
+		if args.sub != nil {
+			t.Errorf("object %d received again is not dropped",
+				args.Counter)
+		}
+		c.handleReceive(Messages, args)
+	}
+	go c.handleReceive(Messages, again[2])
+	c.handleReceive(Messages, first)
+	<-done
+
+	for _, expected := range []uint64{5, 6, 7} {
+		select {
+		case obj := <-sub.Objects():
+			if obj.Counter != expected {
+				t.Errorf("expected object %d, got %d", expected,
+					obj.Counter)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for object %d", expected)
+		}
+	}
+	if from := sub.fromCounter(); from != 8 {
+		t.Errorf("expected to resubscribe from 8, got %d", from)
+	}
+}
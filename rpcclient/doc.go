@@ -0,0 +1,45 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package rpcclient implements a client for the websocket JSON-RPC API of bmd,
+which is described in README_RPC.md.
+
+New connects to bmd over TCP, with or without TLS, or over its Unix domain
+socket, and authenticates with the given username and password. The methods of
+Client make calls to bmd with typed arguments and results.
+
+Objects are delivered through subscriptions. Each Subscribe method returns a
+Subscription whose Objects channel receives the decoded objects along with
+their counters, in the order in which bmd sends them, and whose Expired channel
+receives the counters of objects that bmd has pruned. Both channels must be
+drained, or the subscription unsubscribed, as bmd stops sending to a client
+that falls behind.
+
+If the connection is lost, Client reconnects with increasing delays,
+authenticates again and resumes each subscription from the first object it has
+not delivered, dropping the objects that bmd sends again, unless automatic
+reconnection is disabled in the Config. Calls made while the client is
+disconnected fail with ErrNotConnected.
+
+	client, err := rpcclient.New(&rpcclient.Config{
+		Host:         "localhost:8442",
+		User:         "user",
+		Pass:         "pass",
+		Certificates: certs,
+	})
+	if err != nil {
+		// handle error
+	}
+	defer client.Close()
+
+	sub, err := client.SubscribeMessages(1)
+	if err != nil {
+		// handle error
+	}
+	for obj := range sub.Objects() {
+		// obj.Object is a *wire.MsgObject, obj.Counter its counter.
+	}
+*/
+package rpcclient
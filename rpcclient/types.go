@@ -0,0 +1,254 @@
+// Copyright (c) 2015 Monetas.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package rpcclient
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/monetas/bmutil/wire"
+)
+
+// Methods defined on the RPC server.
+const (
+	methodAuth              = "Authenticate"
+	methodSendObject        = "SendObject"
+	methodGetIdentity       = "GetIdentity"
+	methodGetInfo           = "GetInfo"
+	methodGetBanScores      = "GetBanScores"
+	methodGetPeers          = "GetPeers"
+	methodAddPeer           = "AddPeer"
+	methodDisconnectPeer    = "DisconnectPeer"
+	methodBanPeer           = "BanPeer"
+	methodUnbanPeer         = "UnbanPeer"
+	methodGetBanList        = "GetBanList"
+	methodAddIPRange        = "AddIPRange"
+	methodRemoveIPRange     = "RemoveIPRange"
+	methodListSubscriptions = "ListSubscriptions"
+)
+
+// Kind is a kind of object that can be subscribed to.
+type Kind int
+
+// The kinds of objects that can be subscribed to.
+const (
+	Messages Kind = iota
+	Broadcasts
+	Getpubkeys
+	Pubkeys
+	UnknownObjects
+)
+
+// kindMethods holds the names of the methods on the server and the client
+// that are used for each kind of object.
+var kindMethods = []struct {
+	subscribe   string
+	unsubscribe string
+	receive     string
+	expired     string
+}{
+	Messages: {"SubscribeMessages", "UnsubscribeMessages",
+		"ReceiveMessage", "ExpiredMessages"},
+	Broadcasts: {"SubscribeBroadcasts", "UnsubscribeBroadcasts",
+		"ReceiveBroadcast", "ExpiredBroadcasts"},
+	Getpubkeys: {"SubscribeGetpubkeys", "UnsubscribeGetpubkeys",
+		"ReceiveGetpubkey", "ExpiredGetpubkeys"},
+	Pubkeys: {"SubscribePubkeys", "UnsubscribePubkeys",
+		"ReceivePubkey", "ExpiredPubkeys"},
+	UnknownObjects: {"SubscribeUnknownObjects", "UnsubscribeUnknownObjects",
+		"ReceiveUnknownObject", "ExpiredUnknownObjects"},
+}
+
+// String returns the kind as it is named in the Subscribe methods.
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindMethods) {
+		return "Unknown"
+	}
+	return kindMethods[k].subscribe[len("Subscribe"):]
+}
+
+// Object is an object received from bmd along with its counter.
+type Object struct {
+	Object  *wire.MsgObject
+	Counter uint64
+}
+
+// Filter restricts a subscription to pubkeys or broadcasts to those with one
+// of the given tags or, for pubkeys, belonging to one of the addresses with the
+// given ripes.
+type Filter struct {
+	Tags  []wire.ShaHash
+	Ripes [][wire.RipeHashSize]byte
+}
+
+// Identity is the public identity of a Bitmessage address, as returned by
+// GetIdentity. The keys are serialized uncompressed.
+type Identity struct {
+	Address            string `json:"address"`
+	NonceTrialsPerByte uint64 `json:"nonceTrialsPerByte"`
+	ExtraBytes         uint64 `json:"extraBytes"`
+	SigningKey         []byte `json:"signingKey"`
+	EncryptionKey      []byte `json:"encryptionKey"`
+}
+
+// Counters contains the current counter for each kind of object.
+type Counters struct {
+	Messages       uint64 `json:"messages"`
+	Broadcasts     uint64 `json:"broadcasts"`
+	Getpubkeys     uint64 `json:"getpubkeys"`
+	Pubkeys        uint64 `json:"pubkeys"`
+	UnknownObjects uint64 `json:"unknownObjects"`
+}
+
+// Info contains the status of bmd, as returned by GetInfo.
+type Info struct {
+	Version          string   `json:"version"`
+	Uptime           int64    `json:"uptime"` // In seconds.
+	ProtocolVersion  uint32   `json:"protocolVersion"`
+	Streams          []uint32 `json:"streams"`
+	Listeners        []string `json:"listeners"`
+	InboundPeers     int      `json:"inboundPeers"`
+	OutboundPeers    int      `json:"outboundPeers"`
+	Counters         Counters `json:"counters"`
+	Objects          uint64   `json:"objects"`
+	Pubkeys          uint64   `json:"pubkeys"`
+	BytesSent        uint64   `json:"bytesSent"`
+	BytesReceived    uint64   `json:"bytesReceived"`
+	RequestedObjects int      `json:"requestedObjects"`
+	VerifyingObjects int      `json:"verifyingObjects"`
+	DroppedObjects   uint64   `json:"droppedObjects"`
+	PrunedObjects    uint64   `json:"prunedObjects"`
+	PrunedBytes      uint64   `json:"prunedBytes"`
+}
+
+// BanScoreEvent is a penalty given to a peer for misbehaving.
+type BanScoreEvent struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Penalty uint32    `json:"penalty"`
+	Score   uint32    `json:"score"`
+}
+
+// BanScore is the ban score of a peer along with its most recent penalties, as
+// returned by GetBanScores.
+type BanScore struct {
+	Address   string          `json:"address"`
+	Connected bool            `json:"connected"`
+	Score     uint32          `json:"score"`
+	History   []BanScoreEvent `json:"history"`
+}
+
+// PeerInfo contains details about a connected peer, as returned by GetPeers.
+type PeerInfo struct {
+	Address           string            `json:"address"`
+	Inbound           bool              `json:"inbound"`
+	Persistent        bool              `json:"persistent"`
+	HandshakeComplete bool              `json:"handshakeComplete"`
+	UserAgent         string            `json:"userAgent"`
+	Services          uint64            `json:"services"`
+	ProtocolVersion   uint32            `json:"protocolVersion"`
+	Streams           []uint32          `json:"streams"`
+	Latency           int64             `json:"latency"` // In milliseconds.
+	BanScore          uint32            `json:"banScore"`
+	BytesSent         uint64            `json:"bytesSent"`
+	BytesReceived     uint64            `json:"bytesReceived"`
+	RejectedObjects   map[string]uint64 `json:"rejectedObjects"` // By reason.
+}
+
+// Ban is a banned IP address and the end of its ban.
+type Ban struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// BanList contains the banned IP addresses and the IP ranges in the allow and
+// deny lists of bmd, as returned by GetBanList.
+type BanList struct {
+	Bans  []Ban    `json:"bans"`
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// The names of the lists of IP ranges of bmd, as given to AddIPRange and
+// RemoveIPRange. Peers in the deny list are refused, and peers in the allow
+// list are exempt from it, from bans and from the maximum number of peers.
+const (
+	AllowList = "allow"
+	DenyList  = "deny"
+)
+
+// AuthArgs contains the arguments for Authenticate. The types of the
+// arguments of methods are exported because rpc2 only handles methods whose
+// arguments are of exported types.
+type AuthArgs struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SubscribeArgs contains the arguments for the Subscribe methods.
+type SubscribeArgs struct {
+	FromCounter uint64   `json:"fromCounter"`
+	Tags        []string `json:"tags,omitempty"`
+	Ripes       []string `json:"ripes,omitempty"`
+}
+
+// newSubscribeArgs returns the arguments to subscribe from the given counter
+// with the given filter, which may be nil.
+func newSubscribeArgs(fromCounter uint64, filter *Filter) *SubscribeArgs {
+	args := &SubscribeArgs{FromCounter: fromCounter}
+	if filter == nil {
+		return args
+	}
+	for _, tag := range filter.Tags {
+		args.Tags = append(args.Tags,
+			base64.StdEncoding.EncodeToString(tag[:]))
+	}
+	for _, ripe := range filter.Ripes {
+		args.Ripes = append(args.Ripes,
+			base64.StdEncoding.EncodeToString(ripe[:]))
+	}
+	return args
+}
+
+// ReceiveArgs contains the arguments of the Receive methods on the client.
+type ReceiveArgs struct {
+	Object  []byte `json:"object"`
+	Counter uint64 `json:"counter"`
+
+	sub *Subscription // nil if the object is not delivered.
+}
+
+// ExpiredArgs contains the arguments of the Expired methods on the client.
+type ExpiredArgs struct {
+	Counters []uint64 `json:"counters"`
+}
+
+// banScoresOut contains the result of GetBanScores.
+type banScoresOut struct {
+	Peers []BanScore `json:"peers"`
+}
+
+// getPeersOut contains the result of GetPeers.
+type getPeersOut struct {
+	Peers []PeerInfo `json:"peers"`
+}
+
+// addPeerArgs contains the arguments for AddPeer.
+type addPeerArgs struct {
+	Address   string `json:"address"`
+	Stream    uint32 `json:"stream"`
+	Permanent bool   `json:"permanent"`
+}
+
+// ipRangeArgs contains the arguments for AddIPRange and RemoveIPRange.
+type ipRangeArgs struct {
+	List  string `json:"list"`
+	Range string `json:"range"`
+}
+
+// listSubscriptionsOut contains the result of ListSubscriptions.
+type listSubscriptionsOut struct {
+	Subscriptions []string `json:"subscriptions"`
+}
@@ -9,6 +9,7 @@ package main
 import (
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 // interruptChannel is used to receive SIGINT (Ctrl+C) signals.
@@ -82,3 +83,17 @@ func addInterruptHandler(handler func()) {
 
 	addHandlerChannel <- handler
 }
+
+// addReloadHandler adds a handler to call each time a SIGHUP is received. It
+// must be called only once.
+func addReloadHandler(handler func()) {
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+
+	go func() {
+		for {
+			<-reloadChannel
+			handler()
+		}
+	}()
+}